@@ -0,0 +1,151 @@
+package bolt8_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/crypto-y/babble/bolt8"
+	"github.com/stretchr/testify/require"
+)
+
+// The test vectors are from the appendix of BOLT-8.
+var (
+	initiatorStatic    = "1111111111111111111111111111111111111111111111111111111111111111"
+	initiatorEphemeral = "1212121212121212121212121212121212121212121212121212121212121212"
+	responderStatic    = "2121212121212121212121212121212121212121212121212121212121212121"
+	responderEphemeral = "2222222222222222222222222222222222222222222222222222222222222222"
+
+	initiatorStaticPub = "034f355bdcb7cc0af728ef3cceb9615d90684bb5b2ca5f859ab0f0b704075871aa"
+	responderStaticPub = "028d7500dd4c12685d1f568b4c2b5048e8534b873319f3a8daa612b469132ec7f7"
+
+	actOneVector   = "00036360e856310ce5d294e8be33fc807077dc56ac80d95d9cd4ddbd21325eff73f70df6086551151f58b8afe6c195782c6a"
+	actTwoVector   = "0002466d7fcae563e5cb09a0d1870bb580344804617879a14949cf22285f1bae3f276e2470b93aac583c9ef6eafca3f730ae"
+	actThreeVector = "00b9e3a702e93e3a9948c2ed6e5fd7590a6e1c3a0344cfc9d5b57357049aa22355361aa02e55a8fc28fef5bd6d71ad0c38228dc68b1c466263b47fdf31e560e139ba"
+
+	// messageVectors are the outputs of encrypting "hello" repeatedly by the
+	// initiator, which cover the key rotations.
+	messageVectors = map[int]string{
+		0:    "cf2b30ddf0cf3f80e7c35a6e6730b59fe802473180f396d88a8fb0db8cbcf25d2f214cf9ea1d95",
+		1:    "72887022101f0b6753e0c7de21657d35a4cb2a1f5cde2650528bbc8f837d0f0d7ad833b1a256a1",
+		500:  "178cb9d7387190fa34db9c2d50027d21793c9bc2d40b1e14dcf30ebeeeb220f48364f7a4c68bf8",
+		501:  "1b186c57d44eb6de4c057c49940d79bb838a145cb528d6e8fd26dbe50a60ca2c104b56b60e45bd",
+		1000: "4a2f3cc3b5e78ddb83dcb426d9863d9d9a723b0337c89dd0b005d89f8d3c05c52b76b29b740f09",
+		1001: "2ecd8c8a5629d0d02ab457a0fdd0f7b90a192cd46be5ecb6ca570bfc5e268338b1a16cf4ef2d36",
+	}
+)
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// newHandshakes creates the initiator and responder from the test vectors.
+func newHandshakes(t *testing.T) (*bolt8.Handshake, *bolt8.Handshake) {
+	initiator, err := bolt8.NewHandshake(&bolt8.Config{
+		Initiator:          true,
+		LocalStaticPriv:    mustDecode(initiatorStatic),
+		LocalEphemeralPriv: mustDecode(initiatorEphemeral),
+		RemoteStaticPub:    mustDecode(responderStaticPub),
+	})
+	require.NoError(t, err, "failed to create initiator")
+
+	responder, err := bolt8.NewHandshake(&bolt8.Config{
+		LocalStaticPriv:    mustDecode(responderStatic),
+		LocalEphemeralPriv: mustDecode(responderEphemeral),
+	})
+	require.NoError(t, err, "failed to create responder")
+	return initiator, responder
+}
+
+func TestHandshakeVectors(t *testing.T) {
+	require := require.New(t)
+	initiator, responder := newHandshakes(t)
+
+	actOne, err := initiator.GenActOne()
+	require.NoError(err, "failed to generate act one")
+	require.Equal(actOneVector, hex.EncodeToString(actOne[:]),
+		"act one not match")
+	require.NoError(responder.RecvActOne(actOne), "failed to read act one")
+
+	actTwo, err := responder.GenActTwo()
+	require.NoError(err, "failed to generate act two")
+	require.Equal(actTwoVector, hex.EncodeToString(actTwo[:]),
+		"act two not match")
+	require.NoError(initiator.RecvActTwo(actTwo), "failed to read act two")
+
+	actThree, err := initiator.GenActThree()
+	require.NoError(err, "failed to generate act three")
+	require.Equal(actThreeVector, hex.EncodeToString(actThree[:]),
+		"act three not match")
+	require.NoError(responder.RecvActThree(actThree),
+		"failed to read act three")
+
+	require.True(initiator.Finished(), "initiator should be finished")
+	require.True(responder.Finished(), "responder should be finished")
+
+	sender, err := initiator.Transport()
+	require.NoError(err, "failed to create transport")
+	receiver, err := responder.Transport()
+	require.NoError(err, "failed to create transport")
+	require.Equal(responderStaticPub, hex.EncodeToString(sender.RemoteStatic()),
+		"remote static not match")
+	require.Equal(initiatorStaticPub,
+		hex.EncodeToString(receiver.RemoteStatic()), "remote static not match")
+
+	// encrypt "hello" 1002 times, which rotates the keys twice.
+	msg := []byte("hello")
+	var buf bytes.Buffer
+	for i := 0; i < 1002; i++ {
+		ciphertext, err := sender.Encrypt(msg)
+		require.NoError(err, "failed to encrypt")
+		if want, ok := messageVectors[i]; ok {
+			require.Equal(want, hex.EncodeToString(ciphertext),
+				"message %d not match", i)
+		}
+
+		buf.Write(ciphertext)
+		plaintext, err := receiver.ReadMessage(&buf)
+		require.NoError(err, "failed to decrypt message %d", i)
+		require.Equal(msg, plaintext, "plaintext not match")
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	_, err := bolt8.NewHandshake(nil)
+	require.Equal(t, bolt8.ErrMissingConfig, err, "error not match")
+
+	// the initiator must know the responder's static key
+	_, err = bolt8.NewHandshake(&bolt8.Config{
+		Initiator:       true,
+		LocalStaticPriv: mustDecode(initiatorStatic),
+	})
+	require.Error(t, err, "should return an error")
+
+	// an unknown version
+	initiator, responder := newHandshakes(t)
+	actOne, err := initiator.GenActOne()
+	require.NoError(t, err, "failed to generate act one")
+	actOne[0] = 1
+	require.Equal(t, bolt8.ErrUnknownVersion, responder.RecvActOne(actOne),
+		"error not match")
+
+	// acts out of order are rejected
+	initiator, responder = newHandshakes(t)
+	_, err = initiator.GenActThree()
+	require.Equal(t, bolt8.ErrUnexpectedAct, err, "error not match")
+	actOne, err = initiator.GenActOne()
+	require.NoError(t, err, "failed to generate act one")
+	require.Equal(t, bolt8.ErrUnexpectedAct,
+		responder.RecvActThree([bolt8.ActThreeSize]byte{}),
+		"error not match")
+	require.NoError(t, responder.RecvActOne(actOne),
+		"failed to read act one")
+
+	// the transport is not available before the handshake is finished
+	_, err = initiator.Transport()
+	require.Error(t, err, "should return an error")
+}
@@ -0,0 +1,200 @@
+// Package bolt8 implements the encrypted transport used by the Lightning
+// Network, as specified in
+// https://github.com/lightning/bolts/blob/master/08-transport.md.
+//
+// The handshake is Noise_XK_secp256k1_ChaChaPoly_SHA256 with the prologue
+// "lightning", in which each act is prefixed with a version byte. Once the
+// handshake is finished, each transport message is sent with an encrypted
+// 2-byte length header, and the keys are rotated every 1000 encryptions or
+// decryptions using the chaining key.
+package bolt8
+
+import (
+	"errors"
+
+	"github.com/crypto-y/babble"
+)
+
+const (
+	// ProtocolName is the noise protocol used by BOLT-8.
+	ProtocolName = "Noise_XK_secp256k1_ChaChaPoly_SHA256"
+
+	// Prologue is the prologue used by BOLT-8.
+	Prologue = "lightning"
+
+	// Version is the handshake version, which is the leading byte of each act.
+	Version = 0
+
+	// ActOneSize is the size of act one, version || e || tag.
+	ActOneSize = 1 + 33 + 16
+
+	// ActTwoSize is the size of act two, version || e || tag.
+	ActTwoSize = 1 + 33 + 16
+
+	// ActThreeSize is the size of act three, version || encrypted s || tag.
+	ActThreeSize = 1 + 33 + 16 + 16
+)
+
+var (
+	// ErrUnknownVersion is returned when an act has an unknown version.
+	ErrUnknownVersion = errors.New("unknown handshake version")
+
+	// ErrMissingConfig is returned when no config is provided.
+	ErrMissingConfig = errors.New("missing config")
+
+	// ErrUnexpectedAct is returned when an act is generated or received out
+	// of order, e.g., calling RecvActThree before act two is sent.
+	ErrUnexpectedAct = errors.New("unexpected handshake act")
+)
+
+// actSizes are the sizes of the three acts in order.
+var actSizes = [...]int{ActOneSize, ActTwoSize, ActThreeSize}
+
+// Config is used for creating a BOLT-8 handshake.
+type Config struct {
+	// Initiator specifies whether it's the handshake initiator.
+	Initiator bool
+
+	// LocalStaticPriv is the 32-byte node private key.
+	LocalStaticPriv []byte
+
+	// RemoteStaticPub is the 33-byte compressed node public key of the
+	// responder, which must be known by the initiator.
+	RemoteStaticPub []byte
+
+	// LocalEphemeralPriv is an optional ephemeral private key. It should only
+	// be used for testing, a new key is generated if not provided.
+	LocalEphemeralPriv []byte
+}
+
+// Handshake performs the three acts of the BOLT-8 handshake.
+type Handshake struct {
+	hs        *babble.HandshakeState
+	transport *Transport
+
+	// acts is the number of acts generated or received.
+	acts int
+}
+
+// NewHandshake creates a BOLT-8 handshake using the config.
+func NewHandshake(config *Config) (*Handshake, error) {
+	if config == nil {
+		return nil, ErrMissingConfig
+	}
+
+	hs, err := babble.NewProtocolWithConfig(&babble.ProtocolConfig{
+		Name:               ProtocolName,
+		Initiator:          config.Initiator,
+		Prologue:           Prologue,
+		LocalStaticPriv:    config.LocalStaticPriv,
+		RemoteStaticPub:    config.RemoteStaticPub,
+		LocalEphemeralPriv: config.LocalEphemeralPriv,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{hs: hs}, nil
+}
+
+// GenActOne creates act one, -> e, es, which is sent by the initiator.
+func (h *Handshake) GenActOne() ([ActOneSize]byte, error) {
+	var act [ActOneSize]byte
+	err := h.genAct(act[:])
+	return act, err
+}
+
+// RecvActOne processes act one received by the responder.
+func (h *Handshake) RecvActOne(act [ActOneSize]byte) error {
+	return h.recvAct(act[:])
+}
+
+// GenActTwo creates act two, <- e, ee, which is sent by the responder.
+func (h *Handshake) GenActTwo() ([ActTwoSize]byte, error) {
+	var act [ActTwoSize]byte
+	err := h.genAct(act[:])
+	return act, err
+}
+
+// RecvActTwo processes act two received by the initiator.
+func (h *Handshake) RecvActTwo(act [ActTwoSize]byte) error {
+	return h.recvAct(act[:])
+}
+
+// GenActThree creates act three, -> s, se, which is sent by the initiator.
+func (h *Handshake) GenActThree() ([ActThreeSize]byte, error) {
+	var act [ActThreeSize]byte
+	err := h.genAct(act[:])
+	return act, err
+}
+
+// RecvActThree processes act three received by the responder, which learns
+// the initiator's node public key.
+func (h *Handshake) RecvActThree(act [ActThreeSize]byte) error {
+	return h.recvAct(act[:])
+}
+
+// Finished returns true when the handshake is finished.
+func (h *Handshake) Finished() bool {
+	return h.hs.Finished()
+}
+
+// Transport returns the transport once the handshake is finished. The same
+// transport is returned on subsequent calls.
+func (h *Handshake) Transport() (*Transport, error) {
+	if h.transport != nil {
+		return h.transport, nil
+	}
+
+	t, err := newTransport(h.hs)
+	if err != nil {
+		return nil, err
+	}
+	h.transport = t
+	return t, nil
+}
+
+// genAct writes the next handshake message into the act, prefixed with the
+// version byte.
+func (h *Handshake) genAct(act []byte) error {
+	if err := h.checkAct(act); err != nil {
+		return err
+	}
+
+	msg, err := h.hs.WriteMessage(nil)
+	if err != nil {
+		return err
+	}
+	if len(msg) != len(act)-1 {
+		return ErrUnexpectedAct
+	}
+
+	act[0] = Version
+	copy(act[1:], msg)
+	h.acts++
+	return nil
+}
+
+// recvAct checks the version byte and reads the handshake message.
+func (h *Handshake) recvAct(act []byte) error {
+	if err := h.checkAct(act); err != nil {
+		return err
+	}
+	if act[0] != Version {
+		return ErrUnknownVersion
+	}
+
+	if _, err := h.hs.ReadMessage(act[1:]); err != nil {
+		return err
+	}
+	h.acts++
+	return nil
+}
+
+// checkAct makes sure the act has the size of the next act.
+func (h *Handshake) checkAct(act []byte) error {
+	if h.acts >= len(actSizes) || len(act) != actSizes[h.acts] {
+		return ErrUnexpectedAct
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package bolt8
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/crypto-y/babble"
+	"github.com/crypto-y/babble/rekey"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MaxMessageSize is the max size of the plaintext of a transport message.
+	MaxMessageSize = 65535
+
+	// tagSize is the size of the ChaChaPoly authentication tag.
+	tagSize = 16
+
+	// LengthHeaderSize is the size of the encrypted length header.
+	LengthHeaderSize = 2 + tagSize
+
+	// RekeyInterval is the number of encryptions or decryptions with a key
+	// before it's rotated.
+	RekeyInterval = 1000
+)
+
+var errMessageTooLarge = errors.New("message size exceeds 65535-bytes")
+
+// Transport sends and receives the BOLT-8 transport messages, each of which is
+// an encrypted 2-byte big-endian length followed by the encrypted message.
+type Transport struct {
+	session *babble.Session
+}
+
+// newTransport creates the transport from the finished handshake, and
+// attaches a chaining key rekeyer to each direction.
+func newTransport(hs *babble.HandshakeState) (*Transport, error) {
+	session, err := hs.Session()
+	if err != nil {
+		return nil, err
+	}
+
+	// each direction rotates its own copy of the chaining key.
+	var ck [rekey.CipherKeySize]byte
+	copy(ck[:], hs.GetChainingKey())
+	hs.SendCipherState.RekeyManger = NewRekeyer(ck)
+	hs.RecvCipherState.RekeyManger = NewRekeyer(ck)
+
+	return &Transport{session: session}, nil
+}
+
+// Encrypt encrypts the message, and returns the encrypted length header
+// followed by the encrypted message.
+func (t *Transport) Encrypt(msg []byte) ([]byte, error) {
+	if len(msg) > MaxMessageSize {
+		return nil, errMessageTooLarge
+	}
+
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(msg)))
+	header, err := t.session.Encrypt(nil, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := t.session.Encrypt(nil, msg)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, body...), nil
+}
+
+// DecryptHeader decrypts the length header, and returns the size of the
+// message, not including its tag.
+func (t *Transport) DecryptHeader(header [LengthHeaderSize]byte) (int, error) {
+	length, err := t.session.Decrypt(nil, header[:])
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(length)), nil
+}
+
+// DecryptBody decrypts the message, which must follow the length header.
+func (t *Transport) DecryptBody(body []byte) ([]byte, error) {
+	return t.session.Decrypt(nil, body)
+}
+
+// WriteMessage encrypts the message and writes it to w.
+func (t *Transport) WriteMessage(w io.Writer, msg []byte) error {
+	data, err := t.Encrypt(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads a message from r and decrypts it.
+func (t *Transport) ReadMessage(r io.Reader) ([]byte, error) {
+	var header [LengthHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size, err := t.DecryptHeader(header)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, size+tagSize)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return t.DecryptBody(body)
+}
+
+// RemoteStatic returns the remote node public key.
+func (t *Transport) RemoteStatic() []byte {
+	return t.session.RemoteStatic().Bytes()
+}
+
+// rekeyer implements the key rotation defined in BOLT-8, which sets ck', k' =
+// HKDF(ck, k) once a key has been used RekeyInterval times.
+type rekeyer struct {
+	ck [rekey.CipherKeySize]byte
+}
+
+// NewRekeyer creates a rekeyer which rotates the key using the chaining key
+// every RekeyInterval messages, and resets the nonce to zero.
+func NewRekeyer(ck [rekey.CipherKeySize]byte) rekey.Rekeyer {
+	return &rekeyer{ck: ck}
+}
+
+func (r *rekeyer) Rekey(
+	key [rekey.CipherKeySize]byte) ([rekey.CipherKeySize]byte, error) {
+	var newKey [rekey.CipherKeySize]byte
+	r.ck, newKey = hkdf2(r.ck, key[:])
+	return newKey, nil
+}
+
+func (r *rekeyer) CheckRekey(n uint64) (bool, error) {
+	return n >= RekeyInterval, nil
+}
+
+func (r *rekeyer) ResetNonce() bool {
+	return true
+}
+
+func (r *rekeyer) Interval() uint64 {
+	return RekeyInterval
+}
+
+func (r *rekeyer) Clone() rekey.Rekeyer {
+	return &rekeyer{ck: r.ck}
+}
+
+// hkdf2 returns the two outputs of HKDF(ck, ikm) using SHA256.
+func hkdf2(ck [rekey.CipherKeySize]byte,
+	ikm []byte) (out1, out2 [rekey.CipherKeySize]byte) {
+	r := hkdf.New(sha256.New, ikm, ck[:], nil)
+
+	// reading 64 bytes from HKDF-SHA256 never fails.
+	_, _ = io.ReadFull(r, out1[:])
+	_, _ = io.ReadFull(r, out2[:])
+	return out1, out2
+}
@@ -0,0 +1,95 @@
+package bolt8_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/crypto-y/babble/bolt8"
+	"github.com/stretchr/testify/require"
+)
+
+// newTransports runs the handshake and returns the two transports.
+func newTransports(t *testing.T) (*bolt8.Transport, *bolt8.Transport) {
+	initiator, responder := newHandshakes(t)
+
+	actOne, err := initiator.GenActOne()
+	require.NoError(t, err, "failed to generate act one")
+	require.NoError(t, responder.RecvActOne(actOne), "failed to read act one")
+	actTwo, err := responder.GenActTwo()
+	require.NoError(t, err, "failed to generate act two")
+	require.NoError(t, initiator.RecvActTwo(actTwo), "failed to read act two")
+	actThree, err := initiator.GenActThree()
+	require.NoError(t, err, "failed to generate act three")
+	require.NoError(t, responder.RecvActThree(actThree),
+		"failed to read act three")
+
+	alice, err := initiator.Transport()
+	require.NoError(t, err, "failed to create transport")
+	bob, err := responder.Transport()
+	require.NoError(t, err, "failed to create transport")
+	return alice, bob
+}
+
+func TestTransport(t *testing.T) {
+	alice, bob := newTransports(t)
+
+	// both directions across the key rotations
+	var buf bytes.Buffer
+	for i := 0; i < bolt8.RekeyInterval; i++ {
+		msg := []byte{byte(i), byte(i >> 8)}
+		require.NoError(t, bob.WriteMessage(&buf, msg), "failed to write")
+		plaintext, err := alice.ReadMessage(&buf)
+		require.NoError(t, err, "failed to read message %d", i)
+		require.Equal(t, msg, plaintext, "plaintext not match")
+	}
+
+	// a max sized message, and an oversized one
+	msg := make([]byte, bolt8.MaxMessageSize)
+	require.NoError(t, alice.WriteMessage(&buf, msg), "failed to write")
+	plaintext, err := bob.ReadMessage(&buf)
+	require.NoError(t, err, "failed to read")
+	require.Equal(t, msg, plaintext, "plaintext not match")
+	_, err = alice.Encrypt(make([]byte, bolt8.MaxMessageSize+1))
+	require.Error(t, err, "should return an error")
+
+	// a tampered message is rejected
+	ciphertext, err := alice.Encrypt([]byte("hello"))
+	require.NoError(t, err, "failed to encrypt")
+	ciphertext[len(ciphertext)-1] ^= 1
+	var header [bolt8.LengthHeaderSize]byte
+	copy(header[:], ciphertext)
+	size, err := bob.DecryptHeader(header)
+	require.NoError(t, err, "failed to decrypt header")
+	require.Equal(t, 5, size, "size not match")
+	_, err = bob.DecryptBody(ciphertext[bolt8.LengthHeaderSize:])
+	require.Error(t, err, "should return an error")
+}
+
+func TestRekeyer(t *testing.T) {
+	var ck, key [32]byte
+	r := bolt8.NewRekeyer(ck)
+
+	need, err := r.CheckRekey(bolt8.RekeyInterval - 1)
+	require.NoError(t, err, "failed to check rekey")
+	require.False(t, need, "should not rekey")
+	need, err = r.CheckRekey(bolt8.RekeyInterval)
+	require.NoError(t, err, "failed to check rekey")
+	require.True(t, need, "should rekey")
+	require.True(t, r.ResetNonce(), "should reset nonce")
+	require.Equal(t, uint64(bolt8.RekeyInterval), r.Interval(),
+		"interval not match")
+
+	// the chaining key changes as well, so the same key gives a new key
+	clone := r.Clone()
+	k1, err := r.Rekey(key)
+	require.NoError(t, err, "failed to rekey")
+	k2, err := r.Rekey(key)
+	require.NoError(t, err, "failed to rekey")
+	require.NotEqual(t, key, k1, "key not changed")
+	require.NotEqual(t, k1, k2, "key not changed")
+
+	// the clone has its own chaining key
+	k, err := clone.Rekey(key)
+	require.NoError(t, err, "failed to rekey")
+	require.Equal(t, k1, k, "rekey should be deterministic")
+}
@@ -0,0 +1,291 @@
+// Package cert implements certificates for the static keys used in the noise
+// protocol. A certificate binds a static public key to a validity period and a
+// set of attributes, and is signed by a certificate authority (CA) using
+// Ed25519. It can be placed in the payload of the handshake message carrying
+// the static key, so that the remote party can authenticate the key against a
+// set of trusted CAs, without pre-distributing every public key.
+package cert
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// Version is the version of the certificate format.
+	Version = 1
+
+	// signaturePrefix is prefixed to the signed data for domain separation.
+	signaturePrefix = "babble certificate"
+
+	// maxFieldSize is the max size of a length-prefixed field.
+	maxFieldSize = 1<<16 - 1
+)
+
+var (
+	// ErrInvalidCertificate is returned when a certificate cannot be parsed.
+	ErrInvalidCertificate = errors.New("invalid certificate")
+
+	// ErrInvalidSignature is returned when the signature doesn't match.
+	ErrInvalidSignature = errors.New("invalid certificate signature")
+
+	errFieldTooLarge  = errors.New("certificate field is too large")
+	errInvalidCAKey   = errors.New("invalid CA private key")
+	errInvalidPeriod  = errors.New("certificate expires before it's valid")
+	errMissingIssuer  = errors.New("certificate is not signed")
+	errMissingPubKey  = errors.New("certificate has no public key")
+	errInvalidVersion = errors.New("unsupported certificate version")
+)
+
+// Certificate binds a static public key to a validity period and attributes.
+type Certificate struct {
+	// PublicKey is the static public key certified.
+	PublicKey []byte
+
+	// NotBefore and NotAfter specify the validity period, which are encoded
+	// in seconds.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// Attributes are the application defined properties of the key holder,
+	// e.g., a device ID or a role.
+	Attributes map[string]string
+
+	// Issuer is the Ed25519 public key of the CA, which is set by Sign.
+	Issuer ed25519.PublicKey
+
+	// Signature is the Ed25519 signature of the CA, which is set by Sign.
+	Signature []byte
+}
+
+// New creates an unsigned certificate for the static public key, which is
+// valid from now on for the given duration.
+func New(pub []byte, validFor time.Duration,
+	attributes map[string]string) *Certificate {
+	now := time.Now()
+	return &Certificate{
+		PublicKey:  append([]byte{}, pub...),
+		NotBefore:  now,
+		NotAfter:   now.Add(validFor),
+		Attributes: attributes,
+	}
+}
+
+// Sign signs the certificate using the CA's private key, and sets the Issuer
+// and Signature.
+func (c *Certificate) Sign(ca ed25519.PrivateKey) error {
+	if len(ca) != ed25519.PrivateKeySize {
+		return errInvalidCAKey
+	}
+
+	c.Issuer = ca.Public().(ed25519.PublicKey)
+	data, err := c.signedData()
+	if err != nil {
+		return err
+	}
+	c.Signature = ed25519.Sign(ca, data)
+	return nil
+}
+
+// CheckSignature verifies the signature using the Issuer. Whether the Issuer
+// is trusted is checked by the Verifier.
+func (c *Certificate) CheckSignature() error {
+	if len(c.Issuer) != ed25519.PublicKeySize {
+		return errMissingIssuer
+	}
+	if len(c.Signature) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+
+	data, err := c.signedData()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(c.Issuer, data, c.Signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Marshal encodes the signed certificate. The format is,
+//  - a version byte.
+//  - the public key, prefixed with its 2-byte length.
+//  - NotBefore and NotAfter, as 8-byte unix timestamps in seconds.
+//  - the number of attributes as 2 bytes, followed by the keys and values in
+//    the order of the keys, each prefixed with its 2-byte length.
+//  - the 32-byte issuer and the 64-byte signature.
+// All integers are encoded in big endian.
+func (c *Certificate) Marshal() ([]byte, error) {
+	if len(c.Issuer) != ed25519.PublicKeySize ||
+		len(c.Signature) != ed25519.SignatureSize {
+		return nil, errMissingIssuer
+	}
+
+	data, err := c.encode()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, c.Signature...), nil
+}
+
+// Parse decodes a certificate created by Marshal. Since the certificate can be
+// followed by other data in a handshake payload, the remaining data is also
+// returned. The signature is not verified.
+func Parse(data []byte) (*Certificate, []byte, error) {
+	r := &reader{data: data}
+
+	if version := r.next(1); version != nil && version[0] != Version {
+		return nil, nil, errInvalidVersion
+	}
+
+	c := &Certificate{}
+	c.PublicKey = r.readField()
+	c.NotBefore = time.Unix(int64(r.readUint64()), 0)
+	c.NotAfter = time.Unix(int64(r.readUint64()), 0)
+
+	num := r.readUint16()
+	for i := 0; i < int(num) && r.err == nil; i++ {
+		if c.Attributes == nil {
+			c.Attributes = make(map[string]string, num)
+		}
+		key := string(r.readField())
+		c.Attributes[key] = string(r.readField())
+	}
+
+	c.Issuer = ed25519.PublicKey(r.next(ed25519.PublicKeySize))
+	c.Signature = r.next(ed25519.SignatureSize)
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	if len(c.PublicKey) == 0 || len(c.Attributes) != int(num) {
+		return nil, nil, ErrInvalidCertificate
+	}
+
+	// copy the issuer and signature so the data can be reused.
+	c.Issuer = append(ed25519.PublicKey{}, c.Issuer...)
+	c.Signature = append([]byte{}, c.Signature...)
+	return c, r.data, nil
+}
+
+// String returns a short description of the certificate.
+func (c *Certificate) String() string {
+	return fmt.Sprintf("certificate(key=%x, issuer=%x, expiry=%s)",
+		c.PublicKey, []byte(c.Issuer), c.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// signedData returns the data to be signed by the CA.
+func (c *Certificate) signedData() ([]byte, error) {
+	data, err := c.encode()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(signaturePrefix), data...), nil
+}
+
+// encode encodes the certificate without the signature.
+func (c *Certificate) encode() ([]byte, error) {
+	if len(c.PublicKey) == 0 {
+		return nil, errMissingPubKey
+	}
+	if c.NotAfter.Before(c.NotBefore) {
+		return nil, errInvalidPeriod
+	}
+	if len(c.Attributes) > maxFieldSize {
+		return nil, errFieldTooLarge
+	}
+
+	w := &bytes.Buffer{}
+	w.WriteByte(Version)
+	if err := writeField(w, c.PublicKey); err != nil {
+		return nil, err
+	}
+	writeUint64(w, uint64(c.NotBefore.Unix()))
+	writeUint64(w, uint64(c.NotAfter.Unix()))
+
+	// sort the attributes to make the encoding deterministic.
+	keys := make([]string, 0, len(c.Attributes))
+	for k := range c.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var num [2]byte
+	binary.BigEndian.PutUint16(num[:], uint16(len(keys)))
+	w.Write(num[:])
+	for _, k := range keys {
+		if err := writeField(w, []byte(k)); err != nil {
+			return nil, err
+		}
+		if err := writeField(w, []byte(c.Attributes[k])); err != nil {
+			return nil, err
+		}
+	}
+
+	w.Write(c.Issuer)
+	return w.Bytes(), nil
+}
+
+func writeField(w *bytes.Buffer, data []byte) error {
+	if len(data) > maxFieldSize {
+		return errFieldTooLarge
+	}
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(data)))
+	w.Write(size[:])
+	w.Write(data)
+	return nil
+}
+
+func writeUint64(w *bytes.Buffer, n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	w.Write(b[:])
+}
+
+// reader decodes the certificate fields. Once an error occurs, the following
+// reads return zero values, and the error is kept.
+type reader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes.
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = ErrInvalidCertificate
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) readUint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) readUint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// readField returns a copy of the next length-prefixed field.
+func (r *reader) readField() []byte {
+	size := r.readUint16()
+	return append([]byte{}, r.next(int(size))...)
+}
@@ -0,0 +1,101 @@
+package cert_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble/cert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	caPub, caPriv, _ = ed25519.GenerateKey(nil)
+	staticKey        = bytes.Repeat([]byte{1}, 32)
+)
+
+func TestCertificateMarshal(t *testing.T) {
+	require := require.New(t)
+
+	c := cert.New(staticKey, time.Hour, map[string]string{
+		"device": "yy-01",
+		"role":   "sensor",
+	})
+
+	// an unsigned certificate cannot be marshaled
+	_, err := c.Marshal()
+	require.Error(err, "should return an error")
+	require.Error(c.CheckSignature(), "should return an error")
+
+	require.Error(c.Sign(caPriv[:10]), "invalid CA key")
+	require.NoError(c.Sign(caPriv), "failed to sign")
+	require.Equal(caPub, c.Issuer, "issuer not match")
+	require.NoError(c.CheckSignature(), "failed to check signature")
+
+	data, err := c.Marshal()
+	require.NoError(err, "failed to marshal")
+
+	// parse the certificate followed by other data
+	parsed, rest, err := cert.Parse(append(data, []byte("payload")...))
+	require.NoError(err, "failed to parse")
+	require.Equal([]byte("payload"), rest, "rest not match")
+	require.Equal(c.PublicKey, parsed.PublicKey, "public key not match")
+	require.Equal(c.NotBefore.Unix(), parsed.NotBefore.Unix(),
+		"not before not match")
+	require.Equal(c.NotAfter.Unix(), parsed.NotAfter.Unix(),
+		"not after not match")
+	require.Equal(c.Attributes, parsed.Attributes, "attributes not match")
+	require.Equal(c.Issuer, parsed.Issuer, "issuer not match")
+	require.NoError(parsed.CheckSignature(), "failed to check signature")
+
+	// the encoding is deterministic
+	data2, err := parsed.Marshal()
+	require.NoError(err, "failed to marshal")
+	require.Equal(data, data2, "encoding not match")
+
+	// a modified certificate fails the signature check
+	parsed.Attributes["role"] = "admin"
+	require.Equal(cert.ErrInvalidSignature, parsed.CheckSignature(),
+		"error not match")
+
+	// truncated data cannot be parsed
+	for _, size := range []int{0, 1, 10, len(data) - 1} {
+		_, _, err = cert.Parse(data[:size])
+		require.Equal(cert.ErrInvalidCertificate, err,
+			"size %d should fail", size)
+	}
+
+	// a wrong version
+	wrong := append([]byte{}, data...)
+	wrong[0] = 2
+	_, _, err = cert.Parse(wrong)
+	require.Error(err, "should return an error")
+}
+
+func TestCertificateInvalid(t *testing.T) {
+	// missing public key
+	c := cert.New(nil, time.Hour, nil)
+	require.Error(t, c.Sign(caPriv), "should return an error")
+
+	// invalid validity period
+	c = cert.New(staticKey, -time.Hour, nil)
+	require.Error(t, c.Sign(caPriv), "should return an error")
+
+	// a field is too large
+	c = cert.New(staticKey, time.Hour, map[string]string{
+		"yy": string(make([]byte, 1<<16)),
+	})
+	require.Error(t, c.Sign(caPriv), "should return an error")
+
+	// no attributes
+	c = cert.New(staticKey, time.Hour, nil)
+	require.NoError(t, c.Sign(caPriv), "failed to sign")
+	data, _ := c.Marshal()
+	parsed, rest, err := cert.Parse(data)
+	require.NoError(t, err, "failed to parse")
+	require.Empty(t, rest, "no data left")
+	require.Nil(t, parsed.Attributes, "no attributes")
+	require.Contains(t, parsed.String(), "certificate(key=0101",
+		"string not match")
+}
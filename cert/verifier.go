@@ -0,0 +1,110 @@
+package cert
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"time"
+
+	"github.com/crypto-y/babble/dh"
+)
+
+var (
+	// ErrUnknownIssuer is returned when the certificate is not signed by any
+	// of the trusted CAs.
+	ErrUnknownIssuer = errors.New("certificate is signed by an unknown CA")
+
+	// ErrExpired is returned when the certificate is expired.
+	ErrExpired = errors.New("certificate is expired")
+
+	// ErrNotYetValid is returned when the certificate is not valid yet.
+	ErrNotYetValid = errors.New("certificate is not valid yet")
+
+	// ErrKeyMismatch is returned when the certificate is issued for another
+	// static key.
+	ErrKeyMismatch = errors.New("certificate is issued for another key")
+
+	// ErrMissingCertificate is returned when the handshake payload carries
+	// no certificate.
+	ErrMissingCertificate = errors.New("missing certificate")
+)
+
+// Verifier validates certificates against a set of trusted CAs.
+type Verifier struct {
+	// Roots are the Ed25519 public keys of the trusted CAs.
+	Roots []ed25519.PublicKey
+
+	// Now returns the current time used to check the validity period. If nil,
+	// time.Now is used.
+	Now func() time.Time
+
+	// VerifyCertificate is an optional callback for extra checks once the
+	// certificate is validated, e.g., checking its attributes.
+	VerifyCertificate func(c *Certificate) error
+}
+
+// NewVerifier creates a verifier trusting the given CAs.
+func NewVerifier(roots ...ed25519.PublicKey) *Verifier {
+	return &Verifier{Roots: roots}
+}
+
+// Verify checks the certificate is signed by a trusted CA, is within its
+// validity period, and is issued for the static public key.
+func (v *Verifier) Verify(c *Certificate, pub []byte) error {
+	if !v.trusted(c.Issuer) {
+		return ErrUnknownIssuer
+	}
+	if err := c.CheckSignature(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	if now.Before(c.NotBefore) {
+		return ErrNotYetValid
+	}
+	if now.After(c.NotAfter) {
+		return ErrExpired
+	}
+
+	if !bytes.Equal(c.PublicKey, pub) {
+		return ErrKeyMismatch
+	}
+
+	if v.VerifyCertificate != nil {
+		return v.VerifyCertificate(c)
+	}
+	return nil
+}
+
+// VerifyPeerStatic can be used as the VerifyPeerStatic of the ProtocolConfig.
+// It expects the payload of the handshake message carrying the remote static
+// key to start with the remote party's certificate. When called with a nil
+// payload, the certificate hasn't been received yet, so it returns nil and
+// waits for the call with the payload.
+func (v *Verifier) VerifyPeerStatic(pub dh.PublicKey, payload []byte) error {
+	if payload == nil {
+		return nil
+	}
+	if len(payload) == 0 {
+		return ErrMissingCertificate
+	}
+
+	c, _, err := Parse(payload)
+	if err != nil {
+		return err
+	}
+	return v.Verify(c, pub.Bytes())
+}
+
+// trusted checks whether the issuer is one of the roots.
+func (v *Verifier) trusted(issuer ed25519.PublicKey) bool {
+	for _, root := range v.Roots {
+		if bytes.Equal(root, issuer) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package cert_test
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble"
+	"github.com/crypto-y/babble/cert"
+	"github.com/crypto-y/babble/dh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerify(t *testing.T) {
+	_, otherCA, _ := ed25519.GenerateKey(nil)
+	errRole := errors.New("wrong role")
+
+	newCert := func(ca ed25519.PrivateKey, validFor time.Duration,
+		role string) *cert.Certificate {
+		c := cert.New(staticKey, validFor, map[string]string{"role": role})
+		require.NoError(t, c.Sign(ca), "failed to sign")
+		return c
+	}
+
+	forged := newCert(caPriv, time.Hour, "sensor")
+	forged.Attributes["role"] = "admin"
+
+	testParams := []struct {
+		name string
+		cert *cert.Certificate
+		pub  []byte
+		now  time.Time
+		err  error
+	}{
+		{"valid", newCert(caPriv, time.Hour, "sensor"), staticKey,
+			time.Now(), nil},
+		{"unknown issuer", newCert(otherCA, time.Hour, "sensor"),
+			staticKey, time.Now(), cert.ErrUnknownIssuer},
+		{"invalid signature", forged, staticKey, time.Now(),
+			cert.ErrInvalidSignature},
+		{"expired", newCert(caPriv, time.Hour, "sensor"), staticKey,
+			time.Now().Add(2 * time.Hour), cert.ErrExpired},
+		{"not yet valid", newCert(caPriv, time.Hour, "sensor"), staticKey,
+			time.Now().Add(-time.Hour), cert.ErrNotYetValid},
+		{"key mismatch", newCert(caPriv, time.Hour, "sensor"),
+			make([]byte, 32), time.Now(), cert.ErrKeyMismatch},
+		{"attributes rejected", newCert(caPriv, time.Hour, "admin"),
+			staticKey, time.Now(), errRole},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			v := cert.NewVerifier(caPub)
+			v.Now = func() time.Time { return tt.now }
+			v.VerifyCertificate = func(c *cert.Certificate) error {
+				if c.Attributes["role"] != "sensor" {
+					return errRole
+				}
+				return nil
+			}
+			require.Equal(t, tt.err, v.Verify(tt.cert, tt.pub),
+				"error not match")
+		})
+	}
+}
+
+func TestVerifyPeerStaticHandshake(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	curve, _ := dh.FromString("25519")
+
+	// newPeer creates a static key and its certificate signed by the ca.
+	newPeer := func(ca ed25519.PrivateKey) (dh.PrivateKey, []byte) {
+		key, _ := curve.GenerateKeyPair(nil)
+		c := cert.New(key.PubKey().Bytes(), time.Hour, nil)
+		require.NoError(c.Sign(ca), "failed to sign")
+		data, err := c.Marshal()
+		require.NoError(err, "failed to marshal")
+		return key, data
+	}
+
+	verifier := cert.NewVerifier(caPub)
+	aliceKey, aliceCert := newPeer(caPriv)
+	bobKey, bobCert := newPeer(caPriv)
+
+	alice, err := babble.NewProtocolWithConfig(&babble.ProtocolConfig{
+		Name:             name,
+		Initiator:        true,
+		LocalStaticPriv:  aliceKey.Bytes(),
+		VerifyPeerStatic: verifier.VerifyPeerStatic,
+	})
+	require.NoError(err, "failed to create alice")
+	bob, err := babble.NewProtocolWithConfig(&babble.ProtocolConfig{
+		Name:             name,
+		LocalStaticPriv:  bobKey.Bytes(),
+		VerifyPeerStatic: verifier.VerifyPeerStatic,
+	})
+	require.NoError(err, "failed to create bob")
+
+	// -> e
+	msg, err := alice.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	_, err = bob.ReadMessage(msg)
+	require.NoError(err, "failed to read message")
+
+	// <- e, ee, s, es, with bob's certificate as the payload
+	msg, err = bob.WriteMessage(bobCert)
+	require.NoError(err, "failed to write message")
+	_, err = alice.ReadMessage(msg)
+	require.NoError(err, "failed to verify bob")
+
+	// -> s, se, with alice's certificate signed by an untrusted CA
+	_, otherCA, _ := ed25519.GenerateKey(nil)
+	_, untrusted := newPeer(otherCA)
+	msg, err = alice.WriteMessage(untrusted)
+	require.NoError(err, "failed to write message")
+	_, err = bob.ReadMessage(msg)
+	require.Equal(cert.ErrUnknownIssuer, err, "error not match")
+
+	// a certificate issued for another key, or a missing one
+	pub, _ := curve.LoadPublicKey(aliceKey.PubKey().Bytes())
+	require.Equal(cert.ErrKeyMismatch,
+		verifier.VerifyPeerStatic(pub, bobCert), "error not match")
+	require.Equal(cert.ErrMissingCertificate,
+		verifier.VerifyPeerStatic(pub, []byte{}), "error not match")
+	require.NoError(verifier.VerifyPeerStatic(pub, aliceCert),
+		"failed to verify")
+}
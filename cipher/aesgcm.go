@@ -12,6 +12,10 @@ const nonceSizeaESGCM = 12
 // aESGCMCipher implements the Cipher interface.
 type aESGCMCipher struct {
 	cipher cipher.AEAD
+
+	// nonce is the buffer used to encode the nonce of each message, so no
+	// allocation is needed. It makes the cipher unsafe for concurrent use.
+	nonce [nonceSizeaESGCM]byte
 }
 
 // Cipher returns the AEAD attached in the struct.
@@ -31,26 +35,39 @@ func (agc *aESGCMCipher) EncodeNonce(n uint64) []byte {
 // Encrypt calls the underlying Seal function to create the ciphertext.
 func (agc *aESGCMCipher) Encrypt(
 	n uint64, ad, plaintext []byte) ([]byte, error) {
+	return agc.EncryptTo(nil, n, ad, plaintext)
+}
+
+// EncryptTo calls the underlying Seal function to append the ciphertext to
+// dst.
+func (agc *aESGCMCipher) EncryptTo(
+	dst []byte, n uint64, ad, plaintext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == MaxNonce {
 		return nil, ErrNonceOverflow
 	}
 
-	nonce := agc.EncodeNonce(n)
-	ciphertext := agc.Cipher().Seal(nil, nonce, plaintext, ad)
-	return ciphertext, nil
+	binary.BigEndian.PutUint64(agc.nonce[4:], n)
+	return agc.Cipher().Seal(dst, agc.nonce[:], plaintext, ad), nil
 }
 
-// Decrypt calls the underlying Seal function to extract the plaintext.
+// Decrypt calls the underlying Open function to extract the plaintext.
 func (agc *aESGCMCipher) Decrypt(
 	n uint64, ad, ciphertext []byte) ([]byte, error) {
+	return agc.DecryptTo(nil, n, ad, ciphertext)
+}
+
+// DecryptTo calls the underlying Open function to append the plaintext to
+// dst.
+func (agc *aESGCMCipher) DecryptTo(
+	dst []byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == MaxNonce {
 		return nil, ErrNonceOverflow
 	}
 
-	nonce := agc.EncodeNonce(n)
-	plaintext, err := agc.Cipher().Open(nil, nonce, ciphertext, ad)
+	binary.BigEndian.PutUint64(agc.nonce[4:], n)
+	plaintext, err := agc.Cipher().Open(dst, agc.nonce[:], ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +99,7 @@ func (agc *aESGCMCipher) Rekey() [KeySize]byte {
 	nonce := agc.EncodeNonce(MaxNonce)
 	key := agc.Cipher().Seal(nil, nonce, ZEROS[:], ZEROLEN)
 	copy(newKey[:], key)
+	wipe(key)
 
 	return newKey
 }
@@ -91,6 +109,13 @@ func (agc *aESGCMCipher) Reset() {
 	agc.cipher = nil
 }
 
+// Destroy removes the cipher. The key schedule is kept by the cipher.AEAD
+// created by the standard library, which cannot be wiped from outside, so it's
+// left to the garbage collector once the reference is dropped.
+func (agc *aESGCMCipher) Destroy() {
+	agc.cipher = nil
+}
+
 func (agc *aESGCMCipher) String() string {
 	return "AESGCM"
 }
@@ -13,6 +13,10 @@ const nonceSizechaChaPoly = 12
 // chaChaPolyCipher implements the Cipher interface.
 type chaChaPolyCipher struct {
 	cipher cipher.AEAD
+
+	// nonce is the buffer used to encode the nonce of each message, so no
+	// allocation is needed. It makes the cipher unsafe for concurrent use.
+	nonce [nonceSizechaChaPoly]byte
 }
 
 // Cipher returns the AEAD attached in the struct.
@@ -32,26 +36,39 @@ func (ccpc *chaChaPolyCipher) EncodeNonce(n uint64) []byte {
 // Encrypt calls the underlying Seal function to create the ciphertext.
 func (ccpc *chaChaPolyCipher) Encrypt(
 	n uint64, ad, plaintext []byte) ([]byte, error) {
+	return ccpc.EncryptTo(nil, n, ad, plaintext)
+}
+
+// EncryptTo calls the underlying Seal function to append the ciphertext to
+// dst.
+func (ccpc *chaChaPolyCipher) EncryptTo(
+	dst []byte, n uint64, ad, plaintext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == MaxNonce {
 		return nil, ErrNonceOverflow
 	}
 
-	nonce := ccpc.EncodeNonce(n)
-	ciphertext := ccpc.Cipher().Seal(nil, nonce, plaintext, ad)
-	return ciphertext, nil
+	binary.LittleEndian.PutUint64(ccpc.nonce[4:], n)
+	return ccpc.Cipher().Seal(dst, ccpc.nonce[:], plaintext, ad), nil
 }
 
-// Decrypt calls the underlying Seal function to extract the plaintext.
+// Decrypt calls the underlying Open function to extract the plaintext.
 func (ccpc *chaChaPolyCipher) Decrypt(
 	n uint64, ad, ciphertext []byte) ([]byte, error) {
+	return ccpc.DecryptTo(nil, n, ad, ciphertext)
+}
+
+// DecryptTo calls the underlying Open function to append the plaintext to
+// dst.
+func (ccpc *chaChaPolyCipher) DecryptTo(
+	dst []byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == MaxNonce {
 		return nil, ErrNonceOverflow
 	}
 
-	nonce := ccpc.EncodeNonce(n)
-	plaintext, err := ccpc.Cipher().Open(nil, nonce, ciphertext, ad)
+	binary.LittleEndian.PutUint64(ccpc.nonce[4:], n)
+	plaintext, err := ccpc.Cipher().Open(dst, ccpc.nonce[:], ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -78,6 +95,7 @@ func (ccpc *chaChaPolyCipher) Rekey() [KeySize]byte {
 	nonce := ccpc.EncodeNonce(MaxNonce)
 	key := ccpc.Cipher().Seal(nil, nonce, ZEROS[:], ZEROLEN)
 	copy(newKey[:], key)
+	wipe(key)
 
 	return newKey
 }
@@ -87,6 +105,13 @@ func (ccpc *chaChaPolyCipher) Reset() {
 	ccpc.cipher = nil
 }
 
+// Destroy removes the cipher. The key schedule is kept by the cipher.AEAD
+// created by the standard library, which cannot be wiped from outside, so it's
+// left to the garbage collector once the reference is dropped.
+func (ccpc *chaChaPolyCipher) Destroy() {
+	ccpc.cipher = nil
+}
+
 func (ccpc *chaChaPolyCipher) String() string {
 	return "ChaChaPoly"
 }
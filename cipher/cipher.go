@@ -68,6 +68,17 @@ type AEAD interface {
 	// plaintext plus 16 bytes for authentication data.
 	Encrypt(n uint64, ad, plaintext []byte) ([]byte, error)
 
+	// EncryptTo works like Encrypt, but appends the ciphertext to dst and
+	// returns the updated slice, so no allocation is made if dst has enough
+	// capacity. To encrypt in place, use plaintext[:0] as dst, otherwise dst
+	// must not overlap plaintext.
+	EncryptTo(dst []byte, n uint64, ad, plaintext []byte) ([]byte, error)
+
+	// DecryptTo works like Decrypt, but appends the plaintext to dst and
+	// returns the updated slice. To decrypt in place, use ciphertext[:0] as
+	// dst, otherwise dst must not overlap ciphertext.
+	DecryptTo(dst []byte, n uint64, ad, ciphertext []byte) ([]byte, error)
+
 	// InitCipher creates a cipher with the secret key.
 	InitCipher(key [KeySize]byte) error
 
@@ -80,6 +91,10 @@ type AEAD interface {
 
 	// Reset cleans all the states to zero value, if any.
 	Reset()
+
+	// Destroy wipes the key material held by the cipher. The cipher must be
+	// initialized again using InitCipher before being used.
+	Destroy()
 }
 
 // FromString uses the provided cipher name, s, to query a built-in cipher.
@@ -111,6 +126,13 @@ func SupportedCiphers() string {
 	return strings.Join(keys, ", ")
 }
 
+// wipe overwrites the bytes with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func errUnsupported(s string) error {
 	return fmt.Errorf("cipher: %s is unsupported", s)
 }
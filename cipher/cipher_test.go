@@ -155,6 +155,49 @@ func TestChaChaPoly(t *testing.T) {
 	require.Nil(t, ChaChaPoly.Cipher(), "cipher is not nil")
 }
 
+func TestEncryptTo(t *testing.T) {
+	for _, name := range []string{"AESGCM", "ChaChaPoly"} {
+		c, _ := cipher.FromString(name)
+		require.NoError(t, c.InitCipher(cipher.ZEROS), "failed to init")
+		ad, plaintext := []byte("ad"), []byte("babble")
+
+		// the result is the same as Encrypt, appended to dst
+		want, err := c.Encrypt(1, ad, plaintext)
+		require.NoError(t, err, "failed to encrypt")
+		got, err := c.EncryptTo([]byte("yy"), 1, ad, plaintext)
+		require.NoError(t, err, "failed to encrypt")
+		require.Equal(t, append([]byte("yy"), want...), got,
+			"%s: ciphertext not match", name)
+
+		// decrypt in place
+		ciphertext := got[2:]
+		got, err = c.DecryptTo(ciphertext[:0], 1, ad, ciphertext)
+		require.NoError(t, err, "failed to decrypt")
+		require.Equal(t, plaintext, got, "%s: plaintext not match", name)
+
+		_, err = c.DecryptTo(nil, 2, ad, want)
+		require.Error(t, err, "wrong nonce should fail")
+
+		_, err = c.EncryptTo(nil, cipher.MaxNonce, ad, plaintext)
+		require.Equal(t, cipher.ErrNonceOverflow, err, "error not match")
+		_, err = c.DecryptTo(nil, cipher.MaxNonce, ad, want)
+		require.Equal(t, cipher.ErrNonceOverflow, err, "error not match")
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	for _, name := range []string{"AESGCM", "ChaChaPoly"} {
+		c, _ := cipher.FromString(name)
+		require.NoError(t, c.InitCipher(cipher.ZEROS), "failed to init")
+		c.Destroy()
+		require.Nil(t, c.Cipher(), "cipher is not nil")
+
+		// the cipher can be initialized again
+		require.NoError(t, c.InitCipher(cipher.ZEROS), "failed to init")
+		require.NotNil(t, c.Cipher(), "cipher is nil")
+	}
+}
+
 func TestSetUp(t *testing.T) {
 	// check supported curves
 	aesgcm, err := cipher.FromString("AESGCM")
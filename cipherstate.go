@@ -1,8 +1,8 @@
 package babble
 
 import (
+	"crypto/subtle"
 	"errors"
-	"reflect"
 
 	noiseCipher "github.com/crypto-y/babble/cipher"
 	"github.com/crypto-y/babble/rekey"
@@ -54,8 +54,20 @@ func (cs *CipherState) DecryptWithAd(ad, ciphertext []byte) ([]byte, error) {
 	if !cs.hasKey() {
 		return ciphertext, nil
 	}
+	return cs.DecryptWithAdTo(nil, ad, ciphertext)
+}
 
-	plaintext, err := cs.cipher.Decrypt(cs.nonce, ad, ciphertext)
+// DecryptWithAdTo works like DecryptWithAd, but appends the plaintext to dst
+// and returns the updated slice, so no allocation is made if dst has enough
+// capacity. To decrypt in place, use ciphertext[:0] as dst, otherwise dst must
+// not overlap ciphertext. If the key is empty, the ciphertext is appended.
+func (cs *CipherState) DecryptWithAdTo(
+	dst, ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return append(dst, ciphertext...), nil
+	}
+
+	out, err := cs.cipher.DecryptTo(dst, cs.nonce, ad, ciphertext)
 	if err != nil {
 		return nil, err
 	}
@@ -64,10 +76,10 @@ func (cs *CipherState) DecryptWithAd(ad, ciphertext []byte) ([]byte, error) {
 	//
 	// The error should be safe to ignore here, as if the nonce is incorrect,
 	// Decrypt will have already returned an error above.
-	if err := cs.incrementNonce(); err != nil {
+	if err := cs.incrementNonce(len(out) - len(dst)); err != nil {
 		return nil, err
 	}
-	return plaintext, nil
+	return out, nil
 }
 
 // EncryptWithAd encrypts plaintext with ad. If the key is non-empty it returns
@@ -76,27 +88,63 @@ func (cs *CipherState) EncryptWithAd(ad, plaintext []byte) ([]byte, error) {
 	if !cs.hasKey() {
 		return plaintext, nil
 	}
+	return cs.EncryptWithAdTo(nil, ad, plaintext)
+}
+
+// EncryptWithAdTo works like EncryptWithAd, but appends the ciphertext to dst
+// and returns the updated slice, so no allocation is made if dst has enough
+// capacity, i.e., len(plaintext) plus 16 bytes for the authentication tag. To
+// encrypt in place, use plaintext[:0] as dst, otherwise dst must not overlap
+// plaintext. If the key is empty, the plaintext is appended.
+func (cs *CipherState) EncryptWithAdTo(
+	dst, ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return append(dst, plaintext...), nil
+	}
 
 	if cs.cipher == nil {
 		return nil, errCipherNotInitialized
 	}
 
-	ciphertext, err := cs.cipher.Encrypt(cs.nonce, ad, plaintext)
+	out, err := cs.cipher.EncryptTo(dst, cs.nonce, ad, plaintext)
 	if err != nil {
 		return nil, err
 	}
 
 	// increment and check the nonce
-	if err := cs.incrementNonce(); err != nil {
+	if err := cs.incrementNonce(len(plaintext)); err != nil {
 		return nil, err
 	}
 
-	return ciphertext, nil
+	return out, nil
 }
 
-// hashKey returns true if cipher key is not empty, otherwise false.
+// EncryptWithNonce encrypts plaintext with ad using the explicit nonce n. Unlike
+// EncryptWithAd, the nonce of the cipher state is neither used nor changed, and
+// no rekey is performed. The caller must make sure a nonce is never reused.
+func (cs *CipherState) EncryptWithNonce(
+	n uint64, ad, plaintext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return nil, errMissingCipherKey
+	}
+	return cs.cipher.Encrypt(n, ad, plaintext)
+}
+
+// DecryptWithNonce decrypts ciphertext with ad using the explicit nonce n.
+// Unlike DecryptWithAd, the nonce of the cipher state is neither used nor
+// changed, which is useful for handling out-of-order transport messages.
+func (cs *CipherState) DecryptWithNonce(
+	n uint64, ad, ciphertext []byte) ([]byte, error) {
+	if !cs.hasKey() {
+		return nil, errMissingCipherKey
+	}
+	return cs.cipher.Decrypt(n, ad, ciphertext)
+}
+
+// hashKey returns true if cipher key is not empty, otherwise false. The key is
+// compared in constant time.
 func (cs *CipherState) hasKey() bool {
-	return !reflect.DeepEqual(cs.key, ZEROS)
+	return subtle.ConstantTimeCompare(cs.key[:], ZEROS[:]) != 1
 }
 
 // initializeKey sets the cipher key and nonce.
@@ -121,8 +169,9 @@ func (cs *CipherState) Nonce() uint64 {
 }
 
 // Rekey updates the underlying cipher with a new key. If a rekeyer is defined
-// for the Cipherstate, it's used to generate the new key. Otherwise, it uses
-// the Rekey from the underlying cipher to generate a new key.
+// for the Cipherstate, it's used to generate the new key from the current key.
+// Otherwise, it uses the Rekey from the underlying cipher to generate a new
+// key.
 //
 // There are actually two places to customize a Rekey function. First here, then
 // there's an opportunity in the underlying cipher.Rekey().
@@ -134,17 +183,32 @@ func (cs *CipherState) Rekey() error {
 		// Must have been initialized before
 		return errMissingCipherKey
 	}
-	var newKey [CipherKeySize]byte
 
-	if cs.RekeyManger != nil {
-		// use it if a rekeyer is defined
-		newKey = cs.RekeyManger.Rekey()
-	} else {
+	if cs.RekeyManger == nil {
 		// use the default rekey from the cipher
-		newKey = cs.cipher.Rekey()
+		return cs.rekeyCipher()
 	}
 
-	// update the cipher without resetting the nonce.
+	// use it if a rekeyer is defined
+	newKey, err := cs.RekeyManger.Rekey(cs.key)
+	if err != nil {
+		return err
+	}
+	return cs.updateKey(newKey)
+}
+
+// rekeyCipher performs the REKEY(k) function defined in the noise specs using
+// the cipher state's own cipher, which returns ENCRYPT(k, maxnonce, zerolen,
+// zeros) as the new key.
+func (cs *CipherState) rekeyCipher() error {
+	if !cs.hasKey() {
+		return errMissingCipherKey
+	}
+	return cs.updateKey(cs.cipher.Rekey())
+}
+
+// updateKey updates the cipher without resetting the nonce.
+func (cs *CipherState) updateKey(newKey [CipherKeySize]byte) error {
 	copy(cs.key[:], newKey[:])
 	if err := cs.cipher.InitCipher(cs.key); err != nil {
 		return err
@@ -161,6 +225,16 @@ func (cs *CipherState) Reset() {
 	}
 }
 
+// Destroy wipes the cipher key, sets the nonce to 0, and calls cipher.Destroy.
+// The cipher state must not be used afterwards.
+func (cs *CipherState) Destroy() {
+	wipe(cs.key[:])
+	cs.nonce = 0
+	if cs.cipher != nil {
+		cs.cipher.Destroy()
+	}
+}
+
 // SetNonce sets the nonce. This function is used for handling out-of-order
 // transport messages
 func (cs *CipherState) SetNonce(n uint64) {
@@ -168,8 +242,9 @@ func (cs *CipherState) SetNonce(n uint64) {
 }
 
 // incrementNonce increments and checks the nonce. When it reaches the value of
-// RekeyInterval, a rekey is performed.
-func (cs *CipherState) incrementNonce() error {
+// RekeyInterval, a rekey is performed. The size of the plaintext is passed to
+// the RekeyManger if it implements rekey.Observer.
+func (cs *CipherState) incrementNonce(size int) error {
 	cs.nonce++
 
 	// if no RekeyManger is attached, abort.
@@ -177,6 +252,10 @@ func (cs *CipherState) incrementNonce() error {
 		return nil
 	}
 
+	if o, ok := cs.RekeyManger.(rekey.Observer); ok {
+		o.Observe(size)
+	}
+
 	// use customized logic from RekeyManger to check whether a Rekey is needed.
 	need, err := cs.RekeyManger.CheckRekey(cs.nonce)
 	if err != nil {
@@ -195,6 +274,13 @@ func (cs *CipherState) incrementNonce() error {
 	return nil
 }
 
+// wipe overwrites the bytes with zeros.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
 func newCipherState(
 	cipher noiseCipher.AEAD, rekeyer rekey.Rekeyer) *CipherState {
 	return &CipherState{
@@ -180,3 +180,216 @@ func TestCipherStateDefaultRekeyManager(t *testing.T) {
 		"should return nonce corrupted")
 	require.Nil(t, ciphertext, "no ciphertext encrypted")
 }
+
+func TestCipherStateExplicitNonce(t *testing.T) {
+	cipherA, _ := noiseCipher.FromString("ChaChaPoly")
+	cipherB, _ := noiseCipher.FromString("ChaChaPoly")
+	alice := newCipherState(cipherA, nil)
+	bob := newCipherState(cipherB, nil)
+
+	// no key initialized
+	_, err := alice.EncryptWithNonce(1, nil, []byte("yy"))
+	require.Equal(t, errMissingCipherKey, err, "error not match")
+	_, err = bob.DecryptWithNonce(1, nil, []byte("yy"))
+	require.Equal(t, errMissingCipherKey, err, "error not match")
+
+	key := [CipherKeySize]byte{1}
+	require.NoError(t, alice.initializeKey(key))
+	require.NoError(t, bob.initializeKey(key))
+
+	// the messages can be decrypted out of order
+	first, err := alice.EncryptWithNonce(1, nil, []byte("first"))
+	require.NoError(t, err, "failed to encrypt")
+	second, err := alice.EncryptWithNonce(2, nil, []byte("second"))
+	require.NoError(t, err, "failed to encrypt")
+
+	plaintext, err := bob.DecryptWithNonce(2, nil, second)
+	require.NoError(t, err, "failed to decrypt")
+	require.Equal(t, []byte("second"), plaintext, "plaintext not match")
+	plaintext, err = bob.DecryptWithNonce(1, nil, first)
+	require.NoError(t, err, "failed to decrypt")
+	require.Equal(t, []byte("first"), plaintext, "plaintext not match")
+
+	// a wrong nonce fails
+	_, err = bob.DecryptWithNonce(3, nil, first)
+	require.Error(t, err, "wrong nonce should fail")
+
+	// the nonces are not changed
+	require.Equal(t, uint64(0), alice.Nonce(), "nonce should not change")
+	require.Equal(t, uint64(0), bob.Nonce(), "nonce should not change")
+}
+
+func TestCipherStateSplitRekeyers(t *testing.T) {
+	require := require.New(t)
+	interval := uint64(3)
+
+	for _, name := range []string{
+		"Noise_NN_25519_ChaChaPoly_SHA256",
+		"Noise_NN_25519_AESGCM_SHA256",
+	} {
+		alice, err := NewProtocolWithConfig(&ProtocolConfig{
+			Name:      name,
+			Initiator: true,
+			RekeyerConfig: &DefaultRekeyerConfig{
+				Interval: interval, ResetNonce: true,
+			},
+		})
+		require.NoError(err, "failed to create alice")
+		bob, err := NewProtocolWithConfig(&ProtocolConfig{
+			Name: name,
+			RekeyerConfig: &DefaultRekeyerConfig{
+				Interval: interval, ResetNonce: true,
+			},
+		})
+		require.NoError(err, "failed to create bob")
+		runHandshake(t, alice, bob)
+
+		// each direction has its own rekeyer
+		send, recv := alice.SendCipherState, alice.RecvCipherState
+		require.NotSame(send.RekeyManger, recv.RekeyManger,
+			"rekeyers should not be shared")
+		require.NotSame(alice.ss.rekeyer, send.RekeyManger,
+			"rekeyers should not be shared")
+
+		// the key after a rekey is REKEY(k) from the current key, computed
+		// using a fresh cipher.
+		spec, _ := noiseCipher.FromString(send.cipher.String())
+		require.NoError(spec.InitCipher(send.key), "failed to init cipher")
+		want := spec.Rekey()
+		recvKey := recv.key
+
+		for i := uint64(0); i < interval; i++ {
+			ct, err := alice.SendCipherState.EncryptWithAd(nil, []byte("yy"))
+			require.NoError(err, "failed to encrypt")
+			_, err = bob.RecvCipherState.DecryptWithAd(nil, ct)
+			require.NoError(err, "failed to decrypt")
+		}
+		require.Equal(want, send.key, "key not match")
+		require.Equal(want, bob.RecvCipherState.key, "key not match")
+		require.Equal(uint64(0), send.Nonce(), "nonce should be reset")
+
+		// the other direction is untouched
+		require.Equal(recvKey, recv.key, "key should not change")
+		ct, err := bob.SendCipherState.EncryptWithAd(nil, []byte("yy"))
+		require.NoError(err, "failed to encrypt")
+		_, err = alice.RecvCipherState.DecryptWithAd(nil, ct)
+		require.NoError(err, "failed to decrypt")
+
+		// an explicit rekey uses the rekeyer too
+		spec.Reset()
+		require.NoError(spec.InitCipher(send.key), "failed to init cipher")
+		want = spec.Rekey()
+		require.NoError(send.Rekey(), "failed to rekey")
+		require.Equal(want, send.key, "key not match")
+	}
+}
+
+func TestCipherStateRekeyNewProtocol(t *testing.T) {
+	name := "Noise_NN_25519_ChaChaPoly_SHA256"
+	alice, err := NewProtocol(name, "", true)
+	require.NoError(t, err, "failed to create alice")
+	bob, err := NewProtocol(name, "", false)
+	require.NoError(t, err, "failed to create bob")
+	runHandshake(t, alice, bob)
+
+	// the default rekeyer rekeys the transport cipher states
+	require.NoError(t, alice.SendCipherState.Rekey(), "failed to rekey")
+	require.NoError(t, bob.RecvCipherState.Rekey(), "failed to rekey")
+	ct, err := alice.SendCipherState.EncryptWithAd(nil, []byte("yy"))
+	require.NoError(t, err, "failed to encrypt")
+	pt, err := bob.RecvCipherState.DecryptWithAd(nil, ct)
+	require.NoError(t, err, "failed to decrypt")
+	require.Equal(t, []byte("yy"), pt, "plaintext not match")
+}
+
+func TestCipherStateRekeyPolicy(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_NN_25519_ChaChaPoly_SHA256"
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:      name,
+		Initiator: true,
+		Rekeyer:   rekey.NewBytes(100, c, false),
+	})
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:    name,
+		Rekeyer: rekey.NewBytes(100, c, false),
+	})
+	require.NoError(err, "failed to create bob")
+	runHandshake(t, alice, bob)
+
+	// the cipher state feeds the plaintext size to the rekeyer, so the key is
+	// rotated after the second 60-byte message.
+	send := alice.SendCipherState
+	key := send.key
+	msg := make([]byte, 60)
+	for i := 0; i < 2; i++ {
+		require.Equal(key, send.key, "key should not change")
+		ct, err := send.EncryptWithAd(nil, msg)
+		require.NoError(err, "failed to encrypt")
+		_, err = bob.RecvCipherState.DecryptWithAd(nil, ct)
+		require.NoError(err, "failed to decrypt")
+	}
+
+	want, _ := rekey.NewDefault(1, c, false).Rekey(key)
+	require.Equal(want, send.key, "key not rotated")
+	require.Equal(want, bob.RecvCipherState.key, "key not rotated")
+	require.Equal(uint64(2), send.Nonce(), "nonce should not be reset")
+}
+
+func TestCipherStateRekeyPolicyHandshake(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+
+	// only alice uses a rekeyer, which would fire on the large payloads if it
+	// were used during the handshake.
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:        name,
+		Initiator:   true,
+		Rekeyer:     rekey.NewBytes(16, c, false),
+		autoPadding: true,
+	})
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:        name,
+		autoPadding: true,
+	})
+	require.NoError(err, "failed to create bob")
+	require.Nil(alice.ss.cs.RekeyManger, "handshake must not rekey")
+
+	payload := make([]byte, 1024)
+	sender, receiver := alice, bob
+	for !alice.Finished() {
+		ct, err := sender.WriteMessage(payload)
+		require.NoError(err, "failed to write message")
+		pt, err := receiver.ReadMessage(ct)
+		require.NoError(err, "failed to read message")
+		require.Equal(payload, pt, "payload not match")
+		sender, receiver = receiver, sender
+	}
+	require.Equal(alice.GetDigest(), bob.GetDigest(), "digest not match")
+
+	// the transport cipher states use the rekeyer.
+	require.NotNil(alice.SendCipherState.RekeyManger, "missing rekeyer")
+	require.NotNil(alice.RecvCipherState.RekeyManger, "missing rekeyer")
+}
+
+func TestCipherStateDestroy(t *testing.T) {
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+	cs := newCipherState(c, nil)
+	require.False(t, cs.hasKey(), "should have no key")
+
+	key := [CipherKeySize]byte{1}
+	require.NoError(t, cs.initializeKey(key), "failed to init key")
+	cs.SetNonce(10)
+	require.True(t, cs.hasKey(), "should have a key")
+
+	cs.Destroy()
+	require.Equal(t, ZEROS, cs.key, "key not wiped")
+	require.Zero(t, cs.Nonce(), "nonce not reset")
+	require.False(t, cs.hasKey(), "should have no key")
+	require.Nil(t, c.Cipher(), "cipher not destroyed")
+}
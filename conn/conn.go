@@ -0,0 +1,345 @@
+// Package conn implements a net.Conn secured by the noise protocol, in the
+// spirit of crypto/tls. The handshake is performed on the first Read or Write,
+// or by calling Handshake explicitly. Every handshake and transport message is
+// prefixed with a 2-byte big-endian length, as specified in
+// https://noiseprotocol.org/noise.html#message-format.
+package conn
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/crypto-y/babble"
+)
+
+const (
+	// MaxMessageSize is the max size of a noise message in bytes.
+	MaxMessageSize = 65535
+)
+
+// ConnectionState records basic details about the connection.
+type ConnectionState struct {
+	// HandshakeComplete is true if the handshake has concluded.
+	HandshakeComplete bool
+
+	// Protocol is the full protocol name, e.g.,
+	// Noise_XX_25519_ChaChaPoly_BLAKE2s.
+	Protocol string
+
+	// Initiator is true if the local party is the handshake initiator.
+	Initiator bool
+
+	// HandshakeHash is the handshake hash, which can be used for channel
+	// binding.
+	HandshakeHash []byte
+
+	// PeerStatic is the remote party's static public key, which is empty if
+	// the pattern doesn't have one.
+	PeerStatic []byte
+}
+
+// Conn represents a secured connection. It implements the net.Conn interface.
+// Read and Write can be called concurrently.
+type Conn struct {
+	conn     net.Conn
+	config   *babble.ProtocolConfig
+	isClient bool
+
+	// handshakeMutex guards the handshake, handshakeErr and session.
+	handshakeMutex sync.Mutex
+	handshakeErr   error
+	session        *babble.Session
+
+	// in guards the read side, input holds the plaintext not yet read, and
+	// readErr is set once a read fails.
+	in      sync.Mutex
+	input   []byte
+	readErr error
+
+	// out guards the write side.
+	out sync.Mutex
+}
+
+// Client returns a new client side connection using conn as the underlying
+// transport. The config must specify the protocol name and the keys needed by
+// the pattern, its Initiator field is ignored.
+func Client(conn net.Conn, config *babble.ProtocolConfig) *Conn {
+	return &Conn{conn: conn, config: config, isClient: true}
+}
+
+// Server returns a new server side connection using conn as the underlying
+// transport. The config must specify the protocol name and the keys needed by
+// the pattern, its Initiator field is ignored.
+func Server(conn net.Conn, config *babble.ProtocolConfig) *Conn {
+	return &Conn{conn: conn, config: config}
+}
+
+// Handshake runs the handshake if it has not yet been run. Most uses of this
+// package need not call Handshake explicitly, the first Read or Write will
+// call it automatically. Once failed, the same error is returned.
+func (c *Conn) Handshake() error {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.session != nil || c.handshakeErr != nil {
+		return c.handshakeErr
+	}
+
+	c.session, c.handshakeErr = c.runHandshake()
+	return c.handshakeErr
+}
+
+// runHandshake creates the handshake state and runs it using
+// babble.Handshake.
+func (c *Conn) runHandshake() (*babble.Session, error) {
+	if c.config == nil {
+		return nil, babble.ErrMissingConfig
+	}
+
+	config := *c.config
+	config.Initiator = c.isClient
+	hs, err := babble.NewProtocolWithConfig(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the deadlines of the connection apply instead of a context.
+	if _, err := babble.Handshake(
+		context.Background(), c.conn, hs, nil); err != nil {
+		return nil, err
+	}
+	return hs.Session()
+}
+
+// Read reads data from the connection. A transport message is decrypted as a
+// whole, and the plaintext not fitting in b is kept for the next Read.
+func (c *Conn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for len(c.input) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		c.input, c.readErr = c.readTransport()
+	}
+
+	n := copy(b, c.input)
+	c.input = c.input[n:]
+	return n, nil
+}
+
+// readTransport reads and decrypts the next transport message.
+func (c *Conn) readTransport() ([]byte, error) {
+	msg, err := babble.ReadFrame(c.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.session.Decrypt(nil, msg)
+}
+
+// Write writes data to the connection. Data not fitting in a single transport
+// message of MaxMessageSize, including the authentication tag of the cipher,
+// is split into multiple transport messages.
+func (c *Conn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	maxPlaintextSize := MaxMessageSize - c.session.Overhead()
+
+	var n int
+	for len(b) > 0 {
+		size := len(b)
+		if size > maxPlaintextSize {
+			size = maxPlaintextSize
+		}
+
+		if err := c.writeTransport(b[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// writeTransport encrypts and writes a single transport message.
+func (c *Conn) writeTransport(plaintext []byte) error {
+	msg, err := c.session.Encrypt(nil, plaintext)
+	if err != nil {
+		return err
+	}
+	return babble.WriteFrame(c.conn, msg)
+}
+
+// Close closes the connection, and wipes the keys of the session.
+func (c *Conn) Close() error {
+	// close the underlying connection first to unblock a pending handshake.
+	err := c.conn.Close()
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+	if c.session != nil {
+		c.session.Close()
+	}
+	return err
+}
+
+// ConnectionState returns basic details about the connection. It blocks while
+// the handshake is in progress.
+func (c *Conn) ConnectionState() ConnectionState {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	state := ConnectionState{Initiator: c.isClient}
+	if c.config != nil {
+		state.Protocol = c.config.Name
+	}
+	if c.session == nil {
+		return state
+	}
+
+	state.HandshakeComplete = true
+	state.HandshakeHash = c.session.HandshakeHash()
+	if pub := c.session.RemoteStatic(); pub != nil {
+		state.PeerStatic = pub.Bytes()
+	} else if pub := c.session.RemoteStaticKem(); pub != nil {
+		state.PeerStatic = pub.Bytes()
+	}
+	return state
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// LocalAddr returns the local network address.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines associated with the
+// connection, which also apply to the handshake.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline on the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline on the underlying connection.
+// A timed out Write may have written part of a transport message, after which
+// the connection cannot be used anymore.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// listener implements a net.Listener which returns server side connections.
+type listener struct {
+	net.Listener
+	config *babble.ProtocolConfig
+}
+
+// Accept waits for and returns the next incoming connection. The returned
+// connection is of type *Conn, and its handshake is not yet performed.
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(c, l.config), nil
+}
+
+// NewListener creates a listener which accepts connections from an inner
+// listener and wraps each of them with Server. Since the config is shared by
+// all the connections, it should not specify the local ephemeral key.
+func NewListener(inner net.Listener, config *babble.ProtocolConfig) net.Listener {
+	return &listener{Listener: inner, config: config}
+}
+
+// Listen creates a listener accepting connections on the given network
+// address using net.Listen.
+func Listen(network, laddr string,
+	config *babble.ProtocolConfig) (net.Listener, error) {
+	if config == nil {
+		return nil, babble.ErrMissingConfig
+	}
+
+	l, err := net.Listen(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, config), nil
+}
+
+// Dial connects to the given network address using net.Dial and then performs
+// the handshake, returning the resulting connection.
+func Dial(network, addr string, config *babble.ProtocolConfig) (*Conn, error) {
+	return DialWithDialer(new(net.Dialer), network, addr, config)
+}
+
+// DialWithDialer works the same as Dial, except it uses the dialer to connect.
+// The dialer's Timeout and Deadline also apply to the handshake.
+func DialWithDialer(dialer *net.Dialer, network, addr string,
+	config *babble.ProtocolConfig) (*Conn, error) {
+	if config == nil {
+		return nil, babble.ErrMissingConfig
+	}
+
+	rawConn, err := dialer.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// apply the dialer's timeout to the handshake
+	deadline := dialer.Deadline
+	if dialer.Timeout != 0 {
+		timeout := time.Now().Add(dialer.Timeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	if !deadline.IsZero() {
+		if err := rawConn.SetDeadline(deadline); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+	}
+
+	conn := Client(rawConn, config)
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	if !deadline.IsZero() {
+		if err := rawConn.SetDeadline(time.Time{}); err != nil {
+			rawConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
@@ -0,0 +1,225 @@
+package conn_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble"
+	"github.com/crypto-y/babble/conn"
+	"github.com/crypto-y/babble/dh"
+	"github.com/stretchr/testify/require"
+)
+
+const protocolName = "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+
+// newConfigs creates the configs used by the client and the server.
+func newConfigs(t *testing.T) (*babble.ProtocolConfig, *babble.ProtocolConfig) {
+	curve, _ := dh.FromString("25519")
+	clientKey, err := curve.GenerateKeyPair(nil)
+	require.NoError(t, err, "failed to generate key")
+	serverKey, err := curve.GenerateKeyPair(nil)
+	require.NoError(t, err, "failed to generate key")
+
+	client := &babble.ProtocolConfig{
+		Name:            protocolName,
+		Prologue:        "babble",
+		LocalStaticPriv: clientKey.Bytes(),
+	}
+	server := &babble.ProtocolConfig{
+		Name:            protocolName,
+		Prologue:        "babble",
+		LocalStaticPriv: serverKey.Bytes(),
+	}
+	return client, server
+}
+
+// recordConn records the size of each write.
+type recordConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	writes []int
+}
+
+func (r *recordConn) Write(b []byte) (int, error) {
+	r.mu.Lock()
+	r.writes = append(r.writes, len(b))
+	r.mu.Unlock()
+	return r.Conn.Write(b)
+}
+
+func TestConn(t *testing.T) {
+	require := require.New(t)
+	clientConfig, serverConfig := newConfigs(t)
+
+	c1, c2 := net.Pipe()
+	recorder := &recordConn{Conn: c1}
+	client := conn.Client(recorder, clientConfig)
+	server := conn.Server(c2, serverConfig)
+	defer client.Close()
+	defer server.Close()
+
+	require.False(client.ConnectionState().HandshakeComplete,
+		"handshake should not be completed")
+
+	// write data needing three transport messages, ChaChaPoly adds a 16-byte
+	// tag to each of them.
+	data := bytes.Repeat([]byte{1, 2, 3}, conn.MaxMessageSize-16)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := client.Write(data)
+		errChan <- err
+	}()
+
+	received := make([]byte, len(data))
+	_, err := io.ReadFull(server, received)
+	require.NoError(err, "failed to read")
+	require.Equal(data, received, "data not match")
+	require.NoError(<-errChan, "failed to write")
+
+	// three handshake messages, then three transport messages
+	require.Len(recorder.writes, 5, "number of writes not match")
+	require.Equal(2+conn.MaxMessageSize, recorder.writes[2],
+		"transport message size not match")
+	require.Equal(2+conn.MaxMessageSize, recorder.writes[3],
+		"transport message size not match")
+
+	// check the connection states
+	clientState := client.ConnectionState()
+	serverState := server.ConnectionState()
+	require.True(clientState.HandshakeComplete, "handshake not completed")
+	require.True(serverState.HandshakeComplete, "handshake not completed")
+	require.True(clientState.Initiator, "client must be the initiator")
+	require.False(serverState.Initiator, "server must be the responder")
+	require.Equal(protocolName, clientState.Protocol, "protocol not match")
+	require.Equal(clientState.HandshakeHash, serverState.HandshakeHash,
+		"handshake hash not match")
+
+	curve, _ := dh.FromString("25519")
+	clientKey, _ := curve.LoadPrivateKey(clientConfig.LocalStaticPriv)
+	serverKey, _ := curve.LoadPrivateKey(serverConfig.LocalStaticPriv)
+	require.Equal(serverKey.PubKey().Bytes(), clientState.PeerStatic,
+		"peer static not match")
+	require.Equal(clientKey.PubKey().Bytes(), serverState.PeerStatic,
+		"peer static not match")
+
+	// a short read keeps the rest of the message
+	go func() {
+		_, err := server.Write([]byte("hello"))
+		errChan <- err
+	}()
+	buf := make([]byte, 2)
+	n, err := client.Read(buf)
+	require.NoError(err, "failed to read")
+	require.Equal("he", string(buf[:n]), "data not match")
+	buf = make([]byte, 10)
+	n, err = client.Read(buf)
+	require.NoError(err, "failed to read")
+	require.Equal("llo", string(buf[:n]), "data not match")
+	require.NoError(<-errChan, "failed to write")
+
+	// the remote closes the connection
+	require.NoError(server.Close(), "failed to close")
+	_, err = client.Read(buf)
+	require.Equal(io.EOF, err, "error not match")
+}
+
+func TestConnHandshakeError(t *testing.T) {
+	require := require.New(t)
+	clientConfig, serverConfig := newConfigs(t)
+	serverConfig.Prologue = "yy"
+
+	c1, c2 := net.Pipe()
+	client := conn.Client(c1, clientConfig)
+	server := conn.Server(c2, serverConfig)
+	defer client.Close()
+
+	go func() {
+		// the server fails to decrypt the second message, then closes.
+		server.Handshake()
+		server.Close()
+	}()
+
+	err := client.Handshake()
+	require.Error(err, "handshake should fail")
+
+	// the same error is returned
+	_, err2 := client.Write([]byte("yy"))
+	require.Equal(err, err2, "error not match")
+	_, err2 = client.Read(make([]byte, 1))
+	require.Equal(err, err2, "error not match")
+	require.False(client.ConnectionState().HandshakeComplete,
+		"handshake should not be completed")
+
+	// a missing config
+	c3, _ := net.Pipe()
+	require.Equal(babble.ErrMissingConfig, conn.Client(c3, nil).Handshake(),
+		"error not match")
+}
+
+func TestConnDeadline(t *testing.T) {
+	clientConfig, _ := newConfigs(t)
+
+	// the server never replies
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+
+	client := conn.Client(c1, clientConfig)
+	defer client.Close()
+	require.NoError(t,
+		client.SetDeadline(time.Now().Add(10*time.Millisecond)),
+		"failed to set deadline")
+
+	err := client.Handshake()
+	netErr, ok := err.(net.Error)
+	require.True(t, ok, "must be a net error")
+	require.True(t, netErr.Timeout(), "must be a timeout")
+}
+
+func TestListenAndDial(t *testing.T) {
+	require := require.New(t)
+	clientConfig, serverConfig := newConfigs(t)
+
+	_, err := conn.Listen("tcp", "127.0.0.1:0", nil)
+	require.Equal(babble.ErrMissingConfig, err, "error not match")
+	_, err = conn.Dial("tcp", "127.0.0.1:0", nil)
+	require.Equal(babble.ErrMissingConfig, err, "error not match")
+
+	l, err := conn.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(err, "failed to listen")
+	defer l.Close()
+
+	// the server echoes the message back
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		c.Write(buf)
+	}()
+
+	dialer := &net.Dialer{Timeout: time.Second}
+	client, err := conn.DialWithDialer(
+		dialer, "tcp", l.Addr().String(), clientConfig)
+	require.NoError(err, "failed to dial")
+	defer client.Close()
+	require.True(client.ConnectionState().HandshakeComplete,
+		"handshake must be completed")
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(err, "failed to write")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(client, buf)
+	require.NoError(err, "failed to read")
+	require.Equal("hello", string(buf), "data not match")
+}
@@ -0,0 +1,311 @@
+package babble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+)
+
+const (
+	// DatagramNonceSize is the size of the explicit nonce prefixed to each
+	// datagram packet, an 8-byte big-endian unsigned integer.
+	DatagramNonceSize = 8
+
+	// defaultDatagramRekeyInterval is the number of packets sent using the
+	// same key if not specified.
+	defaultDatagramRekeyInterval = 1 << 20
+
+	// maxEpochSkip is the max number of epochs a receiver moves forward at
+	// once, which limits the keys derived ahead of the current epoch.
+	maxEpochSkip = 16
+)
+
+var (
+	// ErrReplayedPacket is returned when a datagram packet has been received
+	// before, or is too old to be checked by the replay window.
+	ErrReplayedPacket = errors.New("packet is replayed or too old")
+
+	errInvalidPacket = errors.New("packet is too short")
+	errEpochTooFar   = errors.New("packet epoch is too far ahead")
+
+	errDatagramRekeyInterval = fmt.Errorf(
+		"rekey interval must be no less than %d", ReplayWindowSize)
+)
+
+// DatagramConfig is used for creating a datagram session.
+type DatagramConfig struct {
+	// RekeyInterval specifies the number of packets sent using the same key,
+	// which must be the same for both parties. The packets with nonces from n
+	// * RekeyInterval to (n+1) * RekeyInterval - 1 belong to epoch n, and the
+	// key of epoch n is derived by performing REKEY n times. It must be no
+	// less than ReplayWindowSize, if zero, 2^20 is used.
+	RekeyInterval uint64
+}
+
+// DatagramSession is the transport phase of a finished handshake for
+// unreliable transports, where packets can be lost, duplicated or reordered.
+// Each packet carries its nonce explicitly, and a sliding window is used to
+// reject replayed packets. The nonces are never reset, and the keys are
+// rotated every RekeyInterval packets. The receiver keeps the key of the
+// previous epoch, so reordered packets across a rekey still decrypt.
+//
+// A datagram session is safe for concurrent use, with the sending and
+// receiving sides locked separately like a Session.
+type DatagramSession struct {
+	sessionInfo
+
+	interval uint64
+
+	// send is the sending cipher state, nonce is the next nonce to be used,
+	// and sendEpoch is the epoch of the key in use, guarded by sendMu.
+	sendMu    sync.Mutex
+	send      *CipherState
+	nonce     uint64
+	sendEpoch uint64
+
+	// recv is the receiving cipher state of recvEpoch, and prev is the one of
+	// the previous epoch, which is nil for epoch 0. ahead holds the derived
+	// ones of the following epochs, which are not used until a packet of
+	// their epoch is authenticated. They are guarded by recvMu along with the
+	// replay window.
+	recvMu    sync.Mutex
+	recv      *CipherState
+	prev      *CipherState
+	ahead     []*CipherState
+	recvEpoch uint64
+	window    *replayWindow
+
+	// closed is guarded by both sendMu and recvMu.
+	closed bool
+}
+
+// DatagramSession creates a datagram session from the finished handshake. A
+// nil config uses the default settings. The session shares the cipher states
+// with SendCipherState and RecvCipherState, which should not be used directly
+// once a session is created. It's created only once, the later calls with the
+// same settings return the same session, and ErrSessionExists is returned if
+// the settings differ, or a Session is already created.
+func (hs *HandshakeState) DatagramSession(
+	config *DatagramConfig) (*DatagramSession, error) {
+	if hs.hp == nil || hs.ss == nil || !hs.Finished() {
+		return nil, ErrHandshakeNotFinished
+	}
+	if hs.session != nil {
+		return nil, ErrSessionExists
+	}
+
+	interval := uint64(defaultDatagramRekeyInterval)
+	if config != nil && config.RekeyInterval != 0 {
+		interval = config.RekeyInterval
+	}
+	if interval < ReplayWindowSize {
+		return nil, errDatagramRekeyInterval
+	}
+
+	if hs.datagramSession != nil {
+		if hs.datagramSession.interval != interval {
+			return nil, ErrSessionExists
+		}
+		return hs.datagramSession, nil
+	}
+
+	hs.datagramSession = &DatagramSession{
+		sessionInfo: newSessionInfo(hs),
+		interval:    interval,
+		send:        hs.SendCipherState,
+		recv:        hs.RecvCipherState,
+		window:      newReplayWindow(),
+	}
+	return hs.datagramSession, nil
+}
+
+// Encrypt encrypts the plaintext with the associated data, and returns the
+// packet, which is the nonce followed by the ciphertext.
+func (d *DatagramSession) Encrypt(ad, plaintext []byte) ([]byte, error) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	if d.closed {
+		return nil, ErrSessionClosed
+	}
+	if d.send == nil {
+		return nil, errMissingCipherState(DirectionSend)
+	}
+
+	// the max nonce is reserved.
+	n := d.nonce
+	if n == noiseCipher.MaxNonce {
+		return nil, noiseCipher.ErrNonceOverflow
+	}
+
+	// move to the next epoch
+	if epoch := n / d.interval; epoch != d.sendEpoch {
+		if err := d.send.rekeyCipher(); err != nil {
+			return nil, err
+		}
+		d.sendEpoch = epoch
+	}
+
+	ciphertext, err := d.send.EncryptWithNonce(n, ad, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	d.nonce++
+
+	packet := make([]byte, DatagramNonceSize, DatagramNonceSize+len(ciphertext))
+	binary.BigEndian.PutUint64(packet, n)
+	return append(packet, ciphertext...), nil
+}
+
+// Decrypt decrypts the packet with the associated data. A packet is only
+// recorded by the replay window once it's authenticated, so a forged packet
+// doesn't affect the session.
+func (d *DatagramSession) Decrypt(ad, packet []byte) ([]byte, error) {
+	d.recvMu.Lock()
+	defer d.recvMu.Unlock()
+
+	if d.closed {
+		return nil, ErrSessionClosed
+	}
+	if d.recv == nil {
+		return nil, errMissingCipherState(DirectionRecv)
+	}
+	if len(packet) < DatagramNonceSize {
+		return nil, errInvalidPacket
+	}
+
+	n := binary.BigEndian.Uint64(packet)
+	if !d.window.check(n) {
+		return nil, ErrReplayedPacket
+	}
+
+	ciphertext := packet[DatagramNonceSize:]
+	epoch := n / d.interval
+
+	switch {
+	// the current epoch
+	case epoch == d.recvEpoch:
+		return d.decrypt(d.recv, n, ad, ciphertext)
+
+	// the previous epoch
+	case epoch+1 == d.recvEpoch:
+		if d.prev == nil {
+			return nil, ErrReplayedPacket
+		}
+		return d.decrypt(d.prev, n, ad, ciphertext)
+
+	// older epochs are outside of the replay window
+	case epoch < d.recvEpoch:
+		return nil, ErrReplayedPacket
+	}
+
+	// a future epoch, the keys are only used for receiving once the packet is
+	// authenticated.
+	skip := epoch - d.recvEpoch
+	if skip > maxEpochSkip {
+		return nil, errEpochTooFar
+	}
+	next, err := d.deriveEpoch(skip)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := d.decrypt(next, n, ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	d.advance(skip)
+	return plaintext, nil
+}
+
+// decrypt decrypts the ciphertext and marks the nonce as received.
+func (d *DatagramSession) decrypt(cs *CipherState,
+	n uint64, ad, ciphertext []byte) ([]byte, error) {
+	plaintext, err := cs.DecryptWithNonce(n, ad, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	d.window.mark(n)
+	return plaintext, nil
+}
+
+// deriveEpoch returns the cipher state of the epoch skip epochs ahead of the
+// current one. The keys are derived once and kept in ahead, so packets of a
+// future epoch, forged or not, don't repeat the rekeys.
+func (d *DatagramSession) deriveEpoch(skip uint64) (*CipherState, error) {
+	for uint64(len(d.ahead)) < skip {
+		last := d.recv
+		if len(d.ahead) > 0 {
+			last = d.ahead[len(d.ahead)-1]
+		}
+
+		next, err := cloneCipherState(last)
+		if err != nil {
+			return nil, err
+		}
+		if err := next.rekeyCipher(); err != nil {
+			next.Destroy()
+			return nil, err
+		}
+		d.ahead = append(d.ahead, next)
+	}
+	return d.ahead[skip-1], nil
+}
+
+// advance moves the receiver skip epochs forward, keeping the key of the
+// epoch before the new one, and wipes the keys no longer needed.
+func (d *DatagramSession) advance(skip uint64) {
+	// keys[i] is the key of epoch recvEpoch+i.
+	keys := append([]*CipherState{d.recv}, d.ahead...)
+
+	if d.prev != nil {
+		d.prev.Destroy()
+	}
+	for _, cs := range keys[:skip-1] {
+		cs.Destroy()
+	}
+
+	d.prev, d.recv = keys[skip-1], keys[skip]
+	d.ahead = append([]*CipherState{}, keys[skip+1:]...)
+	d.recvEpoch += skip
+}
+
+// Close wipes the keys of the cipher states. Once closed, the session cannot
+// be used anymore. Close is idempotent.
+func (d *DatagramSession) Close() error {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+	d.recvMu.Lock()
+	defer d.recvMu.Unlock()
+
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+
+	for _, cs := range append([]*CipherState{d.send, d.recv, d.prev},
+		d.ahead...) {
+		if cs != nil {
+			cs.Destroy()
+		}
+	}
+	d.send, d.recv, d.prev, d.ahead = nil, nil, nil, nil
+	d.wipe()
+	return nil
+}
+
+// cloneCipherState creates a cipher state with a new cipher using the same key.
+func cloneCipherState(cs *CipherState) (*CipherState, error) {
+	c, err := noiseCipher.FromString(cs.cipher.String())
+	if err != nil {
+		return nil, err
+	}
+
+	clone := newCipherState(c, nil)
+	if err := clone.initializeKey(cs.key); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
@@ -0,0 +1,236 @@
+package babble
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newDatagramSessions creates the datagram sessions for alice and bob.
+func newDatagramSessions(t *testing.T,
+	config *DatagramConfig) (*DatagramSession, *DatagramSession) {
+	name := "Noise_NN_25519_ChaChaPoly_BLAKE2s"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	_, err := alice.DatagramSession(config)
+	require.Equal(t, ErrHandshakeNotFinished, err, "error not match")
+
+	runHandshake(t, alice, bob)
+
+	aliceSession, err := alice.DatagramSession(config)
+	require.NoError(t, err, "failed to create session")
+	bobSession, err := bob.DatagramSession(config)
+	require.NoError(t, err, "failed to create session")
+	return aliceSession, bobSession
+}
+
+// sealPackets encrypts the plaintexts into packets.
+func sealPackets(t *testing.T, s *DatagramSession, num int) [][]byte {
+	packets := make([][]byte, num)
+	for i := range packets {
+		packet, err := s.Encrypt(nil, []byte{byte(i)})
+		require.NoError(t, err, "failed to encrypt")
+		packets[i] = packet
+	}
+	return packets
+}
+
+func TestDatagramSession(t *testing.T) {
+	require := require.New(t)
+	alice, bob := newDatagramSessions(t, nil)
+
+	require.True(alice.Initiator(), "alice is the initiator")
+	require.Equal(alice.HandshakeHash(), bob.HandshakeHash(),
+		"handshake hash not match")
+
+	// the packets carry the nonces
+	packets := sealPackets(t, alice, 5)
+	for i, packet := range packets {
+		require.Equal(uint64(i), binary.BigEndian.Uint64(packet),
+			"nonce not match")
+	}
+
+	// the packets can be decrypted in any order
+	for _, i := range []int{3, 0, 4, 1} {
+		plaintext, err := bob.Decrypt(nil, packets[i])
+		require.NoError(err, "failed to decrypt packet %d", i)
+		require.Equal([]byte{byte(i)}, plaintext, "plaintext not match")
+	}
+
+	// a replayed packet is rejected
+	_, err := bob.Decrypt(nil, packets[3])
+	require.Equal(ErrReplayedPacket, err, "error not match")
+
+	// a forged packet is rejected, and doesn't affect the window
+	forged := append([]byte{}, packets[2]...)
+	forged[len(forged)-1] ^= 1
+	_, err = bob.Decrypt(nil, forged)
+	require.Error(err, "forged packet should fail")
+	plaintext, err := bob.Decrypt(nil, packets[2])
+	require.NoError(err, "failed to decrypt")
+	require.Equal([]byte{2}, plaintext, "plaintext not match")
+
+	// the other direction
+	packet, err := bob.Encrypt([]byte("ad"), []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	plaintext, err = alice.Decrypt([]byte("ad"), packet)
+	require.NoError(err, "failed to decrypt")
+	require.Equal([]byte("yy"), plaintext, "plaintext not match")
+
+	// a short packet
+	_, err = bob.Decrypt(nil, packet[:DatagramNonceSize-1])
+	require.Equal(errInvalidPacket, err, "error not match")
+
+	// close wipes the keys
+	require.NoError(alice.Close(), "failed to close")
+	require.NoError(alice.Close(), "close is idempotent")
+	_, err = alice.Encrypt(nil, nil)
+	require.Equal(ErrSessionClosed, err, "error not match")
+	_, err = alice.Decrypt(nil, packet)
+	require.Equal(ErrSessionClosed, err, "error not match")
+	require.Empty(alice.HandshakeHash(), "hash must be wiped")
+}
+
+func TestDatagramSessionRekey(t *testing.T) {
+	require := require.New(t)
+	interval := uint64(ReplayWindowSize)
+	alice, bob := newDatagramSessions(
+		t, &DatagramConfig{RekeyInterval: interval})
+
+	// epoch 0 and epoch 1
+	packets := sealPackets(t, alice, int(interval)+10)
+
+	// the first packet of epoch 1 moves bob to the next epoch
+	plaintext, err := bob.Decrypt(nil, packets[interval])
+	require.NoError(err, "failed to decrypt")
+	require.Equal([]byte{byte(interval)}, plaintext, "plaintext not match")
+	require.Equal(uint64(1), bob.recvEpoch, "epoch not match")
+
+	// a reordered packet from epoch 0 still decrypts
+	plaintext, err = bob.Decrypt(nil, packets[interval-1])
+	require.NoError(err, "failed to decrypt")
+	require.Equal([]byte{byte(interval - 1)}, plaintext,
+		"plaintext not match")
+
+	// skip to epoch 4 by dropping packets
+	packets = sealPackets(t, alice, int(3*interval))
+	last := packets[len(packets)-1]
+	_, err = bob.Decrypt(nil, last)
+	require.NoError(err, "failed to decrypt")
+	require.Equal(uint64(4), bob.recvEpoch, "epoch not match")
+
+	// a late packet from epoch 3 still decrypts, while packets outside of the
+	// window are rejected.
+	late := packets[len(packets)-11]
+	require.Equal(4*interval-1, binary.BigEndian.Uint64(late),
+		"must be the last packet of epoch 3")
+	_, err = bob.Decrypt(nil, late)
+	require.NoError(err, "failed to decrypt")
+	_, err = bob.Decrypt(nil, packets[0])
+	require.Equal(ErrReplayedPacket, err, "error not match")
+
+	// a forged packet from a future epoch doesn't move the epoch
+	forged := make([]byte, DatagramNonceSize+20)
+	binary.BigEndian.PutUint64(forged, 6*interval)
+	_, err = bob.Decrypt(nil, forged)
+	require.Error(err, "forged packet should fail")
+	require.Equal(uint64(4), bob.recvEpoch, "epoch not match")
+
+	// the keys derived for it are kept, so another forged packet doesn't
+	// derive them again.
+	require.Len(bob.ahead, 2, "keys of epoch 5 and 6 should be derived")
+	derived := bob.ahead[1]
+	_, err = bob.Decrypt(nil, forged)
+	require.Error(err, "forged packet should fail")
+	require.Len(bob.ahead, 2, "no more keys should be derived")
+	require.Same(derived, bob.ahead[1], "derived keys should be reused")
+
+	// an epoch too far ahead is rejected
+	binary.BigEndian.PutUint64(forged, (4+maxEpochSkip+1)*interval)
+	_, err = bob.Decrypt(nil, forged)
+	require.Equal(errEpochTooFar, err, "error not match")
+
+	// the session still works
+	packets = sealPackets(t, alice, 1)
+	_, err = bob.Decrypt(nil, packets[0])
+	require.NoError(err, "failed to decrypt")
+
+	// the derived keys are used once a packet of their epoch is received
+	packets = sealPackets(t, alice, int(2*interval))
+	_, err = bob.Decrypt(nil, packets[interval])
+	require.NoError(err, "failed to decrypt")
+	require.Equal(uint64(5), bob.recvEpoch, "epoch not match")
+	require.Equal([]*CipherState{derived}, bob.ahead, "ahead not match")
+	_, err = bob.Decrypt(nil, packets[len(packets)-1])
+	require.NoError(err, "failed to decrypt")
+	require.Equal(uint64(6), bob.recvEpoch, "epoch not match")
+	require.Same(derived, bob.recv, "derived key should be used")
+	require.Empty(bob.ahead, "no keys should be left")
+
+	// the rekey interval must cover the replay window
+	_, err = (&HandshakeState{}).DatagramSession(
+		&DatagramConfig{RekeyInterval: 1})
+	require.Equal(ErrHandshakeNotFinished, err, "error not match")
+	name := "Noise_N_25519_ChaChaPoly_BLAKE2s"
+	hs, _ := NewProtocol(name, "", false)
+	hs.patternIndex = len(hs.hp.MessagePattern)
+	_, err = hs.DatagramSession(&DatagramConfig{RekeyInterval: 1})
+	require.Equal(errDatagramRekeyInterval, err, "error not match")
+}
+
+func TestDatagramSessionConcurrent(t *testing.T) {
+	const workers, packets = 8, 150
+	alice, bob := newDatagramSessions(t, &DatagramConfig{
+		RekeyInterval: ReplayWindowSize,
+	})
+
+	// move close to the first rekey.
+	for _, packet := range sealPackets(t, alice, ReplayWindowSize-500) {
+		_, err := bob.Decrypt(nil, packet)
+		require.NoError(t, err, "failed to decrypt")
+	}
+
+	// the packets are sent and received by multiple workers, so they arrive
+	// out of order across the rekey. As all of them fit in the replay window,
+	// each one must be accepted exactly once.
+	sent := make(chan []byte, workers)
+	errs := make(chan error, 2*workers)
+	var senders, receivers sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			for j := 0; j < packets; j++ {
+				packet, err := alice.Encrypt(nil, []byte("yy"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				sent <- packet
+			}
+		}()
+
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			for packet := range sent {
+				if _, err := bob.Decrypt(nil, packet); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	senders.Wait()
+	close(sent)
+	receivers.Wait()
+	close(errs)
+
+	require.NoError(t, <-errs, "failed to exchange packets")
+	require.Equal(t, uint64(ReplayWindowSize-500+workers*packets),
+		alice.nonce, "nonce not match")
+	require.Equal(t, uint64(1), bob.recvEpoch, "epoch not match")
+}
@@ -59,6 +59,13 @@ func (pk *privateKey25519) DH(pub []byte) ([]byte, error) {
 	return shared[:], nil
 }
 
+// Destroy overwrites the private key with zeros.
+func (pk *privateKey25519) Destroy() {
+	for i := range pk.raw {
+		pk.raw[i] = 0
+	}
+}
+
 // update writes secret to the private key.
 func (pk *privateKey25519) update(data []byte) {
 	copy(pk.raw[:], data[:dhlen25519])
@@ -64,6 +64,13 @@ func (pk *privateKey448) PubKey() PublicKey {
 	return pk.pub
 }
 
+// Destroy overwrites the private key with zeros.
+func (pk *privateKey448) Destroy() {
+	for i := range pk.raw {
+		pk.raw[i] = 0
+	}
+}
+
 // update writes secret to the private key.
 func (pk *privateKey448) update(data []byte) {
 	copy(pk.raw[:], data[:dhlen448])
@@ -50,6 +50,10 @@ type PrivateKey interface {
 
 	// PubKey returns the associated public key.
 	PubKey() PublicKey
+
+	// Destroy wipes the private key from memory. The key must not be used
+	// afterwards.
+	Destroy()
 }
 
 // Curve represents DH functions specified in the noise specs.
@@ -60,3 +60,20 @@ func ExampleFromString() {
 	secp256k1, _ := dh.FromString("secp256k1")
 	fmt.Println(secp256k1)
 }
+
+func TestDestroy(t *testing.T) {
+	for _, name := range []string{"25519", "448", "secp256k1"} {
+		t.Run(name, func(t *testing.T) {
+			curve, _ := dh.FromString(name)
+			priv, err := curve.GenerateKeyPair(nil)
+			require.NoError(t, err, "failed to generate key")
+			pub := append([]byte{}, priv.PubKey().Bytes()...)
+
+			priv.Destroy()
+			require.Equal(t, make([]byte, len(priv.Bytes())), priv.Bytes(),
+				"private key not wiped")
+			require.Equal(t, pub, priv.PubKey().Bytes(),
+				"public key should not change")
+		})
+	}
+}
@@ -69,12 +69,20 @@ func (pk *privateKeyBitcoin) DH(pub []byte) ([]byte, error) {
 	var shared [dhlenBitcoin]byte
 
 	newPoint := &btcec.PublicKey{}
-	x, y := btcec.S256().ScalarMult(
-		pubKey.X, pubKey.Y, pk.D.Bytes())
+	scalar := pk.D.Bytes()
+	x, y := btcec.S256().ScalarMult(pubKey.X, pubKey.Y, scalar)
 	newPoint.X = x
 	newPoint.Y = y
 
-	shared = sha256.Sum256(newPoint.SerializeCompressed())
+	point := newPoint.SerializeCompressed()
+	shared = sha256.Sum256(point)
+
+	// wipe the intermediate values
+	for _, b := range [][]byte{scalar, point} {
+		for i := range b {
+			b[i] = 0
+		}
+	}
 	return shared[:], nil
 }
 
@@ -83,6 +91,18 @@ func (pk *privateKeyBitcoin) PubKey() PublicKey {
 	return pk.pub
 }
 
+// Destroy overwrites the scalar of the private key with zeros.
+func (pk *privateKeyBitcoin) Destroy() {
+	if pk.PrivateKey == nil || pk.D == nil {
+		return
+	}
+	words := pk.D.Bits()
+	for i := range words {
+		words[i] = 0
+	}
+	pk.D.SetInt64(0)
+}
+
 // update writes secret to the private key.
 func (pk *privateKeyBitcoin) update(data []byte) {
 	// construct the key pairs
@@ -31,25 +31,38 @@ func (nc *NewCipher) EncodeNonce(n uint64) []byte {
 
 // Encrypt calls the underlying Seal function to create the ciphertext.
 func (nc *NewCipher) Encrypt(n uint64, ad, plaintext []byte) ([]byte, error) {
+	return nc.EncryptTo(nil, n, ad, plaintext)
+}
+
+// EncryptTo calls the underlying Seal function to append the ciphertext to
+// dst.
+func (nc *NewCipher) EncryptTo(
+	dst []byte, n uint64, ad, plaintext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == noiseCipher.MaxNonce {
 		return nil, noiseCipher.ErrNonceOverflow
 	}
 
 	nonce := nc.EncodeNonce(n)
-	ciphertext := nc.Cipher().Seal(nil, nonce, plaintext, ad)
-	return ciphertext, nil
+	return nc.Cipher().Seal(dst, nonce, plaintext, ad), nil
 }
 
-// Decrypt calls the underlying Seal function to extract the plaintext.
+// Decrypt calls the underlying Open function to extract the plaintext.
 func (nc *NewCipher) Decrypt(n uint64, ad, ciphertext []byte) ([]byte, error) {
+	return nc.DecryptTo(nil, n, ad, ciphertext)
+}
+
+// DecryptTo calls the underlying Open function to append the plaintext to
+// dst.
+func (nc *NewCipher) DecryptTo(
+	dst []byte, n uint64, ad, ciphertext []byte) ([]byte, error) {
 	// nonce must be less than 2^64-1
 	if n == noiseCipher.MaxNonce {
 		return nil, noiseCipher.ErrNonceOverflow
 	}
 
 	nonce := nc.EncodeNonce(n)
-	plaintext, err := nc.Cipher().Open(nil, nonce, ciphertext, ad)
+	plaintext, err := nc.Cipher().Open(dst, nonce, ciphertext, ad)
 	if err != nil {
 		return nil, err
 	}
@@ -84,6 +97,11 @@ func (nc *NewCipher) Reset() {
 	nc.aead = nil
 }
 
+// Destroy removes the cipher.
+func (nc *NewCipher) Destroy() {
+	nc.aead = nil
+}
+
 func (nc *NewCipher) String() string {
 	return "ChaChaPolyX"
 }
@@ -74,6 +74,13 @@ func (pk *DumbPrivateKey) PubKey() dh.PublicKey {
 	return pk.pub
 }
 
+// Destroy overwrites the private key with zeros.
+func (pk *DumbPrivateKey) Destroy() {
+	for i := range pk.raw {
+		pk.raw[i] = 0
+	}
+}
+
 // Update writes secret to the private key.
 func (pk *DumbPrivateKey) Update(data []byte) {
 	copy(pk.raw[:], data[:DHLEN])
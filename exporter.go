@@ -0,0 +1,67 @@
+package babble
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// exporterLabel is prefixed to the HKDF info used by ExportKeyingMaterial, so
+// the exported keys are independent from the ones created by Split, which uses
+// an empty info.
+const exporterLabel = "babble exporter"
+
+var errInvalidExportLength = errors.New("invalid keying material length")
+
+// ChannelBinding returns the handshake hash, h in the noise specs, which
+// uniquely identifies the handshake and can be used as a channel binding, as
+// specified in https://noiseprotocol.org/noise.html#channel-binding. Unlike
+// GetDigest, it returns an error if the handshake is not finished.
+func (hs *HandshakeState) ChannelBinding() ([]byte, error) {
+	if hs.hp == nil || hs.ss == nil || !hs.Finished() {
+		return nil, ErrHandshakeNotFinished
+	}
+	return append([]byte{}, hs.ss.GetHandshakeHash()...), nil
+}
+
+// ExportKeyingMaterial derives length bytes of keying material from the final
+// chaining key using the HKDF of the protocol's hash function, in which,
+//  - salt is the chaining key,
+//  - the input key material is a zero-length byte sequence,
+//  - info is "babble exporter" followed by the label, the context and the
+//    handshake hash, each prefixed with its 4-byte big-endian length.
+// Different labels and contexts give independent keys, which are also
+// independent from the transport cipher keys. Both parties get the same
+// keying material using the same label and context. The length must be
+// between 1 and 255 * HASHLEN, and it returns an error if the handshake is not
+// finished.
+func (hs *HandshakeState) ExportKeyingMaterial(label string,
+	context []byte, length int) ([]byte, error) {
+	if hs.hp == nil || hs.ss == nil || !hs.Finished() {
+		return nil, ErrHandshakeNotFinished
+	}
+	if length <= 0 || length > 255*hs.ss.hash.HashLen() {
+		return nil, errInvalidExportLength
+	}
+
+	info := []byte(exporterLabel)
+	info = appendWithLength(info, []byte(label))
+	info = appendWithLength(info, context)
+	info = appendWithLength(info, hs.ss.GetHandshakeHash())
+
+	h := hkdf.New(hs.ss.hash.New, ZEROLEN, hs.ss.chainingKey, info)
+	output := make([]byte, length)
+	if _, err := io.ReadFull(h, output); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// appendWithLength appends the data prefixed with its 4-byte big-endian length.
+func appendWithLength(b, data []byte) []byte {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	return append(append(b, size[:]...), data...)
+}
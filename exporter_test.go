@@ -0,0 +1,94 @@
+package babble
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelBinding(t *testing.T) {
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	// not available before the handshake is finished
+	_, err := alice.ChannelBinding()
+	require.Equal(t, ErrHandshakeNotFinished, err, "error not match")
+
+	runHandshake(t, alice, bob)
+
+	aliceBinding, err := alice.ChannelBinding()
+	require.NoError(t, err, "failed to get channel binding")
+	bobBinding, err := bob.ChannelBinding()
+	require.NoError(t, err, "failed to get channel binding")
+	require.Equal(t, aliceBinding, bobBinding, "channel binding not match")
+	require.Equal(t, alice.GetDigest(), aliceBinding, "must be h")
+
+	// the returned binding is a copy
+	aliceBinding[0] ^= 1
+	require.NotEqual(t, alice.GetDigest(), aliceBinding, "must be a copy")
+
+	// not available after reset
+	alice.Reset()
+	_, err = alice.ChannelBinding()
+	require.Equal(t, ErrHandshakeNotFinished, err, "error not match")
+}
+
+func TestExportKeyingMaterial(t *testing.T) {
+	name := "Noise_NN_25519_ChaChaPoly_SHA256"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	_, err := alice.ExportKeyingMaterial("label", nil, 32)
+	require.Equal(t, ErrHandshakeNotFinished, err, "error not match")
+
+	runHandshake(t, alice, bob)
+
+	testParams := []struct {
+		name    string
+		label   string
+		context []byte
+		length  int
+		err     error
+	}{
+		{"zero length", "label", nil, 0, errInvalidExportLength},
+		{"too long", "label", nil, 255*32 + 1, errInvalidExportLength},
+		{"max length", "label", nil, 255 * 32, nil},
+		{"no context", "label", nil, 32, nil},
+		{"with context", "label", []byte("context"), 64, nil},
+		{"empty label", "", []byte("context"), 16, nil},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			aliceKey, err := alice.ExportKeyingMaterial(
+				tt.label, tt.context, tt.length)
+			require.Equal(t, tt.err, err, "error not match")
+			bobKey, _ := bob.ExportKeyingMaterial(
+				tt.label, tt.context, tt.length)
+			require.Equal(t, aliceKey, bobKey, "keys not match")
+			if tt.err == nil {
+				require.Len(t, aliceKey, tt.length, "length not match")
+			}
+		})
+	}
+
+	// different labels or contexts give different keys
+	key1, _ := alice.ExportKeyingMaterial("label", []byte("context"), 32)
+	key2, _ := alice.ExportKeyingMaterial("label2", []byte("context"), 32)
+	key3, _ := alice.ExportKeyingMaterial("label", []byte("context2"), 32)
+	key4, _ := alice.ExportKeyingMaterial("labelc", []byte("ontext"), 32)
+	require.NotEqual(t, key1, key2, "labels should give different keys")
+	require.NotEqual(t, key1, key3, "contexts should give different keys")
+	require.NotEqual(t, key1, key4, "label and context must be separated")
+
+	// a shorter output is a prefix of the longer one
+	short, _ := alice.ExportKeyingMaterial("label", []byte("context"), 16)
+	require.Equal(t, key1[:16], short, "must be a prefix")
+
+	// the exported keys are independent from the transport keys
+	require.NotEqual(t, alice.SendCipherState.key[:], key1,
+		"must not be the transport key")
+	require.NotEqual(t, alice.RecvCipherState.key[:], key1,
+		"must not be the transport key")
+}
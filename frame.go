@@ -0,0 +1,44 @@
+package babble
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// frameHeaderSize is the size of the 2-byte big-endian length prefixed to each
+// message, as specified in the section 13 of the noise specs.
+const frameHeaderSize = 2
+
+// WriteFrame writes the message to w, prefixed with its 2-byte big-endian
+// length. It's used by Handshake, and can be used to send the transport
+// messages in the same format.
+func WriteFrame(w io.Writer, msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return errMessageOverflow
+	}
+
+	frame := make([]byte, frameHeaderSize+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[frameHeaderSize:], msg)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads a message written by WriteFrame. io.ErrUnexpectedEOF is
+// returned if r is closed in the middle of the message.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,39 @@
+package babble
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+	for _, msg := range [][]byte{{}, []byte("yellow submarine")} {
+		err := WriteFrame(buf, msg)
+		require.NoError(t, err, "failed to write frame")
+	}
+	require.Equal(t, append([]byte{0, 0, 0, 16}, "yellow submarine"...),
+		buf.Bytes(), "frames not match")
+
+	msg, err := ReadFrame(buf)
+	require.NoError(t, err, "failed to read frame")
+	require.Empty(t, msg, "msg should be empty")
+	msg, err = ReadFrame(buf)
+	require.NoError(t, err, "failed to read frame")
+	require.Equal(t, []byte("yellow submarine"), msg, "msg not match")
+
+	// nothing left to read
+	_, err = ReadFrame(buf)
+	require.Equal(t, io.EOF, err, "expected EOF")
+
+	// a truncated frame
+	_, err = ReadFrame(bytes.NewReader([]byte{0, 16, 1}))
+	require.Equal(t, io.ErrUnexpectedEOF, err, "expected unexpected EOF")
+
+	// a message too large
+	err = WriteFrame(buf, make([]byte, maxMessageSize+1))
+	require.Equal(t, errMessageOverflow, err, "expected overflow")
+	require.Zero(t, buf.Len(), "nothing should be written")
+}
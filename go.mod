@@ -1,6 +1,6 @@
 module github.com/crypto-y/babble
 
-go 1.13
+go 1.24
 
 require (
 	github.com/btcsuite/btcd v0.20.1-beta
@@ -10,3 +10,10 @@ require (
 	gitlab.com/yawning/x448.git v0.0.0-20190810030840-dcc677c7bddf
 	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
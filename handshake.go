@@ -0,0 +1,155 @@
+package babble
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// PayloadProvider supplies the payloads of the handshake messages written by
+// the local party, and receives the payloads of the ones read. The index is
+// the position of the message in the handshake pattern, starting from 0, so
+// it's the same for both parties.
+type PayloadProvider interface {
+	// WritePayload returns the payload of the message to be written, which
+	// may be nil.
+	WritePayload(index int) ([]byte, error)
+
+	// ReadPayload is called with the decrypted payload of the message read.
+	// Returning an error aborts the handshake.
+	ReadPayload(index int, payload []byte) error
+}
+
+// PayloadFuncs implements PayloadProvider using functions, either of which can
+// be nil, in which case empty payloads are written, or the payloads read are
+// ignored.
+type PayloadFuncs struct {
+	Write func(index int) ([]byte, error)
+	Read  func(index int, payload []byte) error
+}
+
+// WritePayload calls the Write function if set.
+func (p PayloadFuncs) WritePayload(index int) ([]byte, error) {
+	if p.Write == nil {
+		return nil, nil
+	}
+	return p.Write(index)
+}
+
+// ReadPayload calls the Read function if set.
+func (p PayloadFuncs) ReadPayload(index int, payload []byte) error {
+	if p.Read == nil {
+		return nil
+	}
+	return p.Read(index, payload)
+}
+
+// Result holds the outcome of a finished handshake, which are the cipher
+// states created by Split and the details of the handshake.
+type Result struct {
+	sessionInfo
+
+	// SendCipherState is used for encrypting the transport messages.
+	SendCipherState *CipherState
+
+	// RecvCipherState is used for decrypting the transport messages.
+	RecvCipherState *CipherState
+}
+
+// deadlineSetter is implemented by the connections supporting deadlines, such
+// as net.Conn.
+type deadlineSetter interface {
+	SetDeadline(t time.Time) error
+}
+
+// Handshake runs the handshake over rw, writing or reading each message by the
+// direction of the message patterns, until the handshake is finished. Each
+// message is prefixed with its size as a 2-byte big-endian integer, as
+// specified in the noise specs. The payloads are supplied and collected by
+// payloads, which can be nil to send empty payloads.
+//
+// The context is checked before each message. If rw supports deadlines, e.g.,
+// a net.Conn, a pending read or write is also interrupted once the context is
+// done, by setting a deadline in the past, after which rw should be closed.
+// Otherwise, a blocking read or write cannot be interrupted. When the context
+// stops the handshake, its error is returned.
+func Handshake(ctx context.Context, rw io.ReadWriter, hs *HandshakeState,
+	payloads PayloadProvider) (result *Result, err error) {
+	if payloads == nil {
+		payloads = PayloadFuncs{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if d, ok := rw.(deadlineSetter); ok && ctx.Done() != nil {
+		stop := interruptOnDone(ctx, d)
+		defer func() {
+			if ctxErr := stop(); ctxErr != nil {
+				result, err = nil, ctxErr
+			}
+		}()
+	}
+
+	for !hs.Finished() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		index := hs.patternIndex
+		if hs.ShouldWrite() {
+			payload, err := payloads.WritePayload(index)
+			if err != nil {
+				return nil, err
+			}
+			msg, err := hs.WriteMessage(payload)
+			if err != nil {
+				return nil, err
+			}
+			if err := WriteFrame(rw, msg); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		msg, err := ReadFrame(rw)
+		if err != nil {
+			return nil, err
+		}
+		payload, err := hs.ReadMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		if err := payloads.ReadPayload(index, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Result{
+		sessionInfo:     newSessionInfo(hs),
+		SendCipherState: hs.SendCipherState,
+		RecvCipherState: hs.RecvCipherState,
+	}, nil
+}
+
+// interruptOnDone sets a deadline in the past on d once the context is done,
+// which unblocks the pending read or write. The returned function stops the
+// watching, and returns the error of the context if d was interrupted.
+func interruptOnDone(ctx context.Context, d deadlineSetter) func() error {
+	done := make(chan struct{})
+	interrupted := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = d.SetDeadline(time.Unix(1, 0))
+			interrupted <- ctx.Err()
+		case <-done:
+			interrupted <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		return <-interrupted
+	}
+}
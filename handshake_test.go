@@ -0,0 +1,217 @@
+package babble
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPayloads writes the payloads of its name, and records the payloads
+// read.
+type recordingPayloads struct {
+	name string
+	read map[int][]byte
+}
+
+func (p *recordingPayloads) WritePayload(index int) ([]byte, error) {
+	return []byte(fmt.Sprintf("%s-%d", p.name, index)), nil
+}
+
+func (p *recordingPayloads) ReadPayload(index int, payload []byte) error {
+	p.read[index] = payload
+	return nil
+}
+
+// runDriver runs the handshake of both parties over a pipe, and returns the
+// results and errors of alice and bob.
+func runDriver(ctx context.Context, alice, bob *HandshakeState,
+	alicePayloads, bobPayloads PayloadProvider) (*Result, *Result, error,
+	error) {
+	aliceConn, bobConn := net.Pipe()
+	defer aliceConn.Close()
+	defer bobConn.Close()
+
+	type outcome struct {
+		result *Result
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := Handshake(ctx, bobConn, bob, bobPayloads)
+		// unblock alice if bob fails.
+		if err != nil {
+			bobConn.Close()
+		}
+		done <- outcome{result, err}
+	}()
+
+	aliceResult, err := Handshake(ctx, aliceConn, alice, alicePayloads)
+	if err != nil {
+		aliceConn.Close()
+	}
+	bobOutcome := <-done
+	return aliceResult, bobOutcome.result, err, bobOutcome.err
+}
+
+func TestHandshake(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	alicePayloads := &recordingPayloads{name: "alice", read: map[int][]byte{}}
+	bobPayloads := &recordingPayloads{name: "bob", read: map[int][]byte{}}
+	aliceResult, bobResult, aliceErr, bobErr := runDriver(
+		context.Background(), alice, bob, alicePayloads, bobPayloads)
+	require.NoError(aliceErr, "alice's handshake failed")
+	require.NoError(bobErr, "bob's handshake failed")
+
+	// the payloads are exchanged by the message indexes.
+	require.Equal(map[int][]byte{
+		1: []byte("bob-1"),
+	}, alicePayloads.read, "alice's payloads not match")
+	require.Equal(map[int][]byte{
+		0: []byte("alice-0"),
+		2: []byte("alice-2"),
+	}, bobPayloads.read, "bob's payloads not match")
+
+	// the results hold the cipher states of the finished handshake.
+	require.True(aliceResult.Initiator(), "alice is the initiator")
+	require.False(bobResult.Initiator(), "bob is the responder")
+	require.Equal(aliceResult.HandshakeHash(), bobResult.HandshakeHash(),
+		"handshake hash not match")
+	require.Equal(bob.localStatic.PubKey().Bytes(),
+		aliceResult.RemoteStatic().Bytes(), "remote static not match")
+	require.Same(alice.SendCipherState, aliceResult.SendCipherState)
+
+	ciphertext, err := aliceResult.SendCipherState.EncryptWithAd(nil,
+		[]byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	plaintext, err := bobResult.RecvCipherState.DecryptWithAd(nil, ciphertext)
+	require.NoError(err, "failed to decrypt")
+	require.Equal([]byte("yy"), plaintext, "plaintext not match")
+}
+
+func TestHandshakeOneWay(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_N_25519_ChaChaPoly_BLAKE2s"
+	bob, _ := NewProtocol(name, "", false)
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            name,
+		Initiator:       true,
+		RemoteStaticPub: bob.localStatic.PubKey().Bytes(),
+	})
+	require.NoError(err, "failed to create alice")
+
+	// a single message is written to a plain io.ReadWriter.
+	var buf bytes.Buffer
+	result, err := Handshake(context.Background(), &buf, alice, nil)
+	require.NoError(err, "failed to write")
+	require.Nil(result.RecvCipherState, "no receiving cipher state")
+
+	readIndex := -1
+	result, err = Handshake(context.Background(), &buf, bob, PayloadFuncs{
+		Read: func(index int, payload []byte) error {
+			readIndex = index
+			require.Empty(payload, "payload not match")
+			return nil
+		},
+	})
+	require.NoError(err, "failed to read")
+	require.Zero(readIndex, "index not match")
+	require.Nil(result.SendCipherState, "no sending cipher state")
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	name := "Noise_NN_25519_ChaChaPoly_BLAKE2s"
+	newStates := func() (*HandshakeState, *HandshakeState) {
+		alice, _ := NewProtocol(name, "", true)
+		bob, _ := NewProtocol(name, "", false)
+		return alice, bob
+	}
+
+	// an error from the payloads aborts the handshake.
+	errPayload := errors.New("payload rejected")
+	alice, bob := newStates()
+	_, _, _, err := runDriver(context.Background(), alice, bob, nil,
+		PayloadFuncs{Read: func(int, []byte) error { return errPayload }})
+	require.Equal(t, errPayload, err, "error not match")
+	require.False(t, bob.Finished(), "bob should not finish")
+
+	alice, bob = newStates()
+	_, _, err, _ = runDriver(context.Background(), alice, bob,
+		PayloadFuncs{Write: func(int) ([]byte, error) {
+			return nil, errPayload
+		}}, nil)
+	require.Equal(t, errPayload, err, "error not match")
+
+	// a payload too large cannot be written.
+	alice, bob = newStates()
+	_, _, err, _ = runDriver(context.Background(), alice, bob,
+		PayloadFuncs{Write: func(int) ([]byte, error) {
+			return make([]byte, maxMessageSize), nil
+		}}, nil)
+	require.Equal(t, errMessageOverflow, err, "error not match")
+
+	// a truncated message is reported.
+	_, bob = newStates()
+	_, err = Handshake(context.Background(),
+		&readWriter{Reader: bytes.NewReader([]byte{0, 10, 1})}, bob, nil)
+	require.Equal(t, io.ErrUnexpectedEOF, err, "error not match")
+}
+
+func TestHandshakeContext(t *testing.T) {
+	name := "Noise_NN_25519_ChaChaPoly_BLAKE2s"
+
+	// a canceled context stops the handshake before any message.
+	alice, _ := NewProtocol(name, "", true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	_, err := Handshake(ctx, &buf, alice, nil)
+	require.Equal(t, context.Canceled, err, "error not match")
+	require.Zero(t, buf.Len(), "nothing should be written")
+
+	// a pending read is interrupted once the deadline is exceeded, as the
+	// responder never replies.
+	alice, _ = NewProtocol(name, "", true)
+	aliceConn, bobConn := net.Pipe()
+	defer aliceConn.Close()
+	defer bobConn.Close()
+	go func() {
+		_, _ = ReadFrame(bobConn)
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(),
+		50*time.Millisecond)
+	defer cancel()
+	_, err = Handshake(ctx, aliceConn, alice, nil)
+	require.Equal(t, context.DeadlineExceeded, err, "error not match")
+
+	// a pending write is interrupted once the context is canceled.
+	alice, _ = NewProtocol(name, "", true)
+	aliceConn, bobConn = net.Pipe()
+	defer aliceConn.Close()
+	defer bobConn.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = Handshake(ctx, aliceConn, alice, nil)
+	require.Equal(t, context.Canceled, err, "error not match")
+}
+
+// readWriter reads from the reader and discards the writes.
+type readWriter struct {
+	io.Reader
+}
+
+func (readWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/crypto-y/babble/dh"
+	"github.com/crypto-y/babble/kem"
 	"github.com/crypto-y/babble/pattern"
 )
 
@@ -16,11 +17,14 @@ import (
 const maxMessageSize = 65535
 
 var (
+	errFallbackCurveMismatch   = errors.New("fallback must use the same curve")
+	errMissingHybridCurve      = errors.New("missing hybrid dh curve")
 	errInvalidPayload          = errors.New("invalid payload size")
 	errInvalidPskSize          = errors.New("invalid psk size")
 	errMessageOverflow         = errors.New("message size exceeds 65535-bytes")
 	errMissingHandshakePattern = errors.New("missing handshake pattern")
 	errMissingSymmetricState   = errors.New("missing symmetric state")
+	errNotFallbackPattern      = errors.New("pattern has no fallback modifier")
 	errPatternIndexOverflow    = errors.New("pattern index overflow")
 	errProtocolNameInvalid     = errors.New("protocol name is too long")
 	errPskIndexOverflow        = errors.New("psk index overflow")
@@ -49,6 +53,20 @@ type HandshakeState struct {
 	// The remote party's ephemeral public key, re in the noise specs.
 	remoteEphemeralPub dh.PublicKey
 
+	// The local hybrid ephemeral key pair, e1 in the hfs extension specs.
+	localHybridEphemeral dh.PrivateKey
+
+	// The remote party's hybrid ephemeral public key, re1 in the hfs extension
+	// specs.
+	remoteHybridEphemeralPub dh.PublicKey
+
+	// The KEM keys used by the PQNoise patterns, in which the "e" and "s"
+	// tokens carry KEM public keys.
+	localStaticKem        kem.PrivateKey
+	localEphemeralKem     kem.PrivateKey
+	remoteStaticKemPub    kem.PublicKey
+	remoteEphemeralKemPub kem.PublicKey
+
 	// A boolean indicating the initiator or responder role.
 	initiator bool
 
@@ -70,6 +88,29 @@ type HandshakeState struct {
 	pskIndex int
 
 	prologue []byte
+
+	// protocolName is the full protocol name, which is kept so the handshake
+	// state can be marshaled and restored.
+	protocolName []byte
+
+	// verifyPeerStatic is the callback used to authenticate the remote static
+	// key, see ProtocolConfig.VerifyPeerStatic.
+	verifyPeerStatic func(pub dh.PublicKey, payload []byte) error
+
+	// requireVerifyPeerStatic is set when the handshake state is restored from
+	// a state using the verifyPeerStatic, so ReadMessage fails until the
+	// callback is set again.
+	requireVerifyPeerStatic bool
+
+	// minPayloadSecurity is the minimum destination property of the non-empty
+	// payloads, see ProtocolConfig.MinPayloadSecurity.
+	minPayloadSecurity int
+
+	// session and datagramSession hold the transport session created from
+	// the finished handshake, at most one of them is set, so the cipher
+	// states are never used by two sessions.
+	session         *Session
+	datagramSession *DatagramSession
 }
 
 // Finished returns a bool to indicate whether the handshake is done. The
@@ -79,6 +120,93 @@ func (hs *HandshakeState) Finished() bool {
 	return hs.patternIndex == len(hs.hp.MessagePattern)
 }
 
+// SetVerifyPeerStatic sets the callback used to authenticate the remote static
+// key, see ProtocolConfig.VerifyPeerStatic. As the callback cannot be
+// marshaled, it must be set again after restoring a handshake state which used
+// one, otherwise ReadMessage returns ErrMissingVerifyPeerStatic. Like the
+// config, ErrKemMismatch is returned for the KEM patterns.
+func (hs *HandshakeState) SetVerifyPeerStatic(
+	f func(pub dh.PublicKey, payload []byte) error) error {
+	if f != nil && hs.kemMode() {
+		return ErrKemMismatch
+	}
+	hs.verifyPeerStatic = f
+	return nil
+}
+
+// verifyPeerStaticPayload calls the verifyPeerStatic with the payload if the
+// message carries the remote static key.
+func (hs *HandshakeState) verifyPeerStaticPayload(
+	line []pattern.Token, payload []byte) error {
+	if hs.verifyPeerStatic == nil {
+		return nil
+	}
+
+	for _, token := range line[1:] {
+		if token != pattern.TokenS {
+			continue
+		}
+		if payload == nil {
+			payload = []byte{}
+		}
+		return hs.verifyPeerStatic(hs.remoteStaticPub, payload)
+	}
+	return nil
+}
+
+// ShouldWrite returns true if the next handshake message is to be written by
+// the local party, false if it's to be read, or the handshake is finished.
+func (hs *HandshakeState) ShouldWrite() bool {
+	if hs.Finished() {
+		return false
+	}
+	return hs.mustWrite(hs.hp.MessagePattern[hs.patternIndex][0])
+}
+
+// checkPayloadSecurity returns ErrInsecurePayload if the payload is non-empty
+// and the next message has a destination property lower than the minimum.
+func (hs *HandshakeState) checkPayloadSecurity(payload []byte) error {
+	if len(payload) == 0 || hs.minPayloadSecurity == 0 {
+		return nil
+	}
+
+	security, err := hs.PayloadSecurity()
+	if err != nil {
+		return err
+	}
+	if security.Destination < hs.minPayloadSecurity {
+		return ErrInsecurePayload
+	}
+	return nil
+}
+
+// SecurityAnalysis returns the security properties of the handshake pattern in
+// use, as computed by pattern.Analyze.
+func (hs *HandshakeState) SecurityAnalysis() (*pattern.Analysis, error) {
+	return pattern.Analyze(hs.hp)
+}
+
+// PayloadSecurity returns the security properties of the payload of the next
+// handshake message, which is either written or read. Once the handshake is
+// finished, it returns the properties of the transport messages sent by the
+// local party, or the ones received by the responder of a one-way pattern.
+func (hs *HandshakeState) PayloadSecurity() (pattern.PayloadSecurity, error) {
+	analysis, err := hs.SecurityAnalysis()
+	if err != nil {
+		return pattern.PayloadSecurity{}, err
+	}
+	if !hs.Finished() {
+		return analysis.Messages[hs.patternIndex], nil
+	}
+
+	for _, security := range analysis.Transport {
+		if hs.mustWrite(security.Sender) {
+			return security, nil
+		}
+	}
+	return analysis.Transport[0], nil
+}
+
 // GetChainingKey returns the chaining key in use.
 func (hs *HandshakeState) GetChainingKey() []byte {
 	return hs.ss.chainingKey[:]
@@ -131,12 +259,15 @@ func (hs *HandshakeState) GetInfo() ([]byte, error) {
 	}
 
 	type keyPair struct {
-		LocalStaticPriv    string `json:"local_static_priv"`
-		LocalStaticPub     string `json:"local_static_pub"`
-		LocalEphemeralPriv string `json:"local_ephemeral_priv"`
-		LocalEphemeralPub  string `json:"local_ephemeral_pub"`
-		RemoteEphemeralPub string `json:"remote_ephemeral_pub"`
-		RemoteStaticPub    string `json:"remote_static_pub"`
+		LocalStaticPriv          string `json:"local_static_priv"`
+		LocalStaticPub           string `json:"local_static_pub"`
+		LocalEphemeralPriv       string `json:"local_ephemeral_priv"`
+		LocalEphemeralPub        string `json:"local_ephemeral_pub"`
+		LocalHybridEphemeralPriv string `json:"local_hybrid_ephemeral_priv"`
+		LocalHybridEphemeralPub  string `json:"local_hybrid_ephemeral_pub"`
+		RemoteEphemeralPub       string `json:"remote_ephemeral_pub"`
+		RemoteHybridEphemeralPub string `json:"remote_hybrid_ephemeral_pub"`
+		RemoteStaticPub          string `json:"remote_static_pub"`
 	}
 
 	type cipher struct {
@@ -171,9 +302,9 @@ func (hs *HandshakeState) GetInfo() ([]byte, error) {
 	}
 
 	rk := rekey{}
-	if hs.ss.cs.RekeyManger != nil {
-		rk.Interval = hs.ss.cs.RekeyManger.Interval()
-		rk.ResetNonce = hs.ss.cs.RekeyManger.ResetNonce()
+	if hs.ss.rekeyer != nil {
+		rk.Interval = hs.ss.rekeyer.Interval()
+		rk.ResetNonce = hs.ss.rekeyer.ResetNonce()
 	}
 
 	// extract local/remote key pair info
@@ -201,6 +332,16 @@ func (hs *HandshakeState) GetInfo() ([]byte, error) {
 	if hs.remoteEphemeralPub != nil {
 		kp.RemoteEphemeralPub = fmt.Sprintf("%x", hs.remoteEphemeralPub.Bytes())
 	}
+	if hs.localHybridEphemeral != nil {
+		kp.LocalHybridEphemeralPriv = fmt.Sprintf("%x",
+			hs.localHybridEphemeral.Bytes())
+		kp.LocalHybridEphemeralPub = fmt.Sprintf("%x",
+			hs.localHybridEphemeral.PubKey().Bytes())
+	}
+	if hs.remoteHybridEphemeralPub != nil {
+		kp.RemoteHybridEphemeralPub = fmt.Sprintf("%x",
+			hs.remoteHybridEphemeralPub.Bytes())
+	}
 
 	// extract ciphers
 	sc := cipher{}
@@ -270,11 +411,18 @@ func jsonMarshal(t interface{}) ([]byte, error) {
 //    remoteEphemeralPub) are typically left empty, since they are created and
 //    exchanged during the handshake; but there are exceptions when using
 //    compound protocols.
+//  - a hybrid ephemeral key pair (localHybridEphemeral) and public key
+//    (remoteHybridEphemeralPub), which are only used by the hfs modifier.
+//  - a set of KEM key pairs (localStaticKem, localEphemeralKem) and public
+//    keys (remoteStaticKemPub, remoteEphemeralKemPub), which are only used by
+//    the PQNoise patterns.
 func (hs *HandshakeState) initialize(
 	protocolName, prologue []byte, initiator bool,
 	hp *pattern.HandshakePattern,
 	s, e dh.PrivateKey,
-	rs, re dh.PublicKey) error {
+	rs, re dh.PublicKey,
+	e1 dh.PrivateKey, re1 dh.PublicKey,
+	ks, ke kem.PrivateKey, krs, kre kem.PublicKey) error {
 	// Calls InitializeSymmetric(protocolName).
 	hs.ss.InitializeSymmetric(protocolName)
 
@@ -286,8 +434,12 @@ func (hs *HandshakeState) initialize(
 	hs.initiator = initiator
 	hs.localStatic, hs.localEphemeral = s, e
 	hs.remoteStaticPub, hs.remoteEphemeralPub = rs, re
+	hs.localHybridEphemeral, hs.remoteHybridEphemeralPub = e1, re1
+	hs.localStaticKem, hs.localEphemeralKem = ks, ke
+	hs.remoteStaticKemPub, hs.remoteEphemeralKemPub = krs, kre
 	hs.hp = hp
 	hs.prologue = prologue
+	hs.protocolName = protocolName
 
 	if err := hs.processPreMessage(); err != nil {
 		return err
@@ -302,6 +454,9 @@ func (hs *HandshakeState) ReadMessage(message []byte) ([]byte, error) {
 	if len(message) > maxMessageSize {
 		return nil, errMessageOverflow
 	}
+	if hs.requireVerifyPeerStatic && hs.verifyPeerStatic == nil {
+		return nil, ErrMissingVerifyPeerStatic
+	}
 	// find the right pattern line
 	//
 	// first, check the patternIndex is right
@@ -338,6 +493,11 @@ func (hs *HandshakeState) ReadMessage(message []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	// authenticate the remote static key again with the payload.
+	if err := hs.verifyPeerStaticPayload(line, plaintext); err != nil {
+		return nil, err
+	}
+
 	// when finished, increment the pattern index for next round
 	if err := hs.incrementPatternIndexAndSplit(); err != nil {
 		return nil, err
@@ -375,6 +535,12 @@ func (hs *HandshakeState) WriteMessage(payload []byte) ([]byte, error) {
 		return nil, errInvalidDirection("WriteMessage: ", hs.initiator, line[0])
 	}
 
+	// the payload is checked before any token is processed, so the handshake
+	// state is unchanged if it's refused.
+	if err := hs.checkPayloadSecurity(payload); err != nil {
+		return nil, err
+	}
+
 	var err error
 	var buffer []byte
 	for _, token := range line[1:] {
@@ -398,6 +564,92 @@ func (hs *HandshakeState) WriteMessage(payload []byte) ([]byte, error) {
 	return buffer, nil
 }
 
+// Fallback re-initializes the handshake state using a fallback protocol, which
+// is used by the Noise Pipes when a zero-RTT handshake fails. For instance,
+// when the responder fails to decrypt the first IK message from the initiator,
+// both parties can switch to XXfallback by calling Fallback with the protocol
+// name Noise_XXfallback_25519_ChaChaPoly_BLAKE2s.
+//
+// The initiator's first message in the previous handshake becomes the
+// pre-message of the fallback pattern, thus,
+//  - the initiator keeps its local ephemeral key, which was sent in its first
+//    message.
+//  - the responder keeps the remote ephemeral key received from the failed
+//    message.
+// The local static key is kept, while the remote keys not used in the new
+// pre-message are discarded, so they can be received again. The prologue,
+// psks and rekeyer are reused. Both parties keep their initiator/responder
+// roles. The protocol name must use the same curve as the previous one, and
+// the same hybrid curve if the hfs modifier is used.
+func (hs *HandshakeState) Fallback(name string) error {
+	hsc, err := parseProtocolName(name)
+	if err != nil {
+		return err
+	}
+
+	if hsc.pattern.Modifier == nil || !hsc.pattern.Modifier.Fallback {
+		return errNotFallbackPattern
+	}
+
+	// create a new symmetric state while keeping the old rekeyer.
+	cs := newCipherState(hsc.cipher, nil)
+	ss := newSymmetricState(cs, hsc.hash, hsc.curve)
+	ss.hybrid = hsc.hybrid
+	ss.kem = hsc.kem
+	ss.rekeyer = hs.ss.rekeyer
+
+	// the keys must be loadable by the new curve.
+	if ss.keyExchangeName() != hs.ss.keyExchangeName() {
+		return errFallbackCurveMismatch
+	}
+
+	// keep only the remote keys needed by the pre-message.
+	var rs, re, re1 dh.PublicKey
+	var krs, kre kem.PublicKey
+	for _, line := range hsc.pattern.PreMessagePattern {
+		if hs.mustWrite(line[0]) {
+			continue
+		}
+		for _, token := range line[1:] {
+			switch token {
+			case pattern.TokenE:
+				re = hs.remoteEphemeralPub
+				kre = hs.remoteEphemeralKemPub
+			case pattern.TokenE1:
+				re1 = hs.remoteHybridEphemeralPub
+			case pattern.TokenS:
+				rs = hs.remoteStaticPub
+				krs = hs.remoteStaticKemPub
+			}
+		}
+	}
+
+	// drop the psks if the fallback pattern doesn't need them.
+	var psks [][]byte
+	if hsc.pattern.Modifier.PskMode() {
+		for i := range hs.psks {
+			psks = append(psks, hs.psks[i][:])
+		}
+	}
+
+	newHs, err := newHandshakeState(
+		[]byte(name), hs.prologue, psks, hs.initiator, ss, hsc.pattern,
+		hs.localStatic, hs.localEphemeral, rs, re,
+		hs.localHybridEphemeral, re1,
+		hs.localStaticKem, hs.localEphemeralKem, krs, kre, hs.autoPadding)
+	if err != nil {
+		return err
+	}
+
+	// clean the old states before taking the new one.
+	hs.ss.Destroy()
+	newHs.verifyPeerStatic = hs.verifyPeerStatic
+	newHs.requireVerifyPeerStatic = hs.requireVerifyPeerStatic
+	newHs.minPayloadSecurity = hs.minPayloadSecurity
+	*hs = *newHs
+	return nil
+}
+
 // Reset sets the handshake to initial state.
 func (hs *HandshakeState) Reset() {
 	hs.patternIndex = 0
@@ -405,6 +657,9 @@ func (hs *HandshakeState) Reset() {
 	// TODO: maybe leave them alone if were passed from config?
 	hs.localStatic, hs.localEphemeral = nil, nil
 	hs.remoteStaticPub, hs.remoteEphemeralPub = nil, nil
+	hs.localHybridEphemeral, hs.remoteHybridEphemeralPub = nil, nil
+	hs.localStaticKem, hs.localEphemeralKem = nil, nil
+	hs.remoteStaticKemPub, hs.remoteEphemeralKemPub = nil, nil
 
 	if hs.ss != nil {
 		hs.ss.Reset()
@@ -422,6 +677,44 @@ func (hs *HandshakeState) Reset() {
 	}
 }
 
+// Destroy wipes the secrets held by the handshake state, which include the
+// local private keys, the psks, the chaining key and the cipher keys of both
+// the symmetric state and the cipher states created by Split. As the cipher
+// states are shared with the Session, it must only be called once the session
+// is no longer used. The KEM private keys cannot be wiped, and are dropped
+// instead. The handshake state must not be used afterwards.
+func (hs *HandshakeState) Destroy() {
+	for _, k := range []dh.PrivateKey{
+		hs.localStatic, hs.localEphemeral, hs.localHybridEphemeral,
+	} {
+		if k != nil {
+			k.Destroy()
+		}
+	}
+	hs.localStatic, hs.localEphemeral, hs.localHybridEphemeral = nil, nil, nil
+	hs.localStaticKem, hs.localEphemeralKem = nil, nil
+
+	for i := range hs.psks {
+		wipe(hs.psks[i][:])
+	}
+	hs.psks = nil
+
+	if hs.ss != nil {
+		hs.ss.Destroy()
+		hs.ss = nil
+	}
+
+	if hs.SendCipherState != nil {
+		hs.SendCipherState.Destroy()
+		hs.SendCipherState = nil
+	}
+
+	if hs.RecvCipherState != nil {
+		hs.RecvCipherState.Destroy()
+		hs.RecvCipherState = nil
+	}
+}
+
 func errInvalidDHToken(t pattern.Token) error {
 	return fmt.Errorf("invalid token during DHKE: %s", t)
 }
@@ -450,6 +743,9 @@ func errMissingKey(s string) error {
 // handleMissingKeyE will create the missing ephemeral key if the autoPadding
 // flag is turned on.
 func (hs *HandshakeState) handleMissingKeyE() error {
+	if hs.kemMode() {
+		return hs.handleMissingKemKeyE()
+	}
 	if hs.autoPadding {
 		// the only error comes from the underlying rand.Read.
 		key, err := hs.ss.curve.GenerateKeyPair(nil)
@@ -463,9 +759,36 @@ func (hs *HandshakeState) handleMissingKeyE() error {
 	return nil
 }
 
+// handleMissingKeyE1 will create the missing hybrid ephemeral key if the
+// autoPadding flag is turned on.
+func (hs *HandshakeState) handleMissingKeyE1() error {
+	if hs.autoPadding {
+		key, err := hs.generateKeyE1()
+		if err != nil {
+			return err
+		}
+		hs.localHybridEphemeral = key
+	} else {
+		return errMissingKey("local hybrid ephemeral key")
+	}
+	return nil
+}
+
+// generateKeyE1 creates a new key pair using the hybrid curve.
+func (hs *HandshakeState) generateKeyE1() (dh.PrivateKey, error) {
+	if hs.ss.hybrid == nil {
+		return nil, errMissingHybridCurve
+	}
+	// the only error comes from the underlying rand.Read.
+	return hs.ss.hybrid.GenerateKeyPair(nil)
+}
+
 // handleMissingKeyS will create the missing static key if the autoPadding flag
 // is turned on.
 func (hs *HandshakeState) handleMissingKeyS() error {
+	if hs.kemMode() {
+		return hs.handleMissingKemKeyS()
+	}
 	if hs.autoPadding {
 		key, err := hs.ss.curve.GenerateKeyPair(nil)
 		// the only error comes from the underlying rand.Read.
@@ -529,6 +852,8 @@ func newHandshakeState(protocolName, prologue []byte, psks [][]byte,
 	initiator bool,
 	ss *symmetricState, hp *pattern.HandshakePattern,
 	s, e dh.PrivateKey, rs, re dh.PublicKey,
+	e1 dh.PrivateKey, re1 dh.PublicKey,
+	ks, ke kem.PrivateKey, krs, kre kem.PublicKey,
 	autoPadding bool) (*HandshakeState, error) {
 	// Protocol name must be 255 bytes or less
 	if len(protocolName) > 255 {
@@ -549,7 +874,7 @@ func newHandshakeState(protocolName, prologue []byte, psks [][]byte,
 	// call built-in initialize
 	if err := hs.initialize(
 		protocolName, prologue, initiator,
-		hp, s, e, rs, re); err != nil {
+		hp, s, e, rs, re, e1, re1, ks, ke, krs, kre); err != nil {
 		return nil, err
 	}
 
@@ -602,6 +927,10 @@ func (hs *HandshakeState) processPreMessage() error {
 				if err := hs.processPreTokenS(direction); err != nil {
 					return err
 				}
+			case pattern.TokenE1:
+				if err := hs.processPreTokenE1(direction); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -610,6 +939,10 @@ func (hs *HandshakeState) processPreMessage() error {
 }
 
 func (hs *HandshakeState) processPreTokenE(d pattern.Token) error {
+	if hs.kemMode() {
+		return hs.processPreKemTokenE(d)
+	}
+
 	var keyBytes []byte
 	// find out whether a local or remote key to be used
 	if hs.mustWrite(d) {
@@ -636,7 +969,32 @@ func (hs *HandshakeState) processPreTokenE(d pattern.Token) error {
 	return nil
 }
 
+func (hs *HandshakeState) processPreTokenE1(d pattern.Token) error {
+	var keyBytes []byte
+	// find out whether a local or remote key to be used
+	if hs.mustWrite(d) {
+		if hs.localHybridEphemeral == nil {
+			if err := hs.handleMissingKeyE1(); err != nil {
+				return err
+			}
+		}
+		keyBytes = hs.localHybridEphemeral.PubKey().Bytes()
+	} else {
+		if hs.remoteHybridEphemeralPub == nil {
+			return errMissingKey("remote hybrid ephemeral key")
+		}
+		keyBytes = hs.remoteHybridEphemeralPub.Bytes()
+	}
+
+	hs.ss.MixHash(keyBytes)
+	return nil
+}
+
 func (hs *HandshakeState) processPreTokenS(d pattern.Token) error {
+	if hs.kemMode() {
+		return hs.processPreKemTokenS(d)
+	}
+
 	var keyBytes []byte
 	// find out whether a local or remote key to be used
 	if hs.mustWrite(d) {
@@ -671,6 +1029,16 @@ func (hs *HandshakeState) processReadToken(
 		if err != nil {
 			return nil, err
 		}
+	case pattern.TokenE1:
+		payload, err = hs.readTokenE1(payload)
+		if err != nil {
+			return nil, err
+		}
+	case pattern.TokenEkem, pattern.TokenSkem:
+		payload, err = hs.readTokenKem(token, payload)
+		if err != nil {
+			return nil, err
+		}
 	case pattern.TokenPsk:
 		if err := hs.processTokenPsk(); err != nil {
 			return nil, err
@@ -698,6 +1066,16 @@ func (hs *HandshakeState) processWriteToken(
 		if err != nil {
 			return nil, err
 		}
+	case pattern.TokenE1:
+		payload, err = hs.writeTokenE1(payload)
+		if err != nil {
+			return nil, err
+		}
+	case pattern.TokenEkem, pattern.TokenSkem:
+		payload, err = hs.writeTokenKem(token, payload)
+		if err != nil {
+			return nil, err
+		}
 	case pattern.TokenPsk:
 		if err := hs.processTokenPsk(); err != nil {
 			return nil, err
@@ -715,7 +1093,10 @@ func (hs *HandshakeState) processTokenPsk() error {
 	if len(hs.psks)-1 < hs.pskIndex {
 		return errPskIndexOverflow
 	}
+	// the psks are kept for Fallback and MarshalBinary, they are only wiped
+	// by Destroy.
 	token := hs.psks[hs.pskIndex]
+
 	// safe to ignore the error here
 	if err := hs.ss.MixKeyAndHash(token[:]); err != nil {
 		return err
@@ -736,7 +1117,7 @@ func (hs *HandshakeState) validateKeys() error {
 		for _, token := range line[1:] {
 			if token == pattern.TokenS && hs.mustWrite(line[0]) {
 				// s must NOT be empty for writing
-				if hs.localStatic == nil {
+				if hs.localStatic == nil && hs.localStaticKem == nil {
 					if err := hs.handleMissingKeyS(); err != nil {
 						return err
 					}
@@ -751,6 +1132,10 @@ func (hs *HandshakeState) validateKeys() error {
 // readTokenE sets re (which must be empty) to the next DHLEN bytes from the
 // payload. Calls MixHash(re.publicKey).
 func (hs *HandshakeState) readTokenE(payload []byte) ([]byte, error) {
+	if hs.kemMode() {
+		return hs.readKemTokenE(payload)
+	}
+
 	// check empty
 	if hs.remoteEphemeralPub != nil {
 		return nil, errKeyNotEmpty("remote ephemeral key")
@@ -783,6 +1168,10 @@ func (hs *HandshakeState) readTokenE(payload []byte) ([]byte, error) {
 // writeTokenE sets e (if empty) to GENERATE_KEYPAIR(). Appends
 // e.public_key to the buffer. Calls MixHash(e.public_key).
 func (hs *HandshakeState) writeTokenE(payload []byte) ([]byte, error) {
+	if hs.kemMode() {
+		return hs.writeKemTokenE(payload)
+	}
+
 	// generate key if empty
 	if hs.localEphemeral == nil {
 		key, err := hs.ss.curve.GenerateKeyPair(nil)
@@ -811,6 +1200,10 @@ func (hs *HandshakeState) writeTokenE(payload []byte) ([]byte, error) {
 // HasKey() == True, or to the next DHLEN bytes otherwise. Sets rs (if empty) to
 // DecryptAndHash(temp).
 func (hs *HandshakeState) readTokenS(payload []byte) ([]byte, error) {
+	if hs.kemMode() {
+		return hs.readKemTokenS(payload)
+	}
+
 	// The protocol specified a temp key with length DHLEN + 16 bytes, where the
 	// 16 is the AD size of the ciphers used. To generalize the usage, we use
 	// adlen defined by each cipher so that it's not limited to 16 bytes.
@@ -843,12 +1236,23 @@ func (hs *HandshakeState) readTokenS(payload []byte) ([]byte, error) {
 		hs.remoteStaticPub = pub
 	}
 
+	// authenticate the remote static key before processing further.
+	if hs.verifyPeerStatic != nil {
+		if err := hs.verifyPeerStatic(pub, nil); err != nil {
+			return nil, err
+		}
+	}
+
 	return payload[tempLen:], nil
 
 }
 
 // writeTokenS appends EncryptAndHash(s.public_key) to the buffer.
 func (hs *HandshakeState) writeTokenS(payload []byte) ([]byte, error) {
+	if hs.kemMode() {
+		return hs.writeKemTokenS(payload)
+	}
+
 	// local static must not be empty, it should be supplied via creation of
 	// the handshake state.
 	if hs.localStatic == nil {
@@ -863,6 +1267,69 @@ func (hs *HandshakeState) writeTokenS(payload []byte) ([]byte, error) {
 	return payload, nil
 }
 
+// readTokenE1 sets temp to the next DHLEN + ADLEN bytes of the payload if
+// HasKey() == True, or to the next DHLEN bytes otherwise, in which DHLEN is
+// defined by the hybrid curve. Sets re1 (which must be empty) to
+// DecryptAndHash(temp).
+func (hs *HandshakeState) readTokenE1(payload []byte) ([]byte, error) {
+	// check empty
+	if hs.remoteHybridEphemeralPub != nil {
+		return nil, errKeyNotEmpty("remote hybrid ephemeral key")
+	}
+	if hs.ss.hybrid == nil {
+		return nil, errMissingHybridCurve
+	}
+
+	dhlen := hs.ss.hybrid.Size()
+	tempLen := dhlen
+	if hs.ss.cs.hasKey() {
+		adlen := hs.ss.cs.cipher.Cipher().Overhead()
+		tempLen = dhlen + adlen
+	}
+
+	// check we have enough bytes to use
+	if len(payload) < tempLen {
+		return nil, errInvalidPayload
+	}
+
+	temp := make([]byte, tempLen)
+	copy(temp[:], payload[:tempLen])
+	data, err := hs.ss.DecryptAndHash(temp)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := hs.ss.hybrid.LoadPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	hs.remoteHybridEphemeralPub = pub
+
+	return payload[tempLen:], nil
+}
+
+// writeTokenE1 sets e1 (if empty) to GENERATE_KEYPAIR() using the hybrid
+// curve. Appends EncryptAndHash(e1.public_key) to the buffer.
+func (hs *HandshakeState) writeTokenE1(payload []byte) ([]byte, error) {
+	// generate key if empty
+	if hs.localHybridEphemeral == nil {
+		key, err := hs.generateKeyE1()
+		if err != nil {
+			return nil, err
+		}
+		hs.localHybridEphemeral = key
+	}
+
+	data, err := hs.ss.EncryptAndHash(
+		hs.localHybridEphemeral.PubKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	payload = append(payload, data...)
+
+	return payload, nil
+}
+
 // processTokenDH will do a DH exchange on the local and remote key pair.
 func (hs *HandshakeState) processTokenDH(token pattern.Token) error {
 	var local dh.PrivateKey
@@ -875,6 +1342,12 @@ func (hs *HandshakeState) processTokenDH(token pattern.Token) error {
 		local = hs.localEphemeral      // e
 		remote = hs.remoteEphemeralPub // re
 
+	case pattern.TokenEe1:
+		// if it's "ee1", the first is the local hybrid ephemeral key, the
+		// second is the remote hybrid ephemeral key.
+		local = hs.localHybridEphemeral      // e1
+		remote = hs.remoteHybridEphemeralPub // re1
+
 	case pattern.TokenSs:
 		// if it's "ss", the first key is the local static key, the second is
 		// the remote static key.
@@ -917,9 +1390,9 @@ func (hs *HandshakeState) processTokenDH(token pattern.Token) error {
 	if err != nil {
 		return err
 	}
-	if err := hs.ss.MixKey(digest); err != nil {
-		return err
-	}
 
-	return nil
+	// the DH output is wiped once mixed into the chaining key.
+	err = hs.ss.MixKey(digest)
+	wipe(digest)
+	return err
 }
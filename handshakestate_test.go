@@ -38,21 +38,21 @@ func TestInitializeHandshakeState(t *testing.T) {
 
 	// test long protocl name
 	hs, err := newHandshakeState(longProtocolName[:], prologue,
-		nil, true, nil, nil, nil, nil, nil, nil, false)
+		nil, true, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.Equal(t, errProtocolNameInvalid, err,
 		"wrong protocol name error should be returned")
 
 	// test nil symmetric state
 	hs, err = newHandshakeState(protocolName, prologue, nil,
-		true, nil, nil, nil, nil, nil, nil, false)
+		true, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.Equal(t, errMissingSymmetricState, err,
 		"missing symmetric state error should be returned")
 
 	// test nil handshake pattern
 	hs, err = newHandshakeState(protocolName, prologue, nil,
-		true, ssG, nil, nil, nil, nil, nil, false)
+		true, ssG, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.Equal(t, errMissingHandshakePattern, err,
 		"missing handshake pattern error should be returned")
@@ -61,28 +61,28 @@ func TestInitializeHandshakeState(t *testing.T) {
 	// key required in the KN handshake pattern.
 	KN, _ := pattern.FromString("KN")
 	hs, err = newHandshakeState(protocolName, prologue, nil,
-		true, ssG, KN, nil, nil, nil, nil, false)
+		true, ssG, KN, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.NotNil(t, err, "an error should be returned from initialize")
 
 	// test missing psk token
 	NXpsk0, _ := pattern.FromString("NXpsk0")
 	hs, err = newHandshakeState(protocolName, prologue, nil,
-		true, ssG, NXpsk0, nil, nil, nil, nil, false)
+		true, ssG, NXpsk0, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.Equal(t, errMismatchedPsks(1, 0), err,
 		"invalid psk size error should be returned")
 
 	// test wrong psk size
 	hs, err = newHandshakeState(protocolName, prologue, wrongPsk,
-		true, ssG, NXpsk0, nil, nil, nil, nil, false)
+		true, ssG, NXpsk0, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, hs, "no handshake state created")
 	require.Equal(t, errInvalidPskSize, err,
 		"invalid psk size error should be returned")
 
 	// test successfully created a handshake state
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, NXpsk0, nil, nil, nil, nil, false)
+		true, ssG, NXpsk0, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "should return no error")
 	require.NotNil(t, hs, "should return an hs instance")
 	ck := hs.GetChainingKey()
@@ -90,22 +90,18 @@ func TestInitializeHandshakeState(t *testing.T) {
 	h := hs.GetDigest()
 	require.NotNil(t, h, "digest is not nil")
 
-	err = pattern.Register("YY", `
-	-> e, s
-	...
-	-> ee
-	`)
-	require.Nil(t, err, "failed to create a new pattern")
-	YY, _ := pattern.FromString("YYpsk0")
+	// the initiator's e and s are in the pre-message
+	YY, err := pattern.FromString("IXfallback+psk0")
+	require.Nil(t, err, "failed to create the pattern")
 
 	// test no autopadding, will fail to create hs
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, YY, nil, nil, nil, nil, false)
+		true, ssG, YY, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.NotNil(t, err, "failed to create hs")
 
 	// test autopadding s
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, YY, nil, nil, nil, nil, true)
+		true, ssG, YY, nil, nil, nil, nil, nil, nil, nil, nil, nil, nil, true)
 	require.NoError(t, err, "failed to create hs")
 	require.NotNil(t, hs.localStatic, "autopadding for s")
 	require.NotNil(t, hs.localEphemeral, "autopadding for e")
@@ -159,7 +155,7 @@ func TestValidateKeys(t *testing.T) {
 			require.Nil(t, err, "error loading pattern")
 
 			hs, err := newHandshakeState(protocolName, prologue, pskToken,
-				tt.initiator, ssG, p, tt.s, tt.e, tt.rs, tt.re, false)
+				tt.initiator, ssG, p, tt.s, tt.e, tt.rs, tt.re, nil, nil, nil, nil, nil, nil, false)
 			require.Equal(t, tt.errExpected, err, "returned error not match")
 			require.Nil(t, hs, "hs should be nil")
 		})
@@ -194,15 +190,9 @@ func TestProcessPreMessage(t *testing.T) {
 		rs         = remoteS.PubKey()
 	)
 
-	// create a test pattern
-	err := pattern.Register("YY", `
-	-> e, s
-	...
-	-> ee
-	`)
-	require.Nil(t, err, "failed to create a new pattern")
-
-	YY, _ := pattern.FromString("YYpsk0")
+	// the initiator's e and s are in the pre-message
+	YY, err := pattern.FromString("IXfallback+psk0")
+	require.Nil(t, err, "failed to create the pattern")
 
 	testParams := []struct {
 		name        string
@@ -230,7 +220,7 @@ func TestProcessPreMessage(t *testing.T) {
 	for _, tt := range testParams {
 		t.Run(tt.name, func(t *testing.T) {
 			hs, err := newHandshakeState(protocolName, prologue, pskToken,
-				tt.initiator, ssG, YY, tt.s, tt.e, tt.rs, tt.re, false)
+				tt.initiator, ssG, YY, tt.s, tt.e, tt.rs, tt.re, nil, nil, nil, nil, nil, nil, false)
 			if tt.errExpected != nil {
 				require.Nil(t, hs, "handshake state should not be created")
 			} else {
@@ -260,7 +250,7 @@ func TestIncrementPatternIndexAndSplit(t *testing.T) {
 	require := require.New(t)
 
 	hs, err := newHandshakeState(protocolName, prologue, nil,
-		true, ssG, XN, s, nil, nil, nil, false)
+		true, ssG, XN, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(err, "failed to create handshake state")
 	require.Equal(0, hs.patternIndex, "pattern index is not 0")
 	require.Nil(hs.SendCipherState, "no send cipher inited")
@@ -295,7 +285,7 @@ func TestIncrementPatternIndexAndSplit(t *testing.T) {
 
 	// make an invalid chain key error
 	hs, _ = newHandshakeState(protocolName, prologue, nil,
-		true, ssG, XN, s, nil, nil, nil, false)
+		true, ssG, XN, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	hs.ss.chainingKey = nil
 	// increase twice to trigger the error
 	require.NoError(hs.incrementPatternIndexAndSplit())
@@ -352,7 +342,7 @@ func TestProcessReadTokenE(t *testing.T) {
 
 	// test when re is not empty
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 	hs.remoteEphemeralPub = re
 	p, err := hs.readTokenE(nil)
@@ -362,7 +352,7 @@ func TestProcessReadTokenE(t *testing.T) {
 
 	// test invalid payload
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	p, err = hs.readTokenE(nil)
 	require.Nil(t, p, "no payload should be returned")
 	require.Equal(t, errInvalidPayload, err, "should return errInvalidPayload")
@@ -421,7 +411,7 @@ func TestProcessReadTokenS(t *testing.T) {
 
 	// test invalid payload
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, nil, nil, false)
+		true, ssG, XNpsk0, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	// hs.ss.InitializeSymmetric(protocolName)
 	p, err := hs.readTokenS(nil)
 	require.Nil(t, p, "no payload should be returned")
@@ -442,7 +432,7 @@ func TestProcessReadTokenS(t *testing.T) {
 
 	// test failed to decrypt
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XN, s, nil, nil, nil, false)
+		true, ssG, XN, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	err = hs.ss.cs.initializeKey(key)
 	require.NoError(t, err, "failed to initilize key")
 	payload = append(key[:], pubBitcoin[:]...)
@@ -478,7 +468,7 @@ func TestProcessTokenPsk(t *testing.T) {
 
 	// test success
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, nil, nil, false)
+		true, ssG, XNpsk0, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 	err = hs.processTokenPsk()
 	require.Nil(t, err, "should return no error")
@@ -573,7 +563,7 @@ func TestProcessTokenDH(t *testing.T) {
 
 			// test setup
 			hs, err := newHandshakeState(protocolName, prologue, pskToken,
-				tt.initiator, ssG, XN, s, nil, nil, nil, false)
+				tt.initiator, ssG, XN, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 			require.Nil(t, err, "failed to create handshake state")
 
 			oldCk := hs.ss.chainingKey
@@ -657,7 +647,7 @@ func TestProcessReadToken(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// test setup
 			hs, err := newHandshakeState(protocolName, prologue, pskToken,
-				true, ssG, XN, s, nil, tt.rs, nil, false)
+				true, ssG, XN, s, nil, tt.rs, nil, nil, nil, nil, nil, nil, nil, false)
 			require.Nil(t, err, "failed to create handshake state")
 
 			hs.remoteEphemeralPub = tt.re
@@ -670,7 +660,7 @@ func TestProcessReadToken(t *testing.T) {
 
 	// test an edge case for psk
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XN, s, nil, rs, nil, false)
+		true, ssG, XN, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 	hs.pskIndex = 1
 	payload, err := hs.processReadToken(pattern.TokenPsk, nil)
@@ -715,7 +705,7 @@ func TestProcessWriteTokenE(t *testing.T) {
 
 	// test success
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 
 	oldDigest := hs.ss.digest
@@ -759,7 +749,7 @@ func TestProcessWriteTokenS(t *testing.T) {
 
 	payload := []byte{}
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, nil, nil, false)
+		true, ssG, XNpsk0, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 
 	// test missing key
@@ -833,7 +823,7 @@ func TestProcessWriteToken(t *testing.T) {
 
 	// test error when processing token e
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "failed to create handshake state")
 
 	// test error when processing token s
@@ -858,7 +848,7 @@ func TestProcessWriteToken(t *testing.T) {
 
 	// test process the line "e, s"
 	hs, err = newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 	p, err = hs.processWriteToken(pattern.TokenE, payload)
 	require.Nil(t, err, "should return no error")
 	require.Equal(t, len(pubBitcoin), len(p),
@@ -907,7 +897,7 @@ func TestReadMessageErrors(t *testing.T) {
 	// <- e, ee
 	// -> s, se
 	hs, _ := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 
 	// test message too big
 	bigMessage := [maxMessageSize + 1]byte{}
@@ -980,17 +970,12 @@ func TestWriteMessageErrors(t *testing.T) {
 		s, _ = curveG.GenerateKeyPair(nil)
 	)
 
-	// create a test pattern with nonsense
-	err := pattern.Register("YYY", `
-	-> s
-	<- s
-	-> s
-	`)
-	require.Nil(t, err, "failed to create a new pattern")
-	YYYpsk0, _ := pattern.FromString("YYYpsk0")
+	// the initiator sends its s in the third line
+	YYYpsk0, err := pattern.FromString("XNpsk0")
+	require.Nil(t, err, "failed to create the pattern")
 
 	hs, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, YYYpsk0, s, nil, nil, nil, false)
+		true, ssG, YYYpsk0, s, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "should return no error")
 
 	// test message too big
@@ -1059,7 +1044,7 @@ func TestReset(t *testing.T) {
 	)
 
 	hs, _ := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssG, XNpsk0, s, nil, rs, nil, false)
+		true, ssG, XNpsk0, s, nil, rs, nil, nil, nil, nil, nil, nil, nil, false)
 
 	hs.Reset()
 	require.NotNil(t, hs.psks, "should not touch psks")
@@ -1074,6 +1059,52 @@ func TestReset(t *testing.T) {
 	require.Nil(t, hs.RecvCipherState, "reset RecvCipherState")
 }
 
+func TestHandshakeStateDestroy(t *testing.T) {
+	psk := make([]byte, CipherKeySize)
+	psk[0] = 1
+	newHs := func(initiator bool) *HandshakeState {
+		hs, err := NewProtocolWithConfig(&ProtocolConfig{
+			Name:      "Noise_NNpsk0_25519_ChaChaPoly_SHA256",
+			Initiator: initiator,
+			Psks:      [][]byte{psk},
+		})
+		require.NoError(t, err, "failed to create handshake state")
+		return hs
+	}
+	alice, bob := newHs(true), newHs(false)
+
+	// wipe the secrets in the middle of the handshake
+	msg, err := alice.WriteMessage(nil)
+	require.NoError(t, err, "failed to write message")
+	_, err = bob.ReadMessage(msg)
+	require.NoError(t, err, "failed to read message")
+
+	e := alice.localEphemeral
+	ck := alice.ss.chainingKey
+	cs := alice.ss.cs
+	alice.Destroy()
+	require.Equal(t, make([]byte, len(e.Bytes())), e.Bytes(),
+		"ephemeral key not wiped")
+	require.Equal(t, make([]byte, len(ck)), ck, "ck not wiped")
+	require.Equal(t, ZEROS, cs.key, "cipher key not wiped")
+	require.Nil(t, alice.psks, "psks not wiped")
+	require.Nil(t, alice.localEphemeral, "ephemeral key not dropped")
+	require.Nil(t, alice.ss, "ss not dropped")
+
+	// wipe the secrets once the handshake is finished
+	alice = newHs(true)
+	bob = newHs(false)
+	runHandshake(t, alice, bob)
+	psks := alice.psks
+	send, recv := alice.SendCipherState, alice.RecvCipherState
+	alice.Destroy()
+	require.Equal(t, ZEROS, psks[0], "psk not wiped")
+	require.Equal(t, ZEROS, send.key, "send key not wiped")
+	require.Equal(t, ZEROS, recv.key, "recv key not wiped")
+	require.Nil(t, alice.SendCipherState, "send not dropped")
+	require.Nil(t, alice.RecvCipherState, "recv not dropped")
+}
+
 func TestHandshakeState(t *testing.T) {
 	var (
 		cipherA, _ = noiseCipher.FromString("AESGCM")
@@ -1113,11 +1144,11 @@ func TestHandshakeState(t *testing.T) {
 	sBob, _ := curveB.GenerateKeyPair(nil)
 
 	alice, err := newHandshakeState(protocolName, prologue, pskToken,
-		true, ssA, XN, sAlice, nil, nil, nil, false)
+		true, ssA, XN, sAlice, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "alice failed to create handshake state")
 
 	bob, err := newHandshakeState(protocolName, prologue, pskToken,
-		false, ssB, XN, sBob, nil, nil, nil, false)
+		false, ssB, XN, sBob, nil, nil, nil, nil, nil, nil, nil, nil, nil, false)
 	require.Nil(t, err, "bob failed to create handshake state")
 
 	// alice writes message, -> e
@@ -1197,3 +1228,317 @@ func TestHandshakeState(t *testing.T) {
 	require.Nil(t, bob.SendCipherState, "reset SendCipherState")
 	require.Nil(t, bob.RecvCipherState, "reset RecvCipherState")
 }
+
+func TestFallback(t *testing.T) {
+	name := "Noise_IK_25519_ChaChaPoly_BLAKE2s"
+	fallbackName := "Noise_XXfallback_25519_ChaChaPoly_BLAKE2s"
+
+	bobStatic, _ := noiseCurve.FromString("25519")
+	bobS, _ := bobStatic.GenerateKeyPair(nil)
+	wrongS, _ := bobStatic.GenerateKeyPair(nil)
+
+	// alice uses a wrong remote static key for bob
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            name,
+		Initiator:       true,
+		RemoteStaticPub: wrongS.PubKey().Bytes(),
+		autoPadding:     true,
+	})
+	require.NoError(t, err, "failed to create alice")
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            name,
+		Initiator:       false,
+		LocalStaticPriv: bobS.Bytes(),
+	})
+	require.NoError(t, err, "failed to create bob")
+
+	// test fallback with wrong names
+	require.Equal(t, ErrProtocolInvalidName, bob.Fallback("yy"),
+		"should return an invalid name error")
+	require.Equal(t, errNotFallbackPattern, bob.Fallback(name),
+		"should return a not fallback error")
+	require.Equal(t, errFallbackCurveMismatch,
+		bob.Fallback("Noise_XXfallback_448_ChaChaPoly_BLAKE2s"),
+		"should return a curve mismatch error")
+
+	// bob fails to read alice's message and falls back
+	ciphertext, err := alice.WriteMessage(nil)
+	require.NoError(t, err, "alice failed to write the first msg")
+	_, err = bob.ReadMessage(ciphertext)
+	require.Error(t, err, "bob should fail to read the first msg")
+	require.NoError(t, bob.Fallback(fallbackName), "bob failed to fallback")
+	require.Equal(t, alice.localEphemeral.PubKey().Bytes(),
+		bob.remoteEphemeralPub.Bytes(), "bob should keep alice's e")
+	require.Nil(t, bob.remoteStaticPub, "bob should have no rs")
+	require.Equal(t, bobS.Bytes(), bob.localStatic.Bytes(),
+		"bob should keep its s")
+	require.False(t, bob.initiator, "bob should stay as responder")
+
+	// alice fails to read bob's message and falls back
+	ciphertext, err = bob.WriteMessage(nil)
+	require.NoError(t, err, "bob failed to write the fallback msg")
+	_, err = alice.ReadMessage(ciphertext)
+	require.Error(t, err, "alice should fail to read bob's msg")
+	aliceE := alice.localEphemeral
+	require.NoError(t, alice.Fallback(fallbackName),
+		"alice failed to fallback")
+	require.Equal(t, aliceE, alice.localEphemeral, "alice should keep her e")
+	require.Nil(t, alice.remoteEphemeralPub, "alice should have no re")
+	require.Nil(t, alice.remoteStaticPub, "alice should have no rs")
+
+	// finish the handshake
+	_, err = alice.ReadMessage(ciphertext)
+	require.NoError(t, err, "alice failed to read the fallback msg")
+	require.Equal(t, bobS.PubKey().Bytes(), alice.remoteStaticPub.Bytes(),
+		"alice should have bob's s")
+	ciphertext, err = alice.WriteMessage(nil)
+	require.NoError(t, err, "alice failed to write the last msg")
+	_, err = bob.ReadMessage(ciphertext)
+	require.NoError(t, err, "bob failed to read the last msg")
+
+	require.True(t, alice.Finished(), "alice should finish")
+	require.True(t, bob.Finished(), "bob should finish")
+	require.Equal(t, alice.GetDigest(), bob.GetDigest(), "digest not match")
+	require.Equal(t, alice.SendCipherState.key, bob.RecvCipherState.key,
+		"alice's send not match bob's recv")
+}
+
+func TestShouldWrite(t *testing.T) {
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	// -> e
+	require.True(t, alice.ShouldWrite(), "alice should write")
+	require.False(t, bob.ShouldWrite(), "bob should read")
+	ciphertext, _ := alice.WriteMessage(nil)
+	_, _ = bob.ReadMessage(ciphertext)
+
+	// <- e, ee, s, es
+	require.False(t, alice.ShouldWrite(), "alice should read")
+	require.True(t, bob.ShouldWrite(), "bob should write")
+	ciphertext, _ = bob.WriteMessage(nil)
+	_, _ = alice.ReadMessage(ciphertext)
+
+	// -> s, se
+	require.True(t, alice.ShouldWrite(), "alice should write")
+	ciphertext, _ = alice.WriteMessage(nil)
+	_, _ = bob.ReadMessage(ciphertext)
+
+	// finished
+	require.False(t, alice.ShouldWrite(), "alice is finished")
+	require.False(t, bob.ShouldWrite(), "bob is finished")
+}
+
+func TestPayloadSecurity(t *testing.T) {
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+
+	// requireSecurity checks the properties of the next payload of both
+	// parties, which are the same during the handshake.
+	requireSecurity := func(sender pattern.Token, source, destination int) {
+		want := pattern.PayloadSecurity{
+			Sender:      sender,
+			Source:      source,
+			Destination: destination,
+		}
+		for _, hs := range []*HandshakeState{alice, bob} {
+			got, err := hs.PayloadSecurity()
+			require.NoError(t, err, "failed to get payload security")
+			require.Equal(t, want, got, "payload security not match")
+		}
+	}
+
+	// -> e
+	requireSecurity(pattern.TokenInitiator, 0, 0)
+	ciphertext, _ := alice.WriteMessage(nil)
+	_, _ = bob.ReadMessage(ciphertext)
+
+	// <- e, ee, s, es
+	requireSecurity(pattern.TokenResponder, 2, 1)
+	ciphertext, _ = bob.WriteMessage(nil)
+	_, _ = alice.ReadMessage(ciphertext)
+
+	// -> s, se
+	requireSecurity(pattern.TokenInitiator, 2, 5)
+	ciphertext, _ = alice.WriteMessage(nil)
+	_, _ = bob.ReadMessage(ciphertext)
+
+	// once finished, the transport messages sent by each party.
+	got, err := bob.PayloadSecurity()
+	require.NoError(t, err, "failed to get payload security")
+	require.Equal(t, pattern.TokenResponder, got.Sender, "sender not match")
+	got, err = alice.PayloadSecurity()
+	require.NoError(t, err, "failed to get payload security")
+	require.Equal(t, pattern.TokenInitiator, got.Sender, "sender not match")
+
+	analysis, err := alice.SecurityAnalysis()
+	require.NoError(t, err, "failed to get analysis")
+	require.Equal(t, 8, analysis.InitiatorIdentity, "identity not match")
+	require.Equal(t, 1, analysis.ResponderIdentity, "identity not match")
+
+	// the KEM patterns are not supported.
+	alice, _ = NewProtocol("Noise_pqNN_MLKEM768_ChaChaPoly_BLAKE2s", "", true)
+	_, err = alice.PayloadSecurity()
+	require.Error(t, err, "should return an error")
+}
+
+func TestMinPayloadSecurity(t *testing.T) {
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	newState := func(initiator bool, min int) *HandshakeState {
+		hs, err := NewProtocolWithConfig(&ProtocolConfig{
+			Name:               name,
+			Initiator:          initiator,
+			MinPayloadSecurity: min,
+			autoPadding:        true,
+		})
+		require.NoError(t, err, "failed to create handshake state")
+		return hs
+	}
+	alice, bob := newState(true, 5), newState(false, 1)
+
+	// -> e, which has no confidentiality.
+	_, err := alice.WriteMessage([]byte("secret"))
+	require.Equal(t, ErrInsecurePayload, err, "error not match")
+	require.Zero(t, alice.patternIndex, "state should be unchanged")
+
+	// an empty payload is always allowed.
+	ciphertext, err := alice.WriteMessage(nil)
+	require.NoError(t, err, "failed to write")
+	_, err = bob.ReadMessage(ciphertext)
+	require.NoError(t, err, "failed to read")
+
+	// <- e, ee, s, es, which has the destination property 1.
+	ciphertext, err = bob.WriteMessage([]byte("yy"))
+	require.NoError(t, err, "failed to write")
+	_, err = alice.ReadMessage(ciphertext)
+	require.NoError(t, err, "failed to read")
+
+	// -> s, se, which has the destination property 5. The setting is kept
+	// when the state is restored.
+	alice = restore(t, alice)
+	require.Equal(t, 5, alice.minPayloadSecurity, "setting not match")
+	ciphertext, err = alice.WriteMessage([]byte("secret"))
+	require.NoError(t, err, "failed to write")
+	payload, err := bob.ReadMessage(ciphertext)
+	require.NoError(t, err, "failed to read")
+	require.Equal(t, []byte("secret"), payload, "payload not match")
+
+	// the setting must be in range, and cannot be used with KEM patterns.
+	for _, min := range []int{-1, 6} {
+		_, err = NewProtocolWithConfig(&ProtocolConfig{
+			Name:               name,
+			MinPayloadSecurity: min,
+		})
+		require.Equal(t, ErrInvalidPayloadSecurity, err, "error not match")
+	}
+	_, err = NewProtocolWithConfig(&ProtocolConfig{
+		Name:               "Noise_pqNN_MLKEM768_ChaChaPoly_BLAKE2s",
+		MinPayloadSecurity: 1,
+	})
+	require.Error(t, err, "should return an error")
+}
+
+func TestVerifyPeerStatic(t *testing.T) {
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+	curve, _ := noiseCurve.FromString("25519")
+	aliceS, _ := curve.GenerateKeyPair(nil)
+	bobS, _ := curve.GenerateKeyPair(nil)
+	errUnauthorized := errors.New("unauthorized")
+
+	type call struct {
+		pub     []byte
+		payload []byte
+	}
+
+	testParams := []struct {
+		name string
+		// reject decides whether to reject the nth call.
+		reject func(n int) bool
+		// finished specifies whether alice accepts bob's message.
+		finished bool
+	}{
+		{"accept", func(n int) bool { return false }, true},
+		{"reject when decrypted", func(n int) bool { return n == 0 }, false},
+		{"reject with payload", func(n int) bool { return n == 1 }, false},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []call
+			verify := func(pub dh.PublicKey, payload []byte) error {
+				calls = append(calls, call{pub.Bytes(), payload})
+				if tt.reject(len(calls) - 1) {
+					return errUnauthorized
+				}
+				return nil
+			}
+
+			alice, err := NewProtocolWithConfig(&ProtocolConfig{
+				Name:             name,
+				Initiator:        true,
+				LocalStaticPriv:  aliceS.Bytes(),
+				VerifyPeerStatic: verify,
+			})
+			require.NoError(t, err, "failed to create alice")
+			bob, err := NewProtocolWithConfig(&ProtocolConfig{
+				Name:            name,
+				LocalStaticPriv: bobS.Bytes(),
+			})
+			require.NoError(t, err, "failed to create bob")
+
+			// -> e
+			ciphertext, err := alice.WriteMessage(nil)
+			require.NoError(t, err, "failed to write message")
+			_, err = bob.ReadMessage(ciphertext)
+			require.NoError(t, err, "failed to read message")
+			require.Empty(t, calls, "no static key received")
+
+			// <- e, ee, s, es
+			ciphertext, err = bob.WriteMessage([]byte("cert"))
+			require.NoError(t, err, "failed to write message")
+			_, err = alice.ReadMessage(ciphertext)
+
+			if !tt.finished {
+				require.Equal(t, errUnauthorized, err, "error not match")
+				require.False(t, alice.ShouldWrite(),
+					"alice must not write the next message")
+				return
+			}
+
+			require.NoError(t, err, "failed to read message")
+			require.Equal(t, []call{
+				{bobS.PubKey().Bytes(), nil},
+				{bobS.PubKey().Bytes(), []byte("cert")},
+			}, calls, "calls not match")
+		})
+	}
+
+	// the callback is kept after fallback, and receives an empty payload
+	var payloads [][]byte
+	alice, _ := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		Initiator:       true,
+		LocalStaticPriv: aliceS.Bytes(),
+		RemoteStaticPub: aliceS.PubKey().Bytes(),
+		VerifyPeerStatic: func(pub dh.PublicKey, payload []byte) error {
+			payloads = append(payloads, payload)
+			return nil
+		},
+	})
+	bob, _ := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            "Noise_IK_25519_ChaChaPoly_BLAKE2s",
+		LocalStaticPriv: bobS.Bytes(),
+	})
+	fallbackName := "Noise_XXfallback_25519_ChaChaPoly_BLAKE2s"
+	ciphertext, _ := alice.WriteMessage(nil)
+	_, err := bob.ReadMessage(ciphertext)
+	require.Error(t, err, "bob should fail to read")
+	require.NoError(t, bob.Fallback(fallbackName), "failed to fallback")
+	require.NoError(t, alice.Fallback(fallbackName), "failed to fallback")
+	ciphertext, _ = bob.WriteMessage(nil)
+	_, err = alice.ReadMessage(ciphertext)
+	require.NoError(t, err, "failed to read message")
+	require.Equal(t, [][]byte{nil, {}}, payloads, "payloads not match")
+}
@@ -0,0 +1,109 @@
+// Package kem implements the key encapsulation mechanisms used by the
+// post-quantum noise patterns, as specified in the PQNoise paper.
+//  https://eprint.iacr.org/2022/539
+//
+// It currently supports,
+//  - ML-KEM-768, which uses https://pkg.go.dev/crypto/mlkem.
+package kem
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	supportedKEMs = map[string]NewKEM{}
+)
+
+// NewKEM creates a KEM instance.
+type NewKEM func() KEM
+
+// PublicKey represents an encapsulation key. It's used by the sender of an
+// "ekem" or "skem" token to create a shared secret.
+type PublicKey interface {
+	// Bytes turns the underlying bytes array into a slice.
+	Bytes() []byte
+
+	// Hex returns the hexstring of the public key.
+	Hex() string
+
+	// Encapsulate generates a shared secret and a ciphertext, the ciphertext
+	// is sent to the owner of the private key, who can decapsulate it to get
+	// the same shared secret.
+	Encapsulate() (ciphertext, secret []byte, err error)
+}
+
+// PrivateKey is a key pair. Since a private key always corresponds to a public
+// key, it makes sense to pair with it inside the struct.
+type PrivateKey interface {
+	// Bytes turns the underlying bytes array into a slice.
+	Bytes() []byte
+
+	// Decapsulate uses the private key to recover the shared secret from the
+	// ciphertext created by Encapsulate.
+	Decapsulate(ciphertext []byte) ([]byte, error)
+
+	// PubKey returns the associated public key.
+	PubKey() PublicKey
+}
+
+// KEM represents a key encapsulation mechanism.
+type KEM interface {
+	fmt.Stringer
+
+	// GenerateKeyPair generates a new key pair. It creates a key pair from
+	// entropy. If the entropy is not supplied, it will use rand.Read to
+	// generate a new private key.
+	GenerateKeyPair(entropy []byte) (PrivateKey, error)
+
+	// LoadPrivateKey uses the data provided to create a new private key.
+	LoadPrivateKey(data []byte) (PrivateKey, error)
+
+	// LoadPublicKey uses the data provided to create a new public key.
+	LoadPublicKey(data []byte) (PublicKey, error)
+
+	// PublicKeySize returns the size of the public key in bytes.
+	PublicKeySize() int
+
+	// CiphertextSize returns the size of the ciphertext in bytes.
+	CiphertextSize() int
+
+	// SharedSecretSize returns the size of the shared secret in bytes.
+	SharedSecretSize() int
+}
+
+// FromString uses the provided KEM name, s, to query a built-in KEM.
+func FromString(s string) (KEM, error) {
+	if supportedKEMs[s] != nil {
+		return supportedKEMs[s](), nil
+	}
+	return nil, errUnsupported(s)
+}
+
+// Register updates the supported KEMs used in package kem.
+func Register(s string, new NewKEM) {
+	// check the KEM interface is matched
+	var _ KEM = new()
+
+	supportedKEMs[s] = new
+}
+
+// SupportedKEMs gives the names of all the KEMs registered. If no new KEMs
+// are registered, it returns a string as "MLKEM768".
+func SupportedKEMs() string {
+	keys := make([]string, 0, len(supportedKEMs))
+	for k := range supportedKEMs {
+		keys = append(keys, k)
+	}
+	return strings.Join(keys, ", ")
+}
+
+func errUnsupported(s string) error {
+	return fmt.Errorf("kem: %s is unsupported", s)
+}
+
+// errMismatchedKey is returned when the provided key length fails to match.
+func errMismatchedKey(k string, want, got int) error {
+	s := k + " key is wrong: want %v bytes, got %v bytes"
+	return fmt.Errorf(s, want, got)
+}
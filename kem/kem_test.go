@@ -0,0 +1,30 @@
+package kem_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/crypto-y/babble/kem"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetUp(t *testing.T) {
+	// check supported KEMs
+	mlkem768, err := kem.FromString("MLKEM768")
+	require.NotNil(t, mlkem768, "missing MLKEM768")
+	require.Nil(t, err, "should not return an error")
+
+	// check return empty
+	yy, err := kem.FromString("yy")
+	require.Nil(t, yy, "yy does not exist, yet")
+	require.NotNil(t, err, "should return an error")
+
+	require.Equal(t, "MLKEM768", kem.SupportedKEMs(),
+		"MLKEM768 should be returned")
+}
+
+func ExampleFromString() {
+	// use the ML-KEM-768
+	mlkem768, _ := kem.FromString("MLKEM768")
+	fmt.Println(mlkem768)
+}
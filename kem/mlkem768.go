@@ -0,0 +1,138 @@
+package kem
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// publicKeyMLKEM768 implements the PublicKey interface.
+type publicKeyMLKEM768 struct {
+	key *mlkem.EncapsulationKey768
+}
+
+// Bytes turns the underlying bytes array into a slice.
+func (pk *publicKeyMLKEM768) Bytes() []byte {
+	return pk.key.Bytes()
+}
+
+// Hex returns the public key in hexstring.
+func (pk *publicKeyMLKEM768) Hex() string {
+	return hex.EncodeToString(pk.Bytes())
+}
+
+// Encapsulate generates a shared secret and its ciphertext.
+func (pk *publicKeyMLKEM768) Encapsulate() ([]byte, []byte, error) {
+	secret, ciphertext := pk.key.Encapsulate()
+	return ciphertext, secret, nil
+}
+
+// privateKeyMLKEM768 implements the PrivateKey interface.
+type privateKeyMLKEM768 struct {
+	key *mlkem.DecapsulationKey768
+	pub *publicKeyMLKEM768
+}
+
+// Bytes returns the 64-byte seed of the private key.
+func (pk *privateKeyMLKEM768) Bytes() []byte {
+	return pk.key.Bytes()
+}
+
+// Decapsulate recovers the shared secret from the ciphertext.
+func (pk *privateKeyMLKEM768) Decapsulate(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) != mlkem.CiphertextSize768 {
+		return nil, errMismatchedCiphertext(
+			mlkem.CiphertextSize768, len(ciphertext))
+	}
+	return pk.key.Decapsulate(ciphertext)
+}
+
+// PubKey returns the corresponding public key.
+func (pk *privateKeyMLKEM768) PubKey() PublicKey {
+	return pk.pub
+}
+
+// mlkem768 implements the KEM interface.
+type mlkem768 struct{}
+
+// GenerateKeyPair creates a key pair from entropy. If the entropy is not
+// supplied, it will use rand.Read to generate a new 64-byte seed.
+func (k *mlkem768) GenerateKeyPair(entropy []byte) (PrivateKey, error) {
+	seed := make([]byte, mlkem.SeedSize)
+
+	if entropy != nil {
+		// entropy is given, use it to create the private key.
+		if len(entropy) < mlkem.SeedSize {
+			return nil, errMismatchedKey(
+				"private", mlkem.SeedSize, len(entropy))
+		}
+		copy(seed, entropy[:mlkem.SeedSize])
+	} else {
+		// no entropy given, use the default rand.Read.
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+	}
+
+	return k.LoadPrivateKey(seed)
+}
+
+// LoadPrivateKey uses the 64-byte seed provided to create a new private key.
+func (k *mlkem768) LoadPrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) != mlkem.SeedSize {
+		return nil, errMismatchedKey("private", mlkem.SeedSize, len(data))
+	}
+	key, err := mlkem.NewDecapsulationKey768(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pub := &publicKeyMLKEM768{key: key.EncapsulationKey()}
+	return &privateKeyMLKEM768{key: key, pub: pub}, nil
+}
+
+// LoadPublicKey uses the data provided to create a new public key.
+func (k *mlkem768) LoadPublicKey(data []byte) (PublicKey, error) {
+	if len(data) != mlkem.EncapsulationKeySize768 {
+		return nil, errMismatchedKey(
+			"public", mlkem.EncapsulationKeySize768, len(data))
+	}
+	key, err := mlkem.NewEncapsulationKey768(data)
+	if err != nil {
+		return nil, err
+	}
+	return &publicKeyMLKEM768{key: key}, nil
+}
+
+// PublicKeySize returns the size of the encapsulation key.
+func (k *mlkem768) PublicKeySize() int {
+	return mlkem.EncapsulationKeySize768
+}
+
+// CiphertextSize returns the size of the ciphertext.
+func (k *mlkem768) CiphertextSize() int {
+	return mlkem.CiphertextSize768
+}
+
+// SharedSecretSize returns the size of the shared secret.
+func (k *mlkem768) SharedSecretSize() int {
+	return mlkem.SharedKeySize
+}
+
+func (k *mlkem768) String() string {
+	return "MLKEM768"
+}
+
+func newMLKEM768() KEM {
+	return &mlkem768{}
+}
+
+func errMismatchedCiphertext(want, got int) error {
+	return fmt.Errorf("ciphertext is wrong: want %v bytes, got %v bytes",
+		want, got)
+}
+
+func init() {
+	Register("MLKEM768", newMLKEM768)
+}
@@ -0,0 +1,96 @@
+package kem_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/crypto-y/babble/kem"
+	"github.com/stretchr/testify/require"
+)
+
+var mlkem768, _ = kem.FromString("MLKEM768")
+
+func TestGenerateKeyPairMLKEM768(t *testing.T) {
+	seed := bytes.Repeat([]byte{0xab}, 64)
+
+	// supply 64-byte entropy
+	privKey, err := mlkem768.GenerateKeyPair(seed)
+	require.NoError(t, err, "should not return an error")
+	require.Equal(t, seed, privKey.Bytes(), "private keys not match")
+	require.Len(t, privKey.PubKey().Bytes(), mlkem768.PublicKeySize(),
+		"public key size not match")
+
+	// the same seed gives the same key pair.
+	privKey2, _ := mlkem768.GenerateKeyPair(seed)
+	require.Equal(t, privKey.PubKey().Hex(), privKey2.PubKey().Hex(),
+		"public keys should match")
+
+	// make an entropy greater than 64-byte. The function should only take the
+	// first 64-byte.
+	extra := append(seed[:], byte(0x01))
+	privKey2, _ = mlkem768.GenerateKeyPair(extra)
+	require.Equal(t, seed, privKey2.Bytes(), "private keys not match")
+
+	// entropy less than 64-byte is rejected.
+	_, err = mlkem768.GenerateKeyPair(seed[:32])
+	require.Error(t, err, "should return an error")
+
+	// no entropy passed, it should generate a new key pair.
+	privKey2, err = mlkem768.GenerateKeyPair(nil)
+	require.NoError(t, err, "should not return an error")
+	require.NotEqual(t, seed, privKey2.Bytes(),
+		"private keys should not match")
+}
+
+func TestKEMSetUpMLKEM768(t *testing.T) {
+	require.Equal(t, 1184, mlkem768.PublicKeySize(), "wrong public key size")
+	require.Equal(t, 1088, mlkem768.CiphertextSize(), "wrong ciphertext size")
+	require.Equal(t, 32, mlkem768.SharedSecretSize(), "wrong secret size")
+	require.Equal(t, "MLKEM768", mlkem768.String(), "name must be MLKEM768")
+}
+
+func TestEncapsulateMLKEM768(t *testing.T) {
+	privKey, _ := mlkem768.GenerateKeyPair(nil)
+
+	// load the public key from bytes
+	pub, err := mlkem768.LoadPublicKey(privKey.PubKey().Bytes())
+	require.NoError(t, err, "failed to load public key")
+
+	ciphertext, secret, err := pub.Encapsulate()
+	require.NoError(t, err, "failed to encapsulate")
+	require.Len(t, ciphertext, mlkem768.CiphertextSize(),
+		"ciphertext size not match")
+
+	// the private key recovers the same secret
+	recovered, err := privKey.Decapsulate(ciphertext)
+	require.NoError(t, err, "failed to decapsulate")
+	require.Equal(t, secret, recovered, "secrets not match")
+
+	// a wrong key recovers a different secret
+	wrongKey, _ := mlkem768.GenerateKeyPair(nil)
+	recovered, err = wrongKey.Decapsulate(ciphertext)
+	require.NoError(t, err, "implicit rejection returns no error")
+	require.NotEqual(t, secret, recovered, "secrets should not match")
+
+	// a ciphertext with a wrong size is rejected
+	_, err = privKey.Decapsulate(ciphertext[1:])
+	require.Error(t, err, "should return an error")
+}
+
+func TestLoadKeysMLKEM768(t *testing.T) {
+	_, err := mlkem768.LoadPrivateKey([]byte{1})
+	require.Equal(t,
+		"private key is wrong: want 64 bytes, got 1 bytes", err.Error(),
+		"error not match")
+
+	_, err = mlkem768.LoadPublicKey([]byte{1})
+	require.Equal(t,
+		"public key is wrong: want 1184 bytes, got 1 bytes", err.Error(),
+		"error not match")
+
+	privKey, _ := mlkem768.GenerateKeyPair(nil)
+	loaded, err := mlkem768.LoadPrivateKey(privKey.Bytes())
+	require.NoError(t, err, "failed to load private key")
+	require.Equal(t, privKey.PubKey().Bytes(), loaded.PubKey().Bytes(),
+		"public keys not match")
+}
@@ -0,0 +1,182 @@
+package libp2p
+
+import (
+	"errors"
+
+	"github.com/crypto-y/babble"
+	"github.com/crypto-y/babble/dh"
+)
+
+// ProtocolName is the noise protocol used by libp2p.
+const ProtocolName = "Noise_XX_25519_ChaChaPoly_SHA256"
+
+var (
+	// ErrPeerIDMismatch is returned when the remote peer ID doesn't match the
+	// expected one.
+	ErrPeerIDMismatch = errors.New("remote peer ID mismatch")
+
+	// ErrMissingConfig is returned when no config or identity key is
+	// provided.
+	ErrMissingConfig = errors.New("missing config or identity key")
+)
+
+// Config is used for creating a libp2p handshake.
+type Config struct {
+	// Identity is the local identity key, used to sign the noise static key.
+	Identity PrivateKey
+
+	// StaticPriv is the noise static private key. If not provided, a new one
+	// is generated, as suggested by the libp2p specs.
+	StaticPriv []byte
+
+	// Initiator specifies whether it's the handshake initiator.
+	Initiator bool
+
+	// RemotePeer is the expected remote peer ID. If provided, the handshake
+	// fails with ErrPeerIDMismatch when the remote identity doesn't match.
+	RemotePeer PeerID
+}
+
+// Handshake runs the libp2p noise handshake, which is the XX pattern with each
+// party sending its signed identity payload along with its static key.
+type Handshake struct {
+	hs *babble.HandshakeState
+
+	// payload is the local signed identity payload.
+	payload []byte
+
+	// expected is the expected remote peer ID, if any.
+	expected PeerID
+
+	// initiator specifies whether it's the handshake initiator.
+	initiator bool
+
+	// remotePeer and remoteKey are set once the remote payload is verified.
+	remotePeer PeerID
+	remoteKey  PublicKey
+
+	// written is the number of messages written.
+	written int
+}
+
+// NewHandshake creates a libp2p handshake using the config.
+func NewHandshake(config *Config) (*Handshake, error) {
+	if config == nil || config.Identity == nil {
+		return nil, ErrMissingConfig
+	}
+
+	curve, err := dh.FromString("25519")
+	if err != nil {
+		return nil, err
+	}
+
+	var static dh.PrivateKey
+	if config.StaticPriv == nil {
+		static, err = curve.GenerateKeyPair(nil)
+	} else {
+		static, err = curve.LoadPrivateKey(config.StaticPriv)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := NewPayload(config.Identity, static.PubKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Handshake{
+		payload:   payload,
+		expected:  config.RemotePeer,
+		initiator: config.Initiator,
+	}
+	hs, err := babble.NewProtocolWithConfig(&babble.ProtocolConfig{
+		Name:             ProtocolName,
+		Initiator:        config.Initiator,
+		LocalStaticPriv:  static.Bytes(),
+		VerifyPeerStatic: h.verifyPeerStatic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	h.hs = hs
+
+	return h, nil
+}
+
+// WriteMessage creates the next handshake message. The signed identity payload
+// is attached to every message except the initiator's first one, which
+// carries no static key.
+func (h *Handshake) WriteMessage() ([]byte, error) {
+	var payload []byte
+	if !h.initiator || h.written > 0 {
+		payload = h.payload
+	}
+
+	msg, err := h.hs.WriteMessage(payload)
+	if err != nil {
+		return nil, err
+	}
+	h.written++
+	return msg, nil
+}
+
+// ReadMessage processes the handshake message from the remote peer. The
+// remote identity payload is verified when present, and the handshake is
+// aborted if it's invalid.
+func (h *Handshake) ReadMessage(msg []byte) error {
+	_, err := h.hs.ReadMessage(msg)
+	return err
+}
+
+// Finished returns true when the handshake is finished.
+func (h *Handshake) Finished() bool {
+	return h.hs.Finished()
+}
+
+// RemotePeer returns the authenticated remote peer ID, or nil if the remote
+// payload is not yet received.
+func (h *Handshake) RemotePeer() PeerID {
+	return h.remotePeer
+}
+
+// RemotePublicKey returns the authenticated remote identity key, or nil if the
+// remote payload is not yet received.
+func (h *Handshake) RemotePublicKey() PublicKey {
+	return h.remoteKey
+}
+
+// HandshakeState returns the underlying handshake state.
+func (h *Handshake) HandshakeState() *babble.HandshakeState {
+	return h.hs
+}
+
+// Session returns the transport session once the handshake is finished.
+func (h *Handshake) Session() (*babble.Session, error) {
+	return h.hs.Session()
+}
+
+// verifyPeerStatic is used as the VerifyPeerStatic callback, which verifies
+// the remote identity payload signs the remote static key.
+func (h *Handshake) verifyPeerStatic(pub dh.PublicKey, data []byte) error {
+	// The payload is not yet decrypted.
+	if data == nil {
+		return nil
+	}
+
+	p, err := ParsePayload(data)
+	if err != nil {
+		return err
+	}
+	id, err := p.Verify(pub.Bytes())
+	if err != nil {
+		return err
+	}
+	if h.expected != nil && !h.expected.Equal(id) {
+		return ErrPeerIDMismatch
+	}
+
+	h.remotePeer = id
+	h.remoteKey = p.IdentityKey
+	return nil
+}
@@ -0,0 +1,93 @@
+package libp2p_test
+
+import (
+	"testing"
+
+	"github.com/crypto-y/babble/libp2p"
+	"github.com/stretchr/testify/require"
+)
+
+// runHandshake performs the handshake, returning the first error.
+func runHandshake(t *testing.T, initiator, responder *libp2p.Handshake) error {
+	sender, receiver := initiator, responder
+	for !initiator.Finished() || !responder.Finished() {
+		msg, err := sender.WriteMessage()
+		require.NoError(t, err, "failed to write message")
+		if err := receiver.ReadMessage(msg); err != nil {
+			return err
+		}
+		sender, receiver = receiver, sender
+	}
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	ed, _ := libp2p.GenerateEd25519Key()
+	secp, _ := libp2p.GenerateSecp256k1Key()
+
+	alice, err := libp2p.NewHandshake(&libp2p.Config{
+		Identity:   ed,
+		Initiator:  true,
+		RemotePeer: libp2p.IDFromPublicKey(secp.Public()),
+	})
+	require.NoError(t, err, "failed to create alice")
+	bob, err := libp2p.NewHandshake(&libp2p.Config{Identity: secp})
+	require.NoError(t, err, "failed to create bob")
+
+	require.Nil(t, alice.RemotePeer(), "remote peer should be empty")
+	require.NoError(t, runHandshake(t, alice, bob), "handshake failed")
+
+	require.Equal(t, libp2p.IDFromPublicKey(secp.Public()),
+		alice.RemotePeer(), "peer ID not match")
+	require.Equal(t, secp.Public(), alice.RemotePublicKey(),
+		"public key not match")
+	require.Equal(t, libp2p.IDFromPublicKey(ed.Public()), bob.RemotePeer(),
+		"peer ID not match")
+	require.Equal(t, ed.Public(), bob.RemotePublicKey(),
+		"public key not match")
+
+	// the transport sessions work
+	aliceSession, err := alice.Session()
+	require.NoError(t, err, "failed to create session")
+	bobSession, err := bob.Session()
+	require.NoError(t, err, "failed to create session")
+	ct, err := aliceSession.Encrypt(nil, []byte("hello"))
+	require.NoError(t, err, "failed to encrypt")
+	pt, err := bobSession.Decrypt(nil, ct)
+	require.NoError(t, err, "failed to decrypt")
+	require.Equal(t, []byte("hello"), pt, "plaintext not match")
+}
+
+func TestHandshakePeerIDMismatch(t *testing.T) {
+	alice, _ := libp2p.GenerateEd25519Key()
+	bob, _ := libp2p.GenerateEd25519Key()
+	mallory, _ := libp2p.GenerateEd25519Key()
+
+	// alice expects bob, but talks to mallory
+	initiator, err := libp2p.NewHandshake(&libp2p.Config{
+		Identity:   alice,
+		Initiator:  true,
+		RemotePeer: libp2p.IDFromPublicKey(bob.Public()),
+	})
+	require.NoError(t, err, "failed to create initiator")
+	responder, err := libp2p.NewHandshake(&libp2p.Config{Identity: mallory})
+	require.NoError(t, err, "failed to create responder")
+
+	require.Equal(t, libp2p.ErrPeerIDMismatch,
+		runHandshake(t, initiator, responder), "error not match")
+	require.Nil(t, initiator.RemotePeer(), "remote peer should be empty")
+}
+
+func TestNewHandshakeErrors(t *testing.T) {
+	_, err := libp2p.NewHandshake(nil)
+	require.Equal(t, libp2p.ErrMissingConfig, err, "error not match")
+	_, err = libp2p.NewHandshake(&libp2p.Config{})
+	require.Equal(t, libp2p.ErrMissingConfig, err, "error not match")
+
+	identity, _ := libp2p.GenerateEd25519Key()
+	_, err = libp2p.NewHandshake(&libp2p.Config{
+		Identity:   identity,
+		StaticPriv: []byte{1},
+	})
+	require.Error(t, err, "should reject an invalid static key")
+}
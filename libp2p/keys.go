@@ -0,0 +1,245 @@
+package libp2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// KeyType is the type of an identity key, as defined in the libp2p specs.
+type KeyType uint64
+
+// The key types defined in the libp2p specs, of which only Ed25519 and
+// Secp256k1 are supported.
+const (
+	KeyTypeRSA       KeyType = 0
+	KeyTypeEd25519   KeyType = 1
+	KeyTypeSecp256k1 KeyType = 2
+	KeyTypeECDSA     KeyType = 3
+)
+
+// String returns the name of the key type.
+func (t KeyType) String() string {
+	switch t {
+	case KeyTypeRSA:
+		return "RSA"
+	case KeyTypeEd25519:
+		return "Ed25519"
+	case KeyTypeSecp256k1:
+		return "Secp256k1"
+	case KeyTypeECDSA:
+		return "ECDSA"
+	default:
+		return fmt.Sprintf("KeyType(%d)", uint64(t))
+	}
+}
+
+var (
+	// ErrInvalidSignature is returned when the identity signature doesn't
+	// match.
+	ErrInvalidSignature = errors.New("invalid identity signature")
+
+	errInvalidKey = errors.New("invalid identity key")
+)
+
+// PublicKey is the public identity key of a libp2p peer.
+type PublicKey interface {
+	// Type returns the key type.
+	Type() KeyType
+
+	// Raw returns the key bytes used in the protobuf encoding, which is the
+	// 32-byte key for Ed25519, and the 33-byte compressed key for Secp256k1.
+	Raw() []byte
+
+	// Verify checks the signature of the data.
+	Verify(data, sig []byte) error
+}
+
+// PrivateKey is the private identity key of a libp2p peer.
+type PrivateKey interface {
+	// Public returns the public key.
+	Public() PublicKey
+
+	// Sign signs the data.
+	Sign(data []byte) ([]byte, error)
+}
+
+// ed25519PublicKey implements the PublicKey using Ed25519.
+type ed25519PublicKey struct {
+	key ed25519.PublicKey
+}
+
+func (k *ed25519PublicKey) Type() KeyType {
+	return KeyTypeEd25519
+}
+
+func (k *ed25519PublicKey) Raw() []byte {
+	return append([]byte{}, k.key...)
+}
+
+func (k *ed25519PublicKey) Verify(data, sig []byte) error {
+	if !ed25519.Verify(k.key, data, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// ed25519PrivateKey implements the PrivateKey using Ed25519.
+type ed25519PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+func (k *ed25519PrivateKey) Public() PublicKey {
+	return &ed25519PublicKey{key: k.key.Public().(ed25519.PublicKey)}
+}
+
+func (k *ed25519PrivateKey) Sign(data []byte) ([]byte, error) {
+	return ed25519.Sign(k.key, data), nil
+}
+
+// GenerateEd25519Key creates a new Ed25519 identity key.
+func GenerateEd25519Key() (PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ed25519PrivateKey{key: key}, nil
+}
+
+// NewEd25519PrivateKey creates an identity key from the Ed25519 private key.
+func NewEd25519PrivateKey(key ed25519.PrivateKey) (PrivateKey, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errInvalidKey
+	}
+	return &ed25519PrivateKey{key: key}, nil
+}
+
+// secp256k1PublicKey implements the PublicKey using secp256k1.
+type secp256k1PublicKey struct {
+	key *btcec.PublicKey
+}
+
+func (k *secp256k1PublicKey) Type() KeyType {
+	return KeyTypeSecp256k1
+}
+
+func (k *secp256k1PublicKey) Raw() []byte {
+	return k.key.SerializeCompressed()
+}
+
+// Verify checks the DER-encoded ECDSA signature of the data's SHA256 digest.
+func (k *secp256k1PublicKey) Verify(data, sig []byte) error {
+	signature, err := btcec.ParseDERSignature(sig, btcec.S256())
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	digest := sha256.Sum256(data)
+	if !signature.Verify(digest[:], k.key) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// secp256k1PrivateKey implements the PrivateKey using secp256k1.
+type secp256k1PrivateKey struct {
+	key *btcec.PrivateKey
+}
+
+func (k *secp256k1PrivateKey) Public() PublicKey {
+	return &secp256k1PublicKey{key: k.key.PubKey()}
+}
+
+// Sign returns the DER-encoded ECDSA signature of the data's SHA256 digest.
+func (k *secp256k1PrivateKey) Sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	sig, err := k.key.Sign(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return sig.Serialize(), nil
+}
+
+// GenerateSecp256k1Key creates a new secp256k1 identity key.
+func GenerateSecp256k1Key() (PrivateKey, error) {
+	key, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return nil, err
+	}
+	return &secp256k1PrivateKey{key: key}, nil
+}
+
+// NewSecp256k1PrivateKey creates an identity key from the 32-byte secp256k1
+// private key.
+func NewSecp256k1PrivateKey(data []byte) (PrivateKey, error) {
+	if len(data) != btcec.PrivKeyBytesLen {
+		return nil, errInvalidKey
+	}
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), data)
+	return &secp256k1PrivateKey{key: key}, nil
+}
+
+// MarshalPublicKey encodes the public key using the protobuf PublicKey message
+// defined in the libp2p specs,
+//
+//	message PublicKey {
+//		required KeyType Type = 1;
+//		required bytes Data = 2;
+//	}
+func MarshalPublicKey(pub PublicKey) []byte {
+	var b []byte
+	b = appendVarintField(b, 1, uint64(pub.Type()))
+	b = appendBytesField(b, 2, pub.Raw())
+	return b
+}
+
+// UnmarshalPublicKey decodes the protobuf PublicKey message. Only Ed25519 and
+// Secp256k1 keys are supported.
+func UnmarshalPublicKey(data []byte) (PublicKey, error) {
+	var keyType uint64
+	var raw []byte
+	var hasType, hasData bool
+
+	err := parseMessage(data, func(field uint64, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			keyType, hasType = v, true
+		case 2:
+			raw, hasData = b, true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !hasType || !hasData {
+		return nil, errInvalidKey
+	}
+
+	switch KeyType(keyType) {
+	case KeyTypeEd25519:
+		if len(raw) != ed25519.PublicKeySize {
+			return nil, errInvalidKey
+		}
+		key := append(ed25519.PublicKey{}, raw...)
+		return &ed25519PublicKey{key: key}, nil
+
+	case KeyTypeSecp256k1:
+		key, err := btcec.ParsePubKey(raw, btcec.S256())
+		if err != nil {
+			return nil, errInvalidKey
+		}
+		return &secp256k1PublicKey{key: key}, nil
+
+	default:
+		return nil, errUnsupportedKeyType(KeyType(keyType))
+	}
+}
+
+func errUnsupportedKeyType(t KeyType) error {
+	return fmt.Errorf("unsupported identity key type: %s", t)
+}
@@ -0,0 +1,84 @@
+package libp2p_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/crypto-y/babble/libp2p"
+	"github.com/stretchr/testify/require"
+)
+
+// The encoded public keys are the test vectors from the libp2p peer ID specs.
+var (
+	ed25519PubVector   = "080112201ed1e8fae2c4a144b8be8fd4b47bf3d3b34b871c3cacf6010f0e42d474fce27e"
+	secp256k1PubVector = "08021221037777e994e452c21604f91de093ce415f5432f701dd8cd1a7a6fea0e630bfca99"
+)
+
+func TestMarshalPublicKey(t *testing.T) {
+	testParams := []struct {
+		name    string
+		data    string
+		keyType libp2p.KeyType
+		errored bool
+	}{
+		{"ed25519", ed25519PubVector, libp2p.KeyTypeEd25519, false},
+		{"secp256k1", secp256k1PubVector, libp2p.KeyTypeSecp256k1, false},
+		{"rsa not supported", "080012020102", libp2p.KeyTypeRSA, true},
+		{"missing data", "0801", libp2p.KeyTypeEd25519, true},
+		{"wrong size", "080112020102", libp2p.KeyTypeEd25519, true},
+		{"truncated", "08011220", libp2p.KeyTypeEd25519, true},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			pub, err := libp2p.UnmarshalPublicKey(data)
+			if tt.errored {
+				require.Error(t, err, "should return an error")
+				return
+			}
+
+			require.NoError(t, err, "failed to unmarshal")
+			require.Equal(t, tt.keyType, pub.Type(), "key type not match")
+			require.Equal(t, data, libp2p.MarshalPublicKey(pub),
+				"encoding not match")
+		})
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	ed, err := libp2p.GenerateEd25519Key()
+	require.NoError(t, err, "failed to generate ed25519 key")
+	secp, err := libp2p.GenerateSecp256k1Key()
+	require.NoError(t, err, "failed to generate secp256k1 key")
+
+	data := []byte("babble")
+	for _, key := range []libp2p.PrivateKey{ed, secp} {
+		t.Run(key.Public().Type().String(), func(t *testing.T) {
+			sig, err := key.Sign(data)
+			require.NoError(t, err, "failed to sign")
+
+			pub := key.Public()
+			require.NoError(t, pub.Verify(data, sig), "failed to verify")
+			require.Equal(t, libp2p.ErrInvalidSignature,
+				pub.Verify([]byte("elbbab"), sig), "error not match")
+
+			sig[len(sig)-1] ^= 1
+			require.Equal(t, libp2p.ErrInvalidSignature,
+				pub.Verify(data, sig), "error not match")
+		})
+	}
+}
+
+func TestNewPrivateKey(t *testing.T) {
+	_, err := libp2p.NewEd25519PrivateKey(make([]byte, 32))
+	require.Error(t, err, "should reject a wrong sized ed25519 key")
+	_, err = libp2p.NewSecp256k1PrivateKey(make([]byte, 31))
+	require.Error(t, err, "should reject a wrong sized secp256k1 key")
+
+	data, _ := hex.DecodeString(
+		"f1e2d3c4b5a69788f1e2d3c4b5a69788f1e2d3c4b5a69788f1e2d3c4b5a69788")
+	key, err := libp2p.NewSecp256k1PrivateKey(data)
+	require.NoError(t, err, "failed to create secp256k1 key")
+	require.Len(t, key.Public().Raw(), 33, "should be a compressed key")
+}
@@ -0,0 +1,99 @@
+package libp2p
+
+import "errors"
+
+// signaturePrefix is prefixed to the noise static key when signing it with the
+// identity key.
+const signaturePrefix = "noise-libp2p-static-key:"
+
+var errMissingIdentity = errors.New("payload has no identity key or signature")
+
+// Payload is the NoiseHandshakePayload defined in the libp2p specs,
+//
+//	message NoiseHandshakePayload {
+//		optional bytes identity_key = 1;
+//		optional bytes identity_sig = 2;
+//		optional NoiseExtensions extensions = 4;
+//	}
+//
+// It's sent by each party in the handshake message carrying its static key,
+// and proves the static key is owned by the identity.
+type Payload struct {
+	// IdentityKey is the public identity key.
+	IdentityKey PublicKey
+
+	// IdentitySig is the signature of the noise static key signed by the
+	// identity key.
+	IdentitySig []byte
+
+	// Extensions is the encoded NoiseExtensions message, which is kept as is.
+	Extensions []byte
+}
+
+// NewPayload creates the encoded payload, which signs the local noise static
+// public key using the identity key.
+func NewPayload(identity PrivateKey, static []byte) ([]byte, error) {
+	sig, err := identity.Sign(signedData(static))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Payload{IdentityKey: identity.Public(), IdentitySig: sig}
+	return p.Marshal(), nil
+}
+
+// Marshal encodes the payload using protobuf.
+func (p *Payload) Marshal() []byte {
+	var b []byte
+	if p.IdentityKey != nil {
+		b = appendBytesField(b, 1, MarshalPublicKey(p.IdentityKey))
+	}
+	if p.IdentitySig != nil {
+		b = appendBytesField(b, 2, p.IdentitySig)
+	}
+	if p.Extensions != nil {
+		b = appendBytesField(b, 4, p.Extensions)
+	}
+	return b
+}
+
+// ParsePayload decodes the payload. Unknown fields are ignored.
+func ParsePayload(data []byte) (*Payload, error) {
+	p := &Payload{}
+	err := parseMessage(data, func(field uint64, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			key, err := UnmarshalPublicKey(b)
+			if err != nil {
+				return err
+			}
+			p.IdentityKey = key
+		case 2:
+			p.IdentitySig = append([]byte{}, b...)
+		case 4:
+			p.Extensions = append([]byte{}, b...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Verify checks the identity signature of the remote noise static public key,
+// and returns the remote peer ID.
+func (p *Payload) Verify(static []byte) (PeerID, error) {
+	if p.IdentityKey == nil || p.IdentitySig == nil {
+		return nil, errMissingIdentity
+	}
+	if err := p.IdentityKey.Verify(signedData(static), p.IdentitySig); err != nil {
+		return nil, err
+	}
+	return IDFromPublicKey(p.IdentityKey), nil
+}
+
+// signedData returns the data signed by the identity key.
+func signedData(static []byte) []byte {
+	return append([]byte(signaturePrefix), static...)
+}
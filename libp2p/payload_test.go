@@ -0,0 +1,50 @@
+package libp2p_test
+
+import (
+	"testing"
+
+	"github.com/crypto-y/babble/libp2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPayload(t *testing.T) {
+	identity, _ := libp2p.GenerateEd25519Key()
+	other, _ := libp2p.GenerateSecp256k1Key()
+	static := make([]byte, 32)
+	static[0] = 1
+
+	data, err := libp2p.NewPayload(identity, static)
+	require.NoError(t, err, "failed to create payload")
+
+	p, err := libp2p.ParsePayload(data)
+	require.NoError(t, err, "failed to parse payload")
+	require.Equal(t, data, p.Marshal(), "encoding not match")
+
+	id, err := p.Verify(static)
+	require.NoError(t, err, "failed to verify")
+	require.Equal(t, libp2p.IDFromPublicKey(identity.Public()), id,
+		"peer ID not match")
+
+	// a payload with extensions and unknown fields
+	p.Extensions = []byte{0x12, 0x01, 0x61}
+	p2, err := libp2p.ParsePayload(append(p.Marshal(), 0x28, 0x01))
+	require.NoError(t, err, "failed to parse payload")
+	require.Equal(t, p, p2, "payload not match")
+
+	// a different static key
+	_, err = p.Verify(make([]byte, 32))
+	require.Equal(t, libp2p.ErrInvalidSignature, err, "error not match")
+
+	// a different identity key
+	p.IdentityKey = other.Public()
+	_, err = p.Verify(static)
+	require.Equal(t, libp2p.ErrInvalidSignature, err, "error not match")
+
+	// missing fields
+	_, err = (&libp2p.Payload{IdentityKey: other.Public()}).Verify(static)
+	require.Error(t, err, "should return an error")
+
+	// malformed data
+	_, err = libp2p.ParsePayload(data[:len(data)-1])
+	require.Error(t, err, "should return an error")
+}
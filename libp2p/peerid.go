@@ -0,0 +1,124 @@
+package libp2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+const (
+	// maxInlineKeyLength is the max length of an encoded public key to be
+	// inlined in the peer ID using the identity multihash.
+	maxInlineKeyLength = 42
+
+	// The multihash codes used by the peer IDs.
+	multihashIdentity = 0x00
+	multihashSHA256   = 0x12
+
+	// base58Alphabet is the alphabet used by the base58btc encoding.
+	base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+)
+
+var errInvalidPeerID = errors.New("invalid peer ID")
+
+// PeerID identifies a libp2p peer. It's the multihash of the protobuf encoded
+// public identity key, as specified in
+// https://github.com/libp2p/specs/blob/master/peer-ids/peer-ids.md.
+type PeerID []byte
+
+// IDFromPublicKey derives the peer ID from the public key. If the encoded key
+// is no longer than 42 bytes, it's inlined using the identity multihash,
+// otherwise its SHA256 multihash is used.
+func IDFromPublicKey(pub PublicKey) PeerID {
+	data := MarshalPublicKey(pub)
+	if len(data) <= maxInlineKeyLength {
+		return append(PeerID{multihashIdentity, byte(len(data))}, data...)
+	}
+
+	digest := sha256.Sum256(data)
+	return append(PeerID{multihashSHA256, sha256.Size}, digest[:]...)
+}
+
+// DecodePeerID decodes the base58btc encoded peer ID, e.g., 12D3KooW....
+func DecodePeerID(s string) (PeerID, error) {
+	data, err := base58Decode(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// check it's a valid multihash
+	if len(data) < 2 || int(data[1]) != len(data)-2 {
+		return nil, errInvalidPeerID
+	}
+	switch data[0] {
+	case multihashIdentity:
+	case multihashSHA256:
+		if data[1] != sha256.Size {
+			return nil, errInvalidPeerID
+		}
+	default:
+		return nil, errInvalidPeerID
+	}
+	return PeerID(data), nil
+}
+
+// Equal checks the two peer IDs are the same.
+func (id PeerID) Equal(other PeerID) bool {
+	return bytes.Equal(id, other)
+}
+
+// String returns the base58btc encoding of the peer ID.
+func (id PeerID) String() string {
+	return base58Encode(id)
+}
+
+// base58Encode encodes the data using the bitcoin alphabet. Each leading zero
+// byte is encoded as a leading "1".
+func base58Encode(data []byte) string {
+	zeros := 0
+	for zeros < len(data) && data[zeros] == 0 {
+		zeros++
+	}
+
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < zeros; i++ {
+		out = append(out, base58Alphabet[0])
+	}
+
+	// reverse the output
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+// base58Decode decodes the string encoded by base58Encode.
+func base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+
+	for i := 0; i < len(s); i++ {
+		digit := bytes.IndexByte([]byte(base58Alphabet), s[i])
+		if digit < 0 {
+			return nil, errInvalidPeerID
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
@@ -0,0 +1,67 @@
+package libp2p_test
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/crypto-y/babble/libp2p"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerID(t *testing.T) {
+	testParams := []struct {
+		name   string
+		data   string
+		prefix string
+	}{
+		{"ed25519", ed25519PubVector, "12D3KooW"},
+		{"secp256k1", secp256k1PubVector, "16Uiu2HA"},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.data)
+			pub, err := libp2p.UnmarshalPublicKey(data)
+			require.NoError(t, err, "failed to unmarshal")
+
+			// Both keys are short enough to be inlined.
+			id := libp2p.IDFromPublicKey(pub)
+			require.Equal(t, append([]byte{0, byte(len(data))}, data...),
+				[]byte(id), "peer ID not match")
+			require.True(t, strings.HasPrefix(id.String(), tt.prefix),
+				"prefix not match")
+
+			decoded, err := libp2p.DecodePeerID(id.String())
+			require.NoError(t, err, "failed to decode")
+			require.True(t, id.Equal(decoded), "peer ID not match")
+		})
+	}
+}
+
+func TestDecodePeerID(t *testing.T) {
+	testParams := []struct {
+		name    string
+		id      string
+		errored bool
+	}{
+		{"sha256 multihash",
+			"QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx5N", false},
+		{"invalid character", "QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx50",
+			true},
+		{"wrong length", "QmYyQSo1c1Ym7orWxLYvCrM2EmxFTANf8wXmmE7DWjhx", true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := libp2p.DecodePeerID(tt.id)
+			if tt.errored {
+				require.Error(t, err, "should return an error")
+				return
+			}
+			require.NoError(t, err, "failed to decode")
+			require.Equal(t, tt.id, id.String(), "encoding not match")
+		})
+	}
+}
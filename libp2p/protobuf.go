@@ -0,0 +1,99 @@
+package libp2p
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// This file implements the minimal protobuf encoding needed by the libp2p
+// messages, see https://developers.google.com/protocol-buffers/docs/encoding.
+
+// The wire types used by protobuf.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProtobuf = errors.New("invalid protobuf message")
+
+// appendVarint appends the varint encoding of v.
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendVarintField appends a varint field.
+func appendVarintField(b []byte, field, v uint64) []byte {
+	b = appendVarint(b, field<<3|wireVarint)
+	return appendVarint(b, v)
+}
+
+// appendBytesField appends a length-delimited field.
+func appendBytesField(b []byte, field uint64, data []byte) []byte {
+	b = appendVarint(b, field<<3|wireBytes)
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// parseMessage iterates the fields of the message, and calls fn with the field
+// number and its value, which is v for varint fields, and b for
+// length-delimited fields. Fixed-size fields are skipped.
+func parseMessage(data []byte,
+	fn func(field uint64, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errInvalidProtobuf
+		}
+		data = data[n:]
+
+		field := key >> 3
+		if field == 0 {
+			return errInvalidProtobuf
+		}
+
+		var v uint64
+		var b []byte
+		switch key & 7 {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errInvalidProtobuf
+			}
+			data = data[n:]
+
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return errInvalidProtobuf
+			}
+			b = data[n : n+int(size)]
+			data = data[n+int(size):]
+
+		case wireFixed64:
+			if len(data) < 8 {
+				return errInvalidProtobuf
+			}
+			data = data[8:]
+			continue
+
+		case wireFixed32:
+			if len(data) < 4 {
+				return errInvalidProtobuf
+			}
+			data = data[4:]
+			continue
+
+		default:
+			return errInvalidProtobuf
+		}
+
+		if err := fn(field, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
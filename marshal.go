@@ -0,0 +1,496 @@
+package babble
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+	"github.com/crypto-y/babble/rekey"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// marshalVersion is the version of the binary format used by
+	// MarshalBinary. It's bumped whenever the format changes.
+	marshalVersion = 3
+
+	// marshalFlagEncrypted indicates the state is encrypted at rest.
+	marshalFlagEncrypted = 1
+
+	// marshalHeaderSize is the size of the header, a version byte followed by
+	// a flags byte.
+	marshalHeaderSize = 2
+)
+
+var (
+	errMarshalDataInvalid  = errors.New("invalid marshaled handshake state")
+	errMarshalDataCorrupt  = errors.New("marshaled data is corrupted")
+	errMarshalEncrypted    = errors.New("marshaled state is encrypted")
+	errMarshalNotEncrypted = errors.New("marshaled state is not encrypted")
+	errMarshalKeySize      = errors.New("marshal key must be 32 bytes")
+	errMarshalNoState      = errors.New(
+		"handshake state is destroyed or not initialized")
+	errUnsupportedVersion  = errors.New("unsupported marshal version")
+	errRekeyerNotMarshaled = errors.New(
+		"only the rekeyer created by rekey.NewDefault can be marshaled")
+)
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface. It encodes
+// the handshake state into a versioned binary format, so that an in-progress
+// handshake can be restored using UnmarshalBinary, possibly in a different
+// process. The following are captured,
+//  - the protocol name, which specifies the pattern, curve, cipher and hash.
+//  - the role, prologue, psks, patternIndex and pskIndex.
+//  - whether the VerifyPeerStatic callback is used.
+//  - the minimum payload security.
+//  - the symmetric state, which includes the ck, h, cipher key and nonce.
+//  - the local key pairs and the remote public keys.
+//  - the send and receive cipher states if the handshake is finished.
+//  - the interval and nonce reset setting of the rekeyer.
+// The output contains private keys in plaintext, use MarshalBinaryWithKey to
+// encrypt it at rest. Other rekeyers than the one created by rekey.NewDefault,
+// such as the byte and time policies, cannot be recreated, so an error is
+// returned instead of restoring a state without them.
+func (hs *HandshakeState) MarshalBinary() ([]byte, error) {
+	body, err := hs.marshalBody()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{marshalVersion, 0}, body...), nil
+}
+
+// MarshalBinaryWithKey works the same as MarshalBinary, except that the
+// encoded state is encrypted using ChaCha20-Poly1305 with the 32-byte key.
+func (hs *HandshakeState) MarshalBinaryWithKey(key []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, errMarshalKeySize
+	}
+	body, err := hs.marshalBody()
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte{marshalVersion, marshalFlagEncrypted}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	// the header is authenticated as the additional data.
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, body, header), nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. It
+// restores the handshake state from the data created by MarshalBinary. Any
+// customized patterns, curves, ciphers or hash functions used must be
+// registered before calling it. The default rekeyer is recreated with the
+// same interval and nonce reset setting. The VerifyPeerStatic callback cannot
+// be restored, if it was used, it must be set again using SetVerifyPeerStatic
+// before calling ReadMessage.
+func (hs *HandshakeState) UnmarshalBinary(data []byte) error {
+	flags, body, err := parseMarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if flags&marshalFlagEncrypted != 0 {
+		return errMarshalEncrypted
+	}
+	return hs.unmarshalBody(body)
+}
+
+// UnmarshalBinaryWithKey restores the handshake state from the data created
+// by MarshalBinaryWithKey.
+func (hs *HandshakeState) UnmarshalBinaryWithKey(key, data []byte) error {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return errMarshalKeySize
+	}
+
+	flags, body, err := parseMarshalHeader(data)
+	if err != nil {
+		return err
+	}
+	if flags&marshalFlagEncrypted == 0 {
+		return errMarshalNotEncrypted
+	}
+	if len(body) < aead.NonceSize() {
+		return errMarshalDataInvalid
+	}
+
+	nonce := body[:aead.NonceSize()]
+	plaintext, err := aead.Open(
+		nil, nonce, body[aead.NonceSize():], data[:marshalHeaderSize])
+	if err != nil {
+		return errMarshalDataCorrupt
+	}
+	return hs.unmarshalBody(plaintext)
+}
+
+// parseMarshalHeader checks the version and returns the flags and the body.
+func parseMarshalHeader(data []byte) (byte, []byte, error) {
+	if len(data) < marshalHeaderSize {
+		return 0, nil, errMarshalDataInvalid
+	}
+	if data[0] != marshalVersion {
+		return 0, nil, errUnsupportedVersion
+	}
+	return data[1], data[marshalHeaderSize:], nil
+}
+
+// marshalBody encodes the fields of the handshake state in order.
+func (hs *HandshakeState) marshalBody() ([]byte, error) {
+	// a destroyed or zero value handshake state has nothing to marshal.
+	if hs.ss == nil || hs.hp == nil {
+		return nil, errMarshalNoState
+	}
+
+	// the send and receive cipher states use clones of the same rekeyer.
+	rk := hs.ss.rekeyer
+	if rk != nil && !rekey.IsDefault(rk) {
+		return nil, errRekeyerNotMarshaled
+	}
+
+	w := &stateWriter{}
+
+	w.writeBytes(hs.protocolName)
+	w.writeBool(hs.initiator)
+	w.writeBool(hs.autoPadding)
+	w.writeBool(hs.verifyPeerStatic != nil || hs.requireVerifyPeerStatic)
+	w.writeUint64(uint64(hs.minPayloadSecurity))
+	w.writeBytes(hs.prologue)
+	w.writeUint64(uint64(hs.patternIndex))
+	w.writeUint64(uint64(hs.pskIndex))
+
+	w.writeUint64(uint64(len(hs.psks)))
+	for _, psk := range hs.psks {
+		w.writeBytes(psk[:])
+	}
+
+	// symmetric state
+	w.writeBytes(hs.ss.chainingKey)
+	w.writeBytes(hs.ss.digest)
+	w.writeCipherState(hs.ss.cs)
+
+	// rekeyer
+	w.writeBool(rk != nil)
+	if rk != nil {
+		w.writeUint64(rk.Interval())
+		w.writeBool(rk.ResetNonce())
+	}
+
+	// keys, an empty slice is written if the key is nil.
+	for _, k := range hs.keyBytes() {
+		w.writeBytes(k)
+	}
+
+	// cipher states created by Split
+	w.writeBool(hs.SendCipherState != nil)
+	if hs.SendCipherState != nil {
+		w.writeCipherState(hs.SendCipherState)
+	}
+	w.writeBool(hs.RecvCipherState != nil)
+	if hs.RecvCipherState != nil {
+		w.writeCipherState(hs.RecvCipherState)
+	}
+
+	return w.Bytes(), nil
+}
+
+// keyBytes returns the local private keys and remote public keys in a fixed
+// order, a nil is used if the key is empty.
+func (hs *HandshakeState) keyBytes() [][]byte {
+	keys := []interface{ Bytes() []byte }{
+		hs.localStatic, hs.localEphemeral,
+		hs.remoteStaticPub, hs.remoteEphemeralPub,
+		hs.localHybridEphemeral, hs.remoteHybridEphemeralPub,
+		hs.localStaticKem, hs.localEphemeralKem,
+		hs.remoteStaticKemPub, hs.remoteEphemeralKemPub,
+	}
+
+	result := make([][]byte, len(keys))
+	for i, k := range keys {
+		if k != nil {
+			result[i] = k.Bytes()
+		}
+	}
+	return result
+}
+
+// unmarshalBody decodes the fields written by marshalBody, and rebuilds the
+// handshake state.
+func (hs *HandshakeState) unmarshalBody(data []byte) error {
+	r := &stateReader{data: data}
+
+	protocolName := r.readBytes()
+	initiator := r.readBool()
+	autoPadding := r.readBool()
+	requireVerifyPeerStatic := r.readBool()
+	minPayloadSecurity := r.readUint64()
+	prologue := r.readBytes()
+	patternIndex := r.readUint64()
+	pskIndex := r.readUint64()
+
+	var psks [][CipherKeySize]byte
+	n := r.readUint64()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		var psk [CipherKeySize]byte
+		r.readArray(psk[:])
+		psks = append(psks, psk)
+	}
+
+	chainingKey := r.readBytes()
+	digest := r.readBytes()
+	if r.err != nil {
+		return r.err
+	}
+
+	// parse the protocol name to find the components
+	hsc, err := parseProtocolName(string(protocolName))
+	if err != nil {
+		return err
+	}
+	if len(chainingKey) != hsc.hash.HashLen() ||
+		len(digest) != hsc.hash.HashLen() {
+		return errMarshalDataInvalid
+	}
+
+	cs := newCipherState(hsc.cipher, nil)
+	if err := r.readCipherState(cs); err != nil {
+		return err
+	}
+
+	// recreate the default rekeyer
+	var rk rekey.Rekeyer
+	if r.readBool() {
+		interval := r.readUint64()
+		resetNonce := r.readBool()
+		if interval == 0 {
+			return errMarshalDataInvalid
+		}
+		rk = rekey.NewDefault(interval, hsc.cipher, resetNonce)
+	}
+
+	keys := make([][]byte, 10)
+	for i := range keys {
+		keys[i] = r.readBytes()
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// load the keys using the curves or the KEM
+	config := &ProtocolConfig{
+		LocalStaticPriv:    keys[0],
+		LocalEphemeralPriv: keys[1],
+		RemoteStaticPub:    keys[2],
+		RemoteEphemeralPub: keys[3],
+	}
+	if hsc.kem != nil {
+		config.LocalStaticPriv, config.LocalEphemeralPriv = keys[6], keys[7]
+		config.RemoteStaticPub, config.RemoteEphemeralPub = keys[8], keys[9]
+		err = hsc.loadKemKeys(config)
+	} else {
+		config.LocalHybridEphemeralPriv = keys[4]
+		config.RemoteHybridEphemeralPub = keys[5]
+		err = hsc.loadDHKeys(config)
+	}
+	if err != nil {
+		return err
+	}
+
+	// the cipher states created by Split
+	var send, recv *CipherState
+	if r.readBool() {
+		send = newCipherState(nil, cloneRekeyer(rk))
+		if err := r.readSplitCipherState(send, hsc.cipher.String()); err != nil {
+			return err
+		}
+	}
+	if r.readBool() {
+		recv = newCipherState(nil, cloneRekeyer(rk))
+		if err := r.readSplitCipherState(recv, hsc.cipher.String()); err != nil {
+			return err
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return errMarshalDataInvalid
+	}
+
+	// validate the indexes
+	if patternIndex > uint64(len(hsc.pattern.MessagePattern)) ||
+		pskIndex > uint64(len(psks)) {
+		return errMarshalDataInvalid
+	}
+	if requireVerifyPeerStatic && hsc.kem != nil {
+		return errMarshalDataInvalid
+	}
+	if minPayloadSecurity > 5 || checkMinPayloadSecurity(
+		int(minPayloadSecurity), hsc.pattern) != nil {
+		return errMarshalDataInvalid
+	}
+
+	ss := newSymmetricState(cs, hsc.hash, hsc.curve)
+	ss.rekeyer = rk
+	ss.hybrid = hsc.hybrid
+	ss.kem = hsc.kem
+	ss.chainingKey = chainingKey
+	ss.digest = digest
+
+	*hs = HandshakeState{
+		hp:                       hsc.pattern,
+		ss:                       ss,
+		autoPadding:              autoPadding,
+		requireVerifyPeerStatic:  requireVerifyPeerStatic,
+		minPayloadSecurity:       int(minPayloadSecurity),
+		localStatic:              hsc.s,
+		localEphemeral:           hsc.e,
+		remoteStaticPub:          hsc.rs,
+		remoteEphemeralPub:       hsc.re,
+		localHybridEphemeral:     hsc.e1,
+		remoteHybridEphemeralPub: hsc.re1,
+		localStaticKem:           hsc.ks,
+		localEphemeralKem:        hsc.ke,
+		remoteStaticKemPub:       hsc.krs,
+		remoteEphemeralKemPub:    hsc.kre,
+		initiator:                initiator,
+		patternIndex:             int(patternIndex),
+		SendCipherState:          send,
+		RecvCipherState:          recv,
+		psks:                     psks,
+		pskIndex:                 int(pskIndex),
+		prologue:                 prologue,
+		protocolName:             protocolName,
+	}
+	return nil
+}
+
+// stateWriter encodes the handshake state fields. Integers are written in big
+// endian, and byte slices are prefixed with their 4-byte length.
+type stateWriter struct {
+	bytes.Buffer
+}
+
+func (w *stateWriter) writeUint64(n uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	w.Write(b[:])
+}
+
+func (w *stateWriter) writeBool(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+func (w *stateWriter) writeBytes(data []byte) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(len(data)))
+	w.Write(b[:])
+	w.Write(data)
+}
+
+func (w *stateWriter) writeCipherState(cs *CipherState) {
+	w.writeBytes(cs.key[:])
+	w.writeUint64(cs.nonce)
+}
+
+// stateReader decodes the fields written by stateWriter. Once an error
+// occurs, the following reads return zero values, and the error is kept.
+type stateReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes.
+func (r *stateReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errMarshalDataInvalid
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *stateReader) readUint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (r *stateReader) readBool() bool {
+	b := r.next(1)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		r.err = errMarshalDataInvalid
+	}
+	return b[0] == 1
+}
+
+// readBytes returns a copy of the next length-prefixed bytes, a nil is
+// returned if it's empty.
+func (r *stateReader) readBytes() []byte {
+	b := r.next(4)
+	if b == nil {
+		return nil
+	}
+	data := r.next(int(binary.BigEndian.Uint32(b)))
+	if len(data) == 0 {
+		return nil
+	}
+	return append([]byte{}, data...)
+}
+
+// readArray reads the next length-prefixed bytes into the array, whose length
+// must match.
+func (r *stateReader) readArray(a []byte) {
+	data := r.readBytes()
+	if r.err == nil && len(data) != len(a) {
+		r.err = errMarshalDataInvalid
+	}
+	copy(a, data)
+}
+
+// readCipherState reads the key and nonce into the cipher state.
+func (r *stateReader) readCipherState(cs *CipherState) error {
+	var key [CipherKeySize]byte
+	r.readArray(key[:])
+	nonce := r.readUint64()
+	if r.err != nil {
+		return r.err
+	}
+
+	if err := cs.initializeKey(key); err != nil {
+		return err
+	}
+	cs.SetNonce(nonce)
+	return nil
+}
+
+// readSplitCipherState creates a new cipher for the cipher state, then reads
+// its key and nonce.
+func (r *stateReader) readSplitCipherState(cs *CipherState,
+	name string) error {
+	c, err := noiseCipher.FromString(name)
+	if err != nil {
+		return err
+	}
+	cs.cipher = c
+	return r.readCipherState(cs)
+}
@@ -0,0 +1,318 @@
+package babble
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+	"github.com/crypto-y/babble/dh"
+	"github.com/crypto-y/babble/kem"
+	"github.com/crypto-y/babble/rekey"
+	"github.com/stretchr/testify/require"
+)
+
+// restore marshals the handshake state and unmarshals it into a new one.
+func restore(t *testing.T, hs *HandshakeState) *HandshakeState {
+	data, err := hs.MarshalBinary()
+	require.NoError(t, err, "failed to marshal")
+
+	restored := &HandshakeState{}
+	require.NoError(t, restored.UnmarshalBinary(data), "failed to unmarshal")
+	return restored
+}
+
+func TestMarshalHandshakeState(t *testing.T) {
+	mlkem768, _ := kem.FromString("MLKEM768")
+	kemStatic, _ := mlkem768.GenerateKeyPair(nil)
+
+	testParams := []struct {
+		name   string
+		psks   [][]byte
+		rekey  *DefaultRekeyerConfig
+		static []byte
+	}{
+		{"Noise_XX_25519_ChaChaPoly_BLAKE2s", nil, nil, nil},
+		{"Noise_NX_secp256k1_AESGCM_SHA256", nil, nil, nil},
+		{"Noise_NNpsk0_448_ChaChaPoly_BLAKE2b",
+			[][]byte{bytes.Repeat([]byte{1}, 32)}, nil, nil},
+		{"Noise_XXhfs_25519+448_ChaChaPoly_SHA512", nil, nil, nil},
+		{"Noise_NN_25519_ChaChaPoly_SHA256", nil,
+			&DefaultRekeyerConfig{Interval: 10, ResetNonce: false}, nil},
+		{"Noise_pqXX_MLKEM768_ChaChaPoly_BLAKE2s", nil, nil,
+			kemStatic.Bytes()},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			newState := func(initiator bool) *HandshakeState {
+				hs, err := NewProtocolWithConfig(&ProtocolConfig{
+					Name:            tt.name,
+					Initiator:       initiator,
+					Prologue:        "YY",
+					Psks:            tt.psks,
+					autoPadding:     true,
+					RekeyerConfig:   tt.rekey,
+					LocalStaticPriv: tt.static,
+				})
+				require.NoError(err, "failed to create handshake state")
+				return hs
+			}
+			alice, bob := newState(true), newState(false)
+
+			// a freshly created state can be restored
+			alice, bob = restore(t, alice), restore(t, bob)
+
+			// run the handshake, restore both parties after each message
+			sender, receiver := alice, bob
+			for !sender.Finished() {
+				ciphertext, err := sender.WriteMessage([]byte("yy"))
+				require.NoError(err, "failed to write message")
+
+				plaintext, err := receiver.ReadMessage(ciphertext)
+				require.NoError(err, "failed to read message")
+				require.Equal([]byte("yy"), plaintext, "payload not match")
+
+				sender, receiver = restore(t, receiver), restore(t, sender)
+			}
+			if sender.initiator {
+				alice, bob = sender, receiver
+			} else {
+				alice, bob = receiver, sender
+			}
+
+			require.True(bob.Finished(), "bob must be finished")
+			require.Equal(alice.GetDigest(), bob.GetDigest(),
+				"handshake digest not match")
+			require.Equal(tt.name, string(alice.protocolName),
+				"protocol name not match")
+
+			// the transport cipher states are restored
+			ciphertext, err := alice.SendCipherState.EncryptWithAd(
+				nil, []byte("yy"))
+			require.NoError(err, "failed to encrypt")
+			alice, bob = restore(t, alice), restore(t, bob)
+			plaintext, err := bob.RecvCipherState.DecryptWithAd(
+				nil, ciphertext)
+			require.NoError(err, "failed to decrypt")
+			require.Equal([]byte("yy"), plaintext, "payload not match")
+			require.Equal(alice.SendCipherState.Nonce(),
+				bob.RecvCipherState.Nonce(), "nonce not match")
+
+			if tt.rekey != nil {
+				rk := bob.RecvCipherState.RekeyManger
+				require.Equal(tt.rekey.Interval, rk.Interval(),
+					"rekey interval not match")
+				require.Equal(tt.rekey.ResetNonce, rk.ResetNonce(),
+					"rekey reset nonce not match")
+			}
+		})
+	}
+}
+
+func TestMarshalHandshakeStateWithKey(t *testing.T) {
+	require := require.New(t)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	alice, err := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s", "", true)
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s", "", false)
+	require.NoError(err, "failed to create bob")
+
+	ciphertext, err := alice.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+
+	// a wrong key size is rejected
+	_, err = alice.MarshalBinaryWithKey(key[:1])
+	require.Equal(errMarshalKeySize, err, "error not match")
+
+	data, err := alice.MarshalBinaryWithKey(key)
+	require.NoError(err, "failed to marshal")
+	plain, err := alice.MarshalBinary()
+	require.NoError(err, "failed to marshal")
+	require.False(bytes.Contains(data, alice.localEphemeral.Bytes()),
+		"private key must be encrypted")
+
+	// the encrypted and plain formats cannot be mixed
+	hs := &HandshakeState{}
+	require.Equal(errMarshalEncrypted, hs.UnmarshalBinary(data),
+		"error not match")
+	require.Equal(errMarshalNotEncrypted,
+		hs.UnmarshalBinaryWithKey(key, plain), "error not match")
+
+	// a wrong key, a wrong key size, or a modified header fails
+	wrongKey := bytes.Repeat([]byte{2}, 32)
+	require.Equal(errMarshalDataCorrupt,
+		hs.UnmarshalBinaryWithKey(wrongKey, data), "error not match")
+	require.Equal(errMarshalKeySize,
+		hs.UnmarshalBinaryWithKey(key[:1], data), "error not match")
+	require.Equal(errMarshalDataInvalid,
+		hs.UnmarshalBinaryWithKey(key, data[:10]), "error not match")
+	modified := append([]byte{}, data...)
+	modified[1] |= 2
+	require.Equal(errMarshalDataCorrupt,
+		hs.UnmarshalBinaryWithKey(key, modified), "error not match")
+
+	// restore alice and finish the handshake
+	require.NoError(hs.UnmarshalBinaryWithKey(key, data),
+		"failed to unmarshal")
+	_, err = bob.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	ciphertext, err = bob.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	_, err = hs.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	require.Equal(bob.GetDigest(), hs.GetDigest(), "digest not match")
+}
+
+func TestMarshalHandshakeStateDestroyed(t *testing.T) {
+	require := require.New(t)
+	key := bytes.Repeat([]byte{1}, 32)
+
+	// a zero value handshake state
+	hs := &HandshakeState{}
+	_, err := hs.MarshalBinary()
+	require.Equal(errMarshalNoState, err, "error not match")
+
+	// a destroyed handshake state
+	alice, err := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s", "", true)
+	require.NoError(err, "failed to create alice")
+	alice.Destroy()
+	_, err = alice.MarshalBinary()
+	require.Equal(errMarshalNoState, err, "error not match")
+	_, err = alice.MarshalBinaryWithKey(key)
+	require.Equal(errMarshalNoState, err, "error not match")
+}
+
+func TestMarshalHandshakeStateRekeyer(t *testing.T) {
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+	combined, _ := rekey.Any(rekey.NewDefault(10, c, true),
+		rekey.NewBytes(100, c, true))
+	testParams := []struct {
+		name    string
+		rekeyer rekey.Rekeyer
+		err     error
+	}{
+		{"default", rekey.NewDefault(10, c, true), nil},
+		{"bytes", rekey.NewBytes(100, c, false), errRekeyerNotMarshaled},
+		{"time", rekey.NewTime(time.Minute, c, false, nil),
+			errRekeyerNotMarshaled},
+		{"combined", combined, errRekeyerNotMarshaled},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hs, err := NewProtocolWithConfig(&ProtocolConfig{
+				Name:      "Noise_NN_25519_ChaChaPoly_BLAKE2s",
+				Initiator: true,
+				Rekeyer:   tt.rekeyer,
+			})
+			require.NoError(t, err, "failed to create handshake state")
+
+			// the rekeyer is never dropped silently.
+			_, err = hs.MarshalBinary()
+			require.Equal(t, tt.err, err, "error not match")
+			_, err = hs.MarshalBinaryWithKey(bytes.Repeat([]byte{1}, 32))
+			require.Equal(t, tt.err, err, "error not match")
+		})
+	}
+}
+
+func TestMarshalVerifyPeerStatic(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+
+	var verified []byte
+	accept := func(pub dh.PublicKey, payload []byte) error {
+		verified = pub.Bytes()
+		return nil
+	}
+	errRejected := errors.New("rejected")
+	reject := func(pub dh.PublicKey, payload []byte) error {
+		return errRejected
+	}
+
+	alice, _ := NewProtocol(name, "", true)
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:             name,
+		VerifyPeerStatic: accept,
+		autoPadding:      true,
+	})
+	require.NoError(err, "failed to create handshake state")
+
+	ciphertext, err := alice.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	_, err = bob.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	ciphertext, err = bob.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	_, err = alice.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	ciphertext, err = alice.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+
+	// the restored state fails closed until the callback is set again, and
+	// the requirement is kept by marshaling it again.
+	restored := restore(t, restore(t, bob))
+	_, err = restored.ReadMessage(ciphertext)
+	require.Equal(ErrMissingVerifyPeerStatic, err, "error not match")
+
+	restored = restore(t, bob)
+	require.NoError(restored.SetVerifyPeerStatic(reject),
+		"failed to set callback")
+	_, err = restored.ReadMessage(ciphertext)
+	require.Equal(errRejected, err, "error not match")
+
+	restored = restore(t, bob)
+	require.NoError(restored.SetVerifyPeerStatic(accept),
+		"failed to set callback")
+	_, err = restored.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	require.Equal(alice.localStatic.PubKey().Bytes(), verified,
+		"remote static key not match")
+
+	// a state without the callback is restored as it is.
+	_, err = restore(t, alice).ReadMessage(nil)
+	require.NotEqual(ErrMissingVerifyPeerStatic, err, "error not match")
+}
+
+func TestUnmarshalHandshakeStateError(t *testing.T) {
+	alice, _ := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s", "", true)
+	data, _ := alice.MarshalBinary()
+
+	// replace the protocol name with an unsupported one
+	unknown := append([]byte{}, data...)
+	copy(unknown[6:], "Noise_YY")
+	_, errUnknown := parseProtocolName(string(unknown[6:39]))
+
+	// an out of range pattern index, which follows the protocol name, three
+	// bools, the minimum payload security and the empty prologue.
+	badIndex := append([]byte{}, data...)
+	offset := marshalHeaderSize + 4 + len(alice.protocolName) + 3 + 8 + 4
+	badIndex[offset+7] = 3
+
+	testParams := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty data", nil, errMarshalDataInvalid},
+		{"wrong version", []byte{marshalVersion + 1, 0},
+			errUnsupportedVersion},
+		{"truncated data", data[:len(data)-1], errMarshalDataInvalid},
+		{"extra data", append(data, 0), errMarshalDataInvalid},
+		{"unsupported pattern", unknown, errUnknown},
+		{"invalid pattern index", badIndex, errMarshalDataInvalid},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hs := &HandshakeState{}
+			err := hs.UnmarshalBinary(tt.data)
+			require.Equal(t, tt.err, err, "error not match")
+		})
+	}
+}
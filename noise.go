@@ -2,9 +2,11 @@
 //  https://noiseprotocol.org/
 // Supported patterns:
 //  3 oneway patterns, 12 interactive patterns and 23 deffered patterns, with
-//  PSK mode supported.
+//  PSK, fallback and hfs modes supported.
 // Supported dh curves:
 //  curve448, curve25519 and secp256k1
+// Supported KEMs, used by the PQNoise patterns:
+//  ML-KEM-768
 // Supported ciphers:
 //  ChaCha20-Poly1305 and AESGCM
 // Supported hash functions:
@@ -19,6 +21,7 @@ import (
 	"github.com/crypto-y/babble/cipher"
 	"github.com/crypto-y/babble/dh"
 	"github.com/crypto-y/babble/hash"
+	"github.com/crypto-y/babble/kem"
 	"github.com/crypto-y/babble/pattern"
 	"github.com/crypto-y/babble/rekey"
 )
@@ -45,6 +48,30 @@ var (
 
 	// ErrProtocolInvalidName is returned when protocol name is wrong.
 	ErrProtocolInvalidName = errors.New("invalid protocol name")
+
+	// ErrHybridMismatch is returned when a hybrid dh curve is specified
+	// without using the hfs modifier, or vice versa.
+	ErrHybridMismatch = errors.New("hybrid dh curve must be used with hfs")
+
+	// ErrKemMismatch is returned when a KEM is specified with a DH pattern, or
+	// a dh curve or the VerifyPeerStatic callback is specified with a KEM
+	// pattern.
+	ErrKemMismatch = errors.New("KEM must be used with KEM patterns")
+
+	// ErrInvalidPayloadSecurity is returned when the MinPayloadSecurity is
+	// not from 0 to 5.
+	ErrInvalidPayloadSecurity = errors.New(
+		"payload security must be from 0 to 5")
+
+	// ErrInsecurePayload is returned by WriteMessage when a non-empty payload
+	// doesn't meet the MinPayloadSecurity.
+	ErrInsecurePayload = errors.New("payload security is below the minimum")
+
+	// ErrMissingVerifyPeerStatic is returned by ReadMessage when the handshake
+	// state is restored from a state using VerifyPeerStatic, and the callback
+	// hasn't been set again using SetVerifyPeerStatic.
+	ErrMissingVerifyPeerStatic = errors.New(
+		"VerifyPeerStatic must be set on the restored handshake state")
 )
 
 // DefaultRekeyerConfig is used for creating the default rekey manager.
@@ -77,11 +104,14 @@ type ProtocolConfig struct {
 	RekeyerConfig *DefaultRekeyerConfig
 
 	// Rekeyer is a rekey manager, which controls when/how a rekey should be
-	// performed, and whether the cipher nonce should be reset.
+	// performed, and whether the cipher nonce should be reset. It's only used
+	// by the transport cipher states created by Split, each of which has its
+	// own clone, the handshake messages are never rekeyed.
 	Rekeyer rekey.Rekeyer
 
 	// LocalStaticPriv is the s from the noise spec. Only provide it when it's
-	// needed by the message pattern, otherwise leave it empty.
+	// needed by the message pattern, otherwise leave it empty. When a KEM is
+	// used, the four keys below are loaded as KEM keys.
 	LocalStaticPriv []byte
 
 	// LocalEphemeralPriv is the e from the noise spec. Only provide it when
@@ -96,10 +126,37 @@ type ProtocolConfig struct {
 	// it's needed by the message pattern, otherwise leave it empty.
 	RemoteEphemeralPub []byte
 
+	// LocalHybridEphemeralPriv is the e1 from the hfs extension specs. Only
+	// provide it when the hfs modifier is used, otherwise leave it empty.
+	LocalHybridEphemeralPriv []byte
+
+	// RemoteHybridEphemeralPub is the re1 from the hfs extension specs. Only
+	// provide it when it's needed by the pre-message of a fallback pattern
+	// using the hfs modifier, otherwise leave it empty.
+	RemoteHybridEphemeralPub []byte
+
 	// Psks is used to store the pre-shared symmetric keys used if both parties
 	// have a 32-byte shared secret keys.
 	Psks [][]byte
 
+	// VerifyPeerStatic is an optional callback used to authenticate the remote
+	// static key received during the handshake. It's first called with a nil
+	// payload as soon as the remote static key is decrypted, then called again
+	// with the decrypted payload of the same message, which is non-nil. If an
+	// error is returned, ReadMessage aborts with the error, so no further
+	// message is sent to an unauthorized peer. It's not called for the remote
+	// static key provided via the pre-message. The KEM patterns don't transmit
+	// a dh static key, so ErrKemMismatch is returned if it's set with them.
+	VerifyPeerStatic func(pub dh.PublicKey, payload []byte) error
+
+	// MinPayloadSecurity is the minimum destination property, from 0 to 5 as
+	// defined in the section 7.7 of the noise specs, required by the
+	// non-empty payloads of the handshake messages. WriteMessage refuses a
+	// non-empty payload if the message has a lower property, which is given
+	// by HandshakeState.PayloadSecurity. The default 0 allows any payload. It
+	// cannot be used with the KEM patterns, which are not analyzed.
+	MinPayloadSecurity int
+
 	// autoPadding is for internal usage, if true, required local keys will be
 	// created automatically.
 	autoPadding bool
@@ -111,13 +168,22 @@ type handshakeConfig struct {
 	prologue     []byte
 	pattern      *pattern.HandshakePattern
 	curve        dh.Curve
+	hybrid       dh.Curve
+	kem          kem.KEM
 	cipher       cipher.AEAD
 	hash         hash.Hash
 
-	e  dh.PrivateKey
-	s  dh.PrivateKey
-	re dh.PublicKey
-	rs dh.PublicKey
+	e   dh.PrivateKey
+	s   dh.PrivateKey
+	re  dh.PublicKey
+	rs  dh.PublicKey
+	e1  dh.PrivateKey
+	re1 dh.PublicKey
+
+	ks  kem.PrivateKey
+	ke  kem.PrivateKey
+	krs kem.PublicKey
+	kre kem.PublicKey
 }
 
 // NewProtocol creates a new handshake state with the specified name prologue,
@@ -195,51 +261,153 @@ func NewProtocolWithConfig(config *ProtocolConfig) (*HandshakeState, error) {
 		rk = config.Rekeyer
 	}
 
+	if err := checkMinPayloadSecurity(
+		config.MinPayloadSecurity, hsc.pattern); err != nil {
+		return nil, err
+	}
+
+	// the callback would never be called with the KEM static keys.
+	if config.VerifyPeerStatic != nil && hsc.kem != nil {
+		return nil, ErrKemMismatch
+	}
+
 	// parse related keys
+	if hsc.kem != nil {
+		err = hsc.loadKemKeys(config)
+	} else {
+		err = hsc.loadDHKeys(config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hsc.protocolName = []byte(config.Name)
+	hsc.prologue = []byte(config.Prologue)
+
+	// create cipher state, symmetric state and handshake state
+	cs := newCipherState(hsc.cipher, nil)
+	ss := newSymmetricState(cs, hsc.hash, hsc.curve)
+	ss.hybrid = hsc.hybrid
+	ss.kem = hsc.kem
+	ss.rekeyer = rk
+	hs, err := newHandshakeState(
+		hsc.protocolName, hsc.prologue,
+		config.Psks, config.Initiator, ss, hsc.pattern,
+		hsc.s, hsc.e, hsc.rs, hsc.re, hsc.e1, hsc.re1,
+		hsc.ks, hsc.ke, hsc.krs, hsc.kre, config.autoPadding)
+	if err != nil {
+		return nil, err
+	}
+	hs.verifyPeerStatic = config.VerifyPeerStatic
+	hs.minPayloadSecurity = config.MinPayloadSecurity
+
+	return hs, nil
+}
+
+// checkMinPayloadSecurity checks the minimum payload security is in range, and
+// the pattern can be analyzed if it's used.
+func checkMinPayloadSecurity(min int, hp *pattern.HandshakePattern) error {
+	if min < 0 || min > 5 {
+		return ErrInvalidPayloadSecurity
+	}
+	if min == 0 {
+		return nil
+	}
+	_, err := pattern.Analyze(hp)
+	return err
+}
+
+// loadDHKeys loads the keys from the config using the dh curves.
+func (hsc *handshakeConfig) loadDHKeys(config *ProtocolConfig) error {
 	if config.LocalStaticPriv != nil {
 		s, err := hsc.curve.LoadPrivateKey(config.LocalStaticPriv)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		hsc.s = s
 	}
 	if config.LocalEphemeralPriv != nil {
 		e, err := hsc.curve.LoadPrivateKey(config.LocalEphemeralPriv)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		hsc.e = e
 	}
 	if config.RemoteEphemeralPub != nil {
 		re, err := hsc.curve.LoadPublicKey(config.RemoteEphemeralPub)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		hsc.re = re
 	}
 	if config.RemoteStaticPub != nil {
 		rs, err := hsc.curve.LoadPublicKey(config.RemoteStaticPub)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		hsc.rs = rs
 	}
+	if config.LocalHybridEphemeralPriv != nil {
+		if hsc.hybrid == nil {
+			return ErrHybridMismatch
+		}
+		e1, err := hsc.hybrid.LoadPrivateKey(config.LocalHybridEphemeralPriv)
+		if err != nil {
+			return err
+		}
+		hsc.e1 = e1
+	}
+	if config.RemoteHybridEphemeralPub != nil {
+		if hsc.hybrid == nil {
+			return ErrHybridMismatch
+		}
+		re1, err := hsc.hybrid.LoadPublicKey(config.RemoteHybridEphemeralPub)
+		if err != nil {
+			return err
+		}
+		hsc.re1 = re1
+	}
 
-	hsc.protocolName = []byte(config.Name)
-	hsc.prologue = []byte(config.Prologue)
+	return nil
+}
 
-	// create cipher state, symmetric state and handshake state
-	cs := newCipherState(hsc.cipher, rk)
-	ss := newSymmetricState(cs, hsc.hash, hsc.curve)
-	hs, err := newHandshakeState(
-		hsc.protocolName, hsc.prologue,
-		config.Psks, config.Initiator, ss, hsc.pattern,
-		hsc.s, hsc.e, hsc.rs, hsc.re, config.autoPadding)
-	if err != nil {
-		return nil, err
+// loadKemKeys loads the keys from the config using the KEM.
+func (hsc *handshakeConfig) loadKemKeys(config *ProtocolConfig) error {
+	// hybrid keys are not used by KEM patterns.
+	if config.LocalHybridEphemeralPriv != nil ||
+		config.RemoteHybridEphemeralPub != nil {
+		return ErrHybridMismatch
 	}
 
-	return hs, nil
+	if config.LocalStaticPriv != nil {
+		s, err := hsc.kem.LoadPrivateKey(config.LocalStaticPriv)
+		if err != nil {
+			return err
+		}
+		hsc.ks = s
+	}
+	if config.LocalEphemeralPriv != nil {
+		e, err := hsc.kem.LoadPrivateKey(config.LocalEphemeralPriv)
+		if err != nil {
+			return err
+		}
+		hsc.ke = e
+	}
+	if config.RemoteEphemeralPub != nil {
+		re, err := hsc.kem.LoadPublicKey(config.RemoteEphemeralPub)
+		if err != nil {
+			return err
+		}
+		hsc.kre = re
+	}
+	if config.RemoteStaticPub != nil {
+		rs, err := hsc.kem.LoadPublicKey(config.RemoteStaticPub)
+		if err != nil {
+			return err
+		}
+		hsc.krs = rs
+	}
+	return nil
 }
 
 func errInvalidComponent(c string) error {
@@ -247,7 +415,11 @@ func errInvalidComponent(c string) error {
 }
 
 // parseProtocolName takes a full protocol name and parse out the four
-// components - pattern, curve, hash and cipher.
+// components - pattern, curve, hash and cipher. When the hfs modifier is used,
+// the curve component is made of two curves joined by a "+", e.g., 25519+448,
+// in which the second one is the hybrid curve used by the "e1" and "ee1"
+// tokens. When a PQNoise pattern is used, the curve component is replaced by a
+// KEM, e.g., Noise_pqXX_MLKEM768_ChaChaPoly_BLAKE2s.
 func parseProtocolName(s string) (*handshakeConfig, error) {
 	components := strings.Split(s, "_")
 	if len(components) != 5 || components[0] != NoisePrefix {
@@ -260,11 +432,34 @@ func parseProtocolName(s string) (*handshakeConfig, error) {
 		return nil, errInvalidComponent(components[1])
 	}
 
-	// find dh curve
-	d, _ := dh.FromString(components[2])
-	if d == nil {
+	// find KEM if it's a PQNoise pattern
+	k, _ := kem.FromString(components[2])
+	if (k != nil) != p.KemMode() {
+		return nil, ErrKemMismatch
+	}
+
+	// find dh curve and the hybrid curve if specified
+	curves := strings.Split(components[2], "+")
+	if len(curves) > 2 {
 		return nil, errInvalidComponent(components[2])
 	}
+	d, _ := dh.FromString(curves[0])
+	if d == nil && k == nil {
+		return nil, errInvalidComponent(curves[0])
+	}
+	var hybrid dh.Curve
+	if len(curves) == 2 {
+		hybrid, _ = dh.FromString(curves[1])
+		if hybrid == nil {
+			return nil, errInvalidComponent(curves[1])
+		}
+	}
+
+	// the hybrid curve must be used with the hfs modifier
+	hfs := p.Modifier != nil && p.Modifier.Hfs
+	if hfs != (hybrid != nil) {
+		return nil, ErrHybridMismatch
+	}
 
 	// find cipher
 	c, _ := cipher.FromString(components[3])
@@ -281,6 +476,8 @@ func parseProtocolName(s string) (*handshakeConfig, error) {
 	return &handshakeConfig{
 		pattern: p,
 		curve:   d,
+		hybrid:  hybrid,
+		kem:     k,
 		hash:    h,
 		cipher:  c,
 	}, nil
@@ -63,6 +63,24 @@ func TestNewProtocolWithConfig(t *testing.T) {
 			RemoteEphemeralPub: []byte{0},
 		}, errors.New("public key is wrong: want 32 bytes, got 1 bytes"),
 			testInterval, testResetNonce},
+		{"return error when loading hybrid key without hfs", &ProtocolConfig{
+			Name:                     name,
+			LocalHybridEphemeralPriv: key[:],
+		}, ErrHybridMismatch, testInterval, testResetNonce},
+		{"return error when loading remote hybrid ephemeral", &ProtocolConfig{
+			Name:                     "Noise_NNhfs_25519+448_AESGCM_SHA256",
+			RemoteHybridEphemeralPub: []byte{0},
+		}, errors.New("public key is wrong: want 56 bytes, got 1 bytes"),
+			testInterval, testResetNonce},
+		{"return error when loading KEM static", &ProtocolConfig{
+			Name:            "Noise_pqXX_MLKEM768_AESGCM_SHA256",
+			LocalStaticPriv: key[:],
+		}, errors.New("private key is wrong: want 64 bytes, got 32 bytes"),
+			testInterval, testResetNonce},
+		{"return error when loading hybrid key with KEM", &ProtocolConfig{
+			Name:                     "Noise_pqXX_MLKEM768_AESGCM_SHA256",
+			LocalHybridEphemeralPriv: key[:],
+		}, ErrHybridMismatch, testInterval, testResetNonce},
 		{"return error when missing keys", &ProtocolConfig{
 			Name:      name,
 			Initiator: true,
@@ -104,10 +122,10 @@ func TestNewProtocolWithConfig(t *testing.T) {
 			} else {
 				require.NotNil(t, hs, "should return an hs")
 				require.Equal(t, tt.intervalExpected,
-					hs.ss.cs.RekeyManger.Interval(),
+					hs.ss.rekeyer.Interval(),
 					"rekey interval not match")
 				require.Equal(t, tt.resetNonceExpected,
-					hs.ss.cs.RekeyManger.ResetNonce(),
+					hs.ss.rekeyer.ResetNonce(),
 					"rekey reset nonce not match")
 			}
 
@@ -144,10 +162,10 @@ func TestNewProtocol(t *testing.T) {
 			} else {
 				require.NotNil(t, hs, "hs should be created")
 				require.Equal(t, tt.intervalExpected,
-					hs.ss.cs.RekeyManger.Interval(),
+					hs.ss.rekeyer.Interval(),
 					"rekey interval not match")
 				require.Equal(t, tt.resetNonceExpected,
-					hs.ss.cs.RekeyManger.ResetNonce(),
+					hs.ss.rekeyer.ResetNonce(),
 					"rekey reset nonce not match")
 			}
 		})
@@ -199,6 +217,42 @@ func TestParseProtocolName(t *testing.T) {
 			errInvalidComponent(unsupported),
 			nil,
 		},
+		{
+			"parse name with unsupported hybrid curve",
+			"Noise_XXhfs_25519+YXY_AESGCM_SHA256",
+			errInvalidComponent(unsupported),
+			nil,
+		},
+		{
+			"parse name with too many curves",
+			"Noise_XXhfs_25519+448+448_AESGCM_SHA256",
+			errInvalidComponent("25519+448+448"),
+			nil,
+		},
+		{
+			"parse name with hybrid curve but no hfs",
+			"Noise_XX_25519+448_AESGCM_SHA256",
+			ErrHybridMismatch,
+			nil,
+		},
+		{
+			"parse name with hfs but no hybrid curve",
+			"Noise_XXhfs_25519_AESGCM_SHA256",
+			ErrHybridMismatch,
+			nil,
+		},
+		{
+			"parse name with KEM but DH pattern",
+			"Noise_XX_MLKEM768_AESGCM_SHA256",
+			ErrKemMismatch,
+			nil,
+		},
+		{
+			"parse name with DH curve but KEM pattern",
+			"Noise_pqXX_25519_AESGCM_SHA256",
+			ErrKemMismatch,
+			nil,
+		},
 		{
 			"parse name with unsupported cipher",
 			"Noise_XX_25519_YXY_SHA256",
@@ -241,4 +295,18 @@ func TestParseProtocolName(t *testing.T) {
 	c, err := parseProtocolName(name)
 	require.NoError(t, err, "should have no error")
 	require.Equal(t, "XXfallback+psk0", c.pattern.String(), "pattern not match")
+
+	// parse a protocol name with a hybrid curve
+	name = "Noise_XXhfs_25519+448_AESGCM_SHA256"
+	c, err = parseProtocolName(name)
+	require.NoError(t, err, "should have no error")
+	require.Equal(t, "25519", c.curve.String(), "curve not match")
+	require.Equal(t, "448", c.hybrid.String(), "hybrid curve not match")
+
+	// parse a protocol name with a KEM
+	name = "Noise_pqXX_MLKEM768_AESGCM_SHA256"
+	c, err = parseProtocolName(name)
+	require.NoError(t, err, "should have no error")
+	require.Nil(t, c.curve, "should have no curve")
+	require.Equal(t, "MLKEM768", c.kem.String(), "KEM not match")
 }
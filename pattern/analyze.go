@@ -0,0 +1,271 @@
+package pattern
+
+import "github.com/pkg/errors"
+
+// NoIdentity is the identity hiding level of a party without a static key.
+const NoIdentity = -1
+
+var errKemAnalysis = errors.New(
+	"security analysis is not supported for KEM patterns")
+
+// PayloadSecurity holds the security properties of a payload, as defined in
+// the section 7.7 of the noise specs.
+//
+// The source properties describe the authentication of the sender,
+//  0. No authentication.
+//  1. Sender authentication vulnerable to key-compromise impersonation (KCI),
+//     based only on the static-static DH.
+//  2. Sender authentication resistant to KCI, based on a DH between the
+//     sender's static key and the recipient's ephemeral key.
+//
+// The destination properties describe the confidentiality of the payload,
+//  0. No confidentiality.
+//  1. Encryption to an ephemeral recipient, which is forward secret, but the
+//     recipient is not authenticated.
+//  2. Encryption to a known recipient, forward secrecy for sender compromise
+//     only, vulnerable to replay.
+//  3. Encryption to a known recipient, weak forward secrecy, as the binding
+//     between the recipient's ephemeral and static keys is not verified.
+//  4. Encryption to a known recipient, weak forward secrecy if the sender's
+//     private key has been compromised.
+//  5. Encryption to a known recipient, strong forward secrecy.
+type PayloadSecurity struct {
+	// Sender is the direction token of the message, TokenInitiator if it's
+	// sent by the initiator, otherwise TokenResponder.
+	Sender Token
+
+	// Source is the source property, from 0 to 2.
+	Source int
+
+	// Destination is the destination property, from 0 to 5.
+	Destination int
+}
+
+// Analysis holds the security properties of a handshake pattern.
+//
+// The identity hiding levels describe how well the static public key of each
+// party is hidden, as defined in the section 7.8 of the noise specs,
+//  0. Transmitted in clear.
+//  1. Encrypted with forward secrecy, but can be probed by an anonymous
+//     initiator.
+//  2. Encrypted with forward secrecy, but sent to an anonymous responder.
+//  3. Not transmitted, but a passive attacker can check candidates for the
+//     responder's private key.
+//  4. Encrypted to the responder's static public key, without forward
+//     secrecy.
+//  5. Not transmitted, but a passive attacker can check candidates for the
+//     pair of the responder's private key and the initiator's public key.
+//  6. Encrypted but with weak forward secrecy.
+//  7. Not transmitted, but an active attacker who pretends to be the
+//     initiator, then later learns a candidate for the initiator's private
+//     key, can check whether the candidate is correct.
+//  8. Encrypted with forward secrecy to an authenticated party.
+//
+// NoIdentity is used if the party has no static key.
+type Analysis struct {
+	// Messages holds the properties of the payloads of the handshake
+	// messages, in the order of the MessagePattern.
+	Messages []PayloadSecurity
+
+	// Transport holds the properties of the transport payloads, starting
+	// from the party who doesn't send the last handshake message, followed
+	// by the other party. For the one-way patterns, only the initiator sends.
+	Transport []PayloadSecurity
+
+	// InitiatorIdentity and ResponderIdentity are the identity hiding levels
+	// of the static keys.
+	InitiatorIdentity int
+	ResponderIdentity int
+}
+
+// analyzer tracks the keys sent and the DHs performed while walking through a
+// handshake, which is used by Analyze.
+type analyzer struct {
+	// sent holds the public keys sent by each party, including the ones in
+	// the pre-messages.
+	sent map[partyToken]bool
+
+	// done holds the DH tokens performed.
+	done map[Token]bool
+
+	// binding holds, for each party, the destination property of its
+	// payloads once the remote ephemeral and static keys are bound, which is
+	// 3 until a message verifying the binding is received.
+	binding map[Token]int
+
+	// identity holds the identity hiding level of each party whose static
+	// key is transmitted.
+	identity map[Token]int
+}
+
+// Analyze computes the security properties of the payloads and the identity
+// hiding levels of the handshake pattern, following the definitions in the
+// noise specs. It works for both the built-in and the registered patterns.
+//
+// Only the DH tokens are considered, so the properties are lower bounds for
+// the patterns using the psk modifier, and the hfs tokens don't change them.
+// An error is returned for the PQNoise patterns, which use the KEM tokens.
+func Analyze(hp *HandshakePattern) (*Analysis, error) {
+	if hp.KemMode() {
+		return nil, errKemAnalysis
+	}
+
+	a := &analyzer{
+		sent: map[partyToken]bool{},
+		done: map[Token]bool{},
+		binding: map[Token]int{
+			TokenInitiator: 3,
+			TokenResponder: 3,
+		},
+		identity: map[Token]int{},
+	}
+	for _, line := range hp.PreMessagePattern {
+		for _, t := range line[1:] {
+			a.sent[partyToken{line[0], t}] = true
+		}
+	}
+
+	result := &Analysis{}
+	for _, line := range hp.MessagePattern {
+		result.Messages = append(result.Messages, a.message(line))
+	}
+
+	// the transport messages continue alternating after the handshake.
+	last := hp.MessagePattern[len(hp.MessagePattern)-1][0]
+	senders := []Token{otherParty(last), last}
+	if len(hp.MessagePattern) == 1 && last == TokenInitiator {
+		senders = []Token{TokenInitiator}
+	}
+	for _, sender := range senders {
+		result.Transport = append(result.Transport,
+			a.message(patternLine{sender}))
+	}
+
+	result.InitiatorIdentity = a.identityLevel(hp, TokenInitiator)
+	result.ResponderIdentity = a.identityLevel(hp, TokenResponder)
+	return result, nil
+}
+
+// message processes the tokens of the line, and returns the properties of its
+// payload, which is encrypted once all the tokens are processed.
+func (a *analyzer) message(line patternLine) PayloadSecurity {
+	sender := line[0]
+	for _, t := range line[1:] {
+		switch t {
+		case TokenE, TokenE1:
+			a.sent[partyToken{sender, t}] = true
+
+		case TokenS:
+			// the static key is encrypted using the current key.
+			a.identity[sender] = staticIdentity(sender, a.destination(sender))
+			a.sent[partyToken{sender, t}] = true
+
+		case TokenEe, TokenEs, TokenSe, TokenSs:
+			a.done[t] = true
+		}
+	}
+
+	security := PayloadSecurity{
+		Sender:      sender,
+		Source:      a.source(sender),
+		Destination: a.destination(sender),
+	}
+	a.receive(otherParty(sender))
+	return security
+}
+
+// source returns the source property of the payload sent by the party.
+func (a *analyzer) source(party Token) int {
+	switch {
+	case a.done[dhToken(party, TokenS, TokenE)]:
+		return 2
+	case a.done[TokenSs]:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// destination returns the destination property of the payload sent by the
+// party.
+func (a *analyzer) destination(party Token) int {
+	toStatic := a.done[dhToken(party, TokenE, TokenS)] || a.done[TokenSs]
+	switch {
+	case !a.done[TokenEe] && toStatic:
+		return 2
+	case !a.done[TokenEe]:
+		return 0
+	case !a.done[dhToken(party, TokenE, TokenS)]:
+		return 1
+	default:
+		return a.binding[party]
+	}
+}
+
+// receive updates the binding of the remote keys once the party receives a
+// message authenticated by them.
+func (a *analyzer) receive(party Token) {
+	remote := otherParty(party)
+
+	// a DH between the remote static key and the local ephemeral key, plus a
+	// DH using the remote ephemeral key.
+	remoteE := a.done[TokenEe] || a.done[dhToken(remote, TokenE, TokenS)]
+	if a.done[dhToken(remote, TokenS, TokenE)] && remoteE {
+		a.binding[party] = 5
+		return
+	}
+
+	// both DHs involve the local static key.
+	if a.done[TokenSs] && a.done[dhToken(remote, TokenE, TokenS)] &&
+		a.binding[party] < 4 {
+		a.binding[party] = 4
+	}
+}
+
+// identityLevel returns the identity hiding level of the party.
+func (a *analyzer) identityLevel(hp *HandshakePattern, party Token) int {
+	if level, ok := a.identity[party]; ok {
+		return level
+	}
+	if !a.sent[partyToken{party, TokenS}] {
+		return NoIdentity
+	}
+
+	// the static key is known from the pre-message.
+	remoteKnown := false
+	for _, line := range hp.PreMessagePattern {
+		for _, t := range line[1:] {
+			if line[0] == otherParty(party) && t == TokenS {
+				remoteKnown = true
+			}
+		}
+	}
+	switch {
+	case a.done[TokenSs] && remoteKnown:
+		return 5
+	case party == TokenResponder:
+		return 3
+	default:
+		return 7
+	}
+}
+
+// staticIdentity returns the identity hiding level of a static key sent by the
+// party, which is encrypted with the destination property.
+func staticIdentity(party Token, destination int) int {
+	switch destination {
+	case 0:
+		return 0
+	case 1:
+		if party == TokenInitiator {
+			return 2
+		}
+		return 1
+	case 2:
+		return 4
+	case 3, 4:
+		return 6
+	default:
+		return 8
+	}
+}
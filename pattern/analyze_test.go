@@ -0,0 +1,129 @@
+package pattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyze(t *testing.T) {
+	// the expected properties are taken from the tables in the section 7.7
+	// and 7.8 of the noise specs. Each pair is the source and destination
+	// properties of a payload.
+	testParams := []struct {
+		name      string
+		messages  [][2]int
+		transport [][2]int
+		initiator int
+		responder int
+	}{
+		{"N", [][2]int{{0, 2}}, [][2]int{{0, 2}}, NoIdentity, 3},
+		{"K", [][2]int{{1, 2}}, [][2]int{{1, 2}}, 5, 5},
+		{"X", [][2]int{{1, 2}}, [][2]int{{1, 2}}, 4, 3},
+		{"NN", [][2]int{{0, 0}, {0, 1}}, [][2]int{{0, 1}, {0, 1}},
+			NoIdentity, NoIdentity},
+		{"NK", [][2]int{{0, 2}, {2, 1}}, [][2]int{{0, 5}, {2, 1}},
+			NoIdentity, 3},
+		{"NX", [][2]int{{0, 0}, {2, 1}}, [][2]int{{0, 5}, {2, 1}},
+			NoIdentity, 1},
+		{"XN", [][2]int{{0, 0}, {0, 1}, {2, 1}}, [][2]int{{0, 5}, {2, 1}},
+			2, NoIdentity},
+		{"XK", [][2]int{{0, 2}, {2, 1}, {2, 5}}, [][2]int{{2, 5}, {2, 5}},
+			8, 3},
+		{"XX", [][2]int{{0, 0}, {2, 1}, {2, 5}}, [][2]int{{2, 5}, {2, 5}},
+			8, 1},
+		{"KN", [][2]int{{0, 0}, {0, 3}}, [][2]int{{2, 1}, {0, 5}},
+			7, NoIdentity},
+		{"KK", [][2]int{{1, 2}, {2, 4}}, [][2]int{{2, 5}, {2, 5}}, 5, 5},
+		{"KX", [][2]int{{0, 0}, {2, 3}}, [][2]int{{2, 5}, {2, 5}}, 7, 6},
+		{"IN", [][2]int{{0, 0}, {0, 3}}, [][2]int{{2, 1}, {0, 5}},
+			0, NoIdentity},
+		{"IK", [][2]int{{1, 2}, {2, 4}}, [][2]int{{2, 5}, {2, 5}}, 4, 3},
+		{"IX", [][2]int{{0, 0}, {2, 3}}, [][2]int{{2, 5}, {2, 5}}, 0, 6},
+
+		// deferred patterns.
+		{"NK1", [][2]int{{0, 0}, {2, 1}}, [][2]int{{0, 5}, {2, 1}},
+			NoIdentity, 3},
+		{"NX1", [][2]int{{0, 0}, {0, 1}, {0, 3}}, [][2]int{{2, 1}, {0, 5}},
+			NoIdentity, 1},
+		{"X1K", [][2]int{{0, 2}, {2, 1}, {0, 5}, {2, 3}},
+			[][2]int{{2, 5}, {2, 5}}, 8, 3},
+		{"XX1", [][2]int{{0, 0}, {0, 1}, {2, 3}}, [][2]int{{2, 5}, {2, 5}},
+			6, 1},
+		{"X1X1", [][2]int{{0, 0}, {0, 1}, {0, 3}, {2, 3}},
+			[][2]int{{2, 5}, {2, 5}}, 6, 1},
+		{"KK1", [][2]int{{0, 0}, {2, 3}}, [][2]int{{2, 5}, {2, 5}}, 7, 3},
+		{"KX1", [][2]int{{0, 0}, {0, 3}, {2, 3}}, [][2]int{{2, 5}, {2, 5}},
+			7, 6},
+		{"IK1", [][2]int{{0, 0}, {2, 3}}, [][2]int{{2, 5}, {2, 5}}, 0, 3},
+		{"IX1", [][2]int{{0, 0}, {0, 3}, {2, 3}}, [][2]int{{2, 5}, {2, 5}},
+			0, 6},
+		{"I1X1", [][2]int{{0, 0}, {0, 1}, {2, 3}}, [][2]int{{2, 5}, {2, 5}},
+			0, 1},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hp, err := FromString(tt.name)
+			require.NoError(t, err, "failed to load pattern")
+			a, err := Analyze(hp)
+			require.NoError(t, err, "failed to analyze")
+
+			require.Len(t, a.Messages, len(tt.messages), "messages not match")
+			for i, m := range a.Messages {
+				require.Equal(t, hp.MessagePattern[i][0], m.Sender,
+					"sender not match")
+				require.Equal(t, tt.messages[i], [2]int{m.Source,
+					m.Destination}, "message %d not match", i)
+			}
+
+			require.Len(t, a.Transport, len(tt.transport),
+				"transport not match")
+			for i, m := range a.Transport {
+				require.Equal(t, tt.transport[i], [2]int{m.Source,
+					m.Destination}, "transport %d not match", i)
+			}
+			require.Equal(t, tt.initiator, a.InitiatorIdentity,
+				"initiator identity not match")
+			require.Equal(t, tt.responder, a.ResponderIdentity,
+				"responder identity not match")
+		})
+	}
+}
+
+func TestAnalyzeRegistered(t *testing.T) {
+	// a registered pattern is analyzed the same way, which is loaded here
+	// without touching the registry used by the other tests.
+	hp := &HandshakePattern{Name: "XXX", Pattern: `
+		-> e
+		<- e, ee, s, es
+		-> s, se`}
+	require.NoError(t, hp.loadPattern(), "failed to load pattern")
+	copied, err := Analyze(hp)
+	require.NoError(t, err, "failed to analyze")
+
+	hp, _ = FromString("XX")
+	want, _ := Analyze(hp)
+	require.Equal(t, want, copied, "analysis not match")
+
+	// the transport messages of the responder follow the last message.
+	require.Equal(t, TokenResponder, copied.Transport[0].Sender,
+		"sender not match")
+	require.Equal(t, TokenInitiator, copied.Transport[1].Sender,
+		"sender not match")
+
+	// the psk tokens are ignored.
+	hp = &HandshakePattern{Name: "XXX1", Pattern: `
+		-> e
+		<- e, ee, s, es
+		-> s, se, psk`}
+	require.NoError(t, hp.loadPattern(), "failed to load pattern")
+	withPsk, err := Analyze(hp)
+	require.NoError(t, err, "failed to analyze")
+	require.Equal(t, want, withPsk, "analysis not match")
+
+	// KEM patterns are not supported.
+	hp, _ = FromString("pqXX")
+	_, err = Analyze(hp)
+	require.Equal(t, errKemAnalysis, err, "error not match")
+}
@@ -4,7 +4,8 @@ package pattern
 // authentication DHs to the next message. To name these deferred handshake
 // patterns, the numeral "1" is used after the first and/or second character
 // in a fundamental pattern name to indicate that the initiator and/or
-// responder's authentication DH is deferred to the next message.
+// responder's authentication DH is deferred to the next message. The same
+// patterns can be derived from the fundamental ones using Defer.
 var (
 	deferred = []struct {
 		name    string
@@ -0,0 +1,154 @@
+package pattern
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// fundamentalNameRegex matches the two-character name of a fundamental
+	// pattern, whose first and second characters refer to the static keys of
+	// the initiator and the responder.
+	fundamentalNameRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
+	errNothingDeferred    = errors.New("at least one party must be deferred")
+	errMissingPskPosition = errors.New("missing psk positions")
+)
+
+func errCannotDefer(name, reason string) error {
+	return fmt.Errorf("pattern %s cannot be deferred: %s", name, reason)
+}
+
+// Defer derives a deferred pattern from a fundamental pattern, which can be
+// either built-in or registered. The authentication DH of the initiator, se,
+// and/or the responder, es, is moved to the next message, before the static key
+// sent in it, if any. The ss token is removed. The numeral "1" is added after
+// the first and/or second character of the name, for instance, XX becomes
+// X1X, XX1 or X1X1. The returned pattern is not registered.
+func Defer(base *HandshakePattern, initiator,
+	responder bool) (*HandshakePattern, error) {
+	if !initiator && !responder {
+		return nil, errNothingDeferred
+	}
+	if !fundamentalNameRegex.MatchString(base.Name) {
+		return nil, errCannotDefer(base.Name, "not a fundamental pattern")
+	}
+
+	mp := removeToken(copyPattern(base.MessagePattern), TokenSs)
+	name := base.Name[:1]
+	var err error
+	if initiator {
+		if mp, err = deferToken(mp, TokenSe); err != nil {
+			return nil, errCannotDefer(base.Name, err.Error())
+		}
+		name += "1"
+	}
+	name += base.Name[1:]
+	if responder {
+		if mp, err = deferToken(mp, TokenEs); err != nil {
+			return nil, errCannotDefer(base.Name, err.Error())
+		}
+		name += "1"
+	}
+
+	return newPattern(name, joinPattern(base.PreMessagePattern, mp))
+}
+
+// WithPsk derives a pattern using the psk modifiers of the positions from a
+// pattern, which can be either built-in or registered, and may already have
+// modifiers. The psk token is added to the beginning of the first message for
+// position 0, and the end of the Nth message for position N. The modifiers are
+// added to the name, for instance, XX with positions 0 and 2 becomes
+// XXpsk0+psk2. The returned pattern is not registered.
+func WithPsk(base *HandshakePattern, positions ...int) (*HandshakePattern,
+	error) {
+	if len(positions) == 0 {
+		return nil, errMissingPskPosition
+	}
+
+	var used []int
+	if base.Modifier != nil {
+		used = append(used, base.Modifier.PskIndexes...)
+	}
+
+	mp := copyPattern(base.MessagePattern)
+	modifiers := make([]string, 0, len(positions))
+	for _, i := range positions {
+		for _, u := range used {
+			if i == u {
+				return nil, errInvalidPskIndex(i)
+			}
+		}
+		if err := insertPsk(mp, i); err != nil {
+			return nil, err
+		}
+		used = append(used, i)
+		modifiers = append(modifiers, fmt.Sprintf("psk%d", i))
+	}
+
+	name := base.Name
+	if base.Modifier != nil {
+		name += "+"
+	}
+	name += strings.Join(modifiers, "+")
+
+	return newPattern(name, joinPattern(base.PreMessagePattern, mp))
+}
+
+// deferToken moves the token to the next message, before the "s" token in it
+// if any, otherwise to its end. If the token is in the last message, a new
+// message from the other party is appended.
+func deferToken(mp pattern, token Token) (pattern, error) {
+	for i, line := range mp {
+		j := indexOf(line, token)
+		if j == -1 {
+			continue
+		}
+		mp[i] = append(line[:j:j], line[j+1:]...)
+
+		if i == len(mp)-1 {
+			return append(mp, patternLine{otherParty(line[0]), token}), nil
+		}
+		next := mp[i+1]
+		k := indexOf(next, TokenS)
+		if k == -1 {
+			k = len(next)
+		}
+		mp[i+1] = append(next[:k:k], append(patternLine{token},
+			next[k:]...)...)
+		return mp, nil
+	}
+	return nil, fmt.Errorf("missing token %s", token)
+}
+
+// removeToken removes the token from the lines of the pattern.
+func removeToken(p pattern, token Token) pattern {
+	for i, line := range p {
+		if j := indexOf(line, token); j != -1 {
+			p[i] = append(line[:j:j], line[j+1:]...)
+		}
+	}
+	return p
+}
+
+// indexOf returns the index of the token in the line, or -1 if not found.
+func indexOf(line patternLine, token Token) int {
+	for i, t := range line[1:] {
+		if t == token {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// copyPattern returns a deep copy of the pattern.
+func copyPattern(p pattern) pattern {
+	result := make(pattern, 0, len(p))
+	for _, line := range p {
+		result = append(result, append(patternLine{}, line...))
+	}
+	return result
+}
@@ -0,0 +1,156 @@
+package pattern
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// requireSamePattern checks the derived pattern equals the expected one, while
+// the raw pattern strings may differ.
+func requireSamePattern(t *testing.T, want, got *HandshakePattern) {
+	require.Equal(t, want.Name, got.Name, "name not match")
+	require.Equal(t, want.PreMessagePattern, got.PreMessagePattern,
+		"pre-message not match")
+	require.Equal(t, want.MessagePattern, got.MessagePattern,
+		"message not match")
+	require.Equal(t, want.Modifier, got.Modifier, "modifier not match")
+}
+
+func TestDefer(t *testing.T) {
+	// the derived patterns equal the hand-written ones.
+	for _, d := range deferred {
+		t.Run(d.name, func(t *testing.T) {
+			base, err := FromString(strings.Replace(d.name, "1", "", -1))
+			require.NoError(t, err, "failed to load base pattern")
+
+			got, err := Defer(base, d.name[1] == '1',
+				strings.HasSuffix(d.name, "1"))
+			require.NoError(t, err, "failed to defer")
+
+			want, _ := FromString(d.name)
+			requireSamePattern(t, want, got)
+		})
+	}
+}
+
+func TestDeferRegistered(t *testing.T) {
+	// a registered pattern follows the same naming rules.
+	require.NoError(t, Register("YZ", `
+		-> e
+		<- e, ee, s, es
+		-> s, se`), "failed to register")
+	defer delete(supportedPatterns, "YZ")
+
+	base, _ := FromString("YZ")
+	got, err := Defer(base, true, true)
+	require.NoError(t, err, "failed to defer")
+	require.Equal(t, "Y1Z1", got.Name, "name not match")
+
+	want, _ := FromString("X1X1")
+	require.Equal(t, want.MessagePattern, got.MessagePattern,
+		"message not match")
+
+	// the derived pattern can be registered.
+	require.NoError(t, Register(got.Name, got.Pattern), "failed to register")
+	defer delete(supportedPatterns, got.Name)
+	hp, err := FromString("Y1Z1")
+	require.NoError(t, err, "failed to load pattern")
+	require.Equal(t, got.MessagePattern, hp.MessagePattern,
+		"message not match")
+}
+
+func TestDeferError(t *testing.T) {
+	nn, _ := FromString("NN")
+	xx, _ := FromString("XX")
+	x, _ := FromString("X")
+	x1x, _ := FromString("X1X")
+
+	_, err := Defer(xx, false, false)
+	require.Equal(t, errNothingDeferred, err, "error not match")
+
+	_, err = Defer(nn, true, false)
+	require.EqualError(t, err,
+		"pattern NN cannot be deferred: missing token se")
+	_, err = Defer(nn, false, true)
+	require.EqualError(t, err,
+		"pattern NN cannot be deferred: missing token es")
+
+	for _, hp := range []*HandshakePattern{x, x1x} {
+		_, err = Defer(hp, true, false)
+		require.EqualError(t, err, "pattern "+hp.Name+
+			" cannot be deferred: not a fundamental pattern")
+	}
+}
+
+func TestWithPsk(t *testing.T) {
+	testParams := []struct {
+		base      string
+		positions []int
+		name      string
+	}{
+		{"NN", []int{0}, "NNpsk0"},
+		{"XX", []int{3}, "XXpsk3"},
+		{"NK", []int{0, 2}, "NKpsk0+psk2"},
+		{"X1X", []int{1}, "X1Xpsk1"},
+		{"XXfallback", []int{0}, "XXfallback+psk0"},
+		{"XXhfs", []int{2}, "XXhfs+psk2"},
+		{"NNpsk0", []int{2}, "NNpsk0+psk2"},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			// the patterns with modifiers are cached by FromString, which
+			// are removed so the registry is unchanged.
+			for _, name := range []string{tt.base, tt.name} {
+				if supportedPatterns[name] == nil {
+					defer delete(supportedPatterns, name)
+				}
+			}
+
+			base, err := FromString(tt.base)
+			require.NoError(t, err, "failed to load base pattern")
+			got, err := WithPsk(base, tt.positions...)
+			require.NoError(t, err, "failed to add psk")
+
+			want, err := FromString(tt.name)
+			require.NoError(t, err, "failed to load pattern")
+			requireSamePattern(t, want, got)
+
+			// the base pattern is unchanged.
+			again, _ := FromString(tt.base)
+			require.Equal(t, base.MessagePattern, again.MessagePattern,
+				"base pattern changed")
+		})
+	}
+}
+
+func TestWithPskError(t *testing.T) {
+	defer delete(supportedPatterns, "NNpsk0")
+	nn, _ := FromString("NN")
+	nnPsk0, _ := FromString("NNpsk0")
+
+	_, err := WithPsk(nn)
+	require.Equal(t, errMissingPskPosition, err, "error not match")
+
+	_, err = WithPsk(nn, 3)
+	require.EqualError(t, err, "Invalid psk index: 3")
+	_, err = WithPsk(nn, -1)
+	require.EqualError(t, err, "Invalid psk index: -1")
+	_, err = WithPsk(nn, 1, 1)
+	require.EqualError(t, err, "Invalid psk index: 1")
+	_, err = WithPsk(nnPsk0, 0)
+	require.EqualError(t, err, "Invalid psk index: 0")
+
+	// the derived pattern is checked by the rules, in which the responder
+	// sends its static key after the psk without an ephemeral key.
+	require.NoError(t, Register("NX17", `
+		-> e
+		<- s`), "failed to register")
+	defer delete(supportedPatterns, "NX17")
+	nx17, _ := FromString("NX17")
+	_, err = WithPsk(nx17, 0)
+	require.EqualError(t, err, "Invalid pattern: line 2 '<- s', "+
+		"token 1 's': responder cannot encrypt after psk without sending e")
+}
@@ -0,0 +1,105 @@
+package pattern
+
+import "strings"
+
+// minDiagramWidth is the minimal width between the two lifelines of the ASCII
+// diagram, which leaves room for the party names.
+const minDiagramWidth = 20
+
+// ASCIIDiagram renders the pattern as an ASCII sequence diagram, in which each
+// message is an arrow labeled with its tokens. The pre-messages, if any, are
+// drawn above the "..." line. For instance, NK becomes,
+//   NK
+//   Initiator    Responder
+//   |         s          |
+//   |<-------------------|
+//   |        ...         |
+//   |       e, es        |
+//   |------------------->|
+//   |       e, ee        |
+//   |<-------------------|
+func (hp *HandshakePattern) ASCIIDiagram() string {
+	width := minDiagramWidth
+	for _, p := range []pattern{hp.PreMessagePattern, hp.MessagePattern} {
+		for _, line := range p {
+			if n := len(diagramLabel(line)) + 2; n > width {
+				width = n
+			}
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(hp.Name + "\n")
+	gap := width + 2 - len("Initiator") - len("Responder")
+	b.WriteString("Initiator" + strings.Repeat(" ", gap) + "Responder\n")
+
+	writeLines := func(p pattern) {
+		for _, line := range p {
+			b.WriteString("|" + center(diagramLabel(line), width) + "|\n")
+			arrow := strings.Repeat("-", width-1)
+			if line[0] == TokenInitiator {
+				arrow += ">"
+			} else {
+				arrow = "<" + arrow
+			}
+			b.WriteString("|" + arrow + "|\n")
+		}
+	}
+
+	if len(hp.PreMessagePattern) != 0 {
+		writeLines(hp.PreMessagePattern)
+		b.WriteString("|" + center(preMessageIndicator, width) + "|\n")
+	}
+	writeLines(hp.MessagePattern)
+	return b.String()
+}
+
+// MermaidDiagram renders the pattern as a Mermaid sequence diagram, in which
+// each message is an arrow labeled with its tokens. The pre-messages, if any,
+// are drawn as dotted arrows above a "..." note. For instance, NK becomes,
+//   sequenceDiagram
+//       participant I as Initiator
+//       participant R as Responder
+//       Note over I,R: NK
+//       R-->>I: s
+//       Note over I,R: ...
+//       I->>R: e, es
+//       R->>I: e, ee
+func (hp *HandshakePattern) MermaidDiagram() string {
+	var b strings.Builder
+	b.WriteString("sequenceDiagram\n")
+	b.WriteString("    participant I as Initiator\n")
+	b.WriteString("    participant R as Responder\n")
+	b.WriteString("    Note over I,R: " + hp.Name + "\n")
+
+	writeLines := func(p pattern, arrow string) {
+		for _, line := range p {
+			from, to := "I", "R"
+			if line[0] == TokenResponder {
+				from, to = to, from
+			}
+			b.WriteString("    " + from + arrow + to + ": " +
+				diagramLabel(line) + "\n")
+		}
+	}
+
+	if len(hp.PreMessagePattern) != 0 {
+		writeLines(hp.PreMessagePattern, "-->>")
+		b.WriteString("    Note over I,R: " + preMessageIndicator + "\n")
+	}
+	writeLines(hp.MessagePattern, "->>")
+	return b.String()
+}
+
+// diagramLabel returns the tokens of the line, e.g., "e, ee" for "<- e, ee".
+func diagramLabel(line patternLine) string {
+	return strings.TrimSpace(strings.TrimPrefix(line.String(),
+		string(line[0])))
+}
+
+// center pads the string with spaces to the width, keeping it in the middle.
+func center(s string, width int) string {
+	left := (width - len(s)) / 2
+	return strings.Repeat(" ", left) + s +
+		strings.Repeat(" ", width-len(s)-left)
+}
@@ -0,0 +1,55 @@
+package pattern
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestASCIIDiagram(t *testing.T) {
+	hp, _ := FromString("NK")
+	require.Equal(t, `NK
+Initiator    Responder
+|         s          |
+|<-------------------|
+|        ...         |
+|       e, es        |
+|------------------->|
+|       e, ee        |
+|<-------------------|
+`, hp.ASCIIDiagram(), "diagram not match")
+
+	// a long message widens the diagram.
+	defer delete(supportedPatterns, "IXhfs")
+	hp, _ = FromString("IXhfs")
+	require.Equal(t, `IXhfs
+Initiator           Responder
+|         e, e1, s          |
+|-------------------------->|
+| e, e1, ee, ee1, se, s, es |
+|<--------------------------|
+`, hp.ASCIIDiagram(), "diagram not match")
+}
+
+func TestMermaidDiagram(t *testing.T) {
+	hp, _ := FromString("KK")
+	require.Equal(t, `sequenceDiagram
+    participant I as Initiator
+    participant R as Responder
+    Note over I,R: KK
+    I-->>R: s
+    R-->>I: s
+    Note over I,R: ...
+    I->>R: e, es, ss
+    R->>I: e, ee, se
+`, hp.MermaidDiagram(), "diagram not match")
+
+	hp, _ = FromString("NN")
+	require.Equal(t, `sequenceDiagram
+    participant I as Initiator
+    participant R as Responder
+    Note over I,R: NN
+    I->>R: e
+    R->>I: e, ee
+`, hp.MermaidDiagram(), "diagram not match")
+}
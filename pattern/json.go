@@ -0,0 +1,134 @@
+package pattern
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errMismatchedModifiers = errors.New(
+		"modifiers must match the pattern name")
+	errMismatchedTokens = errors.New(
+		"tokens must be parsed back into the same messages")
+)
+
+// patternJSON is the structured JSON form of a HandshakePattern.
+type patternJSON struct {
+	Name        string        `json:"name"`
+	PreMessages []messageJSON `json:"pre_messages,omitempty"`
+	Messages    []messageJSON `json:"messages"`
+	Modifiers   *Modifier     `json:"modifiers,omitempty"`
+}
+
+// messageJSON is the JSON form of a message line, for instance, "<- e, ee"
+// becomes {"direction": "<-", "tokens": ["e", "ee"]}.
+type messageJSON struct {
+	Direction Token   `json:"direction"`
+	Tokens    []Token `json:"tokens"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. It encodes the name,
+// the tokenized pre-messages and messages, and the modifiers of the pattern.
+// The messages are the ones in use, in which the modifiers are already
+// applied, e.g., the psk tokens are padded.
+func (hp *HandshakePattern) MarshalJSON() ([]byte, error) {
+	// the directions are kept readable, e.g., "->" instead of "-\u003e".
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(&patternJSON{
+		Name:        hp.Name,
+		PreMessages: messagesToJSON(hp.PreMessagePattern),
+		Messages:    messagesToJSON(hp.MessagePattern),
+		Modifiers:   hp.Modifier,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. It decodes the data
+// created by MarshalJSON, and checks it the same way as Register, so the
+// modifiers must match the name. The pattern is not registered, which can be
+// done by calling Register(hp.Name, hp.Pattern).
+func (hp *HandshakePattern) UnmarshalJSON(data []byte) error {
+	var pj patternJSON
+	if err := json.Unmarshal(data, &pj); err != nil {
+		return err
+	}
+
+	// the tokens are turned back into the raw string, so it can be checked
+	// by the same rules used by Register.
+	pre, messages := messagesFromJSON(pj.PreMessages),
+		messagesFromJSON(pj.Messages)
+	newHp, err := newPattern(pj.Name, joinPattern(pre, messages))
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(newHp.Modifier, pj.Modifiers) {
+		return errMismatchedModifiers
+	}
+
+	// a token carrying a separator would be parsed differently.
+	if !reflect.DeepEqual(newHp.PreMessagePattern, pre) ||
+		!reflect.DeepEqual(newHp.MessagePattern, messages) {
+		return errMismatchedTokens
+	}
+
+	*hp = *newHp
+	return nil
+}
+
+// messagesToJSON turns the pattern into its JSON form.
+func messagesToJSON(p pattern) []messageJSON {
+	if len(p) == 0 {
+		return nil
+	}
+
+	result := make([]messageJSON, 0, len(p))
+	for _, line := range p {
+		result = append(result, messageJSON{
+			Direction: line[0],
+			Tokens:    append([]Token{}, line[1:]...),
+		})
+	}
+	return result
+}
+
+// messagesFromJSON turns the JSON form back into a pattern.
+func messagesFromJSON(messages []messageJSON) pattern {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	result := make(pattern, 0, len(messages))
+	for _, m := range messages {
+		result = append(result,
+			append(patternLine{m.Direction}, m.Tokens...))
+	}
+	return result
+}
+
+// joinPattern turns the pre-message and message patterns into the raw string
+// used by Register.
+func joinPattern(pre, messages pattern) string {
+	s := joinMessages(messages)
+	if len(pre) != 0 {
+		s = joinMessages(pre) + "\n" + preMessageIndicator + "\n" + s
+	}
+	return s
+}
+
+// joinMessages turns the lines into the raw string, one line per message.
+func joinMessages(p pattern) string {
+	lines := make([]string, 0, len(p))
+	for _, line := range p {
+		lines = append(lines, line.String())
+	}
+	return strings.Join(lines, "\n")
+}
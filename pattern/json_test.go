@@ -0,0 +1,120 @@
+package pattern
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatternJSON(t *testing.T) {
+	names := []string{
+		"NN", "NK", "XX", "IK", "X1X1", "pqXX",
+		"XXpsk3", "NNpsk0+psk2", "XXfallback", "XXhfs", "IXfallback+psk0",
+	}
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			// the patterns with modifiers are cached by FromString, which
+			// are removed so the registry is unchanged.
+			if supportedPatterns[name] == nil {
+				defer delete(supportedPatterns, name)
+			}
+			hp, err := FromString(name)
+			require.NoError(t, err, "failed to load pattern")
+
+			data, err := json.Marshal(hp)
+			require.NoError(t, err, "failed to marshal")
+
+			got := &HandshakePattern{}
+			require.NoError(t, json.Unmarshal(data, got),
+				"failed to unmarshal")
+			require.Equal(t, hp.Name, got.Name, "name not match")
+			require.Equal(t, hp.PreMessagePattern, got.PreMessagePattern,
+				"pre-message not match")
+			require.Equal(t, hp.MessagePattern, got.MessagePattern,
+				"message not match")
+			require.Equal(t, hp.Modifier, got.Modifier, "modifier not match")
+
+			again, err := json.Marshal(got)
+			require.NoError(t, err, "failed to marshal")
+			require.Equal(t, data, again, "data not match")
+		})
+	}
+}
+
+func TestPatternJSONFormat(t *testing.T) {
+	defer delete(supportedPatterns, "XXfallback+psk0")
+	hp, _ := FromString("XXfallback+psk0")
+	data, err := json.Marshal(hp)
+	require.NoError(t, err, "failed to marshal")
+	require.JSONEq(t, `{
+		"name": "XXfallback+psk0",
+		"pre_messages": [{"direction": "->", "tokens": ["e"]}],
+		"messages": [
+			{"direction": "<-", "tokens": ["psk", "e", "ee", "s", "es"]},
+			{"direction": "->", "tokens": ["s", "se"]}
+		],
+		"modifiers": {"fallback": true, "psk_indexes": [0]}
+	}`, string(data), "data not match")
+
+	// the unmarshaled pattern can be registered and used by its name.
+	custom := &HandshakePattern{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"name": "NX16psk2",
+		"messages": [
+			{"direction": "->", "tokens": ["e"]},
+			{"direction": "<-", "tokens": ["e", "ee", "s", "es", "psk"]}
+		],
+		"modifiers": {"psk_indexes": [2]}
+	}`), custom), "failed to unmarshal")
+	require.NoError(t, Register(custom.Name, custom.Pattern),
+		"failed to register")
+	defer delete(supportedPatterns, custom.Name)
+
+	hp, err = FromString("NX16psk2")
+	require.NoError(t, err, "failed to load pattern")
+	require.Equal(t, custom.MessagePattern, hp.MessagePattern,
+		"message not match")
+}
+
+func TestPatternJSONError(t *testing.T) {
+	testParams := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"malformed json", `{"name": 1}`,
+			"json: cannot unmarshal number into Go struct field " +
+				"patternJSON.name of type string"},
+		{"invalid name", `{"name": "nx", "messages": [
+			{"direction": "->", "tokens": ["e"]}]}`,
+			errInvalidPatternName.Error()},
+		{"missing modifiers", `{"name": "NXpsk0", "messages": [
+			{"direction": "->", "tokens": ["psk", "e"]}]}`,
+			errMismatchedModifiers.Error()},
+		{"mismatched modifiers", `{"name": "NN", "messages": [
+			{"direction": "->", "tokens": ["e"]}],
+			"modifiers": {"hfs": true}}`,
+			errMismatchedModifiers.Error()},
+		{"token with separator", `{"name": "NN", "messages": [
+			{"direction": "->", "tokens": ["e, s"]}]}`,
+			errMismatchedTokens.Error()},
+		{"no messages", `{"name": "NN", "messages": []}`,
+			"Invalid pattern: line '' is invalid"},
+		{"broken rules", `{"name": "NN", "messages": [
+			{"direction": "->", "tokens": ["e", "es"]}]}`,
+			"Invalid pattern: line 1 '-> e, es', token 2 'es': " +
+				"es needs the <- key s, which is not sent before"},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hp := &HandshakePattern{}
+			err := json.Unmarshal([]byte(tt.data), hp)
+			require.EqualError(t, err, tt.err, "error not match")
+			require.Equal(t, &HandshakePattern{}, hp,
+				"pattern should be unchanged")
+		})
+	}
+}
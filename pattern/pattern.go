@@ -13,11 +13,16 @@ import (
 var (
 	supportedPatterns = make(map[string]*HandshakePattern)
 
-	patternNameRegex = `^[A-Z0-9]+`
+	// patternNameRegex matches the pattern name, with an optional "pq" prefix
+	// used by the PQNoise patterns.
+	patternNameRegex = `^(pq)?[A-Z0-9]+`
 
 	errWrongPreMessage     = errors.New("invalid pattern")
 	errInvalidPatternName  = errors.New("invalid handshake pattern name")
 	errInvalidModifierName = errors.New("invalid handshake modifier name")
+	errInvalidHfs          = errors.New("hfs needs the pattern to have an ee")
+	errMissingFallbackPre  = errors.New(
+		"fallback pattern needs a pre-message from initiator")
 )
 
 // HandshakePattern represents a noise handshake pattern. It has a strict
@@ -26,7 +31,8 @@ var (
 type HandshakePattern struct {
 	// Name is made of two parts:
 	//  - the pattern name, must be an uppercase ASCII string containing only
-	// 	  alphabetic characters or numerals.
+	// 	  alphabetic characters or numerals, optionally prefixed by "pq" for
+	// 	  the PQNoise patterns.
 	//  - the pattern modifier name, must be a lowercase alphanumeric ASCII
 	//    string that begins with an alphabetic character.
 	Name string
@@ -46,7 +52,7 @@ type HandshakePattern struct {
 	// PreMessagePattern stores the tokenized pre-message pattern.
 	PreMessagePattern pattern
 
-	// Modifier specifies fallback/psk modifiers.
+	// Modifier specifies fallback/psk/hfs modifiers.
 	Modifier *Modifier
 }
 
@@ -54,14 +60,30 @@ func (hp *HandshakePattern) String() string {
 	return hp.Name
 }
 
+// KemMode specifies whether the pattern uses the KEM tokens, "ekem" and
+// "skem", as defined by PQNoise. In this mode, the "e" and "s" tokens carry
+// KEM public keys instead of DH public keys.
+func (hp *HandshakePattern) KemMode() bool {
+	for _, line := range hp.MessagePattern {
+		for _, t := range line[1:] {
+			if isKemToken(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Modifier implements the two modifiers, psk and fallback specified from the
-// noise protocol.
+// noise protocol, plus the hfs modifier from the hybrid forward secrecy
+// extension.
 //
 // According to the noise specs, a "psk" token is allowed to appear one or more
 // times in a handshake pattern, thus a PskIndexes slice is used.
 type Modifier struct {
-	Fallback   bool
-	PskIndexes []int
+	Fallback   bool  `json:"fallback,omitempty"`
+	Hfs        bool  `json:"hfs,omitempty"`
+	PskIndexes []int `json:"psk_indexes,omitempty"`
 }
 
 // PskMode specifies whether there is a psk modifier.
@@ -107,13 +129,36 @@ func FromString(s string) (*HandshakePattern, error) {
 	newHp.MessagePattern = p
 
 	// mount the modifiers if specified, eg, psk and fallback
-	modifier := strings.Trim(s, name)
+	modifier := strings.TrimPrefix(s, name)
 	if err := newHp.mountModifiers(modifier); err != nil {
 		return nil, err
 	}
 
+	// add the hfs tokens if needed, this must be done before the fallback
+	// conversion, as the "e1" token is sent along with the initiator's first
+	// "e" token.
+	if err := newHp.applyHfs(); err != nil {
+		return nil, err
+	}
+
+	// convert the pattern into a fallback pattern if needed, this must be done
+	// before padding the psk tokens, as the psk indexes are counted using the
+	// fallback pattern.
+	if err := newHp.applyFallback(); err != nil {
+		return nil, err
+	}
+
 	// pad the psk tokens
-	newHp.padPskToken()
+	if err := newHp.padPskToken(); err != nil {
+		return nil, err
+	}
+
+	// the modifiers may break the rules, e.g., a psk token sent before the
+	// "e" token of a party without one.
+	err := validateHandshake(newHp.PreMessagePattern, newHp.MessagePattern)
+	if err != nil {
+		return nil, err
+	}
 
 	// cache it for future reference
 	supportedPatterns[s] = newHp
@@ -125,11 +170,23 @@ func FromString(s string) (*HandshakePattern, error) {
 // pattern used must statisfy the requirements specified in the noise protocol
 // specification.
 func Register(s, pattern string) error {
+	hp, err := newPattern(s, pattern)
+	if err != nil {
+		return err
+	}
+
+	supportedPatterns[s] = hp
+	return nil
+}
+
+// newPattern creates a handshake pattern with the name and pattern, and
+// validates it without registering.
+func newPattern(s, pattern string) (*HandshakePattern, error) {
 	// parse out the pattern name, XXpsk0+fallback becomes XX and psk0+fallback
 	re := regexp.MustCompile(patternNameRegex)
 	name := re.FindString(s)
 	if name == "" {
-		return errInvalidPatternName
+		return nil, errInvalidPatternName
 	}
 
 	hp := &HandshakePattern{
@@ -137,22 +194,20 @@ func Register(s, pattern string) error {
 		Pattern: pattern,
 	}
 	// mount the modifiers if specified, eg, psk and fallback
-	modifier := strings.Trim(s, name)
+	modifier := strings.TrimPrefix(s, name)
 	if err := hp.mountModifiers(modifier); err != nil {
-		return err
+		return nil, err
 	}
 
 	// validate the pattern
 	if err := hp.loadPattern(); err != nil {
-		return err
+		return nil, err
 	}
-
-	supportedPatterns[s] = hp
-	return nil
+	return hp, nil
 }
 
 // SupportedPatterns gives the names of all the patterns registered. If no new
-// patterns are registered, it returns a total of 38 patterns, orders not
+// patterns are registered, it returns a total of 50 patterns, orders not
 // preserved.
 func SupportedPatterns() string {
 	keys := make([]string, 0, len(supportedPatterns))
@@ -187,7 +242,13 @@ func (hp *HandshakePattern) loadPattern() error {
 	}
 
 	// turn message string into tokens
-	mp, err := tokenize(messages, false)
+	var mp pattern
+	var err error
+	if hp.fallbackMode() {
+		mp, err = tokenizeFallback(messages)
+	} else {
+		mp, err = tokenize(messages, false)
+	}
 	if err != nil {
 		return err
 	}
@@ -198,17 +259,168 @@ func (hp *HandshakePattern) loadPattern() error {
 		return err
 	}
 
-	if preMessages == "" {
+	if preMessages != "" {
+		// turn pre-message string into tokens
+		pmm, err := tokenize(preMessages, true)
+		if err != nil {
+			return err
+		}
+		hp.PreMessagePattern = pmm
+	}
+
+	// a fallback pattern must have the initiator's first message as its
+	// pre-message.
+	if hp.fallbackMode() && (hp.PreMessagePattern == nil ||
+		hp.PreMessagePattern[0][0] != TokenInitiator) {
+		return errMissingFallbackPre
+	}
+
+	// check the rules depending on the keys known by each party.
+	return validateHandshake(hp.PreMessagePattern, hp.MessagePattern)
+}
+
+// fallbackMode specifies whether there is a fallback modifier.
+func (hp *HandshakePattern) fallbackMode() bool {
+	return hp.Modifier != nil && hp.Modifier.Fallback
+}
+
+func errInvalidFallback(name string) error {
+	return fmt.Errorf("pattern %s cannot be used with fallback", name)
+}
+
+// applyFallback converts an Alice-initiated pattern into a Bob-initiated
+// pattern if the fallback modifier is specified. The initiator's first message
+// is turned into a pre-message, which the responder must receive through some
+// other means, e.g., via a failed IK message. For instance, XX,
+//   -> e
+//   <- e, ee, s, es
+//   -> s, se
+// becomes XXfallback,
+//   -> e
+//   ...
+//   <- e, ee, s, es
+//   -> s, se
+// Only patterns whose first message contains nothing but "e", "e1" and "s" can
+// be used with fallback.
+func (hp *HandshakePattern) applyFallback() error {
+	if !hp.fallbackMode() {
 		return nil
 	}
 
-	// turn pre-message string into tokens
-	pmm, err := tokenize(preMessages, true)
-	if err != nil {
-		return err
+	// need at least one message left after the conversion.
+	if len(hp.MessagePattern) < 2 {
+		return errInvalidFallback(hp.Name)
+	}
+
+	// collect the tokens sent by the initiator before the handshake, which
+	// are the initiator's pre-message plus its first message.
+	seen := map[Token]bool{}
+	var responderLine patternLine
+	for _, line := range hp.PreMessagePattern {
+		if line[0] == TokenResponder {
+			responderLine = line
+			continue
+		}
+		for _, t := range line[1:] {
+			seen[t] = true
+		}
+	}
+	for _, t := range hp.MessagePattern[0][1:] {
+		if t != TokenE && t != TokenE1 && t != TokenS {
+			return errInvalidFallback(hp.Name)
+		}
+		// a key cannot be sent twice
+		if seen[t] {
+			return errInvalidFallback(hp.Name)
+		}
+		seen[t] = true
+	}
+
+	// pre-message must be in the order of "e, e1, s"
+	initiatorLine := patternLine{TokenInitiator}
+	for _, t := range []Token{TokenE, TokenE1, TokenS} {
+		if seen[t] {
+			initiatorLine = append(initiatorLine, t)
+		}
 	}
-	hp.PreMessagePattern = pmm
 
+	// the initiator's pre-message is processed first.
+	pre := pattern{initiatorLine}
+	if responderLine != nil {
+		pre = append(pre, responderLine)
+	}
+
+	hp.PreMessagePattern = pre
+	hp.MessagePattern = hp.MessagePattern[1:]
+	return nil
+}
+
+// hfsMode specifies whether there is a hfs modifier.
+func (hp *HandshakePattern) hfsMode() bool {
+	return hp.Modifier != nil && hp.Modifier.Hfs
+}
+
+// applyHfs adds the "e1" and "ee1" tokens if the hfs modifier is specified.
+// As defined in the hfs extension, an "e1" token is added directly following
+// the first "e" token of each party, and an "ee1" token is added directly
+// following the first "ee" token. For instance, XX,
+//   -> e
+//   <- e, ee, s, es
+//   -> s, se
+// becomes XXhfs,
+//   -> e, e1
+//   <- e, e1, ee, ee1, s, es
+//   -> s, se
+// Only patterns having an "ee" token can be used with hfs.
+func (hp *HandshakePattern) applyHfs() error {
+	if !hp.hfsMode() {
+		return nil
+	}
+
+	// tracks whether the "e1" token has been added for each party.
+	added := map[Token]bool{}
+
+	// addE1 makes a copy of the line, in which an "e1" token is added after
+	// the first "e" token.
+	addE1 := func(line patternLine) patternLine {
+		newLine := patternLine{}
+		for _, t := range line {
+			newLine = append(newLine, t)
+			if t == TokenE && !added[line[0]] {
+				newLine = append(newLine, TokenE1)
+				added[line[0]] = true
+			}
+		}
+		return newLine
+	}
+
+	pre := pattern{}
+	for _, line := range hp.PreMessagePattern {
+		pre = append(pre, addE1(line))
+	}
+
+	var eeFound bool
+	mp := pattern{}
+	for _, line := range hp.MessagePattern {
+		newLine := patternLine{}
+		for _, t := range addE1(line) {
+			newLine = append(newLine, t)
+			if t == TokenEe && !eeFound {
+				newLine = append(newLine, TokenEe1)
+				eeFound = true
+			}
+		}
+		mp = append(mp, newLine)
+	}
+
+	if !eeFound {
+		return errInvalidHfs
+	}
+
+	if len(pre) != 0 {
+		hp.PreMessagePattern = pre
+	}
+	hp.MessagePattern = mp
 	return nil
 }
 
@@ -218,11 +430,13 @@ func (hp *HandshakePattern) mountModifiers(s string) error {
 	}
 
 	modifiers := strings.Split(s, "+")
-	// we only have two modifiers atm, either a fallback or a psk.
+	// we have three modifiers atm, a fallback, a hfs or a psk.
 	modifier := &Modifier{}
 	for _, m := range modifiers {
 		if m == "fallback" {
 			modifier.Fallback = true
+		} else if m == "hfs" {
+			modifier.Hfs = true
 		} else {
 			// if it's not a fallback, then it must be a psk
 			if !strings.HasPrefix(m, "psk") {
@@ -262,23 +476,36 @@ func findAndRemove(s []int, n int) ([]int, bool) {
 
 // padPskToken will pad the psk tokens if they are missing in the pattern but
 // specified in the modifiers.
-func (hp *HandshakePattern) padPskToken() {
+func (hp *HandshakePattern) padPskToken() error {
 	if hp.Modifier == nil || !hp.Modifier.PskMode() {
-		return
+		return nil
 	}
 
 	// now we will pad all the psk tokens
 	for _, i := range hp.Modifier.PskIndexes {
-		if i == 0 {
-			hp.MessagePattern[0] = append(
-				hp.MessagePattern[0][:1], append(
-					patternLine{TokenPsk}, hp.MessagePattern[0][1:]...)...,
-			)
-		} else {
-			hp.MessagePattern[i-1] = append(hp.MessagePattern[i-1], TokenPsk)
+		if err := insertPsk(hp.MessagePattern, i); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
+// insertPsk adds the psk token of the index to the message pattern, psk0 is
+// placed at the beginning of the first message, and pskN at the end of the
+// Nth message.
+func insertPsk(mp pattern, i int) error {
+	if i < 0 || i > len(mp) {
+		return errInvalidPskIndex(i)
+	}
+
+	if i == 0 {
+		mp[0] = append(mp[0][:1], append(
+			patternLine{TokenPsk}, mp[0][1:]...)...,
+		)
+	} else {
+		mp[i-1] = append(mp[i-1], TokenPsk)
+	}
+	return nil
 }
 
 // validatePsk checks the psk token is in the right position if enabled.
@@ -293,7 +520,8 @@ func (hp *HandshakePattern) validatePsk() error {
 	// find all psk tokens in the pattern
 	var PskIndexes []int
 	var found bool
-	PskIndexes = hp.Modifier.PskIndexes
+	// copy the indexes, as findAndRemove changes the slice in place.
+	PskIndexes = append([]int{}, hp.Modifier.PskIndexes...)
 	// find psk0
 	if hp.MessagePattern[0][1] == TokenPsk {
 		PskIndexes, found = findAndRemove(PskIndexes, 0)
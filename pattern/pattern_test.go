@@ -18,6 +18,9 @@ func TestSetUp(t *testing.T) {
 		"NK1", "NX1", "X1N", "X1K", "XK1", "X1K1", "X1X", "XX1", "X1X1", "K1N",
 		"K1K", "KK1", "K1K1", "K1X", "KX1", "K1X1", "I1N", "I1K", "IK1", "I1K1",
 		"I1X", "IX1", "I1X1",
+		// 12 PQNoise patterns
+		"pqNN", "pqKN", "pqNK", "pqKK", "pqNX", "pqKX", "pqXN", "pqIN", "pqXK",
+		"pqIK", "pqXX", "pqIX",
 	}
 	// check supported patterns
 	//
@@ -42,7 +45,7 @@ func TestSetUp(t *testing.T) {
 
 	require.Equal(t, len(strings.Join(supported, ", ")),
 		len(SupportedPatterns()),
-		"supported patterns should be 3+12+23=38")
+		"supported patterns should be 3+12+23+12=50")
 
 	// mount a psk modifier
 	n, err = FromString("Npsk0")
@@ -95,15 +98,20 @@ func TestPskPadding(t *testing.T) {
 	require.Equal(t, expected, hp.MessagePattern, "pattern mismatched")
 	require.Equal(t, "NKpsk1+psk2", hp.String(), "name mismatched")
 
-	// fallback has no effect
-	hp, err = FromString("NKfallback")
+	// psk is padded after fallback is applied
+	hp, err = FromString("XXfallback+psk0")
 	expected = pattern{
-		patternLine{TokenInitiator, TokenE, TokenEs},
-		patternLine{TokenResponder, TokenE, TokenEe},
+		patternLine{TokenResponder, TokenPsk, TokenE, TokenEe, TokenS, TokenEs},
+		patternLine{TokenInitiator, TokenS, TokenSe},
 	}
-	require.NoError(t, err, "failed to get NK with fallback")
+	require.NoError(t, err, "failed to get XX with fallback and psk")
 	require.Equal(t, expected, hp.MessagePattern, "pattern mismatched")
-	require.Equal(t, "NKfallback", hp.String(), "name mismatched")
+	require.Equal(t, "XXfallback+psk0", hp.String(), "name mismatched")
+
+	// a psk index beyond the messages is rejected
+	hp, err = FromString("NKpsk3")
+	require.Nil(t, hp, "should not return a pattern")
+	require.EqualError(t, err, "Invalid psk index: 3")
 
 	// NK should stay unchanged
 	hp, err = FromString("NK")
@@ -154,7 +162,24 @@ func TestRegister(t *testing.T) {
 		`, true},
 		{"register pattern with fallback", "NX1fallback", `
 			-> e
+			...
+			<- e, ee
 		`, false},
+		{"fallback must start from responder", "NX7fallback", `
+			-> e
+			...
+			-> s
+			<- e, ee
+		`, true},
+		{"fallback must have pre-message", "NX8fallback", `
+			<- e
+			-> e, ee
+		`, true},
+		{"fallback must have initiator's pre-message", "NX9fallback", `
+			<- e
+			...
+			<- e, ee
+		`, true},
 		{"missing modifier name", "NX2psk", `
 			-> e
 		`, true},
@@ -175,6 +200,21 @@ func TestRegister(t *testing.T) {
 			-> e, psk
 			<- e
 		`, true},
+		{"dh without the remote key", "NX10", `
+			-> e, es
+		`, true},
+		{"encrypt after es without ee", "NX11", `
+			<- s
+			...
+			-> e
+			<- e, es
+		`, true},
+		{"psk without e", "NX12psk2", `
+			-> s
+			...
+			-> e
+			<- psk
+		`, true},
 	}
 
 	for _, tt := range testParams {
@@ -194,6 +234,33 @@ func TestRegister(t *testing.T) {
 	}
 }
 
+func TestRegisterError(t *testing.T) {
+	// the error points to the line and token breaking the rules
+	err := Register("NX13", `
+		<- s
+		...
+		-> e
+		<- e, es`)
+	require.EqualError(t, err, "Invalid pattern: line 2 '<- e, es', "+
+		"payload: responder cannot encrypt after es without ee")
+
+	err = Register("NX14", `
+		-> e
+		<- e, ee, s, ss`)
+	require.EqualError(t, err, "Invalid pattern: line 2 '<- e, ee, s, ss', "+
+		"token 4 'ss': ss needs the -> key s, which is not sent before")
+
+	// the modifiers applied by FromString are checked too, in which the
+	// responder sends its static key after the psk without an ephemeral key.
+	require.NoError(t, Register("NX15", `
+		-> e
+		<- s`))
+	hp, err := FromString("NX15psk0")
+	require.Nil(t, hp, "should not return a pattern")
+	require.EqualError(t, err, "Invalid pattern: line 2 '<- s', "+
+		"token 1 's': responder cannot encrypt after psk without sending e")
+}
+
 func TestParseModifiers(t *testing.T) {
 	testParams := []struct {
 		name         string
@@ -213,6 +280,9 @@ func TestParseModifiers(t *testing.T) {
 				Fallback:   true,
 				PskIndexes: []int{0, 1}},
 		},
+		{"parse a name with a hfs modifier", "hfs", nil, &Modifier{
+			Hfs: true},
+		},
 		{"parse a name with wrong fallback", "fallbak",
 			errInvalidModifierName, nil,
 		},
@@ -235,6 +305,147 @@ func TestParseModifiers(t *testing.T) {
 	}
 }
 
+func TestApplyFallback(t *testing.T) {
+	testParams := []struct {
+		name        string
+		patternName string
+		preExpected pattern
+		msgExpected pattern
+		hasErr      bool
+	}{
+		{"XX to XXfallback", "XXfallback",
+			pattern{
+				patternLine{TokenInitiator, TokenE},
+			},
+			pattern{
+				patternLine{TokenResponder, TokenE, TokenEe, TokenS, TokenEs},
+				patternLine{TokenInitiator, TokenS, TokenSe},
+			}, false},
+		{"IX to IXfallback", "IXfallback",
+			pattern{
+				patternLine{TokenInitiator, TokenE, TokenS},
+			},
+			pattern{
+				patternLine{TokenResponder,
+					TokenE, TokenEe, TokenSe, TokenS, TokenEs},
+			}, false},
+		{"KN merges pre-message", "KNfallback",
+			pattern{
+				patternLine{TokenInitiator, TokenE, TokenS},
+			},
+			pattern{
+				patternLine{TokenResponder, TokenE, TokenEe, TokenSe},
+			}, false},
+		{"NK cannot fallback", "NKfallback", nil, nil, true},
+		{"one-way cannot fallback", "Nfallback", nil, nil, true},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hp, err := FromString(tt.patternName)
+			if tt.hasErr {
+				require.Equal(t, errInvalidFallback(tt.patternName), err,
+					"error not match")
+				require.Nil(t, hp, "should not return a pattern")
+				return
+			}
+			require.NoError(t, err, "should return no error")
+			require.Equal(t, tt.preExpected, hp.PreMessagePattern,
+				"pre-message not match")
+			require.Equal(t, tt.msgExpected, hp.MessagePattern,
+				"message not match")
+		})
+	}
+
+	// the original pattern should stay unchanged
+	hp, err := FromString("XX")
+	require.NoError(t, err, "should return no error")
+	require.Nil(t, hp.PreMessagePattern, "XX has no pre-message")
+	require.Len(t, hp.MessagePattern, 3, "XX has 3 messages")
+}
+
+func TestApplyHfs(t *testing.T) {
+	testParams := []struct {
+		name        string
+		patternName string
+		preExpected pattern
+		msgExpected pattern
+		errExpected error
+	}{
+		{"NN to NNhfs", "NNhfs", nil,
+			pattern{
+				patternLine{TokenInitiator, TokenE, TokenE1},
+				patternLine{TokenResponder,
+					TokenE, TokenE1, TokenEe, TokenEe1},
+			}, nil},
+		{"IK to IKhfs", "IKhfs",
+			pattern{
+				patternLine{TokenResponder, TokenS},
+			},
+			pattern{
+				patternLine{TokenInitiator,
+					TokenE, TokenE1, TokenEs, TokenS, TokenSs},
+				patternLine{TokenResponder,
+					TokenE, TokenE1, TokenEe, TokenEe1, TokenSe},
+			}, nil},
+		{"XX to XXfallback+hfs", "XXfallback+hfs",
+			pattern{
+				patternLine{TokenInitiator, TokenE, TokenE1},
+			},
+			pattern{
+				patternLine{TokenResponder, TokenE, TokenE1, TokenEe,
+					TokenEe1, TokenS, TokenEs},
+				patternLine{TokenInitiator, TokenS, TokenSe},
+			}, nil},
+		{"one-way cannot use hfs", "Nhfs", nil, nil, errInvalidHfs},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			hp, err := FromString(tt.patternName)
+			require.Equal(t, tt.errExpected, err, "error not match")
+			if tt.errExpected != nil {
+				require.Nil(t, hp, "should not return a pattern")
+				return
+			}
+			require.Equal(t, tt.preExpected, hp.PreMessagePattern,
+				"pre-message not match")
+			require.Equal(t, tt.msgExpected, hp.MessagePattern,
+				"message not match")
+		})
+	}
+
+	// the original pattern should stay unchanged
+	hp, err := FromString("IK")
+	require.NoError(t, err, "should return no error")
+	require.Len(t, hp.PreMessagePattern[0], 2, "IK pre-message unchanged")
+	require.Len(t, hp.MessagePattern[0], 5, "IK message unchanged")
+}
+
+func TestKemMode(t *testing.T) {
+	xx, err := FromString("XX")
+	require.NoError(t, err, "should return no error")
+	require.False(t, xx.KemMode(), "XX is not in KEM mode")
+
+	pqXX, err := FromString("pqXX")
+	require.NoError(t, err, "should return no error")
+	require.True(t, pqXX.KemMode(), "pqXX is in KEM mode")
+	require.Equal(t, pattern{
+		patternLine{TokenInitiator, TokenE},
+		patternLine{TokenResponder, TokenEkem, TokenS},
+		patternLine{TokenInitiator, TokenSkem, TokenS},
+		patternLine{TokenResponder, TokenSkem},
+	}, pqXX.MessagePattern, "message not match")
+
+	// modifiers can be mounted to the PQNoise patterns
+	pqXXpsk0, err := FromString("pqXXpsk0")
+	require.NoError(t, err, "should return no error")
+	require.Equal(t, &Modifier{PskIndexes: []int{0}}, pqXXpsk0.Modifier,
+		"modifier returned not match")
+	require.Equal(t, patternLine{TokenInitiator, TokenPsk, TokenE},
+		pqXXpsk0.MessagePattern[0], "psk not padded")
+}
+
 func ExampleRegister() {
 	// Register a psk0 with NK
 	name := "NKpsk0"
@@ -0,0 +1,107 @@
+package pattern
+
+// Post-quantum handshake patterns, as defined in the PQNoise paper,
+//   https://eprint.iacr.org/2022/539
+// They follow the same naming as the interactive patterns, prefixed by "pq".
+// The "e" and "s" tokens carry KEM public keys, and the DH tokens are replaced
+// by the KEM tokens,
+//   ekem = encapsulate a shared secret to the remote ephemeral key
+//   skem = encapsulate a shared secret to the remote static key
+var (
+	pq = []struct {
+		name    string
+		pattern string
+	}{
+		{
+			name: "pqNN",
+			pattern: `
+  				-> e
+  				<- ekem`,
+		}, {
+			name: "pqKN",
+			pattern: `
+  				-> s
+  				...
+  				-> e
+  				<- ekem, skem`,
+		}, {
+			name: "pqNK",
+			pattern: `
+  				<- s
+  				...
+  				-> skem, e
+  				<- ekem`,
+		}, {
+			name: "pqKK",
+			pattern: `
+  				-> s
+  				<- s
+  				...
+  				-> skem, e
+  				<- ekem, skem`,
+		}, {
+			name: "pqNX",
+			pattern: `
+  				-> e
+  				<- ekem, s
+  				-> skem`,
+		}, {
+			name: "pqKX",
+			pattern: `
+  				-> s
+  				...
+  				-> e
+  				<- ekem, skem, s
+  				-> skem`,
+		}, {
+			name: "pqXN",
+			pattern: `
+  				-> e
+  				<- ekem
+  				-> s
+  				<- skem`,
+		}, {
+			name: "pqIN",
+			pattern: `
+  				-> e, s
+  				<- ekem, skem`,
+		}, {
+			name: "pqXK",
+			pattern: `
+  				<- s
+  				...
+  				-> skem, e
+  				<- ekem
+  				-> s
+  				<- skem`,
+		}, {
+			name: "pqIK",
+			pattern: `
+  				<- s
+  				...
+  				-> skem, e, s
+  				<- ekem, skem`,
+		}, {
+			name: "pqXX",
+			pattern: `
+  				-> e
+  				<- ekem, s
+  				-> skem, s
+  				<- skem`,
+		}, {
+			name: "pqIX",
+			pattern: `
+  				-> e, s
+  				<- ekem, skem, s
+  				-> skem`,
+		},
+	}
+)
+
+func init() {
+	for _, p := range pq {
+		if err := Register(p.name, p.pattern); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -23,6 +23,18 @@ const (
 	TokenSs = Token("ss")
 	// TokenPsk is the psk from noise specs.
 	TokenPsk = Token("psk")
+	// TokenE1 is the e1 from the hfs extension specs, which is the second
+	// ephemeral key using the hybrid dh curve.
+	TokenE1 = Token("e1")
+	// TokenEe1 is the ee1 from the hfs extension specs, which performs a DH
+	// using the local and remote hybrid ephemeral keys.
+	TokenEe1 = Token("ee1")
+	// TokenEkem is the ekem from the PQNoise specs, which encapsulates a
+	// shared secret using the remote ephemeral KEM public key.
+	TokenEkem = Token("ekem")
+	// TokenSkem is the skem from the PQNoise specs, which encapsulates a
+	// shared secret using the remote static KEM public key.
+	TokenSkem = Token("skem")
 
 	// TokenInitiator indicates the message is sent from initiator to responder.
 	TokenInitiator = Token("->")
@@ -35,11 +47,16 @@ const (
 	errConsecutiveTokens = "cannot have two consecutive line using %s"
 	errRepeatedTokens    = "token '%s' appeared more than once"
 	errMissingToken      = "need token %s before %s"
+	errMixedTokens       = "cannot mix %s with KEM tokens"
 	errMustBeInitiator   = "the first line must be from initiator"
+	errMustBeResponder   = "the first line must be from responder in fallback"
 	errInvalidLine       = "line '%s' is invalid"
 	errPskNotAllowed     = "psk is not allowed"
-	errTooManyTokens     = "pre-message cannot have more then 2 tokens"
+	errTooManyTokens     = "pre-message cannot have more then 3 tokens"
 	errTokenNotAllowed   = "%s is not allowed in pre-message"
+	errUnknownKey        = "%s needs the %s key %s, which is not sent before"
+	errUnsafeEncrypt     = "%s cannot encrypt after %s without %s"
+	errPskWithoutE       = "%s cannot encrypt after psk without sending e"
 )
 
 type patternLine []Token
@@ -106,6 +123,14 @@ func parseTokenFromString(s string) (Token, error) {
 		return TokenResponder, nil
 	case "psk":
 		return TokenPsk, nil
+	case "e1":
+		return TokenE1, nil
+	case "ee1":
+		return TokenEe1, nil
+	case "ekem":
+		return TokenEkem, nil
+	case "skem":
+		return TokenSkem, nil
 	default:
 		return tokenInvalid, fmt.Errorf("token %s is invalid", s)
 	}
@@ -117,6 +142,46 @@ func parseTokenFromString(s string) (Token, error) {
 //   <- e, ee
 // and returns, a pattern, which is []patternline. A patternline is []Token.
 func tokenize(ms string, pre bool) (pattern, error) {
+	p, err := parseMessages(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate pattern based on it's pre-message or not
+	if pre {
+		if err := validatePrePattern(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	if err := validatePattern(p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// tokenizeFallback takes a message string of a fallback pattern and turns it
+// into a pattern. Unlike tokenize, the first line of the message must be sent
+// by the responder, as the initiator's first message has been turned into a
+// pre-message.
+func tokenizeFallback(ms string) (pattern, error) {
+	p, err := parseMessages(ms)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateFallbackPattern(p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// parseMessages breaks a message string into lines of tokens without
+// validating it.
+func parseMessages(ms string) (pattern, error) {
 	p := pattern{}
 
 	// remove message whitespaces
@@ -139,24 +204,14 @@ func tokenize(ms string, pre bool) (pattern, error) {
 		p = append(p, pl)
 	}
 
-	// validate pattern based on it's pre-message or not
-	if pre {
-		if err := validatePrePattern(p); err != nil {
-			return nil, err
-		}
-		return p, nil
-	}
-
-	if err := validatePattern(p); err != nil {
-		return nil, err
-	}
-
 	return p, nil
 }
 
 // tokenizePreMessage takes a pre-message string and turns it into tokens. A
 // valid pre-message must pass the following checks,
 //  - it can only have a line of "e", "s", or "e, s", no "psk" is allowed.
+//  - when the hfs modifier is used, "e1" can follow "e", which gives "e, e1"
+//    or "e, e1, s".
 func validatePrePattern(pl pattern) error {
 	isInitiator := pl[0][0] == TokenInitiator
 	prevIsInitiator := !isInitiator
@@ -177,9 +232,9 @@ func validatePrePattern(pl pattern) error {
 		}
 		prevIsInitiator = isInitiator
 
-		// pre-message can have at most 2 tokens, e and s, plus a direction
-		// token, "->" or "<-", so max is 3.
-		if len(line) > 3 {
+		// pre-message can have at most 3 tokens, e, e1 and s, plus a
+		// direction token, "->" or "<-", so max is 4.
+		if len(line) > 4 {
 			return errInvalidPattern(errTooManyTokens)
 		}
 
@@ -195,41 +250,82 @@ func validatePrePattern(pl pattern) error {
 			}
 		}
 
-		if len(tokens) == 2 {
-			if tokens[0] != TokenE || tokens[1] != TokenS {
-				return errInvalidPattern(errTokenNotAllowed, tokens)
-			}
+		if len(tokens) > 1 && !isValidPreLine(tokens) {
+			return errInvalidPattern(errTokenNotAllowed, tokens)
 		}
 
 	}
 	return nil
 }
 
-// validatePattern implements the rules specified in the noise specs, which,
-// 1. Parties must not send their static public key or ephemeral public key
-// more than once per handshake.
-// 2. Parties must not perform a DH calculation more than once per handshake
-// (i.e. there must be no more than one occurrence of "ee", "es", "se", or
-// "ss" per handshake).
-// 3. After an "se" token, the initiator must not send a handshake payload or
-// transport payload unless there has also been an "ee" token.
-// 4. After an "ss" token, the initiator must not send a handshake payload or
-// transport payload unless there has also been an "es" token.
-// 5. After an "es" token, the responder must not send a handshake payload or
-// transport payload unless there has also been an "ee" token.
-// 6. After an "ss" token, the responder must not send a handshake payload or
-// transport payload unless there has also been an "se" token.
-func validatePattern(pl pattern) error {
-	tokenSeen := map[Token]int{}
+// isValidPreLine checks that a pre-message line with more than one token is
+// one of "e, s", "e, e1" or "e, e1, s".
+func isValidPreLine(tokens patternLine) bool {
+	validLines := []patternLine{
+		{TokenE, TokenS},
+		{TokenE, TokenE1},
+		{TokenE, TokenE1, TokenS},
+	}
 
+	for _, l := range validLines {
+		if len(l) != len(tokens) {
+			continue
+		}
+		matched := true
+		for i := range l {
+			if l[i] != tokens[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePattern checks the structure of the message lines, which,
+// 1. The initiator and responder must send their messages alternately.
+// 2. A token cannot appear more than once in a message, except for "psk".
+// In addition, when the hfs modifier is used, an "e1" token must follow an
+// "e" token in the same message, and an "ee1" token must follow an "ee" token.
+// For the PQNoise patterns, the KEM tokens "ekem" and "skem" cannot be mixed
+// with the DH tokens.
+//
+// The rules depending on the keys known by each party, which need the
+// pre-messages, are checked by validateHandshake.
+func validatePattern(pl pattern) error {
 	// checks that the first line in the message is an initiator token.
-	isInitiator := pl[0][0] == TokenInitiator
-	if isInitiator != true {
+	if pl[0][0] != TokenInitiator {
 		return errInvalidPattern(errMustBeInitiator)
 	}
+
+	return validateMessageLines(pl)
+}
+
+// validateFallbackPattern implements the same rules as validatePattern, except
+// that the first line must be sent by the responder. A fallback pattern is a
+// Bob-initiated pattern, in which the initiator's first message is converted
+// into a pre-message.
+func validateFallbackPattern(pl pattern) error {
+	// checks that the first line in the message is a responder token.
+	if pl[0][0] != TokenResponder {
+		return errInvalidPattern(errMustBeResponder)
+	}
+
+	return validateMessageLines(pl)
+}
+
+// validateMessageLines checks the message lines against the rules listed in
+// validatePattern, regardless of which party sends the first line.
+func validateMessageLines(pl pattern) error {
+	tokenSeen := map[Token]int{}
+
+	isInitiator := pl[0][0] == TokenInitiator
 	prevIsInitiator := !isInitiator
 
-	for _, line := range pl {
+	for i, line := range pl {
 		count := map[Token]int{}
 
 		isInitiator = line[0] == TokenInitiator
@@ -243,56 +339,347 @@ func validatePattern(pl pattern) error {
 		//   -> e, ee, se
 		// is not legal as they are both from the initiator(->)
 		if prevIsInitiator == isInitiator {
-			return errInvalidPattern(errConsecutiveTokens, line[0])
+			return errInvalidMessageLine(
+				i, line, errConsecutiveTokens, line[0])
 		}
 		prevIsInitiator = isInitiator
 
 		// TODO: psk token can only be at the begining or end of a line
 
-		for _, token := range line[1:] {
-			// check rule 1 and 2 on each pattern line. Not that a "psk" token
-			// is allowed to appear one or more times in a handshake pattern.
+		for j := 1; j < len(line); j++ {
+			token := line[j]
+
+			// a token cannot be repeated in a line. Not that a "psk" token is
+			// allowed to appear one or more times in a handshake pattern.
 			if token != TokenPsk && count[token] > 0 {
-				return errInvalidPattern(errRepeatedTokens, token)
+				return errInvalidToken(i, line, j, errRepeatedTokens, token)
+			}
+
+			// check the hfs tokens
+			switch token {
+			case TokenE1:
+				// must have sent an "e" token in the same line
+				if count[TokenE] < 1 {
+					return errInvalidToken(
+						i, line, j, errMissingToken, TokenE, TokenE1)
+				}
+			case TokenEe1:
+				// must have seen an "ee" token before
+				if tokenSeen[TokenEe] < 1 {
+					return errInvalidToken(
+						i, line, j, errMissingToken, TokenEe, TokenEe1)
+				}
 			}
 
 			count[token]++
 			tokenSeen[token]++
 
-			if isInitiator {
-				// check rule 3 and 4
-				switch token {
-				case TokenSe:
-					// must have seen an "ee" token before
-					if tokenSeen[TokenEe] < 1 {
-						return errInvalidPattern(
-							errMissingToken, TokenEe, TokenSe)
-					}
-				case TokenSs:
-					// must have seen an "es" token before
-					if tokenSeen[TokenEs] < 1 {
-						return errInvalidPattern(
-							errMissingToken, TokenEs, TokenSs)
-					}
-				}
-			} else {
-				// check rule 5 and 6
-				switch token {
-				case TokenEs:
-					// must have seen an "ee" token before
-					if tokenSeen[TokenEe] < 1 {
-						return errInvalidPattern(
-							errMissingToken, TokenEe, TokenEs)
-					}
-				case TokenSs:
-					// must have seen an "se" token before
-					if tokenSeen[TokenSe] < 1 {
-						return errInvalidPattern(
-							errMissingToken, TokenSe, TokenSs)
-					}
-				}
+			if isKemToken(token) && hasDHToken(tokenSeen) ||
+				isDHToken(token) && hasKemToken(tokenSeen) {
+				return errInvalidToken(i, line, j, errMixedTokens, token)
 			}
 		}
 	}
 	return nil
 }
+
+// dhKeys gives the keys used by each DH token, which are the initiator's key
+// followed by the responder's key.
+var dhKeys = map[Token][2]Token{
+	TokenEe:  {TokenE, TokenE},
+	TokenEs:  {TokenE, TokenS},
+	TokenSe:  {TokenS, TokenE},
+	TokenSs:  {TokenS, TokenS},
+	TokenEe1: {TokenE1, TokenE1},
+}
+
+// partyToken is a token sent by a party, where party is the direction token.
+type partyToken struct {
+	party Token
+	token Token
+}
+
+// handshakeTracker tracks the keys sent and the DHs performed while walking
+// through a handshake, which is used by validateHandshake.
+type handshakeTracker struct {
+	// sent holds the public keys and the KEM tokens sent by each party.
+	sent map[partyToken]bool
+
+	// done holds the DH tokens performed.
+	done map[Token]bool
+
+	// psk specifies whether a "psk" token has been processed, and pskMode
+	// specifies whether the pattern has any, in which case the "e" token
+	// also mixes the key.
+	psk     bool
+	pskMode bool
+
+	// hasKey specifies whether the cipher key is set, after which the "s"
+	// tokens and the payloads are encrypted.
+	hasKey bool
+}
+
+// validateHandshake checks the full handshake, including the pre-messages,
+// against the validity rules in the section 7.3 of the noise specs, which,
+// 1. Parties can only perform DH between private keys and public keys they
+// possess.
+// 2. Parties must not send their static public key or ephemeral public key
+// more than once per handshake, including the pre-messages.
+// 3. Parties must not perform a DH calculation more than once per handshake.
+// 4. After performing a DH between a remote public key (either static or
+// ephemeral) and the local static key, the local party must not call
+// ENCRYPT() unless it has also performed a DH between its local ephemeral key
+// and the remote public key.
+// And the rule for the psk modifier in the section 9.3,
+// 5. A party must not send any encrypted data after it processes a "psk"
+// token unless it has previously sent an ephemeral public key, either before
+// or after the "psk" token.
+// The rule 4 and 5 are checked whenever a party encrypts, which happens to
+// the "s" tokens sent after a key is set, the payloads, and the transport
+// messages. The "ekem" and "skem" tokens of the PQNoise patterns follow the
+// rule 1 and 3, which need the remote ephemeral or static key respectively,
+// and as each encapsulation is freshly generated, sending one also satisfies
+// the rule 5.
+func validateHandshake(pre, messages pattern) error {
+	tr := &handshakeTracker{
+		sent: map[partyToken]bool{},
+		done: map[Token]bool{},
+	}
+	for _, line := range messages {
+		for _, t := range line[1:] {
+			if t == TokenPsk {
+				tr.pskMode = true
+			}
+		}
+	}
+
+	for i, line := range pre {
+		for j, t := range line[1:] {
+			key := partyToken{line[0], t}
+			if tr.sent[key] {
+				return errInvalidPreToken(
+					i, line, j+1, errRepeatedTokens, t)
+			}
+			tr.sent[key] = true
+		}
+	}
+
+	for i, line := range messages {
+		party := line[0]
+		for j := 1; j < len(line); j++ {
+			if reason := tr.process(party, line[j]); reason != "" {
+				return errInvalidToken(i, line, j, "%s", reason)
+			}
+		}
+
+		// the payload is encrypted once a key is set.
+		if reason := tr.checkEncrypt(party); reason != "" {
+			return errInvalidPayload(i, line, "%s", reason)
+		}
+	}
+
+	// both parties send transport messages, except for the one-way patterns,
+	// in which only the initiator sends.
+	parties := []Token{TokenInitiator, TokenResponder}
+	if len(messages) == 1 && messages[0][0] == TokenInitiator {
+		parties = parties[:1]
+	}
+	for _, party := range parties {
+		if reason := tr.checkEncrypt(party); reason != "" {
+			return errInvalidPattern("transport message: %s", reason)
+		}
+	}
+	return nil
+}
+
+// process processes a token sent by the party, and returns the reason if a
+// rule is broken.
+func (tr *handshakeTracker) process(party, t Token) string {
+	switch t {
+	case TokenE, TokenS, TokenE1:
+		// the static key is encrypted once a key is set.
+		if t == TokenS {
+			if reason := tr.checkEncrypt(party); reason != "" {
+				return reason
+			}
+		}
+
+		key := partyToken{party, t}
+		if tr.sent[key] {
+			return fmt.Sprintf(errRepeatedTokens, t)
+		}
+		tr.sent[key] = true
+
+		if t == TokenE && tr.pskMode {
+			tr.hasKey = true
+		}
+
+	case TokenEe, TokenEs, TokenSe, TokenSs, TokenEe1:
+		keys := dhKeys[t]
+		if !tr.sent[partyToken{TokenInitiator, keys[0]}] {
+			return fmt.Sprintf(errUnknownKey, t, TokenInitiator, keys[0])
+		}
+		if !tr.sent[partyToken{TokenResponder, keys[1]}] {
+			return fmt.Sprintf(errUnknownKey, t, TokenResponder, keys[1])
+		}
+		if tr.done[t] {
+			return fmt.Sprintf(errRepeatedTokens, t)
+		}
+		tr.done[t] = true
+		tr.hasKey = true
+
+	case TokenEkem, TokenSkem:
+		// the shared secret is encapsulated to the remote key.
+		remote := TokenE
+		if t == TokenSkem {
+			remote = TokenS
+		}
+		other := otherParty(party)
+		if !tr.sent[partyToken{other, remote}] {
+			return fmt.Sprintf(errUnknownKey, t, other, remote)
+		}
+
+		key := partyToken{party, t}
+		if tr.sent[key] {
+			return fmt.Sprintf(errRepeatedTokens, t)
+		}
+		tr.sent[key] = true
+		tr.hasKey = true
+
+	case TokenPsk:
+		tr.psk = true
+		tr.hasKey = true
+	}
+	return ""
+}
+
+// checkEncrypt checks the rule 4 and 5 when the party encrypts, and returns
+// the reason if a rule is broken. Nothing is encrypted before a key is set.
+func (tr *handshakeTracker) checkEncrypt(party Token) string {
+	if !tr.hasKey {
+		return ""
+	}
+
+	// a DH with the local static key needs a DH with the local ephemeral key
+	// and the same remote key.
+	for _, remote := range []Token{TokenE, TokenS} {
+		static := dhToken(party, TokenS, remote)
+		ephemeral := dhToken(party, TokenE, remote)
+		if tr.done[static] && !tr.done[ephemeral] {
+			return fmt.Sprintf(errUnsafeEncrypt,
+				partyName(party), static, ephemeral)
+		}
+	}
+
+	if tr.psk && !tr.sentRandomness(party) {
+		return fmt.Sprintf(errPskWithoutE, partyName(party))
+	}
+	return ""
+}
+
+// sentRandomness specifies whether the party has sent an ephemeral public key,
+// or a KEM ciphertext, which are freshly generated.
+func (tr *handshakeTracker) sentRandomness(party Token) bool {
+	for _, t := range []Token{TokenE, TokenEkem, TokenSkem} {
+		if tr.sent[partyToken{party, t}] {
+			return true
+		}
+	}
+	return false
+}
+
+// dhToken returns the DH token performed by the party using its local key and
+// the remote key.
+func dhToken(party, local, remote Token) Token {
+	if party == TokenInitiator {
+		return local + remote
+	}
+	return remote + local
+}
+
+// partyName returns the name of the party sending the direction token.
+func partyName(party Token) string {
+	if party == TokenInitiator {
+		return "initiator"
+	}
+	return "responder"
+}
+
+// String returns the line as written in the pattern, e.g., "<- e, ee".
+func (pl patternLine) String() string {
+	if len(pl) == 0 {
+		return ""
+	}
+	tokens := make([]string, 0, len(pl)-1)
+	for _, t := range pl[1:] {
+		tokens = append(tokens, string(t))
+	}
+	return strings.TrimSpace(string(pl[0]) + " " + strings.Join(tokens, ", "))
+}
+
+// errInvalidMessageLine returns an error pointing to the message line of the index.
+func errInvalidMessageLine(i int, line patternLine,
+	format string, a ...interface{}) error {
+	return errInvalidPattern("line %d '%s': %s",
+		i+1, line, fmt.Sprintf(format, a...))
+}
+
+// errInvalidToken returns an error pointing to the token of the index j in
+// the message line of the index i.
+func errInvalidToken(i int, line patternLine, j int,
+	format string, a ...interface{}) error {
+	return errInvalidPattern("line %d '%s', token %d '%s': %s",
+		i+1, line, j, line[j], fmt.Sprintf(format, a...))
+}
+
+// errInvalidPreToken works like errInvalidToken for the pre-message lines.
+func errInvalidPreToken(i int, line patternLine, j int,
+	format string, a ...interface{}) error {
+	return errInvalidPattern("pre-message line %d '%s', token %d '%s': %s",
+		i+1, line, j, line[j], fmt.Sprintf(format, a...))
+}
+
+// errInvalidPayload returns an error pointing to the payload of the message
+// line of the index.
+func errInvalidPayload(i int, line patternLine,
+	format string, a ...interface{}) error {
+	return errInvalidPattern("line %d '%s', payload: %s",
+		i+1, line, fmt.Sprintf(format, a...))
+}
+
+// otherParty returns the direction token of the other party.
+func otherParty(t Token) Token {
+	if t == TokenInitiator {
+		return TokenResponder
+	}
+	return TokenInitiator
+}
+
+// isKemToken checks whether the token is a KEM token.
+func isKemToken(t Token) bool {
+	return t == TokenEkem || t == TokenSkem
+}
+
+// isDHToken checks whether the token performs a DH.
+func isDHToken(t Token) bool {
+	switch t {
+	case TokenEe, TokenEs, TokenSe, TokenSs, TokenEe1:
+		return true
+	}
+	return false
+}
+
+// hasKemToken checks whether a KEM token has been seen.
+func hasKemToken(seen map[Token]int) bool {
+	return seen[TokenEkem] > 0 || seen[TokenSkem] > 0
+}
+
+// hasDHToken checks whether a DH token has been seen.
+func hasDHToken(seen map[Token]int) bool {
+	for t, n := range seen {
+		if n > 0 && isDHToken(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -51,6 +51,10 @@ func TestParseTokenFromString(t *testing.T) {
 		{"->", TokenInitiator},
 		{"<-", TokenResponder},
 		{"psk", TokenPsk},
+		{"e1", TokenE1},
+		{"ee1", TokenEe1},
+		{"ekem", TokenEkem},
+		{"skem", TokenSkem},
 		{"x", tokenInvalid},
 	}
 
@@ -90,8 +94,8 @@ func TestValidatePrePattern(t *testing.T) {
 			patternLine{TokenInitiator, TokenE},
 		}, errInvalidPattern(errConsecutiveTokens, TokenInitiator)},
 		{"invalid pattern: wrong number of tokens", pattern{
-			//   -> e, e, e
-			patternLine{TokenInitiator, TokenE, TokenE, TokenE},
+			//   -> e, e, e, e
+			patternLine{TokenInitiator, TokenE, TokenE, TokenE, TokenE},
 		}, errInvalidPattern(errTooManyTokens)},
 		{"invalid pattern: wrong first token", pattern{
 			//   -> es
@@ -101,6 +105,19 @@ func TestValidatePrePattern(t *testing.T) {
 			//   -> e, e
 			patternLine{TokenInitiator, TokenE, TokenE},
 		}, errInvalidPattern(errTokenNotAllowed, patternLine{TokenE, TokenE})},
+		{"valid pattern: hfs pre-message", pattern{
+			//   -> e, e1, s
+			patternLine{TokenInitiator, TokenE, TokenE1, TokenS},
+		}, nil},
+		{"invalid pattern: e1 without e", pattern{
+			//   -> e1
+			patternLine{TokenInitiator, TokenE1},
+		}, errInvalidPattern(errTokenNotAllowed, TokenE1)},
+		{"invalid pattern: wrong hfs order", pattern{
+			//   -> e, s, e1
+			patternLine{TokenInitiator, TokenE, TokenS, TokenE1},
+		}, errInvalidPattern(errTokenNotAllowed,
+			patternLine{TokenE, TokenS, TokenE1})},
 	}
 
 	for _, tt := range testParams {
@@ -146,39 +163,55 @@ func TestValidatePattern(t *testing.T) {
 			//   -> e, ee
 			patternLine{TokenInitiator, TokenE},
 			patternLine{TokenInitiator, TokenE, TokenEe},
-		}, errInvalidPattern(errConsecutiveTokens, TokenInitiator)},
+		}, errInvalidPattern(
+			"line 2 '-> e, ee': cannot have two consecutive line using ->")},
 		{"invalid pattern: repeated token e", pattern{
-			//   -> e, s
+			//   -> e, e
 			patternLine{TokenInitiator, TokenE, TokenE},
-		}, errInvalidPattern(errRepeatedTokens, TokenE)},
+		}, errInvalidPattern("line 1 '-> e, e', token 2 'e': " +
+			"token 'e' appeared more than once")},
 		{"invalid pattern: repeated token es", pattern{
 			//   -> es, es
 			patternLine{TokenInitiator, TokenEs, TokenEs},
-		}, errInvalidPattern(errRepeatedTokens, TokenEs)},
+		}, errInvalidPattern("line 1 '-> es, es', token 2 'es': " +
+			"token 'es' appeared more than once")},
 		{"valid pattern: repeated token psk is allowed in message", pattern{
 			// -> psk, psk
 			patternLine{TokenInitiator, TokenPsk, TokenPsk},
 		}, nil},
-		{"invalid pattern: initiator needs ee before se", pattern{
-			//   -> se
-			patternLine{TokenInitiator, TokenSe},
-		}, errInvalidPattern(errMissingToken, TokenEe, TokenSe)},
-		{"invalid pattern: initiator needs es before ss", pattern{
-			//   -> ss
-			patternLine{TokenInitiator, TokenSs},
-		}, errInvalidPattern(errMissingToken, TokenEs, TokenSs)},
-		{"invalid pattern: responder needs ee before es", pattern{
+		{"valid pattern: hfs tokens", pattern{
+			//   -> e, e1
+			//   <- e, e1, ee, ee1
+			patternLine{TokenInitiator, TokenE, TokenE1},
+			patternLine{TokenResponder, TokenE, TokenE1, TokenEe, TokenEe1},
+		}, nil},
+		{"invalid pattern: needs e before e1", pattern{
+			//   -> e1, e
+			patternLine{TokenInitiator, TokenE1, TokenE},
+		}, errInvalidPattern("line 1 '-> e1, e', token 1 'e1': " +
+			"need token e before e1")},
+		{"invalid pattern: needs ee before ee1", pattern{
+			//   -> e, e1
+			//   <- e, e1, ee1, ee
+			patternLine{TokenInitiator, TokenE, TokenE1},
+			patternLine{TokenResponder, TokenE, TokenE1, TokenEe1, TokenEe},
+		}, errInvalidPattern("line 2 '<- e, e1, ee1, ee', token 3 'ee1': " +
+			"need token ee before ee1")},
+		{"valid pattern: KEM tokens", pattern{
 			//   -> e
-			//   <- es
+			//   <- ekem, s
+			//   -> skem
 			patternLine{TokenInitiator, TokenE},
-			patternLine{TokenResponder, TokenEs},
-		}, errInvalidPattern(errMissingToken, TokenEe, TokenEs)},
-		{"invalid pattern: responder needs se before ss", pattern{
+			patternLine{TokenResponder, TokenEkem, TokenS},
+			patternLine{TokenInitiator, TokenSkem},
+		}, nil},
+		{"invalid pattern: cannot mix KEM and DH tokens", pattern{
 			//   -> e
-			//   <- ss
+			//   <- ekem, e, ee
 			patternLine{TokenInitiator, TokenE},
-			patternLine{TokenResponder, TokenSs},
-		}, errInvalidPattern(errMissingToken, TokenSe, TokenSs)},
+			patternLine{TokenResponder, TokenEkem, TokenE, TokenEe},
+		}, errInvalidPattern("line 2 '<- ekem, e, ee', token 3 'ee': " +
+			"cannot mix ee with KEM tokens")},
 	}
 
 	for _, tt := range testParams {
@@ -189,6 +222,188 @@ func TestValidatePattern(t *testing.T) {
 	}
 }
 
+func TestValidateFallbackPattern(t *testing.T) {
+	testParams := []struct {
+		name     string
+		p        pattern
+		expected error
+	}{
+		{"valid pattern: XXfallback", pattern{
+			//   <- e, ee, s, es
+			//   -> s, se
+			patternLine{TokenResponder, TokenE, TokenEe, TokenS, TokenEs},
+			patternLine{TokenInitiator, TokenS, TokenSe},
+		}, nil},
+		{"invalid pattern: first token must be responder", pattern{
+			//   -> e
+			patternLine{TokenInitiator, TokenE},
+		}, errInvalidPattern(errMustBeResponder)},
+		{"invalid pattern: two responders", pattern{
+			//   <- e
+			//   <- e, ee
+			patternLine{TokenResponder, TokenE},
+			patternLine{TokenResponder, TokenE, TokenEe},
+		}, errInvalidPattern(
+			"line 2 '<- e, ee': cannot have two consecutive line using <-")},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFallbackPattern(tt.p)
+			require.Equal(t, tt.expected, err, "error not match")
+		})
+	}
+}
+
+func TestValidateHandshake(t *testing.T) {
+	testParams := []struct {
+		name     string
+		pre      string
+		messages string
+		expected string
+	}{
+		{"valid pattern: XX", "", `
+			-> e
+			<- e, ee, s, es
+			-> s, se`, ""},
+		{"valid pattern: IK", "<- s", `
+			-> e, es, s, ss
+			<- e, ee, se`, ""},
+		{"valid pattern: one-way K", "-> s\n<- s", `
+			-> e, es, ss`, ""},
+		{"valid pattern: XXfallback", "-> e", `
+			<- e, ee, s, es
+			-> s, se`, ""},
+		{"valid pattern: ee after se in the same line", "", `
+			-> e, s
+			<- e, se, ee`, ""},
+		{"valid pattern: psk with e", "<- s", `
+			-> psk, e, es
+			<- e, ee`, ""},
+		{"valid pattern: psk with KEM", "", `
+			-> psk, e
+			<- ekem, s
+			-> skem`, ""},
+
+		// rule 1, the keys must be known
+		{"invalid pattern: responder's e unknown", "", `
+			-> e, s, se`,
+			"line 1 '-> e, s, se', token 3 'se': " +
+				"se needs the <- key e, which is not sent before"},
+		{"invalid pattern: initiator's s unknown", "", `
+			-> e
+			<- e, ee, ss`,
+			"line 2 '<- e, ee, ss', token 3 'ss': " +
+				"ss needs the -> key s, which is not sent before"},
+		{"invalid pattern: pre-message key is known", "<- s", `
+			-> e, es`, ""},
+		{"invalid pattern: hfs needs both e1", "", `
+			-> e, e1
+			<- e, ee, ee1`,
+			"line 2 '<- e, ee, ee1', token 3 'ee1': " +
+				"ee1 needs the <- key e1, which is not sent before"},
+		{"invalid pattern: ekem needs the remote e", "", `
+			-> e, ekem`,
+			"line 1 '-> e, ekem', token 2 'ekem': " +
+				"ekem needs the <- key e, which is not sent before"},
+		{"invalid pattern: skem needs the remote s", "", `
+			-> e
+			<- ekem, skem`,
+			"line 2 '<- ekem, skem', token 2 'skem': " +
+				"skem needs the -> key s, which is not sent before"},
+
+		// rule 2, the keys are sent once
+		{"invalid pattern: e sent twice", "", `
+			-> e
+			<- e, ee
+			-> e`,
+			"line 3 '-> e', token 1 'e': token 'e' appeared more than once"},
+		{"invalid pattern: s sent in pre-message", "-> s", `
+			-> e, s`,
+			"line 1 '-> e, s', token 2 's': token 's' appeared more than once"},
+		{"invalid pattern: ekem sent twice", "", `
+			-> e
+			<- e, ekem
+			-> ekem
+			<- ekem`,
+			"line 4 '<- ekem', token 1 'ekem': " +
+				"token 'ekem' appeared more than once"},
+
+		// rule 3, the DHs are performed once
+		{"invalid pattern: ee performed twice", "", `
+			-> e
+			<- e, ee
+			-> ee`,
+			"line 3 '-> ee', token 1 'ee': token 'ee' appeared more than once"},
+
+		// rule 4, the static DH needs the ephemeral DH before encrypting
+		{"invalid pattern: initiator encrypts after se without ee", "", `
+			-> e, s
+			<- e, se`,
+			"transport message: initiator cannot encrypt after se without ee"},
+		{"invalid pattern: initiator payload after ss without es",
+			"<- s", `
+			-> e, s, ss`,
+			"line 1 '-> e, s, ss', payload: " +
+				"initiator cannot encrypt after ss without es"},
+		{"invalid pattern: responder payload after es without ee",
+			"<- s", `
+			-> e
+			<- es`,
+			"line 2 '<- es', payload: " +
+				"responder cannot encrypt after es without ee"},
+		{"invalid pattern: responder payload after ss without se",
+			"-> s\n<- s", `
+			-> e, es
+			<- e, ee, ss
+			-> s`,
+			"line 2 '<- e, ee, ss', payload: " +
+				"responder cannot encrypt after ss without se"},
+
+		// rule 5, psk needs e
+		{"invalid pattern: psk without e", "", `
+			-> psk`,
+			"line 1 '-> psk', payload: " +
+				"initiator cannot encrypt after psk without sending e"},
+		{"invalid pattern: s encrypted after psk without e", "<- s", `
+			-> psk, s, e, es`,
+			"line 1 '-> psk, s, e, es', token 2 's': " +
+				"initiator cannot encrypt after psk without sending e"},
+		{"invalid pattern: responder without e", "", `
+			-> e
+			<- psk`,
+			"line 2 '<- psk', payload: " +
+				"responder cannot encrypt after psk without sending e"},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			var pre pattern
+			if tt.pre != "" {
+				var err error
+				pre, err = tokenize(tt.pre, true)
+				require.NoError(t, err, "failed to parse pre-message")
+			}
+			p, err := parseMessages(tt.messages)
+			require.NoError(t, err, "failed to parse messages")
+
+			err = validateHandshake(pre, p)
+			if tt.expected == "" {
+				require.NoError(t, err, "should have no error")
+			} else {
+				require.EqualError(t, err, "Invalid pattern: "+tt.expected,
+					"error not match")
+			}
+		})
+	}
+
+	// a pre-message key cannot be sent twice
+	err := validateHandshake(
+		pattern{{TokenInitiator, TokenE, TokenE}}, pattern{{TokenResponder}})
+	require.EqualError(t, err, "Invalid pattern: pre-message line 1 "+
+		"'-> e, e', token 2 'e': token 'e' appeared more than once")
+}
+
 func TestTokenize(t *testing.T) {
 	testParams := []struct {
 		name     string
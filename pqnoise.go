@@ -0,0 +1,331 @@
+package babble
+
+import (
+	"errors"
+
+	"github.com/crypto-y/babble/kem"
+	"github.com/crypto-y/babble/pattern"
+)
+
+// This file implements the KEM tokens used by the PQNoise patterns, as
+// specified in https://eprint.iacr.org/2022/539. When a KEM is used, the "e"
+// and "s" tokens carry KEM public keys, and the DH tokens are replaced by,
+//  - "ekem", the sender encapsulates a shared secret to the remote ephemeral
+//    key. Appends the ciphertext to the buffer, calls MixHash(ciphertext) and
+//    MixKey(secret).
+//  - "skem", the sender encapsulates a shared secret to the remote static key.
+//    Appends EncryptAndHash(ciphertext) to the buffer, and calls
+//    MixKey(secret).
+// The receiver decapsulates the ciphertext using its local ephemeral or static
+// key to get the same secret.
+
+var errMissingKem = errors.New("missing KEM")
+
+// kemMode specifies whether the handshake uses a KEM instead of a dh curve.
+func (hs *HandshakeState) kemMode() bool {
+	return hs.ss.kem != nil
+}
+
+// handleMissingKemKeyE will create the missing KEM ephemeral key if the
+// autoPadding flag is turned on.
+func (hs *HandshakeState) handleMissingKemKeyE() error {
+	if hs.autoPadding {
+		// the only error comes from the underlying rand.Read.
+		key, err := hs.ss.kem.GenerateKeyPair(nil)
+		if err != nil {
+			return err
+		}
+		hs.localEphemeralKem = key
+	} else {
+		return errMissingKey("local ephemeral key")
+	}
+	return nil
+}
+
+// handleMissingKemKeyS will create the missing KEM static key if the
+// autoPadding flag is turned on.
+func (hs *HandshakeState) handleMissingKemKeyS() error {
+	if hs.autoPadding {
+		// the only error comes from the underlying rand.Read.
+		key, err := hs.ss.kem.GenerateKeyPair(nil)
+		if err != nil {
+			return err
+		}
+		hs.localStaticKem = key
+	} else {
+		return errMissingKey("local static key")
+	}
+	return nil
+}
+
+func (hs *HandshakeState) processPreKemTokenE(d pattern.Token) error {
+	var keyBytes []byte
+	// find out whether a local or remote key to be used
+	if hs.mustWrite(d) {
+		if hs.localEphemeralKem == nil {
+			if err := hs.handleMissingKemKeyE(); err != nil {
+				return err
+			}
+		}
+		keyBytes = hs.localEphemeralKem.PubKey().Bytes()
+	} else {
+		if hs.remoteEphemeralKemPub == nil {
+			return errMissingKey("remote ephemeral key")
+		}
+		keyBytes = hs.remoteEphemeralKemPub.Bytes()
+	}
+
+	hs.ss.MixHash(keyBytes)
+	// if psk enabled, call MixKey
+	if hs.pskMode() {
+		if err := hs.ss.MixKey(keyBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs *HandshakeState) processPreKemTokenS(d pattern.Token) error {
+	var keyBytes []byte
+	// find out whether a local or remote key to be used
+	if hs.mustWrite(d) {
+		if hs.localStaticKem == nil {
+			if err := hs.handleMissingKemKeyS(); err != nil {
+				return err
+			}
+		}
+		keyBytes = hs.localStaticKem.PubKey().Bytes()
+	} else {
+		if hs.remoteStaticKemPub == nil {
+			return errMissingKey("remote static key")
+		}
+		keyBytes = hs.remoteStaticKemPub.Bytes()
+	}
+
+	hs.ss.MixHash(keyBytes)
+	return nil
+}
+
+// readKemTokenE sets re (which must be empty) to the next PUBLEN bytes from
+// the payload. Calls MixHash(re.publicKey).
+func (hs *HandshakeState) readKemTokenE(payload []byte) ([]byte, error) {
+	// check empty
+	if hs.remoteEphemeralKemPub != nil {
+		return nil, errKeyNotEmpty("remote ephemeral key")
+	}
+
+	// check we have enough bytes to use
+	publen := hs.ss.kem.PublicKeySize()
+	if len(payload) < publen {
+		return nil, errInvalidPayload
+	}
+
+	pub, err := hs.ss.kem.LoadPublicKey(payload[:publen])
+	if err != nil {
+		return nil, err
+	}
+	hs.remoteEphemeralKemPub = pub
+
+	hs.ss.MixHash(pub.Bytes())
+
+	// if psk enabled, call MixKey
+	if hs.pskMode() {
+		if err := hs.ss.MixKey(pub.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	return payload[publen:], nil
+}
+
+// writeKemTokenE sets e (if empty) to GENERATE_KEYPAIR(). Appends
+// e.public_key to the buffer. Calls MixHash(e.public_key).
+func (hs *HandshakeState) writeKemTokenE(payload []byte) ([]byte, error) {
+	// generate key if empty
+	if hs.localEphemeralKem == nil {
+		key, err := hs.ss.kem.GenerateKeyPair(nil)
+		// the only error comes from the underlying rand.Read.
+		if err != nil {
+			return nil, err
+		}
+		hs.localEphemeralKem = key
+	}
+
+	pub := hs.localEphemeralKem.PubKey().Bytes()
+	payload = append(payload, pub...)
+
+	hs.ss.MixHash(pub)
+
+	// if psk enabled, call MixKey
+	if hs.pskMode() {
+		if err := hs.ss.MixKey(pub); err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+// readKemTokenS sets temp to the next PUBLEN + ADLEN bytes of the payload if
+// HasKey() == True, or to the next PUBLEN bytes otherwise. Sets rs (if empty)
+// to DecryptAndHash(temp).
+func (hs *HandshakeState) readKemTokenS(payload []byte) ([]byte, error) {
+	data, payload, err := hs.readAndDecrypt(
+		payload, hs.ss.kem.PublicKeySize())
+	if err != nil {
+		return nil, err
+	}
+
+	// create the public key
+	pub, err := hs.ss.kem.LoadPublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	// check empty
+	if hs.remoteStaticKemPub == nil {
+		hs.remoteStaticKemPub = pub
+	}
+
+	return payload, nil
+}
+
+// writeKemTokenS appends EncryptAndHash(s.public_key) to the buffer.
+func (hs *HandshakeState) writeKemTokenS(payload []byte) ([]byte, error) {
+	// local static must not be empty, it should be supplied via creation of
+	// the handshake state.
+	if hs.localStaticKem == nil {
+		return nil, errMissingKey("local static key")
+	}
+	data, err := hs.ss.EncryptAndHash(hs.localStaticKem.PubKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	payload = append(payload, data...)
+
+	return payload, nil
+}
+
+// readTokenKem reads the ciphertext of an "ekem" or "skem" token, decapsulates
+// it using the local ephemeral or static key, and calls MixKey(secret).
+func (hs *HandshakeState) readTokenKem(
+	token pattern.Token, payload []byte) ([]byte, error) {
+	if !hs.kemMode() {
+		return nil, errMissingKem
+	}
+
+	var local kem.PrivateKey
+	var ciphertext []byte
+	var err error
+
+	ctlen := hs.ss.kem.CiphertextSize()
+	switch token {
+	case pattern.TokenEkem:
+		// the ciphertext is sent in clear.
+		local = hs.localEphemeralKem
+		if len(payload) < ctlen {
+			return nil, errInvalidPayload
+		}
+		ciphertext = payload[:ctlen]
+		payload = payload[ctlen:]
+		hs.ss.MixHash(ciphertext)
+
+	case pattern.TokenSkem:
+		// the ciphertext is encrypted if there's a key.
+		local = hs.localStaticKem
+		ciphertext, payload, err = hs.readAndDecrypt(payload, ctlen)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if local == nil {
+		return nil, errMissingKey("missing key when performing KEM")
+	}
+
+	secret, err := local.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+
+	if err := hs.ss.MixKey(secret); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// writeTokenKem encapsulates a shared secret to the remote ephemeral or static
+// key for an "ekem" or "skem" token, appends the ciphertext to the buffer, and
+// calls MixKey(secret).
+func (hs *HandshakeState) writeTokenKem(
+	token pattern.Token, payload []byte) ([]byte, error) {
+	if !hs.kemMode() {
+		return nil, errMissingKem
+	}
+
+	var remote kem.PublicKey
+	switch token {
+	case pattern.TokenEkem:
+		remote = hs.remoteEphemeralKemPub
+	case pattern.TokenSkem:
+		remote = hs.remoteStaticKemPub
+	}
+
+	if remote == nil {
+		return nil, errMissingKey("missing key when performing KEM")
+	}
+
+	ciphertext, secret, err := remote.Encapsulate()
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+
+	switch token {
+	case pattern.TokenEkem:
+		// the ciphertext is sent in clear.
+		hs.ss.MixHash(ciphertext)
+		payload = append(payload, ciphertext...)
+
+	case pattern.TokenSkem:
+		// the ciphertext is encrypted if there's a key.
+		data, err := hs.ss.EncryptAndHash(ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		payload = append(payload, data...)
+	}
+
+	if err := hs.ss.MixKey(secret); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// readAndDecrypt sets temp to the next size + ADLEN bytes of the payload if
+// HasKey() == True, or to the next size bytes otherwise. It returns
+// DecryptAndHash(temp) and the remaining payload.
+func (hs *HandshakeState) readAndDecrypt(
+	payload []byte, size int) ([]byte, []byte, error) {
+	tempLen := size
+	if hs.ss.cs.hasKey() {
+		adlen := hs.ss.cs.cipher.Cipher().Overhead()
+		tempLen = size + adlen
+	}
+
+	// check we have enough bytes to use
+	if len(payload) < tempLen {
+		return nil, nil, errInvalidPayload
+	}
+
+	temp := make([]byte, tempLen)
+	copy(temp[:], payload[:tempLen])
+	data, err := hs.ss.DecryptAndHash(temp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, payload[tempLen:], nil
+}
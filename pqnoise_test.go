@@ -0,0 +1,162 @@
+package babble
+
+import (
+	"testing"
+
+	"github.com/crypto-y/babble/dh"
+	"github.com/crypto-y/babble/kem"
+	"github.com/crypto-y/babble/pattern"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPQNoiseHandshake(t *testing.T) {
+	mlkem768, _ := kem.FromString("MLKEM768")
+	aliceStatic, _ := mlkem768.GenerateKeyPair(nil)
+	bobStatic, _ := mlkem768.GenerateKeyPair(nil)
+
+	testParams := []struct {
+		name string
+		psks [][]byte
+	}{
+		{"Noise_pqNN_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqKN_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqNK_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqKK_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqNX_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqKX_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqXN_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqIN_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqXK_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqIK_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqXX_MLKEM768_ChaChaPoly_BLAKE2s", nil},
+		{"Noise_pqIX_MLKEM768_AESGCM_SHA256", nil},
+		{"Noise_pqXXpsk0_MLKEM768_ChaChaPoly_BLAKE2s",
+			[][]byte{make([]byte, 32)}},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+
+			alice, err := NewProtocolWithConfig(&ProtocolConfig{
+				Name:            tt.name,
+				Initiator:       true,
+				LocalStaticPriv: aliceStatic.Bytes(),
+				RemoteStaticPub: bobStatic.PubKey().Bytes(),
+				Psks:            tt.psks,
+			})
+			require.NoError(err, "failed to create alice")
+
+			bob, err := NewProtocolWithConfig(&ProtocolConfig{
+				Name:            tt.name,
+				Initiator:       false,
+				LocalStaticPriv: bobStatic.Bytes(),
+				RemoteStaticPub: aliceStatic.PubKey().Bytes(),
+				Psks:            tt.psks,
+			})
+			require.NoError(err, "failed to create bob")
+
+			// run the handshake
+			sender, receiver := alice, bob
+			for !alice.Finished() {
+				payload := []byte("yy")
+				ciphertext, err := sender.WriteMessage(payload)
+				require.NoError(err, "failed to write message")
+
+				plaintext, err := receiver.ReadMessage(ciphertext)
+				require.NoError(err, "failed to read message")
+				require.Equal(payload, plaintext, "payload not match")
+
+				sender, receiver = receiver, sender
+			}
+
+			require.True(bob.Finished(), "bob must be finished")
+			require.Equal(alice.GetDigest(), bob.GetDigest(),
+				"handshake digest not match")
+
+			// check the transport messages
+			ciphertext, err := alice.SendCipherState.EncryptWithAd(
+				nil, []byte("yy"))
+			require.NoError(err, "failed to encrypt")
+			plaintext, err := bob.RecvCipherState.DecryptWithAd(
+				nil, ciphertext)
+			require.NoError(err, "failed to decrypt")
+			require.Equal([]byte("yy"), plaintext, "payload not match")
+		})
+	}
+}
+
+func TestPQNoiseTokenKem(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_pqNN_MLKEM768_ChaChaPoly_BLAKE2s"
+
+	alice, err := NewProtocol(name, "", true)
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocol(name, "", false)
+	require.NoError(err, "failed to create bob")
+
+	// a KEM token needs the remote key
+	_, err = bob.writeTokenKem(pattern.TokenEkem, nil)
+	require.Equal(errMissingKey("missing key when performing KEM"), err,
+		"error not match")
+
+	ciphertext, err := alice.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	require.Len(ciphertext, 1184, "must carry the KEM public key")
+
+	_, err = bob.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+
+	// bob replies with an ekem ciphertext and an encrypted payload
+	ciphertext, err = bob.WriteMessage(nil)
+	require.NoError(err, "failed to write message")
+	require.Len(ciphertext, 1088+16, "must carry the KEM ciphertext")
+
+	// a short payload cannot be read
+	_, err = alice.readTokenKem(pattern.TokenEkem, ciphertext[:10])
+	require.Equal(errInvalidPayload, err, "error not match")
+
+	_, err = alice.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	require.Equal(alice.GetDigest(), bob.GetDigest(),
+		"handshake digest not match")
+
+	// a DH protocol cannot process the KEM tokens
+	dhState, err := NewProtocol("Noise_NN_25519_ChaChaPoly_BLAKE2s", "", true)
+	require.NoError(err, "failed to create handshake state")
+	_, err = dhState.writeTokenKem(pattern.TokenEkem, nil)
+	require.Equal(errMissingKem, err, "error not match")
+	_, err = dhState.readTokenKem(pattern.TokenSkem, nil)
+	require.Equal(errMissingKem, err, "error not match")
+}
+
+func TestPQNoiseVerifyPeerStatic(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_pqXX_MLKEM768_ChaChaPoly_BLAKE2s"
+	mlkem768, _ := kem.FromString("MLKEM768")
+	static, _ := mlkem768.GenerateKeyPair(nil)
+	verify := func(pub dh.PublicKey, payload []byte) error { return nil }
+
+	// the callback is never skipped silently.
+	_, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:             name,
+		LocalStaticPriv:  static.Bytes(),
+		VerifyPeerStatic: verify,
+	})
+	require.Equal(ErrKemMismatch, err, "error not match")
+
+	hs, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            name,
+		LocalStaticPriv: static.Bytes(),
+	})
+	require.NoError(err, "failed to create handshake state")
+	require.Equal(ErrKemMismatch, hs.SetVerifyPeerStatic(verify),
+		"error not match")
+
+	// nor is the requirement of a restored state.
+	data, err := hs.MarshalBinary()
+	require.NoError(err, "failed to marshal")
+	data[marshalHeaderSize+4+len(name)+2] = 1
+	require.Equal(errMarshalDataInvalid, (&HandshakeState{}).UnmarshalBinary(
+		data), "error not match")
+}
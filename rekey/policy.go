@@ -0,0 +1,332 @@
+package rekey
+
+import (
+	"fmt"
+	"time"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+)
+
+// Observer is an optional interface implemented by the rekeyers which need the
+// size of each message, such as the one created by NewBytes. The CipherState
+// calls Observe with the plaintext size of each message encrypted or
+// decrypted, before calling CheckRekey.
+type Observer interface {
+	Observe(size int)
+}
+
+// Limits specifies the number of messages and bytes a cipher key can safely
+// process. A zero value means no limit.
+type Limits struct {
+	// Messages is the max number of messages encrypted or decrypted.
+	Messages uint64
+
+	// Bytes is the max number of plaintext bytes encrypted or decrypted.
+	Bytes uint64
+}
+
+// aeadLimits holds the limits of the ciphers, keyed by the cipher name.
+var aeadLimits = map[string]Limits{
+	// The confidentiality limit of AES-GCM, derived from the 2^24.5 full-size
+	// records allowed by TLS 1.3, in which each record carries 2^14 bytes.
+	// The message limit is rounded down to 2^24, the byte limit to 2^38.
+	"AESGCM": {Messages: 1 << 24, Bytes: 1 << 38},
+
+	// ChaCha20-Poly1305 has no practical confidentiality limit within the
+	// nonce space.
+	"ChaChaPoly": {},
+}
+
+// RegisterAEADLimits sets the limits of the named cipher, which are used by
+// NewAEADLimits. It can be used to tighten the built-in limits, or to add the
+// limits of a customized cipher.
+func RegisterAEADLimits(name string, limits Limits) {
+	aeadLimits[name] = limits
+}
+
+// policy holds the states shared by the rekeyers below, which use the default
+// REKEY(k) of the cipher to create the new key, and count the messages and
+// bytes processed since the last rekey.
+type policy struct {
+	cipherName string
+	resetNonce bool
+
+	messages uint64
+	bytes    uint64
+}
+
+func newPolicy(cipher noiseCipher.AEAD, resetNonce bool) policy {
+	return policy{cipherName: cipher.String(), resetNonce: resetNonce}
+}
+
+// rekey creates the new key and resets the counters.
+func (p *policy) rekey(key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	p.messages, p.bytes = 0, 0
+	return cipherRekey(p.cipherName, key)
+}
+
+// clone returns the settings with the counters cleared.
+func (p *policy) clone() policy {
+	return policy{cipherName: p.cipherName, resetNonce: p.resetNonce}
+}
+
+func (p *policy) Observe(size int) {
+	p.bytes += uint64(size)
+}
+
+func (p *policy) ResetNonce() bool {
+	return p.resetNonce
+}
+
+// bytesRekeyer rekeys once a number of bytes are processed.
+type bytesRekeyer struct {
+	policy
+	limit uint64
+}
+
+// NewBytes creates a rekeyer which performs a rekey once limit bytes of
+// plaintext are encrypted or decrypted with the key. As the check is done
+// after each message, the last message may exceed the limit by its size. The
+// new key is created using the Rekey defined in the cipher.
+func NewBytes(limit uint64, cipher noiseCipher.AEAD, resetNonce bool) Rekeyer {
+	return &bytesRekeyer{policy: newPolicy(cipher, resetNonce), limit: limit}
+}
+
+func (b *bytesRekeyer) Rekey(
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	return b.rekey(key)
+}
+
+func (b *bytesRekeyer) CheckRekey(n uint64) (bool, error) {
+	b.messages++
+	return b.bytes >= b.limit, nil
+}
+
+// Interval returns zero, as the rekey doesn't depend on the message count.
+func (b *bytesRekeyer) Interval() uint64 {
+	return 0
+}
+
+func (b *bytesRekeyer) Clone() Rekeyer {
+	return &bytesRekeyer{policy: b.clone(), limit: b.limit}
+}
+
+// timeRekeyer rekeys once the key is older than maxAge.
+type timeRekeyer struct {
+	policy
+	maxAge  time.Duration
+	now     func() time.Time
+	created time.Time
+}
+
+// NewTime creates a rekeyer which performs a rekey on the first message after
+// the key is older than maxAge. The age is counted from the time the rekeyer
+// is created or cloned, and from the last rekey. The now function provides
+// the current time, which defaults to time.Now if nil.
+//
+// Unlike the other rekeyers, the decision depends on the local clock, so the
+// two parties may rekey at different messages. It should only be used when
+// the receiver can learn a rekey is performed, e.g., signaled by the
+// application.
+func NewTime(maxAge time.Duration, cipher noiseCipher.AEAD, resetNonce bool,
+	now func() time.Time) Rekeyer {
+	if now == nil {
+		now = time.Now
+	}
+	return &timeRekeyer{
+		policy:  newPolicy(cipher, resetNonce),
+		maxAge:  maxAge,
+		now:     now,
+		created: now(),
+	}
+}
+
+func (t *timeRekeyer) Rekey(
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	t.created = t.now()
+	return t.rekey(key)
+}
+
+func (t *timeRekeyer) CheckRekey(n uint64) (bool, error) {
+	t.messages++
+	return t.now().Sub(t.created) >= t.maxAge, nil
+}
+
+// Interval returns zero, as the rekey doesn't depend on the message count.
+func (t *timeRekeyer) Interval() uint64 {
+	return 0
+}
+
+func (t *timeRekeyer) Clone() Rekeyer {
+	return &timeRekeyer{
+		policy:  t.clone(),
+		maxAge:  t.maxAge,
+		now:     t.now,
+		created: t.now(),
+	}
+}
+
+// limitsRekeyer rekeys before the limits of the cipher are reached.
+type limitsRekeyer struct {
+	policy
+	limits Limits
+}
+
+// NewAEADLimits creates a rekeyer which performs a rekey once the number of
+// messages or bytes processed with the key reaches the limits of the cipher,
+// which are set using RegisterAEADLimits. An error is returned if the cipher
+// has no limits registered.
+func NewAEADLimits(cipher noiseCipher.AEAD, resetNonce bool) (Rekeyer, error) {
+	limits, ok := aeadLimits[cipher.String()]
+	if !ok {
+		return nil, errMissingLimits(cipher.String())
+	}
+	return &limitsRekeyer{
+		policy: newPolicy(cipher, resetNonce),
+		limits: limits,
+	}, nil
+}
+
+func (l *limitsRekeyer) Rekey(
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	return l.rekey(key)
+}
+
+func (l *limitsRekeyer) CheckRekey(n uint64) (bool, error) {
+	l.messages++
+	if l.limits.Messages != 0 && l.messages >= l.limits.Messages {
+		return true, nil
+	}
+	if l.limits.Bytes != 0 && l.bytes >= l.limits.Bytes {
+		return true, nil
+	}
+	return false, nil
+}
+
+// Interval returns the message limit of the cipher.
+func (l *limitsRekeyer) Interval() uint64 {
+	return l.limits.Messages
+}
+
+func (l *limitsRekeyer) Clone() Rekeyer {
+	return &limitsRekeyer{policy: l.clone(), limits: l.limits}
+}
+
+// combinedRekeyer combines the decisions of multiple rekeyers.
+type combinedRekeyer struct {
+	rekeyers []Rekeyer
+
+	// all specifies whether all the rekeyers must agree.
+	all bool
+}
+
+// Any creates a rekeyer which performs a rekey as soon as one of the rekeyers
+// decides to, e.g., every 10000 messages or 1 GB, whichever comes first.
+//
+// When rekeying, every rekeyer's Rekey is called so they can reset their
+// states, and the key created by the first one is used. As the nonce is reset
+// or kept for all of them, the rekeyers must have the same nonce reset
+// setting, otherwise an error is returned. A combination without any rekeyer
+// never rekeys.
+func Any(rekeyers ...Rekeyer) (Rekeyer, error) {
+	return newCombinedRekeyer(rekeyers, false)
+}
+
+// All creates a rekeyer which performs a rekey only when all the rekeyers
+// decide to. The rest works the same as Any.
+func All(rekeyers ...Rekeyer) (Rekeyer, error) {
+	return newCombinedRekeyer(rekeyers, true)
+}
+
+func newCombinedRekeyer(rekeyers []Rekeyer, all bool) (Rekeyer, error) {
+	for _, r := range rekeyers {
+		if r.ResetNonce() != rekeyers[0].ResetNonce() {
+			return nil, errMixedResetNonce
+		}
+	}
+	return &combinedRekeyer{rekeyers: rekeyers, all: all}, nil
+}
+
+func (c *combinedRekeyer) Rekey(
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	var newKey [CipherKeySize]byte
+	for i, r := range c.rekeyers {
+		k, err := r.Rekey(key)
+		if err != nil {
+			return [CipherKeySize]byte{}, err
+		}
+		if i == 0 {
+			newKey = k
+		}
+	}
+	return newKey, nil
+}
+
+// CheckRekey calls every rekeyer, so each of them counts the message.
+func (c *combinedRekeyer) CheckRekey(n uint64) (bool, error) {
+	if len(c.rekeyers) == 0 {
+		return false, nil
+	}
+
+	result := c.all
+	for _, r := range c.rekeyers {
+		need, err := r.CheckRekey(n)
+		if err != nil {
+			return false, err
+		}
+		if c.all {
+			result = result && need
+		} else {
+			result = result || need
+		}
+	}
+	return result, nil
+}
+
+// Observe passes the message size to the rekeyers implementing Observer.
+func (c *combinedRekeyer) Observe(size int) {
+	for _, r := range c.rekeyers {
+		if o, ok := r.(Observer); ok {
+			o.Observe(size)
+		}
+	}
+}
+
+// ResetNonce returns the nonce reset setting shared by the rekeyers.
+func (c *combinedRekeyer) ResetNonce() bool {
+	if len(c.rekeyers) == 0 {
+		return false
+	}
+	return c.rekeyers[0].ResetNonce()
+}
+
+// Interval returns the smallest non-zero interval of the rekeyers for Any,
+// and the largest one for All.
+func (c *combinedRekeyer) Interval() uint64 {
+	var interval uint64
+	for _, r := range c.rekeyers {
+		i := r.Interval()
+		switch {
+		case i == 0:
+		case interval == 0:
+			interval = i
+		case c.all && i > interval:
+			interval = i
+		case !c.all && i < interval:
+			interval = i
+		}
+	}
+	return interval
+}
+
+func (c *combinedRekeyer) Clone() Rekeyer {
+	rekeyers := make([]Rekeyer, len(c.rekeyers))
+	for i, r := range c.rekeyers {
+		rekeyers[i] = r.Clone()
+	}
+	return &combinedRekeyer{rekeyers: rekeyers, all: c.all}
+}
+
+func errMissingLimits(name string) error {
+	return fmt.Errorf("no limits registered for cipher %s", name)
+}
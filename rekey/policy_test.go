@@ -0,0 +1,219 @@
+package rekey
+
+import (
+	"testing"
+	"time"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock advanced manually.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestBytesRekeyer(t *testing.T) {
+	cipher, _ := noiseCipher.FromString("ChaChaPoly")
+	rk := NewBytes(100, cipher, true)
+	require.True(t, rk.ResetNonce(), "ResetNonce should be true")
+	require.Zero(t, rk.Interval(), "Interval should be zero")
+
+	o, ok := rk.(Observer)
+	require.True(t, ok, "bytes rekeyer should be an Observer")
+
+	o.Observe(60)
+	need, err := rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "should not rekey below the limit")
+
+	o.Observe(40)
+	need, err = rk.CheckRekey(2)
+	require.NoError(t, err)
+	require.True(t, need, "should rekey at the limit")
+
+	// the counter is reset after rekey.
+	key := [CipherKeySize]byte{1}
+	newKey, err := rk.Rekey(key)
+	require.NoError(t, err)
+	expected, err := cipherRekey("ChaChaPoly", key)
+	require.NoError(t, err)
+	require.Equal(t, expected, newKey, "should use the cipher's rekey")
+
+	need, err = rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "counter should be reset")
+}
+
+func TestTimeRekeyer(t *testing.T) {
+	cipher, _ := noiseCipher.FromString("ChaChaPoly")
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	rk := NewTime(time.Minute, cipher, false, clock.Now)
+	require.False(t, rk.ResetNonce(), "ResetNonce should be false")
+	require.Zero(t, rk.Interval(), "Interval should be zero")
+
+	clock.now = clock.now.Add(59 * time.Second)
+	need, err := rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "should not rekey before maxAge")
+
+	// the clone starts its own clock.
+	clone := rk.Clone()
+
+	clock.now = clock.now.Add(time.Second)
+	need, err = rk.CheckRekey(2)
+	require.NoError(t, err)
+	require.True(t, need, "should rekey at maxAge")
+
+	need, err = clone.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "clone should not rekey")
+
+	// the age is counted from the rekey.
+	_, err = rk.Rekey([CipherKeySize]byte{})
+	require.NoError(t, err)
+	need, err = rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "should not rekey after rekey")
+
+	// a nil clock defaults to time.Now.
+	rk = NewTime(time.Hour, cipher, false, nil)
+	need, err = rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need)
+}
+
+func TestAEADLimitsRekeyer(t *testing.T) {
+	chacha, _ := noiseCipher.FromString("ChaChaPoly")
+	aesgcm, _ := noiseCipher.FromString("AESGCM")
+
+	// ChaChaPoly has no limits.
+	rk, err := NewAEADLimits(chacha, true)
+	require.NoError(t, err)
+	require.Zero(t, rk.Interval(), "ChaChaPoly should have no limit")
+	need, err := rk.CheckRekey(1 << 40)
+	require.NoError(t, err)
+	require.False(t, need, "ChaChaPoly should never rekey")
+
+	rk, err = NewAEADLimits(aesgcm, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1<<24), rk.Interval(), "AESGCM interval")
+
+	// the byte limit is checked.
+	rk.(Observer).Observe(1 << 38)
+	need, err = rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.True(t, need, "should rekey at the byte limit")
+
+	// tighten the limits to check the message limit.
+	defer RegisterAEADLimits("AESGCM", aeadLimits["AESGCM"])
+	RegisterAEADLimits("AESGCM", Limits{Messages: 3})
+	rk, err = NewAEADLimits(aesgcm, true)
+	require.NoError(t, err)
+	for i := uint64(1); i < 3; i++ {
+		need, err = rk.CheckRekey(i)
+		require.NoError(t, err)
+		require.False(t, need, "should not rekey below the message limit")
+	}
+	need, err = rk.CheckRekey(3)
+	require.NoError(t, err)
+	require.True(t, need, "should rekey at the message limit")
+
+	// an unknown cipher returns an error.
+	delete(aeadLimits, "ChaChaPoly")
+	defer RegisterAEADLimits("ChaChaPoly", Limits{})
+	_, err = NewAEADLimits(chacha, true)
+	require.Equal(t, errMissingLimits("ChaChaPoly"), err)
+}
+
+func TestCombinedRekeyer(t *testing.T) {
+	cipher, _ := noiseCipher.FromString("ChaChaPoly")
+
+	testParams := []struct {
+		name     string
+		combine  func(...Rekeyer) (Rekeyer, error)
+		bytes    int
+		nonce    uint64
+		need     bool
+		interval uint64
+	}{
+		{"any without trigger", Any, 10, 1, false, 10},
+		{"any by bytes", Any, 100, 1, true, 10},
+		{"any by messages", Any, 10, 10, true, 10},
+		{"all with one trigger", All, 100, 1, false, 20},
+		{"all with both triggers", All, 100, 20, true, 20},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			rk, err := tt.combine(
+				NewBytes(100, cipher, false),
+				NewDefault(10, cipher, false),
+				NewDefault(20, cipher, false),
+			)
+			require.NoError(t, err)
+			require.False(t, rk.ResetNonce(), "should use the shared ResetNonce")
+			require.Equal(t, tt.interval, rk.Interval())
+
+			rk.(Observer).Observe(tt.bytes)
+			need, err := rk.CheckRekey(tt.nonce)
+			require.NoError(t, err)
+			require.Equal(t, tt.need, need)
+		})
+	}
+
+	// the key is created by the first rekeyer.
+	key := [CipherKeySize]byte{1}
+	rk, err := Any(NewBytes(100, cipher, true), NewBytes(50, cipher, true))
+	require.NoError(t, err)
+	expected, _ := cipherRekey("ChaChaPoly", key)
+	newKey, err := rk.Rekey(key)
+	require.NoError(t, err)
+	require.Equal(t, expected, newKey)
+
+	// the errors from the rekeyers are returned.
+	rk, err = Any(NewDefault(10, cipher, true))
+	require.NoError(t, err)
+	_, err = rk.CheckRekey(11)
+	require.Equal(t, errCorruptedNonce, err)
+
+	// the rekeyers must agree on the nonce reset setting.
+	for _, combine := range []func(...Rekeyer) (Rekeyer, error){Any, All} {
+		_, err := combine(
+			NewBytes(100, cipher, false), NewDefault(10, cipher, true))
+		require.Equal(t, errMixedResetNonce, err)
+	}
+
+	// an empty combination never rekeys.
+	for _, combine := range []func(...Rekeyer) (Rekeyer, error){Any, All} {
+		rk, err := combine()
+		require.NoError(t, err)
+		need, err := rk.CheckRekey(1)
+		require.NoError(t, err)
+		require.False(t, need)
+		require.False(t, rk.ResetNonce())
+		require.Zero(t, rk.Interval())
+	}
+}
+
+func TestCombinedRekeyerClone(t *testing.T) {
+	cipher, _ := noiseCipher.FromString("ChaChaPoly")
+	rk, err := Any(NewBytes(100, cipher, true))
+	require.NoError(t, err)
+	clone := rk.Clone()
+	require.NotSame(t, rk, clone)
+
+	// the counters are not shared.
+	rk.(Observer).Observe(100)
+	need, err := rk.CheckRekey(1)
+	require.NoError(t, err)
+	require.True(t, need)
+
+	need, err = clone.CheckRekey(1)
+	require.NoError(t, err)
+	require.False(t, need, "clone should have its own counter")
+}
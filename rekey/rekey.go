@@ -16,15 +16,18 @@ const CipherKeySize = 32
 var (
 	errCorruptedNonce  = errors.New("Nonce is corrupted, please reset")
 	errInvalidInterval = errors.New("invalid interval value")
+	errMixedResetNonce = errors.New(
+		"combined rekeyers must have the same nonce reset setting")
 )
 
 // Rekeyer defines a customized Rekey function to be used when rotating cipher
-// key.
+// key. Each CipherState created by Split has its own rekeyer, cloned from the
+// one provided in the config, so the sending and receiving directions are
+// rekeyed independently.
 type Rekeyer interface {
-	// Rekey creates a new key. The old key can be accessed using cipher.key if
-	// the implementation uses algorithms which relies on the old cipher key to
-	// create the new key. A 32-byte key is returned.
-	Rekey() [CipherKeySize]byte
+	// Rekey creates a new 32-byte key from the current key of the
+	// CipherState the rekeyer belongs to.
+	Rekey(key [CipherKeySize]byte) ([CipherKeySize]byte, error)
 
 	// CheckRekey implements the logic to decide whether a rekey should be
 	// performed based on the given nonce. Other customized logic unrelated to
@@ -38,6 +41,10 @@ type Rekeyer interface {
 	// Interval returns the number of messages to be sent before a rekey is
 	// performed.
 	Interval() uint64
+
+	// Clone returns a new rekeyer with the same settings and a fresh state,
+	// which is used by Split to create a rekeyer for each direction.
+	Clone() Rekeyer
 }
 
 type defaultRekeyer struct {
@@ -45,33 +52,40 @@ type defaultRekeyer struct {
 	// cipher key by calling Rekey. If it's not set, then the key's never
 	// changed.
 	RekeyInterval uint64
-	cipher        noiseCipher.AEAD
+	cipherName    string
 	resetNonce    bool
 	count         uint64
 }
 
 // NewDefault creates a default rekeyer defined by the noise protocol. It
 // returns a 32-byte key from calling the Rekey function defined in the cipher,
-// which is the result of ENCRYPT(k, maxnonce, zerolen, zeros), where maxnonce
-// equals 2^64-1, zerolen is a zero-length byte sequence, and zeros is a
-// sequence of 32 bytes filled with zeros.
+// which is the result of ENCRYPT(k, maxnonce, zerolen, zeros), where k is the
+// current key, maxnonce equals 2^64-1, zerolen is a zero-length byte sequence,
+// and zeros is a sequence of 32 bytes filled with zeros.
 //
 // The parameter interval specifies after how many messages a rekey is
 // performed, and the resetNonce decides whether the nonce should be reset to
-// zero when performing rekey.
+// zero when performing rekey. Only the algorithm of the cipher is used, the
+// rekeyer never changes its state.
 func NewDefault(interval uint64, cipher noiseCipher.AEAD,
 	resetNonce bool) Rekeyer {
 	return &defaultRekeyer{
 		RekeyInterval: uint64(interval),
-		cipher:        cipher,
+		cipherName:    cipher.String(),
 		resetNonce:    resetNonce,
 	}
 }
 
-func (d *defaultRekeyer) Rekey() [CipherKeySize]byte {
-	// use the default rekey from the cipher
-	// TODO: rm dependency on cipher
-	return d.cipher.Rekey()
+// IsDefault reports whether the rekeyer is created by NewDefault, which can be
+// recreated from its interval and nonce reset setting alone.
+func IsDefault(r Rekeyer) bool {
+	_, ok := r.(*defaultRekeyer)
+	return ok
+}
+
+func (d *defaultRekeyer) Rekey(
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	return cipherRekey(d.cipherName, key)
 }
 
 func (d *defaultRekeyer) ResetNonce() bool {
@@ -100,3 +114,28 @@ func (d *defaultRekeyer) CheckRekey(n uint64) (bool, error) {
 func (d *defaultRekeyer) Interval() uint64 {
 	return d.RekeyInterval
 }
+
+func (d *defaultRekeyer) Clone() Rekeyer {
+	return &defaultRekeyer{
+		RekeyInterval: d.RekeyInterval,
+		cipherName:    d.cipherName,
+		resetNonce:    d.resetNonce,
+	}
+}
+
+// cipherRekey returns REKEY(k) using the Rekey of the named cipher. A fresh
+// cipher initialized with the key is used, so the cipher of the cipher state
+// is untouched.
+func cipherRekey(name string,
+	key [CipherKeySize]byte) ([CipherKeySize]byte, error) {
+	cipher, err := noiseCipher.FromString(name)
+	if err != nil {
+		return [CipherKeySize]byte{}, err
+	}
+	defer cipher.Destroy()
+
+	if err := cipher.InitCipher(key); err != nil {
+		return [CipherKeySize]byte{}, err
+	}
+	return cipher.Rekey(), nil
+}
@@ -1,11 +1,14 @@
 package rekey
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"fmt"
 	"testing"
 
 	noiseCipher "github.com/crypto-y/babble/cipher"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 func TestDefaultRekeyer(t *testing.T) {
@@ -17,10 +20,10 @@ func TestDefaultRekeyer(t *testing.T) {
 		0xab, 0xab, 0xab, 0xab, 0xab, 0xab, 0xab, 0x6b,
 	}
 	cipher, _ := noiseCipher.FromString("ChaChaPoly")
-	require.NoError(t, cipher.InitCipher(key))
 	rk := NewDefault(testInterval, cipher, true)
 
-	newKey := rk.Rekey()
+	newKey, err := rk.Rekey(key)
+	require.NoError(t, err, "failed to rekey")
 	require.Equal(t, CipherKeySize, len(newKey), "key size not match")
 	require.NotEqual(t, key, newKey, "key not changed")
 	require.True(t, rk.ResetNonce(), "ResetNonce should be true")
@@ -49,6 +52,89 @@ func TestDefaultRekeyer(t *testing.T) {
 	}
 }
 
+// specRekey computes REKEY(k) defined in the noise specs independently, which
+// is the first 32 bytes of ENCRYPT(k, maxnonce, zerolen, zeros).
+func specRekey(t *testing.T, name string, k [CipherKeySize]byte) []byte {
+	var aead cipher.AEAD
+	var err error
+	switch name {
+	case "ChaChaPoly":
+		aead, err = chacha20poly1305.New(k[:])
+	case "AESGCM":
+		var block cipher.Block
+		block, err = aes.NewCipher(k[:])
+		require.NoError(t, err, "failed to create block")
+		aead, err = cipher.NewGCM(block)
+	}
+	require.NoError(t, err, "failed to create aead")
+
+	// maxnonce is 2^64-1, which is encoded as 4 zero bytes followed by 8
+	// 0xff bytes by both ciphers.
+	nonce := make([]byte, 12)
+	for i := 4; i < 12; i++ {
+		nonce[i] = 0xff
+	}
+	return aead.Seal(nil, nonce, make([]byte, CipherKeySize), nil)[:32]
+}
+
+func TestDefaultRekeyerSpec(t *testing.T) {
+	key := [CipherKeySize]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, name := range []string{"ChaChaPoly", "AESGCM"} {
+		t.Run(name, func(t *testing.T) {
+			c, _ := noiseCipher.FromString(name)
+			require.NoError(t, c.InitCipher([CipherKeySize]byte{9}))
+			tag, _ := c.Encrypt(0, nil, nil)
+			rk := NewDefault(10, c, false)
+
+			// rekey twice, each time from the current key
+			k1, err := rk.Rekey(key)
+			require.NoError(t, err, "failed to rekey")
+			require.Equal(t, specRekey(t, name, key), k1[:],
+				"key not match")
+			k2, err := rk.Rekey(k1)
+			require.NoError(t, err, "failed to rekey")
+			require.Equal(t, specRekey(t, name, k1), k2[:],
+				"key not match")
+
+			// the cipher passed in is untouched
+			newTag, _ := c.Encrypt(0, nil, nil)
+			require.Equal(t, tag, newTag, "cipher should be unchanged")
+		})
+	}
+}
+
+func TestDefaultRekeyerClone(t *testing.T) {
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+	rk := NewDefault(10, c, true)
+	clone := rk.Clone()
+
+	require.Equal(t, rk.Interval(), clone.Interval(), "interval not match")
+	require.Equal(t, rk.ResetNonce(), clone.ResetNonce(),
+		"reset nonce not match")
+
+	// the counters are independent
+	_, err := rk.CheckRekey(3)
+	require.NoError(t, err, "failed to check rekey")
+	require.Equal(t, uint64(3), rk.(*defaultRekeyer).count, "count not match")
+	require.Equal(t, uint64(0), clone.(*defaultRekeyer).count,
+		"clone count should be zero")
+}
+
+func TestIsDefault(t *testing.T) {
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+	rk := NewDefault(10, c, true)
+	require.True(t, IsDefault(rk), "should be default")
+	require.True(t, IsDefault(rk.Clone()), "clone should be default")
+
+	require.False(t, IsDefault(nil), "nil is not default")
+	require.False(t, IsDefault(NewBytes(10, c, true)),
+		"bytes rekeyer is not default")
+	combined, err := Any(rk, NewBytes(10, c, true))
+	require.NoError(t, err, "failed to combine rekeyers")
+	require.False(t, IsDefault(combined), "combined rekeyer is not default")
+}
+
 func ExampleNewDefault() {
 	// Get the related cipher
 	cipher, _ := noiseCipher.FromString("ChaChaPoly")
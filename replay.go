@@ -0,0 +1,80 @@
+package babble
+
+const (
+	// replayBlockBits is the number of bits in a bitmap block.
+	replayBlockBits = 64
+
+	// replayRingBlocks is the number of blocks in the bitmap ring, which must
+	// be a power of 2.
+	replayRingBlocks = 32
+
+	// ReplayWindowSize is the number of nonces behind the highest one received
+	// that are still accepted by a datagram session. One block of the ring is
+	// kept as a buffer when the window moves forward.
+	ReplayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+// replayWindow implements a sliding window of the nonces received, as
+// described in RFC 6479 and used by WireGuard. The bitmap is a ring of blocks,
+// so moving the window forward only clears the blocks passed.
+type replayWindow struct {
+	// highest is the highest nonce received.
+	highest uint64
+
+	// empty is true if no nonce has been received.
+	empty bool
+
+	ring [replayRingBlocks]uint64
+}
+
+func newReplayWindow() *replayWindow {
+	return &replayWindow{empty: true}
+}
+
+// check returns true if the nonce is within the window and hasn't been
+// received, it doesn't change the window.
+func (w *replayWindow) check(n uint64) bool {
+	if w.empty || n > w.highest {
+		return true
+	}
+	if w.highest-n >= ReplayWindowSize {
+		return false
+	}
+
+	block, bit := replayPosition(n)
+	return w.ring[block]&bit == 0
+}
+
+// mark records the nonce as received, moving the window forward if it's the
+// highest nonce. It must only be called after the nonce passes the check and
+// the message is authenticated.
+func (w *replayWindow) mark(n uint64) {
+	if w.empty || n > w.highest {
+		// clear the blocks passed by the window
+		current := w.highest / replayBlockBits
+		if w.empty {
+			current = n / replayBlockBits
+			w.ring[current%replayRingBlocks] = 0
+		}
+		diff := n/replayBlockBits - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := uint64(1); i <= diff; i++ {
+			w.ring[(current+i)%replayRingBlocks] = 0
+		}
+
+		w.highest = n
+		w.empty = false
+	}
+
+	block, bit := replayPosition(n)
+	w.ring[block] |= bit
+}
+
+// replayPosition returns the block index and the bit mask of the nonce.
+func replayPosition(n uint64) (uint64, uint64) {
+	block := (n / replayBlockBits) % replayRingBlocks
+	bit := uint64(1) << (n % replayBlockBits)
+	return block, bit
+}
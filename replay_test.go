@@ -0,0 +1,65 @@
+package babble
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := newReplayWindow()
+
+	// accept marks the nonce if it passes the check.
+	accept := func(n uint64) bool {
+		if !w.check(n) {
+			return false
+		}
+		w.mark(n)
+		return true
+	}
+
+	testParams := []struct {
+		name     string
+		nonce    uint64
+		accepted bool
+	}{
+		{"first nonce", 0, true},
+		{"replayed first nonce", 0, false},
+		{"next nonce", 1, true},
+		{"skip nonces", 10, true},
+		{"out of order", 5, true},
+		{"replayed out of order", 5, false},
+		{"edge of the window", ReplayWindowSize + 9, true},
+		{"just inside the window", 11, true},
+		{"replayed inside the window", 10, false},
+		{"just outside the window", 9, false},
+		{"jump far ahead", 100000, true},
+		{"behind the jump", 100000 - ReplayWindowSize + 1, true},
+		{"outside the jump", 100000 - ReplayWindowSize, false},
+		{"the highest again", 100000, false},
+		{"max nonce", ^uint64(0) - 1, true},
+		{"far behind the max nonce", 100001, false},
+	}
+
+	for _, tt := range testParams {
+		require.Equal(t, tt.accepted, accept(tt.nonce), tt.name)
+	}
+}
+
+func TestReplayWindowClearsBlocks(t *testing.T) {
+	w := newReplayWindow()
+
+	// fill the whole window
+	for n := uint64(0); n < ReplayWindowSize; n++ {
+		require.True(t, w.check(n), "nonce %d should pass", n)
+		w.mark(n)
+	}
+
+	// moving forward by one ring clears all the bits, so the nonces in the
+	// new window can be received.
+	highest := uint64(ReplayWindowSize + replayRingBlocks*replayBlockBits)
+	w.mark(highest)
+	for n := highest - ReplayWindowSize + 1; n < highest; n++ {
+		require.True(t, w.check(n), "nonce %d should pass", n)
+	}
+}
@@ -0,0 +1,303 @@
+package babble
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/crypto-y/babble/dh"
+	"github.com/crypto-y/babble/kem"
+)
+
+// Direction specifies which cipher state of a session is used.
+type Direction uint8
+
+const (
+	// DirectionSend specifies the cipher state used for sending messages.
+	DirectionSend Direction = iota
+
+	// DirectionRecv specifies the cipher state used for receiving messages.
+	DirectionRecv
+)
+
+// String returns the name of the direction.
+func (d Direction) String() string {
+	switch d {
+	case DirectionSend:
+		return "send"
+	case DirectionRecv:
+		return "recv"
+	default:
+		return fmt.Sprintf("direction(%d)", uint8(d))
+	}
+}
+
+var (
+	// ErrHandshakeNotFinished is returned when creating a session before the
+	// handshake is finished.
+	ErrHandshakeNotFinished = errors.New("handshake is not finished")
+
+	// ErrSessionClosed is returned when using a session after it's closed.
+	ErrSessionClosed = errors.New("session is closed")
+
+	// ErrSessionExists is returned when creating a session from a handshake
+	// state which already has a session of another kind, or a datagram
+	// session with another config, as they would share the cipher states.
+	ErrSessionExists = errors.New("handshake state already has a session")
+)
+
+// Session is the transport phase of a finished handshake. It holds the two
+// cipher states created by Split, and takes care of the nonces and rekeys when
+// encrypting and decrypting transport messages.
+//
+// A session is safe for concurrent use. Each encryption takes the next nonce
+// of the sending cipher state while holding its lock, so no nonce is ever
+// reused, and the two directions are locked separately, so a goroutine can
+// send while another one receives. As the nonces are implicit, the messages
+// must still be delivered in the order they are encrypted, for unordered
+// delivery, use a DatagramSession instead.
+type Session struct {
+	sessionInfo
+
+	// sendMu guards send, and recvMu guards recv.
+	sendMu sync.Mutex
+	send   *CipherState
+	recvMu sync.Mutex
+	recv   *CipherState
+
+	// overhead is the size of the authentication tag added by the cipher.
+	overhead int
+
+	// closed is guarded by both sendMu and recvMu, and is set by Close while
+	// holding both of them.
+	closed bool
+}
+
+// sessionInfo holds the details of a finished handshake.
+type sessionInfo struct {
+	// handshakeHash is the h from the final symmetric state.
+	handshakeHash []byte
+
+	remoteStatic    dh.PublicKey
+	remoteStaticKem kem.PublicKey
+
+	initiator bool
+}
+
+// newSessionInfo copies the details from the finished handshake.
+func newSessionInfo(hs *HandshakeState) sessionInfo {
+	return sessionInfo{
+		handshakeHash:   append([]byte{}, hs.ss.GetHandshakeHash()...),
+		remoteStatic:    hs.remoteStaticPub,
+		remoteStaticKem: hs.remoteStaticKemPub,
+		initiator:       hs.initiator,
+	}
+}
+
+// Session creates a transport session from the finished handshake. The session
+// shares the cipher states with SendCipherState and RecvCipherState, which
+// should not be used directly once a session is created. It's created only
+// once, the later calls return the same session, and ErrSessionExists is
+// returned if a DatagramSession is already created. For one-way patterns, the
+// initiator can only send, and the responder can only receive.
+func (hs *HandshakeState) Session() (*Session, error) {
+	if hs.hp == nil || hs.ss == nil || !hs.Finished() {
+		return nil, ErrHandshakeNotFinished
+	}
+	if hs.datagramSession != nil {
+		return nil, ErrSessionExists
+	}
+
+	if hs.session == nil {
+		// one-way patterns only have one cipher state.
+		cs := hs.SendCipherState
+		if cs == nil {
+			cs = hs.RecvCipherState
+		}
+		hs.session = &Session{
+			sessionInfo: newSessionInfo(hs),
+			send:        hs.SendCipherState,
+			recv:        hs.RecvCipherState,
+			overhead:    cs.cipher.Cipher().Overhead(),
+		}
+	}
+	return hs.session, nil
+}
+
+// Overhead returns the number of bytes added to the plaintext when it's
+// encrypted, which is the size of the authentication tag of the cipher.
+func (s *Session) Overhead() int {
+	return s.overhead
+}
+
+// Encrypt encrypts the plaintext with the associated data using the sending
+// cipher state.
+func (s *Session) Encrypt(ad, plaintext []byte) ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	cs, err := s.cipherState(DirectionSend)
+	if err != nil {
+		return nil, err
+	}
+	return cs.EncryptWithAd(ad, plaintext)
+}
+
+// EncryptTo works like Encrypt, but appends the ciphertext to dst, so no
+// allocation is made if dst has enough capacity. See
+// CipherState.EncryptWithAdTo.
+func (s *Session) EncryptTo(dst, ad, plaintext []byte) ([]byte, error) {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+
+	cs, err := s.cipherState(DirectionSend)
+	if err != nil {
+		return nil, err
+	}
+	return cs.EncryptWithAdTo(dst, ad, plaintext)
+}
+
+// Decrypt decrypts the ciphertext with the associated data using the
+// receiving cipher state. If decryption fails, the nonce is not incremented.
+func (s *Session) Decrypt(ad, ciphertext []byte) ([]byte, error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	cs, err := s.cipherState(DirectionRecv)
+	if err != nil {
+		return nil, err
+	}
+	return cs.DecryptWithAd(ad, ciphertext)
+}
+
+// DecryptTo works like Decrypt, but appends the plaintext to dst, which can be
+// ciphertext[:0] to decrypt in place. See CipherState.DecryptWithAdTo.
+func (s *Session) DecryptTo(dst, ad, ciphertext []byte) ([]byte, error) {
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	cs, err := s.cipherState(DirectionRecv)
+	if err != nil {
+		return nil, err
+	}
+	return cs.DecryptWithAdTo(dst, ad, ciphertext)
+}
+
+// Rekey updates the key of the cipher state for the direction using its
+// rekeyer, or the REKEY(k) function defined in the noise specs if there's
+// none, the nonce is not changed. Both parties must rekey the matching
+// directions at the same point in the message stream, i.e., the sender's
+// DirectionSend and the receiver's DirectionRecv.
+func (s *Session) Rekey(d Direction) error {
+	mu, err := s.mutex(d)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+
+	cs, err := s.cipherState(d)
+	if err != nil {
+		return err
+	}
+	return cs.Rekey()
+}
+
+// HandshakeHash returns the handshake hash, which uniquely identifies the
+// handshake and can be used for channel binding.
+func (s *sessionInfo) HandshakeHash() []byte {
+	return append([]byte{}, s.handshakeHash...)
+}
+
+// RemoteStatic returns the remote party's static public key, or nil if it's
+// not known, e.g., when the pattern doesn't transmit it, or a KEM is used.
+func (s *sessionInfo) RemoteStatic() dh.PublicKey {
+	return s.remoteStatic
+}
+
+// RemoteStaticKem returns the remote party's static KEM public key, which is
+// only used by the PQNoise patterns.
+func (s *sessionInfo) RemoteStaticKem() kem.PublicKey {
+	return s.remoteStaticKem
+}
+
+// Initiator returns true if the local party is the handshake initiator.
+func (s *sessionInfo) Initiator() bool {
+	return s.initiator
+}
+
+// Close wipes the keys of the cipher states. Once closed, the session cannot
+// be used anymore. Close is idempotent, and waits for the pending encryption
+// and decryption to finish.
+func (s *Session) Close() error {
+	s.sendMu.Lock()
+	defer s.sendMu.Unlock()
+	s.recvMu.Lock()
+	defer s.recvMu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if s.send != nil {
+		s.send.Destroy()
+		s.send = nil
+	}
+	if s.recv != nil {
+		s.recv.Destroy()
+		s.recv = nil
+	}
+	s.wipe()
+	return nil
+}
+
+// wipe clears the handshake hash.
+func (s *sessionInfo) wipe() {
+	wipe(s.handshakeHash)
+	s.handshakeHash = nil
+}
+
+// mutex returns the lock guarding the cipher state of the direction.
+func (s *Session) mutex(d Direction) (*sync.Mutex, error) {
+	switch d {
+	case DirectionSend:
+		return &s.sendMu, nil
+	case DirectionRecv:
+		return &s.recvMu, nil
+	default:
+		return nil, errInvalidDirectionValue(d)
+	}
+}
+
+// cipherState returns the cipher state used for the direction. The caller
+// must hold the lock of the direction.
+func (s *Session) cipherState(d Direction) (*CipherState, error) {
+	if s.closed {
+		return nil, ErrSessionClosed
+	}
+
+	var cs *CipherState
+	switch d {
+	case DirectionSend:
+		cs = s.send
+	case DirectionRecv:
+		cs = s.recv
+	default:
+		return nil, errInvalidDirectionValue(d)
+	}
+
+	// one-way patterns only have one cipher state.
+	if cs == nil {
+		return nil, errMissingCipherState(d)
+	}
+	return cs, nil
+}
+
+func errInvalidDirectionValue(d Direction) error {
+	return fmt.Errorf("invalid direction: %s", d)
+}
+
+func errMissingCipherState(d Direction) error {
+	return fmt.Errorf("no cipher state for direction %s", d)
+}
@@ -0,0 +1,464 @@
+package babble
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+
+	noiseCipher "github.com/crypto-y/babble/cipher"
+	"github.com/crypto-y/babble/rekey"
+	"github.com/stretchr/testify/require"
+)
+
+// runHandshake performs the handshake between the initiator and responder.
+func runHandshake(t testing.TB, initiator, responder *HandshakeState) {
+	sender, receiver := initiator, responder
+	for !initiator.Finished() {
+		ciphertext, err := sender.WriteMessage(nil)
+		require.NoError(t, err, "failed to write message")
+		_, err = receiver.ReadMessage(ciphertext)
+		require.NoError(t, err, "failed to read message")
+		sender, receiver = receiver, sender
+	}
+}
+
+func TestSession(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_XX_25519_ChaChaPoly_BLAKE2s"
+
+	alice, err := NewProtocol(name, "", true)
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocol(name, "", false)
+	require.NoError(err, "failed to create bob")
+
+	// a session cannot be created before the handshake is finished
+	_, err = alice.Session()
+	require.Equal(ErrHandshakeNotFinished, err, "error not match")
+
+	runHandshake(t, alice, bob)
+
+	aliceSession, err := alice.Session()
+	require.NoError(err, "failed to create session")
+	bobSession, err := bob.Session()
+	require.NoError(err, "failed to create session")
+
+	require.True(aliceSession.Initiator(), "alice is the initiator")
+	require.False(bobSession.Initiator(), "bob is the responder")
+	require.Equal(alice.GetDigest(), aliceSession.HandshakeHash(),
+		"handshake hash not match")
+	require.Equal(aliceSession.HandshakeHash(), bobSession.HandshakeHash(),
+		"handshake hash not match")
+	require.Equal(bob.localStatic.PubKey().Bytes(),
+		aliceSession.RemoteStatic().Bytes(), "remote static not match")
+	require.Equal(alice.localStatic.PubKey().Bytes(),
+		bobSession.RemoteStatic().Bytes(), "remote static not match")
+	require.Nil(aliceSession.RemoteStaticKem(), "no KEM is used")
+	require.Equal(16, aliceSession.Overhead(), "overhead not match")
+
+	// exchange messages in both directions
+	for i := 0; i < 3; i++ {
+		ciphertext, err := aliceSession.Encrypt([]byte("ad"), []byte("yy"))
+		require.NoError(err, "failed to encrypt")
+		plaintext, err := bobSession.Decrypt([]byte("ad"), ciphertext)
+		require.NoError(err, "failed to decrypt")
+		require.Equal([]byte("yy"), plaintext, "plaintext not match")
+
+		ciphertext, err = bobSession.Encrypt(nil, []byte("yy"))
+		require.NoError(err, "failed to encrypt")
+		plaintext, err = aliceSession.Decrypt(nil, ciphertext)
+		require.NoError(err, "failed to decrypt")
+		require.Equal([]byte("yy"), plaintext, "plaintext not match")
+	}
+
+	// a tampered message fails, and the nonce is kept
+	ciphertext, err := aliceSession.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	_, err = bobSession.Decrypt([]byte("ad"), ciphertext)
+	require.Error(err, "wrong ad should fail")
+	_, err = bobSession.Decrypt(nil, ciphertext)
+	require.NoError(err, "failed to decrypt")
+
+	// rekey one direction
+	require.NoError(aliceSession.Rekey(DirectionSend), "failed to rekey")
+	ciphertext, err = aliceSession.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	_, err = bobSession.Decrypt(nil, ciphertext)
+	require.Error(err, "bob hasn't rekeyed")
+	require.NoError(bobSession.Rekey(DirectionRecv), "failed to rekey")
+	_, err = bobSession.Decrypt(nil, ciphertext)
+	require.NoError(err, "failed to decrypt")
+
+	// the other direction is not affected
+	ciphertext, err = bobSession.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	_, err = aliceSession.Decrypt(nil, ciphertext)
+	require.NoError(err, "failed to decrypt")
+
+	// an invalid direction
+	require.Equal(errInvalidDirectionValue(Direction(2)),
+		aliceSession.Rekey(Direction(2)), "error not match")
+
+	// close wipes the keys
+	send := alice.SendCipherState
+	require.NoError(aliceSession.Close(), "failed to close")
+	require.False(send.hasKey(), "key must be wiped")
+	require.NoError(aliceSession.Close(), "close is idempotent")
+
+	_, err = aliceSession.Encrypt(nil, []byte("yy"))
+	require.Equal(ErrSessionClosed, err, "error not match")
+	_, err = aliceSession.Decrypt(nil, ciphertext)
+	require.Equal(ErrSessionClosed, err, "error not match")
+	require.Equal(ErrSessionClosed, aliceSession.Rekey(DirectionSend),
+		"error not match")
+	require.Empty(aliceSession.HandshakeHash(), "hash must be wiped")
+}
+
+func TestSessionRekeyPolicy(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_NN_25519_ChaChaPoly_BLAKE2s"
+	c, _ := noiseCipher.FromString("ChaChaPoly")
+
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:      name,
+		Initiator: true,
+		Rekeyer:   rekey.NewBytes(10, c, false),
+	})
+	require.NoError(err, "failed to create alice")
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:    name,
+		Rekeyer: rekey.NewBytes(10, c, false),
+	})
+	require.NoError(err, "failed to create bob")
+	runHandshake(t, alice, bob)
+
+	aliceSession, err := alice.Session()
+	require.NoError(err, "failed to create session")
+	bobSession, err := bob.Session()
+	require.NoError(err, "failed to create session")
+
+	send := func() {
+		ciphertext, err := aliceSession.Encrypt(nil, make([]byte, 6))
+		require.NoError(err, "failed to encrypt")
+		_, err = bobSession.Decrypt(nil, ciphertext)
+		require.NoError(err, "failed to decrypt")
+	}
+
+	// a manual rekey goes through the rekeyer, which clears its counters, so
+	// the next 6 bytes don't reach the limit.
+	send()
+	require.NoError(aliceSession.Rekey(DirectionSend), "failed to rekey")
+	require.NoError(bobSession.Rekey(DirectionRecv), "failed to rekey")
+	key := alice.SendCipherState.key
+	send()
+	require.Equal(key, alice.SendCipherState.key, "should not rekey")
+
+	// the limit is reached by the next message.
+	send()
+	require.NotEqual(key, alice.SendCipherState.key, "should rekey")
+}
+
+func TestSessionReuse(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_NN_25519_ChaChaPoly_BLAKE2s"
+
+	alice, _ := NewProtocol(name, "", true)
+	bob, _ := NewProtocol(name, "", false)
+	runHandshake(t, alice, bob)
+
+	// the session is created once, so the nonces are never reused.
+	s1, err := alice.Session()
+	require.NoError(err, "failed to create session")
+	s2, err := alice.Session()
+	require.NoError(err, "failed to create session")
+	require.Same(s1, s2, "session should be reused")
+	c1, err := s1.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	c2, err := s2.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	require.NotEqual(c1, c2, "nonce must not be reused")
+
+	// a datagram session cannot share the cipher states with it.
+	_, err = alice.DatagramSession(nil)
+	require.Equal(ErrSessionExists, err, "error not match")
+
+	d1, err := bob.DatagramSession(nil)
+	require.NoError(err, "failed to create datagram session")
+	d2, err := bob.DatagramSession(&DatagramConfig{
+		RekeyInterval: defaultDatagramRekeyInterval,
+	})
+	require.NoError(err, "failed to create datagram session")
+	require.Same(d1, d2, "datagram session should be reused")
+
+	_, err = bob.DatagramSession(&DatagramConfig{
+		RekeyInterval: ReplayWindowSize,
+	})
+	require.Equal(ErrSessionExists, err, "error not match")
+	_, err = bob.Session()
+	require.Equal(ErrSessionExists, err, "error not match")
+}
+
+func TestSessionOneWay(t *testing.T) {
+	require := require.New(t)
+	name := "Noise_N_25519_ChaChaPoly_BLAKE2s"
+
+	bob, err := NewProtocol(name, "", false)
+	require.NoError(err, "failed to create bob")
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:            name,
+		Initiator:       true,
+		RemoteStaticPub: bob.localStatic.PubKey().Bytes(),
+	})
+	require.NoError(err, "failed to create alice")
+
+	runHandshake(t, alice, bob)
+
+	aliceSession, err := alice.Session()
+	require.NoError(err, "failed to create session")
+	bobSession, err := bob.Session()
+	require.NoError(err, "failed to create session")
+
+	ciphertext, err := aliceSession.Encrypt(nil, []byte("yy"))
+	require.NoError(err, "failed to encrypt")
+	_, err = bobSession.Decrypt(nil, ciphertext)
+	require.NoError(err, "failed to decrypt")
+
+	// the responder cannot send, the initiator cannot receive
+	_, err = bobSession.Encrypt(nil, []byte("yy"))
+	require.Equal(errMissingCipherState(DirectionSend), err,
+		"error not match")
+	_, err = aliceSession.Decrypt(nil, ciphertext)
+	require.Equal(errMissingCipherState(DirectionRecv), err,
+		"error not match")
+}
+
+// newTransportSessions creates the sessions of a finished NN handshake.
+func newTransportSessions(t testing.TB, cipher string) (*Session, *Session) {
+	name := "Noise_NN_25519_" + cipher + "_SHA256"
+	alice, err := NewProtocol(name, "", true)
+	require.NoError(t, err, "failed to create alice")
+	bob, err := NewProtocol(name, "", false)
+	require.NoError(t, err, "failed to create bob")
+	runHandshake(t, alice, bob)
+
+	aliceSession, err := alice.Session()
+	require.NoError(t, err, "failed to create session")
+	bobSession, err := bob.Session()
+	require.NoError(t, err, "failed to create session")
+	return aliceSession, bobSession
+}
+
+func TestSessionAppend(t *testing.T) {
+	for _, cipher := range []string{"ChaChaPoly", "AESGCM"} {
+		t.Run(cipher, func(t *testing.T) {
+			require := require.New(t)
+			alice, bob := newTransportSessions(t, cipher)
+			ad, msg := []byte("ad"), []byte("yy")
+
+			// the ciphertext is appended to dst
+			prefix := []byte("prefix")
+			out, err := alice.EncryptTo(prefix, ad, msg)
+			require.NoError(err, "failed to encrypt")
+			require.Equal(prefix, out[:len(prefix)], "prefix not kept")
+
+			// decrypt in place
+			ciphertext := out[len(prefix):]
+			plaintext, err := bob.DecryptTo(ciphertext[:0], ad, ciphertext)
+			require.NoError(err, "failed to decrypt")
+			require.Equal(msg, plaintext, "plaintext not match")
+			require.Equal(&ciphertext[0], &plaintext[0], "not in place")
+
+			// it works with the allocating API
+			ciphertext, err = alice.EncryptTo(nil, ad, msg)
+			require.NoError(err, "failed to encrypt")
+			plaintext, err = bob.Decrypt(ad, ciphertext)
+			require.NoError(err, "failed to decrypt")
+			require.Equal(msg, plaintext, "plaintext not match")
+
+			// a failed decryption leaves the nonce untouched
+			ciphertext, err = alice.EncryptTo(nil, ad, msg)
+			require.NoError(err, "failed to encrypt")
+			_, err = bob.DecryptTo(nil, nil, ciphertext)
+			require.Error(err, "wrong ad should fail")
+			plaintext, err = bob.DecryptTo(nil, ad, ciphertext)
+			require.NoError(err, "failed to decrypt")
+			require.Equal(msg, plaintext, "plaintext not match")
+		})
+	}
+}
+
+func TestSessionZeroAlloc(t *testing.T) {
+	for _, cipher := range []string{"ChaChaPoly", "AESGCM"} {
+		t.Run(cipher, func(t *testing.T) {
+			alice, bob := newTransportSessions(t, cipher)
+			ad := []byte("ad")
+			msg := make([]byte, 1024)
+			buf := make([]byte, 0, len(msg)+16)
+
+			allocs := testing.AllocsPerRun(100, func() {
+				ciphertext, err := alice.EncryptTo(buf[:0], ad, msg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := bob.DecryptTo(
+					ciphertext[:0], ad, ciphertext); err != nil {
+					t.Fatal(err)
+				}
+			})
+			require.Zero(t, allocs, "transport message should not allocate")
+		})
+	}
+}
+
+func TestSessionConcurrent(t *testing.T) {
+	const workers, messages = 8, 200
+	alice, bob := newTransportSessions(t, "ChaChaPoly")
+
+	// the same plaintext is encrypted by all the workers, a reused nonce
+	// would produce the same ciphertext.
+	results := make(chan string, workers*messages)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				ciphertext, err := alice.Encrypt(nil, []byte("yy"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				results <- string(ciphertext)
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+	close(errs)
+	require.NoError(t, <-errs, "failed to encrypt")
+
+	seen := make(map[string]bool)
+	for ciphertext := range results {
+		require.False(t, seen[ciphertext], "nonce is reused")
+		seen[ciphertext] = true
+	}
+	require.Len(t, seen, workers*messages, "ciphertexts not match")
+	require.Equal(t, uint64(workers*messages), alice.send.Nonce(),
+		"nonce not match")
+
+	// both parties send and receive at the same time.
+	errs = make(chan error, 4)
+	exchange := func(sender, receiver *Session) {
+		msgs := make(chan []byte, messages)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			defer close(msgs)
+			for i := 0; i < messages; i++ {
+				ciphertext, err := sender.Encrypt(nil, []byte{byte(i)})
+				if err != nil {
+					errs <- err
+					return
+				}
+				msgs <- ciphertext
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < messages; i++ {
+				ciphertext, ok := <-msgs
+				if !ok {
+					return
+				}
+				plaintext, err := receiver.Decrypt(nil, ciphertext)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal([]byte{byte(i)}, plaintext) {
+					errs <- fmt.Errorf("plaintext %d not match", i)
+					return
+				}
+			}
+		}()
+	}
+	alice, bob = newTransportSessions(t, "AESGCM")
+	exchange(alice, bob)
+	exchange(bob, alice)
+	wg.Wait()
+	close(errs)
+	require.NoError(t, <-errs, "failed to exchange messages")
+}
+
+func TestSessionConcurrentClose(t *testing.T) {
+	const workers = 8
+	alice, _ := newTransportSessions(t, "ChaChaPoly")
+
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := alice.Encrypt(nil, []byte("yy"))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	require.NoError(t, alice.Close(), "failed to close")
+	require.NoError(t, alice.Close(), "close should be idempotent")
+	wg.Wait()
+	close(errs)
+
+	// the encryption only stops once the session is closed.
+	for err := range errs {
+		require.Equal(t, ErrSessionClosed, err, "error not match")
+	}
+}
+
+func BenchmarkSessionTransport(b *testing.B) {
+	for _, cipher := range []string{"ChaChaPoly", "AESGCM"} {
+		for _, size := range []int{64, 1024, 16384} {
+			b.Run(fmt.Sprintf("%s/%d", cipher, size), func(b *testing.B) {
+				alice, bob := newTransportSessions(b, cipher)
+				msg := make([]byte, size)
+				buf := make([]byte, 0, size+16)
+
+				b.ReportAllocs()
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ciphertext, err := alice.EncryptTo(buf[:0], nil, msg)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, err := bob.DecryptTo(
+						ciphertext[:0], nil, ciphertext); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkHandshake(b *testing.B) {
+	for _, name := range []string{
+		"Noise_XX_25519_ChaChaPoly_BLAKE2s",
+		"Noise_XX_25519_AESGCM_SHA256",
+	} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				alice, _ := NewProtocol(name, "", true)
+				bob, _ := NewProtocol(name, "", false)
+				runHandshake(b, alice, bob)
+			}
+		})
+	}
+}
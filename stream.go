@@ -0,0 +1,218 @@
+package babble
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// streamHeaderSize is the size of the 2-byte big-endian length prefixed
+	// to each chunk.
+	streamHeaderSize = 2
+
+	// The chunk types, which are encrypted as the first byte of each chunk.
+	chunkMore  byte = 0
+	chunkFinal byte = 1
+)
+
+var (
+	// ErrStreamTruncated is returned by DecryptReader when the stream ends
+	// before the final chunk is received.
+	ErrStreamTruncated = errors.New("stream is truncated")
+
+	errStreamClosed = errors.New("stream is closed")
+	errInvalidChunk = errors.New("invalid stream chunk")
+)
+
+// EncryptWriter encrypts the data written to it using a cipher state, and
+// writes it to the underlying writer in chunks. Each chunk is a 2-byte
+// big-endian length followed by a transport message, whose plaintext is a
+// chunk type followed by the data. The chunks are as large as the 65535-byte
+// message limit allows, and the last one is marked as final, so the reader can
+// detect a truncated stream. Close must be called to write the final chunk.
+//
+// Each chunk is encrypted using EncryptWithAd, so the nonce and the rekeyer of
+// the cipher state work the same as for the other transport messages. The
+// cipher state must not be used elsewhere while the writer is in use.
+type EncryptWriter struct {
+	cs *CipherState
+	w  io.Writer
+
+	// buf holds the chunk type followed by the data not yet written, and out
+	// holds the encrypted chunk.
+	buf []byte
+	out []byte
+
+	// err is set once a write fails, which is returned by the later calls.
+	err error
+}
+
+// NewEncryptWriter creates an EncryptWriter which encrypts the data using the
+// cipher state and writes it to w. The cipher state must have a key, e.g., the
+// SendCipherState of a finished handshake.
+func NewEncryptWriter(cs *CipherState, w io.Writer) *EncryptWriter {
+	ew := &EncryptWriter{cs: cs, w: w}
+	if cs == nil || !cs.hasKey() {
+		ew.err = errMissingCipherKey
+		return ew
+	}
+
+	overhead := cs.cipher.Cipher().Overhead()
+	ew.buf = make([]byte, 1, maxMessageSize-overhead)
+	ew.out = make([]byte, streamHeaderSize, streamHeaderSize+maxMessageSize)
+	return ew
+}
+
+// Write encrypts p and writes it in chunks. The data may be buffered until a
+// full chunk is collected or Close is called.
+func (ew *EncryptWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only written once more data comes, so the last
+		// chunk always carries data unless the stream is empty.
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.flush(chunkMore); err != nil {
+				return n, err
+			}
+		}
+
+		size := cap(ew.buf) - len(ew.buf)
+		if size > len(p) {
+			size = len(p)
+		}
+		ew.buf = append(ew.buf, p[:size]...)
+		p = p[size:]
+		n += size
+	}
+	return n, nil
+}
+
+// Close writes the buffered data as the final chunk. It doesn't close the
+// underlying writer. The writer cannot be used once closed.
+func (ew *EncryptWriter) Close() error {
+	if ew.err != nil {
+		if ew.err == errStreamClosed {
+			return nil
+		}
+		return ew.err
+	}
+
+	if err := ew.flush(chunkFinal); err != nil {
+		return err
+	}
+	ew.err = errStreamClosed
+	wipe(ew.buf[:cap(ew.buf)])
+	return nil
+}
+
+// flush encrypts the buffered data as a chunk of the type and writes it.
+func (ew *EncryptWriter) flush(chunkType byte) error {
+	ew.buf[0] = chunkType
+	out, err := ew.cs.EncryptWithAdTo(ew.out[:streamHeaderSize], nil, ew.buf)
+	if err != nil {
+		ew.err = err
+		return err
+	}
+
+	binary.BigEndian.PutUint16(out, uint16(len(out)-streamHeaderSize))
+	if _, err := ew.w.Write(out); err != nil {
+		ew.err = err
+		return err
+	}
+	ew.buf = ew.buf[:1]
+	return nil
+}
+
+// DecryptReader reads the chunks written by an EncryptWriter, and decrypts
+// them using a cipher state. Once the final chunk is read, Read returns
+// io.EOF. If the underlying reader ends before the final chunk,
+// ErrStreamTruncated is returned. The cipher state must not be used elsewhere
+// while the reader is in use.
+type DecryptReader struct {
+	cs *CipherState
+	r  io.Reader
+
+	// buf holds the encrypted chunk, which is decrypted in place, and data is
+	// the plaintext not yet read.
+	buf  []byte
+	data []byte
+
+	// final is set once the final chunk is decrypted.
+	final bool
+
+	// err is set once a read fails, which is returned by the later calls.
+	err error
+}
+
+// NewDecryptReader creates a DecryptReader which reads the chunks from r and
+// decrypts them using the cipher state. The cipher state must have a key,
+// e.g., the RecvCipherState of a finished handshake.
+func NewDecryptReader(cs *CipherState, r io.Reader) *DecryptReader {
+	dr := &DecryptReader{cs: cs, r: r}
+	if cs == nil || !cs.hasKey() {
+		dr.err = errMissingCipherKey
+		return dr
+	}
+	dr.buf = make([]byte, streamHeaderSize+maxMessageSize)
+	return dr
+}
+
+// Read reads the decrypted data into p.
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.data) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.final {
+			return 0, io.EOF
+		}
+		if err := dr.readChunk(); err != nil {
+			dr.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, dr.data)
+	dr.data = dr.data[n:]
+	return n, nil
+}
+
+// readChunk reads and decrypts the next chunk.
+func (dr *DecryptReader) readChunk() error {
+	header := dr.buf[:streamHeaderSize]
+	if _, err := io.ReadFull(dr.r, header); err != nil {
+		return streamReadError(err)
+	}
+
+	size := int(binary.BigEndian.Uint16(header))
+	chunk := dr.buf[streamHeaderSize : streamHeaderSize+size]
+	if _, err := io.ReadFull(dr.r, chunk); err != nil {
+		return streamReadError(err)
+	}
+
+	plaintext, err := dr.cs.DecryptWithAdTo(chunk[:0], nil, chunk)
+	if err != nil {
+		return err
+	}
+	if len(plaintext) == 0 || plaintext[0] > chunkFinal {
+		return errInvalidChunk
+	}
+
+	dr.final = plaintext[0] == chunkFinal
+	dr.data = plaintext[1:]
+	return nil
+}
+
+// streamReadError turns the EOF of the underlying reader into
+// ErrStreamTruncated, as the final chunk is not yet received.
+func streamReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrStreamTruncated
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package babble
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newStreamCipherStates returns the sending cipher state of the initiator and
+// the receiving cipher state of the responder from a finished handshake.
+func newStreamCipherStates(t *testing.T,
+	config *DefaultRekeyerConfig) (*CipherState, *CipherState) {
+	name := "Noise_NN_25519_ChaChaPoly_SHA256"
+	alice, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:          name,
+		Initiator:     true,
+		RekeyerConfig: config,
+	})
+	require.NoError(t, err, "failed to create alice")
+	bob, err := NewProtocolWithConfig(&ProtocolConfig{
+		Name:          name,
+		RekeyerConfig: config,
+	})
+	require.NoError(t, err, "failed to create bob")
+	runHandshake(t, alice, bob)
+	return alice.SendCipherState, bob.RecvCipherState
+}
+
+// encryptStream encrypts the data using the writes of the size.
+func encryptStream(t *testing.T,
+	cs *CipherState, data []byte, size int) []byte {
+	var buf bytes.Buffer
+	w := NewEncryptWriter(cs, &buf)
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		written, err := w.Write(data[:n])
+		require.NoError(t, err, "failed to write")
+		require.Equal(t, n, written, "written size not match")
+		data = data[n:]
+	}
+	require.NoError(t, w.Close(), "failed to close")
+	return buf.Bytes()
+}
+
+// streamChunks splits the encrypted stream into chunks.
+func streamChunks(stream []byte) [][]byte {
+	var chunks [][]byte
+	for len(stream) > 0 {
+		size := streamHeaderSize + int(binary.BigEndian.Uint16(stream))
+		chunks = append(chunks, stream[:size])
+		stream = stream[size:]
+	}
+	return chunks
+}
+
+func TestStream(t *testing.T) {
+	maxData := maxMessageSize - 16 - 1
+	large := make([]byte, 3*maxData+100)
+	_, _ = rand.Read(large)
+
+	testParams := []struct {
+		name      string
+		data      []byte
+		writeSize int
+		chunks    int
+	}{
+		{"empty stream", nil, 1, 1},
+		{"small stream", []byte("yy"), 1, 1},
+		{"exactly one chunk", large[:maxData], maxData, 1},
+		{"one byte over a chunk", large[:maxData+1], 1000, 2},
+		{"large stream", large, 1 << 20, 4},
+		{"large stream by small writes", large, 4096, 4},
+	}
+
+	for _, tt := range testParams {
+		t.Run(tt.name, func(t *testing.T) {
+			send, recv := newStreamCipherStates(t, nil)
+			stream := encryptStream(t, send, tt.data, tt.writeSize)
+
+			chunks := streamChunks(stream)
+			require.Len(t, chunks, tt.chunks, "chunks not match")
+			for _, c := range chunks {
+				require.LessOrEqual(t, len(c)-streamHeaderSize,
+					maxMessageSize, "chunk too large")
+			}
+
+			got, err := ioutil.ReadAll(
+				NewDecryptReader(recv, bytes.NewReader(stream)))
+			require.NoError(t, err, "failed to read")
+			require.Equal(t, len(tt.data), len(got), "size not match")
+			require.True(t, bytes.Equal(tt.data, got), "data not match")
+			require.Equal(t, send.Nonce(), recv.Nonce(), "nonce not match")
+		})
+	}
+}
+
+func TestStreamRekey(t *testing.T) {
+	// rekey every 3 chunks
+	config := &DefaultRekeyerConfig{Interval: 3, ResetNonce: true}
+	send, recv := newStreamCipherStates(t, config)
+	key := send.key
+
+	data := make([]byte, 10*(maxMessageSize-16-1))
+	_, _ = rand.Read(data)
+	stream := encryptStream(t, send, data, len(data))
+	require.Len(t, streamChunks(stream), 10, "chunks not match")
+	require.NotEqual(t, key, send.key, "key should be rotated")
+
+	got, err := ioutil.ReadAll(NewDecryptReader(recv, bytes.NewReader(stream)))
+	require.NoError(t, err, "failed to read")
+	require.True(t, bytes.Equal(data, got), "data not match")
+	require.Equal(t, send.key, recv.key, "key not match")
+	require.Equal(t, uint64(1), recv.Nonce(), "nonce not match")
+
+	// the cipher states can be used for more streams
+	stream = encryptStream(t, send, []byte("yy"), 2)
+	got, err = ioutil.ReadAll(NewDecryptReader(recv, bytes.NewReader(stream)))
+	require.NoError(t, err, "failed to read")
+	require.Equal(t, []byte("yy"), got, "data not match")
+}
+
+func TestStreamErrors(t *testing.T) {
+	data := make([]byte, 2*(maxMessageSize-16-1))
+	_, _ = rand.Read(data)
+
+	// newStream returns the chunks of the encrypted data, and the receiving
+	// cipher state of the same handshake.
+	newStream := func() ([][]byte, *CipherState) {
+		send, recv := newStreamCipherStates(t, nil)
+		return streamChunks(encryptStream(t, send, data, len(data))), recv
+	}
+	read := func(recv *CipherState, chunks ...[]byte) error {
+		_, err := ioutil.ReadAll(NewDecryptReader(
+			recv, bytes.NewReader(bytes.Join(chunks, nil))))
+		return err
+	}
+
+	// dropping the final chunk is detected
+	chunks, recv := newStream()
+	require.Len(t, chunks, 2, "chunks not match")
+	require.Equal(t, ErrStreamTruncated, read(recv, chunks[0]),
+		"error not match")
+
+	// a partial chunk is detected
+	chunks, recv = newStream()
+	last := chunks[1]
+	require.Equal(t, ErrStreamTruncated,
+		read(recv, chunks[0], last[:len(last)-1]), "error not match")
+
+	// reordered chunks fail to decrypt
+	chunks, recv = newStream()
+	require.Error(t, read(recv, chunks[1], chunks[0]),
+		"reordered chunks should fail")
+
+	// a modified chunk fails to decrypt
+	chunks, recv = newStream()
+	chunks[1][streamHeaderSize] ^= 1
+	require.Error(t, read(recv, chunks...), "modified chunk should fail")
+
+	// an unknown chunk type is rejected
+	send, recv := newStreamCipherStates(t, nil)
+	msg, err := send.EncryptWithAd(nil, []byte{2, 'y', 'y'})
+	require.NoError(t, err, "failed to encrypt")
+	header := make([]byte, streamHeaderSize)
+	binary.BigEndian.PutUint16(header, uint16(len(msg)))
+	require.Equal(t, errInvalidChunk, read(recv, header, msg),
+		"error not match")
+
+	// a missing key is reported
+	_, err = NewEncryptWriter(newCipherState(nil, nil), ioutil.Discard).
+		Write([]byte("yy"))
+	require.Equal(t, errMissingCipherKey, err, "error not match")
+	_, err = NewDecryptReader(nil, bytes.NewReader(nil)).Read(make([]byte, 1))
+	require.Equal(t, errMissingCipherKey, err, "error not match")
+
+	// the writer cannot be used once closed
+	send, _ = newStreamCipherStates(t, nil)
+	w := NewEncryptWriter(send, ioutil.Discard)
+	require.NoError(t, w.Close(), "failed to close")
+	require.NoError(t, w.Close(), "close should be idempotent")
+	_, err = w.Write([]byte("yy"))
+	require.Equal(t, errStreamClosed, err, "error not match")
+
+	// the error of the underlying writer is returned
+	send, _ = newStreamCipherStates(t, nil)
+	w = NewEncryptWriter(send, failingWriter{})
+	require.Equal(t, io.ErrClosedPipe, w.Close(), "error not match")
+	require.Equal(t, io.ErrClosedPipe, w.Close(), "error should be kept")
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -2,11 +2,13 @@ package babble
 
 import (
 	"errors"
+	gohash "hash"
 
 	noiseCipher "github.com/crypto-y/babble/cipher"
 	"github.com/crypto-y/babble/dh"
 	"github.com/crypto-y/babble/hash"
-	"golang.org/x/crypto/hkdf"
+	"github.com/crypto-y/babble/kem"
+	"github.com/crypto-y/babble/rekey"
 )
 
 var (
@@ -24,6 +26,19 @@ type symmetricState struct {
 	hash  hash.Hash
 	curve dh.Curve
 
+	// hybrid is the second dh curve used by the hfs modifier, nil if hfs is
+	// not used.
+	hybrid dh.Curve
+
+	// kem is the key encapsulation mechanism used by the PQNoise patterns, in
+	// which case curve is nil.
+	kem kem.KEM
+
+	// rekeyer is cloned into the cipher states created by Split. The cs used
+	// during the handshake has no rekeyer, so the key never changes in the
+	// middle of the handshake.
+	rekeyer rekey.Rekeyer
+
 	// A chaining key of HASHLEN bytes.
 	//
 	// chainingKey is the ck in the noise specs.
@@ -33,6 +48,11 @@ type symmetricState struct {
 	//
 	// digest is the h in the noise specs.
 	digest []byte
+
+	// hasher and mac are reused by MixHash and HKDF, so no hash instance is
+	// created for each call. They're created on first use.
+	hasher gohash.Hash
+	mac    *hmacHash
 }
 
 // DecryptAndHash sets plaintext = DecryptWithAd(digest, ciphertext), calls
@@ -74,6 +94,8 @@ func (s *symmetricState) GetHandshakeHash() []byte {
 // chainingKey, secret, and num, in which,
 //  - chainingKey must be byte sequence of length HASHLEN
 //  - secret must be byte sequence with length either zero, 32, or DHLEN bytes.
+//    If the hfs modifier is used, DHLEN of the hybrid curve is also allowed.
+//    If a KEM is used, the size of its public key is allowed instead of DHLEN.
 //  - num must be 2 or 3.
 func (s *symmetricState) HKDF(secret []byte, num int) ([][]byte, error) {
 	// first, validate num
@@ -82,9 +104,7 @@ func (s *symmetricState) HKDF(secret []byte, num int) ([][]byte, error) {
 	}
 
 	// then, validate the secret size
-	if len(secret) != 0 &&
-		len(secret) != 32 &&
-		len(secret) != s.curve.Size() {
+	if !s.validSecretSize(len(secret)) {
 		return nil, errInvalidKeySize
 	}
 
@@ -93,30 +113,69 @@ func (s *symmetricState) HKDF(secret []byte, num int) ([][]byte, error) {
 		return nil, errInvalidChainingKey
 	}
 
-	// A concept remapping
-	//  - salt is the chaining key
-	//  - info is an empty byte slice([]byte)
-	h := hkdf.New(s.hash.New, secret, s.chainingKey, ZEROLEN)
-
-	// read [num] outputs
-	var result [][]byte
+	// As defined in the noise specs,
+	//  - tempKey = HMAC-HASH(chainingKey, secret)
+	//  - output1 = HMAC-HASH(tempKey, byte(0x01))
+	//  - output2 = HMAC-HASH(tempKey, output1 || byte(0x02))
+	//  - output3 = HMAC-HASH(tempKey, output2 || byte(0x03))
+	// which is the HKDF in RFC 5869 using the chaining key as the salt and an
+	// empty info. The outputs share one buffer.
+	hashLen := s.hash.HashLen()
+	buf := make([]byte, (num+1)*hashLen)
+	tempKey := buf[num*hashLen:]
+	defer wipe(tempKey)
+
+	mac := s.hmac()
+	mac.reset(s.chainingKey)
+	_, _ = mac.Write(secret)
+	mac.sum(tempKey[:0])
+
+	result := make([][]byte, num)
+	var prev []byte
 	for i := 0; i < num; i++ {
-		output := make([]byte, s.hash.HashLen())
-
-		n, err := h.Read(output)
-		if err != nil {
-			return nil, err
-		}
-		// return an error if not full HASHLEN bytes are read
-		if n != s.hash.HashLen() {
-			return nil, errors.New("HKDF cannot read full HASHLEN bytes")
-		}
-
-		result = append(result, output)
+		mac.reset(tempKey)
+		_, _ = mac.Write(prev)
+		_, _ = mac.Write([]byte{byte(i + 1)})
+
+		output := buf[i*hashLen : (i+1)*hashLen : (i+1)*hashLen]
+		mac.sum(output[:0])
+		result[i] = output
+		prev = output
 	}
+	mac.wipe()
+
 	return result, nil
 }
 
+// validSecretSize checks the secret size used by HKDF is either zero, 32, or
+// the key size defined by the curves or KEM in use.
+func (s *symmetricState) validSecretSize(n int) bool {
+	switch {
+	case n == 0 || n == 32:
+		return true
+	case s.curve != nil && n == s.curve.Size():
+		return true
+	case s.hybrid != nil && n == s.hybrid.Size():
+		return true
+	case s.kem != nil && n == s.kem.PublicKeySize():
+		return true
+	}
+	return false
+}
+
+// keyExchangeName returns the name of the key exchange component in the
+// protocol name, e.g., 25519, 25519+448 or MLKEM768.
+func (s *symmetricState) keyExchangeName() string {
+	if s.kem != nil {
+		return s.kem.String()
+	}
+	name := s.curve.String()
+	if s.hybrid != nil {
+		name += "+" + s.hybrid.String()
+	}
+	return name
+}
+
 // InitializeSymmetric takes an arbitrary-length protocolName byte sequence.
 // Executes the following steps:
 // 	- If protocolName is less than or equal to HASHLEN bytes in length, sets
@@ -143,14 +202,17 @@ func (s *symmetricState) InitializeSymmetric(protocolName []byte) {
 	_ = s.cs.initializeKey(ZEROS)
 }
 
-// MixHash sets h = HASH(h || data) and writes it to digest.
+// MixHash sets h = HASH(h || data) and writes it to digest. The digest is
+// written to a new slice, so the ones returned earlier are left untouched.
 func (s *symmetricState) MixHash(data []byte) {
-
-	h := s.hash.New()
+	if s.hasher == nil {
+		s.hasher = s.hash.New()
+	}
+	h := s.hasher
 
 	_, _ = h.Write(s.digest)
 	_, _ = h.Write(data)
-	s.digest = h.Sum(nil)
+	s.digest = h.Sum(make([]byte, 0, s.hash.HashLen()))
 
 	h.Reset()
 }
@@ -167,15 +229,16 @@ func (s *symmetricState) MixKey(keyMaterial []byte) error {
 		return err
 	}
 
+	wipe(s.chainingKey)
 	s.chainingKey = digests[0]
 	// because tempKey is fixed size 32-byte array, it will automatically
 	// truncate if HASHLEN is 64.
 	copy(tempKey[:], digests[1])
+	wipe(digests[1])
 
-	if err := s.cs.initializeKey(tempKey); err != nil {
-		return err
-	}
-	return nil
+	err = s.cs.initializeKey(tempKey)
+	wipe(tempKey[:])
+	return err
 }
 
 // MixKeyAndHash is used for handling pre-shared symmetric keys, it executes the
@@ -193,17 +256,19 @@ func (s *symmetricState) MixKeyAndHash(keyMaterial []byte) error {
 
 	var tempKey [CipherKeySize]byte
 
+	wipe(s.chainingKey)
 	s.chainingKey = digests[0]
 	tempHashOutput := digests[1]
 	// because tempKey is fixed size 32-byte array, it will automatically
 	// truncate if HASHLEN is 64.
 	copy(tempKey[:], digests[2])
+	wipe(digests[2])
 	s.MixHash(tempHashOutput)
-	if err := s.cs.initializeKey(tempKey); err != nil {
-		return err
-	}
+	wipe(tempHashOutput)
 
-	return nil
+	err = s.cs.initializeKey(tempKey)
+	wipe(tempKey[:])
+	return err
 }
 
 // Reset sets the symmetric state's chaining key and hash digest to be nil, and
@@ -218,11 +283,30 @@ func (s *symmetricState) Reset() {
 	}
 }
 
+// Destroy wipes the chaining key and hash digest, and destroys the cipher
+// state. The symmetric state must not be used afterwards.
+func (s *symmetricState) Destroy() {
+	wipe(s.chainingKey)
+	wipe(s.digest)
+	s.chainingKey = nil
+	s.digest = nil
+
+	if s.mac != nil {
+		s.mac.wipe()
+	}
+
+	if s.cs != nil {
+		s.cs.Destroy()
+		s.cs = nil
+	}
+}
+
 // Split returns a pair of CipherState structs for encrypting transport
 // messages. Executes the following steps,
 // 	- Sets tempKey1, tempKey2 = HKDF(zerolen, 2).
 // 	- If HASHLEN is 64, then truncates tempKey1 and tempKey2 to 32 bytes.
-// 	- Creates two new CipherState instances c1 and c2.
+// 	- Creates two new CipherState instances c1 and c2, each with a clone of
+// 	  the rekeyer, if any.
 // 	- Calls c1.initializeKey(tempKey1) and c2.initializeKey(tempKey2).
 // 	- Returns the pair (c1, c2).
 func (s *symmetricState) Split() (c1, c2 *CipherState, err error) {
@@ -235,12 +319,17 @@ func (s *symmetricState) Split() (c1, c2 *CipherState, err error) {
 	var tempKey2 [CipherKeySize]byte
 	copy(tempKey1[:], digests[0])
 	copy(tempKey2[:], digests[1])
+	wipe(digests[0])
+	wipe(digests[1])
+	defer wipe(tempKey1[:])
+	defer wipe(tempKey2[:])
 
 	cipher1, _ := noiseCipher.FromString(s.cs.cipher.String())
 	cipher2, _ := noiseCipher.FromString(s.cs.cipher.String())
 
-	c1 = newCipherState(cipher1, s.cs.RekeyManger)
-	c2 = newCipherState(cipher2, s.cs.RekeyManger)
+	// each direction has its own rekeyer.
+	c1 = newCipherState(cipher1, cloneRekeyer(s.rekeyer))
+	c2 = newCipherState(cipher2, cloneRekeyer(s.rekeyer))
 
 	if err := c1.initializeKey(tempKey1); err != nil {
 		return nil, nil, err
@@ -252,6 +341,92 @@ func (s *symmetricState) Split() (c1, c2 *CipherState, err error) {
 	return c1, c2, nil
 }
 
+// hmac returns the reusable HMAC, which is created on first use.
+func (s *symmetricState) hmac() *hmacHash {
+	if s.mac == nil {
+		s.mac = newHMAC(s.hash)
+	}
+	return s.mac
+}
+
+// hmacHash implements HMAC-HASH as specified in RFC 2104, in which the hash
+// instances are reused across keys, unlike the crypto/hmac that binds a key to
+// each instance.
+type hmacHash struct {
+	inner gohash.Hash
+	outer gohash.Hash
+
+	// ipad and opad are the key XORed with 0x36 and 0x5c, padded to BLOCKLEN.
+	ipad []byte
+	opad []byte
+
+	// innerSum holds the inner hash output.
+	innerSum []byte
+}
+
+func newHMAC(h hash.Hash) *hmacHash {
+	return &hmacHash{
+		inner:    h.New(),
+		outer:    h.New(),
+		ipad:     make([]byte, h.BlockLen()),
+		opad:     make([]byte, h.BlockLen()),
+		innerSum: make([]byte, 0, h.HashLen()),
+	}
+}
+
+// reset starts a new HMAC using the key.
+func (m *hmacHash) reset(key []byte) {
+	// keys longer than BLOCKLEN are hashed first.
+	if len(key) > len(m.ipad) {
+		m.outer.Reset()
+		_, _ = m.outer.Write(key)
+		key = m.outer.Sum(m.innerSum[:0])
+	}
+
+	wipe(m.ipad)
+	wipe(m.opad)
+	copy(m.ipad, key)
+	copy(m.opad, key)
+	for i := range m.ipad {
+		m.ipad[i] ^= 0x36
+		m.opad[i] ^= 0x5c
+	}
+
+	m.inner.Reset()
+	_, _ = m.inner.Write(m.ipad)
+}
+
+// Write adds data to the running HMAC.
+func (m *hmacHash) Write(data []byte) (int, error) {
+	return m.inner.Write(data)
+}
+
+// sum appends the HMAC to out and returns the updated slice.
+func (m *hmacHash) sum(out []byte) []byte {
+	m.innerSum = m.inner.Sum(m.innerSum[:0])
+	m.outer.Reset()
+	_, _ = m.outer.Write(m.opad)
+	_, _ = m.outer.Write(m.innerSum)
+	return m.outer.Sum(out)
+}
+
+// wipe clears the key material held by the HMAC.
+func (m *hmacHash) wipe() {
+	wipe(m.ipad)
+	wipe(m.opad)
+	wipe(m.innerSum[:cap(m.innerSum)])
+	m.inner.Reset()
+	m.outer.Reset()
+}
+
+// cloneRekeyer returns a clone of the rekeyer, or nil if it's nil.
+func cloneRekeyer(rk rekey.Rekeyer) rekey.Rekeyer {
+	if rk == nil {
+		return nil
+	}
+	return rk.Clone()
+}
+
 func newSymmetricState(
 	cs *CipherState, h hash.Hash, c dh.Curve) *symmetricState {
 	ss := &symmetricState{
@@ -1,6 +1,8 @@
 package babble
 
 import (
+	"bytes"
+	"crypto/hmac"
 	"testing"
 
 	"github.com/crypto-y/babble/cipher"
@@ -193,6 +195,35 @@ func TestSymmetricStateHKDF(t *testing.T) {
 	require.Nil(t, ss.cs, "cs should be nil")
 }
 
+func TestSymmetricStateDestroy(t *testing.T) {
+	cipherA, _ := noiseCipher.FromString("ChaChaPoly")
+	hashA, _ := noiseHash.FromString("SHA256")
+	curveA, _ := noiseCurve.FromString("25519")
+
+	cs := newCipherState(cipherA, nil)
+	ss := newSymmetricState(cs, hashA, curveA)
+	ss.InitializeSymmetric([]byte("Noise_NN_25519_ChaChaPoly_SHA256"))
+
+	// the old chaining key is wiped once replaced
+	oldCk := ss.chainingKey
+	require.NoError(t, ss.MixKey(make([]byte, 32)), "failed to mix key")
+	require.Equal(t, make([]byte, len(oldCk)), oldCk, "old ck not wiped")
+
+	oldCk = ss.chainingKey
+	require.NoError(t, ss.MixKeyAndHash(make([]byte, 32)), "failed to mix")
+	require.Equal(t, make([]byte, len(oldCk)), oldCk, "old ck not wiped")
+
+	ck, digest := ss.chainingKey, ss.digest
+	require.True(t, cs.hasKey(), "should have a key")
+	ss.Destroy()
+	require.Equal(t, make([]byte, len(ck)), ck, "ck not wiped")
+	require.Equal(t, make([]byte, len(digest)), digest, "digest not wiped")
+	require.Nil(t, ss.chainingKey, "ck should be nil")
+	require.Nil(t, ss.digest, "digest should be nil")
+	require.Nil(t, ss.cs, "cs should be nil")
+	require.Equal(t, ZEROS, cs.key, "cipher key not wiped")
+}
+
 func TestSymmetricStateSplit(t *testing.T) {
 	var (
 		// outputs for testing HKDF, generated using the follow script,
@@ -231,3 +262,24 @@ func TestSymmetricStateSplit(t *testing.T) {
 	require.Equal(t, output1, c1.key[:], "c1 should use output1 as cipher key")
 	require.Equal(t, output2, c2.key[:], "c2 should use output2 as cipher key")
 }
+
+func TestSymmetricStateHMAC(t *testing.T) {
+	for _, name := range []string{"SHA256", "SHA512", "BLAKE2s", "BLAKE2b"} {
+		h, _ := noiseHash.FromString(name)
+		mac := newHMAC(h)
+
+		// keys shorter, equal to and longer than BLOCKLEN
+		for _, size := range []int{0, 32, h.BlockLen(), h.BlockLen() + 1} {
+			key := bytes.Repeat([]byte{0xab}, size)
+			data := []byte("babble")
+
+			want := hmac.New(h.New, key)
+			want.Write(data)
+
+			mac.reset(key)
+			_, _ = mac.Write(data)
+			require.Equal(t, want.Sum(nil), mac.sum(nil),
+				"%s: HMAC with %d-byte key not match", name, size)
+		}
+	}
+}
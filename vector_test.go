@@ -5,13 +5,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
+	"github.com/crypto-y/babble/dh"
 	"github.com/crypto-y/babble/vectors"
 )
 
-const filepath = "./vectors/vectors.txt"
+const (
+	filepath         = "./vectors/vectors.txt"
+	fallbackFilepath = "./vectors/data/noise-c-fallback.txt"
+	hybridFilepath   = "./vectors/data/noise-c-hybrid.txt"
+)
 
 func TestVectors(t *testing.T) {
 	require := require.New(t)
@@ -31,6 +37,161 @@ func TestVectors(t *testing.T) {
 	}
 }
 
+func TestFallbackVectors(t *testing.T) {
+	require := require.New(t)
+	// load test file
+	data, err := ioutil.ReadFile(fallbackFilepath)
+	require.NoError(err, "failed to load test file")
+
+	// create json
+	var vectorsFile vectors.File
+	err = json.Unmarshal(data, &vectorsFile)
+	require.NoError(err, "failed to unmarshal data")
+
+	for i, v := range vectorsFile.Vectors {
+		// skip the old NoisePSK vectors
+		components := strings.Split(v.Name, "_")
+		if components[0] != NoisePrefix {
+			continue
+		}
+
+		// Name is the fallback protocol, eg, Noise_XXfallback_..., while
+		// Pattern is the one used before falling back, eg, IK.
+		v.FallbackPattern = components[1]
+		components[1] = v.Pattern
+		v.ProtocolName = strings.Join(components, "_")
+
+		t.Run(strconv.Itoa(i)+" - "+v.Name, func(t *testing.T) {
+			testFallbackVector(t, &v)
+		})
+	}
+}
+
+func TestHybridVectors(t *testing.T) {
+	require := require.New(t)
+	// load test file
+	data, err := ioutil.ReadFile(hybridFilepath)
+	require.NoError(err, "failed to load test file")
+
+	// create json
+	var vectorsFile vectors.File
+	err = json.Unmarshal(data, &vectorsFile)
+	require.NoError(err, "failed to unmarshal data")
+
+	for i, v := range vectorsFile.Vectors {
+		// skip the old NoisePSK vectors
+		components := strings.Split(v.Name, "_")
+		if components[0] != NoisePrefix {
+			continue
+		}
+
+		// skip the hybrid curves not supported, eg, NewHope
+		if d, _ := dh.FromString(v.Hybrid); d == nil {
+			continue
+		}
+
+		v.ProtocolName = v.Name
+		if v.Fallback {
+			// Name is the fallback protocol, eg, Noise_XXfallback+hfs_...,
+			// while Pattern is the one used before falling back, eg, IKhfs.
+			components[1] = v.Pattern
+			v.ProtocolName = strings.Join(components, "_")
+		}
+
+		t.Run(strconv.Itoa(i)+" - "+v.Name, func(t *testing.T) {
+			if v.Fallback {
+				testFallbackVector(t, &v)
+				return
+			}
+			testVector(t, &v)
+		})
+	}
+}
+
+func testFallbackVector(t *testing.T, v *vectors.Vector) {
+	require := require.New(t)
+	aliceCfg, bobCfg := createConfigFromVector(t, v)
+
+	alice, err := NewProtocolWithConfig(aliceCfg)
+	require.NoError(err, "failed to create alice's handshake state")
+	defer alice.Reset()
+
+	bob, err := NewProtocolWithConfig(bobCfg)
+	require.NoError(err, "failed to create bob's handshake state")
+	defer bob.Reset()
+
+	// alice sends the first message using a wrong remote static key
+	msg := v.Messages[0]
+	ciphertext, err := alice.WriteMessage(msg.Payload)
+	require.NoError(err, "failed to write message")
+	require.Equal([]byte(msg.Ciphertext), ciphertext, "failed to encrypt 0")
+
+	// bob fails to read it, and switches to the fallback protocol
+	_, err = bob.ReadMessage(ciphertext)
+	require.Error(err, "bob should fail to read the first message")
+	name := strings.Replace(
+		v.ProtocolName, "_"+v.Pattern+"_", "_"+v.FallbackPattern+"_", 1)
+	require.NoError(bob.Fallback(name), "bob failed to fallback")
+
+	// bob now sends the first message of the fallback pattern
+	msg = v.Messages[1]
+	ciphertext, err = bob.WriteMessage(msg.Payload)
+	require.NoError(err, "failed to write message")
+	require.Equal([]byte(msg.Ciphertext), ciphertext, "failed to encrypt 1")
+
+	// alice fails to read it, and switches to the fallback protocol
+	_, err = alice.ReadMessage(ciphertext)
+	require.Error(err, "alice should fail to read bob's message")
+	require.NoError(alice.Fallback(name), "alice failed to fallback")
+
+	plaintext, err := alice.ReadMessage(ciphertext)
+	require.NoError(err, "failed to read message")
+	require.Equal([]byte(msg.Payload), plaintext, "failed to decrypt 1")
+
+	// the rest of the handshake messages are sent alternately, starting from
+	// alice.
+	senders := []*HandshakeState{alice, bob}
+	n := len(alice.hp.MessagePattern) + 1
+	for i, msg := range v.Messages[2:n] {
+		sender, receiver := senders[i%2], senders[(i+1)%2]
+
+		ciphertext, err := sender.WriteMessage(msg.Payload)
+		require.NoError(err, "failed to write message")
+		require.Equal([]byte(msg.Ciphertext), ciphertext,
+			"failed to encrypt %v", i+2)
+
+		plaintext, err := receiver.ReadMessage(msg.Ciphertext)
+		require.NoError(err, "failed to read message")
+		require.Equal([]byte(msg.Payload), plaintext,
+			"failed to decrypt %v", i+2)
+	}
+
+	require.True(alice.Finished(), "must be finished at the end")
+	require.True(bob.Finished(), "must be finished at the end")
+	require.EqualValues([]byte(v.HandshakeHash), alice.GetDigest(),
+		"alice handshake digest not match")
+	require.EqualValues([]byte(v.HandshakeHash), bob.GetDigest(),
+		"bob handshake digest not match")
+
+	// the transport messages are also sent alternately, starting from alice.
+	for i, msg := range v.Messages[n:] {
+		sender, receiver := senders[i%2], senders[(i+1)%2]
+
+		ciphertext, err := sender.SendCipherState.EncryptWithAd(
+			nil, msg.Payload)
+		require.NoError(err,
+			"Transport: send failed to encrypt %v", i+n)
+		require.Equal([]byte(msg.Ciphertext), ciphertext,
+			"Transport: send - mismatched encrypt %v", i+n)
+
+		plaintext, err := receiver.RecvCipherState.DecryptWithAd(
+			nil, msg.Ciphertext)
+		require.NoError(err, "Transport: recv failed to decrypt")
+		require.Equal([]byte(msg.Payload), plaintext,
+			"Transport: recv - mismatched decrypt %v", i+n)
+	}
+}
+
 func testVector(t *testing.T, v *vectors.Vector) {
 	require := require.New(t)
 	aliceCfg, bobCfg := createConfigFromVector(t, v)
@@ -142,6 +303,8 @@ func createConfigFromVector(t *testing.T, v *vectors.Vector) (
 		LocalEphemeralPriv: v.InitEphemeral,
 		RemoteStaticPub:    v.InitRemoteStatic,
 		Prologue:           fmt.Sprintf("%s", v.InitPrologue),
+
+		LocalHybridEphemeralPriv: v.InitHybridEphemeral,
 	}
 
 	for _, psk := range v.InitPsks {
@@ -155,6 +318,8 @@ func createConfigFromVector(t *testing.T, v *vectors.Vector) (
 		LocalEphemeralPriv: v.RespEphemeral,
 		RemoteStaticPub:    v.RespRemoteStatic,
 		Prologue:           fmt.Sprintf("%s", v.RespPrologue),
+
+		LocalHybridEphemeralPriv: v.RespHybridEphemeral,
 	}
 
 	for _, psk := range v.RespPsks {
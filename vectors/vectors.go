@@ -44,18 +44,31 @@ type Vector struct {
 	Fallback        bool   `json:"fallback"`
 	FallbackPattern string `json:"fallback_pattern"`
 
+	// Pattern is the handshake pattern used before the fallback. It's only
+	// used by the noise-c fallback vectors, in which the Name is the
+	// fallback protocol name.
+	Pattern string `json:"pattern"`
+
+	// Hybrid is the hybrid dh curve used by the hfs modifier. It's only used
+	// by the noise-c hybrid vectors.
+	Hybrid string `json:"hybrid"`
+
 	InitPrologue     HexBuffer   `json:"init_prologue"`
 	InitPsks         []HexBuffer `json:"init_psks"`
 	InitStatic       HexBuffer   `json:"init_static"`
 	InitEphemeral    HexBuffer   `json:"init_ephemeral"`
 	InitRemoteStatic HexBuffer   `json:"init_remote_static"`
 
+	InitHybridEphemeral HexBuffer `json:"init_hybrid_ephemeral"`
+
 	RespPrologue     HexBuffer   `json:"resp_prologue"`
 	RespPsks         []HexBuffer `json:"resp_psks"`
 	RespStatic       HexBuffer   `json:"resp_static"`
 	RespEphemeral    HexBuffer   `json:"resp_ephemeral"`
 	RespRemoteStatic HexBuffer   `json:"resp_remote_static"`
 
+	RespHybridEphemeral HexBuffer `json:"resp_hybrid_ephemeral"`
+
 	HandshakeHash HexBuffer `json:"handshake_hash"`
 
 	Messages []Message `json:"messages"`
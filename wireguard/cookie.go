@@ -0,0 +1,231 @@
+package wireguard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// labelMAC1 and labelCookie are the labels used to derive the mac1 key
+	// and the cookie encryption key from a static public key.
+	labelMAC1   = "mac1----"
+	labelCookie = "cookie--"
+
+	// macSize is the size of mac1, mac2 and the cookie.
+	macSize = blake2s.Size128
+
+	// CookieRefreshTime is the lifetime of a cookie, after which the
+	// responder rotates its cookie secret, and the initiator stops using the
+	// cookie received.
+	CookieRefreshTime = 120 * time.Second
+)
+
+var (
+	// ErrInvalidMAC1 is returned when mac1 of a message doesn't match.
+	ErrInvalidMAC1 = errors.New("invalid mac1")
+
+	// ErrUnexpectedCookieReply is returned when a cookie reply is received
+	// before any message is sent.
+	ErrUnexpectedCookieReply = errors.New("unexpected cookie reply")
+
+	errInvalidCookieReply = errors.New("invalid cookie reply")
+)
+
+// CookieGenerator adds mac1 and mac2 to the messages sent to a peer, and
+// consumes the cookie replies from it. The initiator should keep one for each
+// peer across handshakes, so the cookie received is used by the next
+// initiation. It's safe for concurrent use.
+type CookieGenerator struct {
+	mac1Key   [blake2s.Size]byte
+	cookieKey [blake2s.Size]byte
+
+	// Now returns the current time, which defaults to time.Now.
+	Now func() time.Time
+
+	mu sync.Mutex
+
+	// lastMAC1 is the mac1 of the last message sent, which is used as the
+	// associated data of the cookie reply.
+	lastMAC1    [macSize]byte
+	hasLastMAC1 bool
+
+	// cookie is the last cookie received, which is valid until
+	// cookieSet+CookieRefreshTime.
+	cookie    [macSize]byte
+	cookieSet time.Time
+}
+
+// NewCookieGenerator creates a cookie generator for the peer with the static
+// public key.
+func NewCookieGenerator(remoteStaticPub []byte) *CookieGenerator {
+	return &CookieGenerator{
+		mac1Key:   deriveKey(labelMAC1, remoteStaticPub),
+		cookieKey: deriveKey(labelCookie, remoteStaticPub),
+		Now:       time.Now,
+	}
+}
+
+// AddMACs fills mac1 and mac2 at the end of the message. The mac2 is left
+// zero if no valid cookie is held.
+func (g *CookieGenerator) AddMACs(msg []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	mac1 := msg[len(msg)-2*macSize : len(msg)-macSize]
+	mac2 := msg[len(msg)-macSize:]
+
+	copy(mac1, mac(g.mac1Key[:], msg[:len(msg)-2*macSize]))
+	copy(g.lastMAC1[:], mac1)
+	g.hasLastMAC1 = true
+
+	if g.cookieSet.IsZero() || g.Now().Sub(g.cookieSet) >= CookieRefreshTime {
+		for i := range mac2 {
+			mac2[i] = 0
+		}
+		return
+	}
+	copy(mac2, mac(g.cookie[:], msg[:len(msg)-macSize]))
+}
+
+// ConsumeReply decrypts the cookie from the cookie reply, which is then used
+// to compute mac2 of the next messages. The caller should check the receiver
+// index of the reply matches a pending handshake.
+func (g *CookieGenerator) ConsumeReply(msg []byte) error {
+	if len(msg) != MessageCookieReplySize || msg[0] != MessageCookieReplyType {
+		return errInvalidCookieReply
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.hasLastMAC1 {
+		return ErrUnexpectedCookieReply
+	}
+
+	aead, _ := chacha20poly1305.NewX(g.cookieKey[:])
+	nonce := msg[8 : 8+chacha20poly1305.NonceSizeX]
+	cookie, err := aead.Open(nil, nonce, msg[8+len(nonce):], g.lastMAC1[:])
+	if err != nil {
+		return err
+	}
+
+	copy(g.cookie[:], cookie)
+	g.cookieSet = g.Now()
+	return nil
+}
+
+// CookieChecker validates the mac1 and mac2 of the messages received by the
+// local party, and creates the cookie replies. The cookie secret is rotated
+// every CookieRefreshTime. It's safe for concurrent use.
+type CookieChecker struct {
+	mac1Key   [blake2s.Size]byte
+	cookieKey [blake2s.Size]byte
+
+	// Now returns the current time, which defaults to time.Now.
+	Now func() time.Time
+
+	// Rand is the source of the cookie secrets and the nonces of the cookie
+	// replies, which defaults to crypto/rand.Reader.
+	Rand io.Reader
+
+	mu        sync.Mutex
+	secret    [blake2s.Size]byte
+	secretSet time.Time
+}
+
+// NewCookieChecker creates a cookie checker using the local static public
+// key.
+func NewCookieChecker(localStaticPub []byte) *CookieChecker {
+	return &CookieChecker{
+		mac1Key:   deriveKey(labelMAC1, localStaticPub),
+		cookieKey: deriveKey(labelCookie, localStaticPub),
+		Now:       time.Now,
+		Rand:      rand.Reader,
+	}
+}
+
+// CheckMAC1 checks the mac1 of the message. Messages with an invalid mac1
+// should be dropped without further processing.
+func (c *CookieChecker) CheckMAC1(msg []byte) bool {
+	if len(msg) < 2*macSize {
+		return false
+	}
+	want := mac(c.mac1Key[:], msg[:len(msg)-2*macSize])
+	return hmac.Equal(want, msg[len(msg)-2*macSize:len(msg)-macSize])
+}
+
+// CheckMAC2 checks the mac2 of the message using the cookie of the source
+// address, e.g., the IP address and port of the sender. When under load, the
+// responder should only process the messages with a valid mac2, and reply
+// with a cookie otherwise.
+func (c *CookieChecker) CheckMAC2(msg, src []byte) bool {
+	if len(msg) < 2*macSize {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the cookie secret has expired, so has the cookie.
+	if c.secretSet.IsZero() || c.Now().Sub(c.secretSet) >= CookieRefreshTime {
+		return false
+	}
+
+	cookie := mac(c.secret[:], src)
+	want := mac(cookie, msg[:len(msg)-macSize])
+	return hmac.Equal(want, msg[len(msg)-macSize:])
+}
+
+// CreateReply creates the cookie reply to the message received from the
+// source address. The message must have a valid mac1.
+func (c *CookieChecker) CreateReply(msg, src []byte) ([]byte, error) {
+	if !c.CheckMAC1(msg) {
+		return nil, ErrInvalidMAC1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// rotate the cookie secret
+	if c.secretSet.IsZero() || c.Now().Sub(c.secretSet) >= CookieRefreshTime {
+		if _, err := io.ReadFull(c.Rand, c.secret[:]); err != nil {
+			return nil, err
+		}
+		c.secretSet = c.Now()
+	}
+
+	reply := make([]byte, 8+chacha20poly1305.NonceSizeX, MessageCookieReplySize)
+	reply[0] = MessageCookieReplyType
+
+	// the receiver index is the sender index of the message.
+	copy(reply[4:8], msg[4:8])
+
+	nonce := reply[8:]
+	if _, err := io.ReadFull(c.Rand, nonce); err != nil {
+		return nil, err
+	}
+
+	cookie := mac(c.secret[:], src)
+	mac1 := msg[len(msg)-2*macSize : len(msg)-macSize]
+	aead, _ := chacha20poly1305.NewX(c.cookieKey[:])
+	return aead.Seal(reply, nonce, cookie, mac1), nil
+}
+
+// deriveKey returns HASH(label || pub).
+func deriveKey(label string, pub []byte) [blake2s.Size]byte {
+	return blake2s.Sum256(append([]byte(label), pub...))
+}
+
+// mac returns the keyed BLAKE2s-128 of the data.
+func mac(key, data []byte) []byte {
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+	return h.Sum(nil)
+}
@@ -0,0 +1,106 @@
+package wireguard_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble/wireguard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieReply(t *testing.T) {
+	require := require.New(t)
+	now := clock
+	clockFn := func() time.Time { return now }
+	src := []byte{192, 168, 1, 1, 0xca, 0x6c}
+
+	checker := wireguard.NewCookieChecker(pub(responderStatic))
+	checker.Now = clockFn
+	cookies := wireguard.NewCookieGenerator(pub(responderStatic))
+	cookies.Now = clockFn
+
+	newInitiation := func() (*wireguard.Handshake, []byte) {
+		h, err := wireguard.NewHandshake(&wireguard.Config{
+			Initiator:       true,
+			LocalStaticPriv: initiatorStatic,
+			RemoteStaticPub: pub(responderStatic),
+			Cookies:         cookies,
+		})
+		require.NoError(err, "failed to create initiator")
+		msg, err := h.CreateInitiation()
+		require.NoError(err, "failed to create initiation")
+		return h, msg
+	}
+
+	// no cookie reply is sent to a message with an invalid mac1.
+	_, err := checker.CreateReply(make([]byte, 148), src)
+	require.Equal(wireguard.ErrInvalidMAC1, err, "error not match")
+
+	// the responder is under load, and the initiation has no mac2.
+	initiator, msg := newInitiation()
+	require.True(checker.CheckMAC1(msg), "mac1 should be valid")
+	require.False(checker.CheckMAC2(msg, src), "mac2 should be invalid")
+	require.Equal(make([]byte, 16), msg[len(msg)-16:], "mac2 should be zero")
+
+	reply, err := checker.CreateReply(msg, src)
+	require.NoError(err, "failed to create cookie reply")
+	require.Len(reply, wireguard.MessageCookieReplySize, "size not match")
+
+	// a tampered reply is rejected
+	tampered := append([]byte{}, reply...)
+	tampered[len(tampered)-1] ^= 1
+	require.Error(initiator.ConsumeCookieReply(tampered),
+		"should reject a tampered reply")
+	require.NoError(initiator.ConsumeCookieReply(reply),
+		"failed to consume cookie reply")
+
+	// the next initiation carries a valid mac2 for the source address only.
+	_, msg = newInitiation()
+	require.True(checker.CheckMAC1(msg), "mac1 should be valid")
+	require.True(checker.CheckMAC2(msg, src), "mac2 should be valid")
+	require.False(checker.CheckMAC2(msg, []byte{10, 0, 0, 1, 0xca, 0x6c}),
+		"mac2 should be invalid for another address")
+
+	// the cookie expires
+	now = now.Add(wireguard.CookieRefreshTime)
+	require.False(checker.CheckMAC2(msg, src), "mac2 should be expired")
+	_, msg = newInitiation()
+	require.Equal(make([]byte, 16), msg[len(msg)-16:], "mac2 should be zero")
+}
+
+func TestCookieGeneratorErrors(t *testing.T) {
+	cookies := wireguard.NewCookieGenerator(pub(responderStatic))
+	reply := make([]byte, wireguard.MessageCookieReplySize)
+	reply[0] = wireguard.MessageCookieReplyType
+	require.Equal(t, wireguard.ErrUnexpectedCookieReply,
+		cookies.ConsumeReply(reply), "error not match")
+	require.Error(t, cookies.ConsumeReply(reply[:10]),
+		"should reject a short reply")
+}
+
+func TestCookieReplyVector(t *testing.T) {
+	require := require.New(t)
+	clockFn := func() time.Time { return clock }
+
+	// the checker reads the cookie secret, then the nonce of the reply.
+	checker := wireguard.NewCookieChecker(pub(responderStatic))
+	checker.Now = clockFn
+	checker.Rand = bytes.NewReader(
+		append(append([]byte{}, cookieSecret...), wantCookieReply[8:32]...))
+	reply, err := checker.CreateReply(wantInitiation, cookieSource)
+	require.NoError(err, "failed to create cookie reply")
+	require.Equal(wantCookieReply, reply, "cookie reply not match")
+
+	// the generator decrypts the cookie, and computes the same mac2.
+	cookies := wireguard.NewCookieGenerator(pub(responderStatic))
+	cookies.Now = clockFn
+	msg := append([]byte{}, wantInitiation...)
+	cookies.AddMACs(msg)
+	require.Equal(wantInitiation, msg, "initiation not match")
+	require.NoError(cookies.ConsumeReply(wantCookieReply),
+		"failed to consume cookie reply")
+	cookies.AddMACs(msg)
+	require.Equal(wantInitiationMAC2, msg, "initiation not match")
+	require.True(checker.CheckMAC2(msg, cookieSource), "mac2 should be valid")
+}
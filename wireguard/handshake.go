@@ -0,0 +1,342 @@
+// Package wireguard implements the handshake messages of WireGuard, as
+// specified in https://www.wireguard.com/protocol/.
+//
+// The handshake is Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s with the identifier
+// "WireGuard v1 zx2c4 Jason@zx2c4.com" as the prologue, in which the
+// initiation carries a TAI64N timestamp as its payload. Each message ends with
+// mac1, which proves the sender knows the receiver's static public key, and
+// mac2, which is keyed by the cookie from a cookie reply, so a responder under
+// load can require a round trip before performing any DH.
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/crypto-y/babble"
+	"github.com/crypto-y/babble/dh"
+)
+
+const (
+	// ProtocolName is the noise protocol used by WireGuard.
+	ProtocolName = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+
+	// Identifier is the WireGuard identifier used as the prologue.
+	Identifier = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+
+	// The message types.
+	MessageInitiationType  = 1
+	MessageResponseType    = 2
+	MessageCookieReplyType = 3
+
+	// The message sizes.
+	MessageInitiationSize  = 148
+	MessageResponseSize    = 92
+	MessageCookieReplySize = 64
+
+	// PresharedKeySize is the size of the preshared key.
+	PresharedKeySize = 32
+)
+
+var (
+	// ErrMissingConfig is returned when no config is provided.
+	ErrMissingConfig = errors.New("missing config")
+
+	// ErrIndexMismatch is returned when the receiver index of a message
+	// doesn't match the local index.
+	ErrIndexMismatch = errors.New("receiver index mismatch")
+
+	errInvalidPresharedKey = errors.New("preshared key must be 32 bytes")
+)
+
+// Config is used for creating a WireGuard handshake.
+type Config struct {
+	// Initiator specifies whether it's the handshake initiator.
+	Initiator bool
+
+	// LocalStaticPriv is the 32-byte Curve25519 private key.
+	LocalStaticPriv []byte
+
+	// RemoteStaticPub is the responder's static public key, which must be
+	// known by the initiator. The responder learns the initiator's static key
+	// from the initiation.
+	RemoteStaticPub []byte
+
+	// PresharedKey is the optional 32-byte preshared key. If not provided, a
+	// key of zeros is used, as WireGuard does.
+	PresharedKey []byte
+
+	// LocalIndex is the sender index of the local party. A random one is used
+	// if it's zero.
+	LocalIndex uint32
+
+	// Cookies adds the MACs to the messages sent. If not provided, a new one
+	// is created using the remote static key, which cannot use the cookie
+	// from an earlier cookie reply. The initiator should keep a generator for
+	// each peer across handshakes.
+	Cookies *CookieGenerator
+
+	// VerifyPeerStatic is an optional callback used by the responder to
+	// authorize the initiator. It's called with the initiator's static key,
+	// and then with the timestamp payload, which should be checked against
+	// the last timestamp accepted from the same peer to prevent replays.
+	VerifyPeerStatic func(pub dh.PublicKey, payload []byte) error
+
+	// LocalEphemeralPriv is an optional ephemeral private key. It should only
+	// be used for testing, a new key is generated if not provided.
+	LocalEphemeralPriv []byte
+
+	// Now returns the current time used by the timestamp, which defaults to
+	// time.Now.
+	Now func() time.Time
+}
+
+// Handshake creates and consumes the WireGuard handshake messages.
+type Handshake struct {
+	hs      *babble.HandshakeState
+	checker *CookieChecker
+	cookies *CookieGenerator
+	now     func() time.Time
+
+	localIndex  uint32
+	remoteIndex uint32
+
+	// remoteStatic is the remote static public key, and verifyPeerStatic is
+	// the callback provided by the config.
+	remoteStatic     []byte
+	verifyPeerStatic func(pub dh.PublicKey, payload []byte) error
+
+	// timestamp is the timestamp of the initiation consumed by the
+	// responder.
+	timestamp Timestamp
+}
+
+// NewHandshake creates a WireGuard handshake using the config.
+func NewHandshake(config *Config) (*Handshake, error) {
+	if config == nil {
+		return nil, ErrMissingConfig
+	}
+
+	psk := config.PresharedKey
+	if psk == nil {
+		psk = make([]byte, PresharedKeySize)
+	}
+	if len(psk) != PresharedKeySize {
+		return nil, errInvalidPresharedKey
+	}
+
+	h := &Handshake{
+		cookies:          config.Cookies,
+		now:              config.Now,
+		localIndex:       config.LocalIndex,
+		remoteStatic:     config.RemoteStaticPub,
+		verifyPeerStatic: config.VerifyPeerStatic,
+	}
+
+	hs, err := babble.NewProtocolWithConfig(&babble.ProtocolConfig{
+		Name:               ProtocolName,
+		Initiator:          config.Initiator,
+		Prologue:           Identifier,
+		LocalStaticPriv:    config.LocalStaticPriv,
+		RemoteStaticPub:    config.RemoteStaticPub,
+		LocalEphemeralPriv: config.LocalEphemeralPriv,
+		Psks:               [][]byte{psk},
+		VerifyPeerStatic:   h.recordPeerStatic,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the local static key is validated when creating the handshake state.
+	curve, _ := dh.FromString("25519")
+	static, _ := curve.LoadPrivateKey(config.LocalStaticPriv)
+
+	h.hs = hs
+	h.checker = NewCookieChecker(static.PubKey().Bytes())
+
+	if h.cookies == nil && config.RemoteStaticPub != nil {
+		h.cookies = NewCookieGenerator(config.RemoteStaticPub)
+	}
+	if h.now == nil {
+		h.now = time.Now
+	}
+	if h.localIndex == 0 {
+		var index [4]byte
+		if _, err := rand.Read(index[:]); err != nil {
+			return nil, err
+		}
+		h.localIndex = binary.LittleEndian.Uint32(index[:])
+	}
+
+	return h, nil
+}
+
+// CreateInitiation creates the handshake initiation, which is sent by the
+// initiator.
+//
+//	type (1) || reserved (3) || sender (4) || ephemeral (32) ||
+//	static (32+16) || timestamp (12+16) || mac1 (16) || mac2 (16)
+func (h *Handshake) CreateInitiation() ([]byte, error) {
+	ts := NewTimestamp(h.now())
+	msg, err := h.hs.WriteMessage(ts[:])
+	if err != nil {
+		return nil, err
+	}
+	return h.finishMessage(MessageInitiationType, msg, MessageInitiationSize)
+}
+
+// ConsumeInitiation processes the handshake initiation received by the
+// responder. The mac1 is checked, while mac2 should be checked beforehand
+// using a CookieChecker when the responder is under load.
+func (h *Handshake) ConsumeInitiation(msg []byte) error {
+	if err := h.checkMessage(
+		msg, MessageInitiationType, MessageInitiationSize); err != nil {
+		return err
+	}
+
+	payload, err := h.hs.ReadMessage(msg[8 : len(msg)-2*macSize])
+	if err != nil {
+		return err
+	}
+	if len(payload) != TimestampSize {
+		return errInvalidMessage(MessageInitiationType)
+	}
+
+	h.remoteIndex = binary.LittleEndian.Uint32(msg[4:8])
+	copy(h.timestamp[:], payload)
+	return nil
+}
+
+// CreateResponse creates the handshake response, which is sent by the
+// responder.
+//
+//	type (1) || reserved (3) || sender (4) || receiver (4) ||
+//	ephemeral (32) || empty (0+16) || mac1 (16) || mac2 (16)
+func (h *Handshake) CreateResponse() ([]byte, error) {
+	msg, err := h.hs.WriteMessage(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var receiver [4]byte
+	binary.LittleEndian.PutUint32(receiver[:], h.remoteIndex)
+	msg = append(receiver[:], msg...)
+
+	if h.cookies == nil {
+		h.cookies = NewCookieGenerator(h.RemoteStatic())
+	}
+	return h.finishMessage(MessageResponseType, msg, MessageResponseSize)
+}
+
+// ConsumeResponse processes the handshake response received by the
+// initiator, which finishes the handshake.
+func (h *Handshake) ConsumeResponse(msg []byte) error {
+	if err := h.checkMessage(
+		msg, MessageResponseType, MessageResponseSize); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(msg[8:12]) != h.localIndex {
+		return ErrIndexMismatch
+	}
+
+	if _, err := h.hs.ReadMessage(msg[12 : len(msg)-2*macSize]); err != nil {
+		return err
+	}
+
+	h.remoteIndex = binary.LittleEndian.Uint32(msg[4:8])
+	return nil
+}
+
+// ConsumeCookieReply processes a cookie reply to the last message sent. The
+// cookie is used for mac2 by the next messages created with the same
+// CookieGenerator, e.g., the initiation of a new handshake.
+func (h *Handshake) ConsumeCookieReply(msg []byte) error {
+	if len(msg) != MessageCookieReplySize {
+		return errInvalidCookieReply
+	}
+	if binary.LittleEndian.Uint32(msg[4:8]) != h.localIndex {
+		return ErrIndexMismatch
+	}
+	if h.cookies == nil {
+		return ErrUnexpectedCookieReply
+	}
+	return h.cookies.ConsumeReply(msg)
+}
+
+// Finished returns true when the handshake is finished.
+func (h *Handshake) Finished() bool {
+	return h.hs.Finished()
+}
+
+// LocalIndex returns the sender index of the local party.
+func (h *Handshake) LocalIndex() uint32 {
+	return h.localIndex
+}
+
+// RemoteIndex returns the sender index of the remote party, which is known
+// once its message is consumed.
+func (h *Handshake) RemoteIndex() uint32 {
+	return h.remoteIndex
+}
+
+// RemoteStatic returns the remote static public key. For the responder, it's
+// known once the initiation is consumed.
+func (h *Handshake) RemoteStatic() []byte {
+	return h.remoteStatic
+}
+
+// Timestamp returns the timestamp of the initiation consumed by the
+// responder.
+func (h *Handshake) Timestamp() Timestamp {
+	return h.timestamp
+}
+
+// HandshakeState returns the underlying handshake state.
+func (h *Handshake) HandshakeState() *babble.HandshakeState {
+	return h.hs
+}
+
+// recordPeerStatic records the initiator's static key received by the
+// responder, and calls the VerifyPeerStatic callback if provided.
+func (h *Handshake) recordPeerStatic(pub dh.PublicKey, payload []byte) error {
+	h.remoteStatic = pub.Bytes()
+	if h.verifyPeerStatic == nil {
+		return nil
+	}
+	return h.verifyPeerStatic(pub, payload)
+}
+
+// finishMessage adds the header and MACs to the noise message.
+func (h *Handshake) finishMessage(
+	msgType byte, noiseMsg []byte, size int) ([]byte, error) {
+	msg := make([]byte, 8, size)
+	msg[0] = msgType
+	binary.LittleEndian.PutUint32(msg[4:8], h.localIndex)
+	msg = append(msg, noiseMsg...)
+	msg = append(msg, make([]byte, 2*macSize)...)
+	if len(msg) != size {
+		return nil, errInvalidMessage(msgType)
+	}
+
+	h.cookies.AddMACs(msg)
+	return msg, nil
+}
+
+// checkMessage checks the type, size and mac1 of the message.
+func (h *Handshake) checkMessage(msg []byte, msgType byte, size int) error {
+	// the type is a little-endian uint32 including the reserved bytes.
+	if len(msg) != size || binary.LittleEndian.Uint32(msg) != uint32(msgType) {
+		return errInvalidMessage(msgType)
+	}
+	if !h.checker.CheckMAC1(msg) {
+		return ErrInvalidMAC1
+	}
+	return nil
+}
+
+func errInvalidMessage(msgType byte) error {
+	return fmt.Errorf("invalid message of type %d", msgType)
+}
@@ -0,0 +1,317 @@
+package wireguard_test
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble/dh"
+	"github.com/crypto-y/babble/wireguard"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// The vectors below are recorded from a handshake between two devices of
+// wireguard-go, golang.zx2c4.com/wireguard v0.0.0-20231211153847-12269c276173,
+// configured with the static keys and the preshared key. The ephemeral keys,
+// the indexes and the timestamp are the ones generated by wireguard-go.
+var (
+	initiatorStatic    = mustDecode("e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a")
+	initiatorEphemeral = mustDecode("f08f3c150ac6618033b3d3bd13653bcbac3bd416ed7d1fa3a4edb0c1ae26ea46")
+	responderStatic    = mustDecode("48c9f2d8f4d3e2a1b0c9d8e7f6a5b4c3d2e1f0a9b8c7d6e5f4a3b2c1d0e9f8a7")
+	responderEphemeral = mustDecode("583172af6d5b7f071ab65c10ce449c83c4b09720de032f01f72b730e19231140")
+	presharedKey       = mustDecode("fc9a2e3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f7")
+
+	initiatorIndex = uint32(0xc7ba4e52)
+	responderIndex = uint32(0x63ba58e2)
+
+	// clock is the time of the timestamp 400000006ad2099f1e000000.
+	clock = time.Unix(0x6ad20995, 0x1e000000)
+
+	// wantInitiation and wantResponse are the handshake messages, and
+	// wantTransport is the first transport message sent by the initiator,
+	// which encrypts "hello".
+	wantInitiation = mustDecode("01000000524ebac7bf2c7a334decbb8902451dcd8ecf90e5f771022d84fcd4b93c93c2df216a0a0560171c781c0bceb02011fe21a19e5f1fa3c05c782c6a9be0f1c4c2428d8dc46aa3dcc8e5d9811573f2d5c14b1412cc7044e016548f16b650b5541606bcfb58266ad33c8d301803884b3dc3f8e7a3f97fc9104d168f2f4eeb676d736c00000000000000000000000000000000")
+	wantResponse   = mustDecode("02000000e258ba63524ebac7124bce10485c056b9b6eb6b98993d7028e02f1d4d91489a486b51da8a607d9659598476c3a3dd81ade1b4b9a3b67eff1740523ca836c1da329cc3f7564216d0e00000000000000000000000000000000")
+	wantTransport  = mustDecode("38c48ca80aa90fe566c28fedd0e41d07eb19a6954a")
+
+	// wantCookieReply is the cookie reply sent by the responder to the
+	// initiation from cookieSource using cookieSecret, and
+	// wantInitiationMAC2 is the same initiation with the mac2 computed from
+	// the cookie.
+	cookieSource       = []byte{192, 0, 2, 1, 0x6c, 0xca}
+	cookieSecret       = mustDecode("78ebfc73a5251846f562c1fe88cd25a03f640772d6cfe853f35de740784c496b")
+	wantCookieReply    = mustDecode("03000000524ebac7032f62602571f4c666905f6324aa8f25e71ee28139d69794a2cc611ee5a01d54e5c332b9517ddf3b88edd0b6623eb4683a7e933438a8af05")
+	wantInitiationMAC2 = mustDecode("01000000524ebac7bf2c7a334decbb8902451dcd8ecf90e5f771022d84fcd4b93c93c2df216a0a0560171c781c0bceb02011fe21a19e5f1fa3c05c782c6a9be0f1c4c2428d8dc46aa3dcc8e5d9811573f2d5c14b1412cc7044e016548f16b650b5541606bcfb58266ad33c8d301803884b3dc3f8e7a3f97fc9104d168f2f4eeb676d736c398fb91074c379d0f71ee68ea5c166d3")
+)
+
+func mustDecode(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func pub(priv []byte) []byte {
+	p, _ := curve25519.X25519(priv, curve25519.Basepoint)
+	return p
+}
+
+// The functions below follow the WireGuard protocol description, which are
+// used to compute the expected messages independently from babble, as a
+// secondary check of the vectors.
+
+func wgHash(parts ...[]byte) []byte {
+	h, _ := blake2s.New256(nil)
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func wgHMAC(key []byte, parts ...[]byte) []byte {
+	m := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	for _, p := range parts {
+		m.Write(p)
+	}
+	return m.Sum(nil)
+}
+
+func wgKDF(n int, key, input []byte) [][]byte {
+	t0 := wgHMAC(key, input)
+	out := [][]byte{}
+	prev := []byte{}
+	for i := 1; i <= n; i++ {
+		prev = wgHMAC(t0, prev, []byte{byte(i)})
+		out = append(out, prev)
+	}
+	return out
+}
+
+func wgAEAD(key []byte, counter uint64, plaintext, ad []byte) []byte {
+	aead, _ := chacha20poly1305.New(key)
+	var nonce [12]byte
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return aead.Seal(nil, nonce[:], plaintext, ad)
+}
+
+func wgDH(priv, pub []byte) []byte {
+	shared, _ := curve25519.X25519(priv, pub)
+	return shared
+}
+
+func wgMAC(key, data []byte) []byte {
+	h, _ := blake2s.New128(key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// reference computes the initiation, the response and the first transport
+// message sent by the initiator.
+func reference() (initiation, response, transport []byte) {
+	sr, si := pub(responderStatic), pub(initiatorStatic)
+	ei, er := pub(initiatorEphemeral), pub(responderEphemeral)
+
+	c := wgHash([]byte(wireguard.ProtocolName))
+	h := wgHash(c, []byte(wireguard.Identifier))
+	h = wgHash(h, sr)
+
+	// initiation
+	msg := make([]byte, 8)
+	msg[0] = 1
+	binary.LittleEndian.PutUint32(msg[4:], initiatorIndex)
+	c = wgKDF(1, c, ei)[0]
+	msg = append(msg, ei...)
+	h = wgHash(h, ei)
+	out := wgKDF(2, c, wgDH(initiatorEphemeral, sr))
+	c = out[0]
+	static := wgAEAD(out[1], 0, si, h)
+	msg = append(msg, static...)
+	h = wgHash(h, static)
+	out = wgKDF(2, c, wgDH(initiatorStatic, sr))
+	c = out[0]
+	ts := wireguard.NewTimestamp(clock)
+	encTs := wgAEAD(out[1], 0, ts[:], h)
+	msg = append(msg, encTs...)
+	h = wgHash(h, encTs)
+	msg = append(msg, wgMAC(wgHash([]byte("mac1----"), sr), msg)...)
+	initiation = append(msg, make([]byte, 16)...)
+
+	// response
+	msg = make([]byte, 12)
+	msg[0] = 2
+	binary.LittleEndian.PutUint32(msg[4:], responderIndex)
+	binary.LittleEndian.PutUint32(msg[8:], initiatorIndex)
+	c = wgKDF(1, c, er)[0]
+	msg = append(msg, er...)
+	h = wgHash(h, er)
+	c = wgKDF(1, c, wgDH(responderEphemeral, ei))[0]
+	c = wgKDF(1, c, wgDH(responderEphemeral, si))[0]
+	out = wgKDF(3, c, presharedKey)
+	c = out[0]
+	h = wgHash(h, out[1])
+	empty := wgAEAD(out[2], 0, nil, h)
+	msg = append(msg, empty...)
+	msg = append(msg, wgMAC(wgHash([]byte("mac1----"), si), msg)...)
+	response = append(msg, make([]byte, 16)...)
+
+	// the first transport message from the initiator
+	keys := wgKDF(2, c, nil)
+	transport = wgAEAD(keys[0], 0, []byte("hello"), nil)
+	return initiation, response, transport
+}
+
+func newHandshakes(t *testing.T) (*wireguard.Handshake, *wireguard.Handshake) {
+	now := func() time.Time { return clock }
+	initiator, err := wireguard.NewHandshake(&wireguard.Config{
+		Initiator:          true,
+		LocalStaticPriv:    initiatorStatic,
+		RemoteStaticPub:    pub(responderStatic),
+		PresharedKey:       presharedKey,
+		LocalIndex:         initiatorIndex,
+		LocalEphemeralPriv: initiatorEphemeral,
+		Now:                now,
+	})
+	require.NoError(t, err, "failed to create initiator")
+
+	responder, err := wireguard.NewHandshake(&wireguard.Config{
+		LocalStaticPriv:    responderStatic,
+		PresharedKey:       presharedKey,
+		LocalIndex:         responderIndex,
+		LocalEphemeralPriv: responderEphemeral,
+		Now:                now,
+	})
+	require.NoError(t, err, "failed to create responder")
+	return initiator, responder
+}
+
+func TestHandshake(t *testing.T) {
+	require := require.New(t)
+	initiator, responder := newHandshakes(t)
+
+	// the reference agrees with wireguard-go.
+	refInitiation, refResponse, refTransport := reference()
+	require.Equal(wantInitiation, refInitiation, "reference not match")
+	require.Equal(wantResponse, refResponse, "reference not match")
+	require.Equal(wantTransport, refTransport, "reference not match")
+
+	initiation, err := initiator.CreateInitiation()
+	require.NoError(err, "failed to create initiation")
+	require.Len(initiation, wireguard.MessageInitiationSize, "size not match")
+	require.Equal(wantInitiation, initiation, "initiation not match")
+
+	require.NoError(responder.ConsumeInitiation(initiation),
+		"failed to consume initiation")
+	require.Equal(initiatorIndex, responder.RemoteIndex(), "index not match")
+	require.Equal(pub(initiatorStatic), responder.RemoteStatic(),
+		"remote static not match")
+	require.Equal(wireguard.NewTimestamp(clock), responder.Timestamp(),
+		"timestamp not match")
+
+	response, err := responder.CreateResponse()
+	require.NoError(err, "failed to create response")
+	require.Len(response, wireguard.MessageResponseSize, "size not match")
+	require.Equal(wantResponse, response, "response not match")
+
+	require.NoError(initiator.ConsumeResponse(response),
+		"failed to consume response")
+	require.Equal(responderIndex, initiator.RemoteIndex(), "index not match")
+	require.True(initiator.Finished(), "initiator should be finished")
+	require.True(responder.Finished(), "responder should be finished")
+
+	// the transport keys match
+	session, err := initiator.HandshakeState().Session()
+	require.NoError(err, "failed to create session")
+	ciphertext, err := session.Encrypt(nil, []byte("hello"))
+	require.NoError(err, "failed to encrypt")
+	require.Equal(wantTransport, ciphertext, "transport not match")
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	_, err := wireguard.NewHandshake(nil)
+	require.Equal(t, wireguard.ErrMissingConfig, err, "error not match")
+	_, err = wireguard.NewHandshake(&wireguard.Config{
+		LocalStaticPriv: responderStatic,
+		PresharedKey:    []byte{1},
+	})
+	require.Error(t, err, "should reject an invalid preshared key")
+
+	initiator, responder := newHandshakes(t)
+	initiation, err := initiator.CreateInitiation()
+	require.NoError(t, err, "failed to create initiation")
+
+	// a wrong mac1
+	tampered := append([]byte{}, initiation...)
+	tampered[len(tampered)-17] ^= 1
+	require.Equal(t, wireguard.ErrInvalidMAC1,
+		responder.ConsumeInitiation(tampered), "error not match")
+
+	// a wrong type or size
+	tampered = append([]byte{}, initiation...)
+	tampered[1] = 1
+	require.Error(t, responder.ConsumeInitiation(tampered),
+		"should reject non-zero reserved bytes")
+	require.Error(t, responder.ConsumeInitiation(initiation[:100]),
+		"should reject a short message")
+
+	// a response for another handshake
+	require.NoError(t, responder.ConsumeInitiation(initiation),
+		"failed to consume initiation")
+	response, err := responder.CreateResponse()
+	require.NoError(t, err, "failed to create response")
+	other, err := wireguard.NewHandshake(&wireguard.Config{
+		Initiator:       true,
+		LocalStaticPriv: initiatorStatic,
+		RemoteStaticPub: pub(responderStatic),
+		LocalIndex:      initiatorIndex + 1,
+	})
+	require.NoError(t, err, "failed to create initiator")
+	_, err = other.CreateInitiation()
+	require.NoError(t, err, "failed to create initiation")
+	require.Equal(t, wireguard.ErrIndexMismatch,
+		other.ConsumeResponse(response), "error not match")
+}
+
+func TestHandshakeReplayedTimestamp(t *testing.T) {
+	errReplay := errors.New("replayed initiation")
+
+	// last is the timestamp of the last initiation accepted.
+	var last wireguard.Timestamp
+	verify := func(pub dh.PublicKey, payload []byte) error {
+		if payload == nil {
+			return nil
+		}
+		var ts wireguard.Timestamp
+		copy(ts[:], payload)
+		if !ts.After(last) {
+			return errReplay
+		}
+		last = ts
+		return nil
+	}
+
+	initiator, _ := newHandshakes(t)
+	initiation, err := initiator.CreateInitiation()
+	require.NoError(t, err, "failed to create initiation")
+
+	for i, want := range []error{nil, errReplay} {
+		responder, err := wireguard.NewHandshake(&wireguard.Config{
+			LocalStaticPriv:  responderStatic,
+			PresharedKey:     presharedKey,
+			VerifyPeerStatic: verify,
+		})
+		require.NoError(t, err, "failed to create responder")
+		require.Equal(t, want, responder.ConsumeInitiation(initiation),
+			"error not match in round %d", i)
+	}
+}
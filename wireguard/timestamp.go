@@ -0,0 +1,47 @@
+package wireguard
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// TimestampSize is the size of a TAI64N timestamp.
+	TimestampSize = 12
+
+	// tai64Base is the TAI64 label of the unix epoch, which includes the 10
+	// seconds of TAI-UTC offset in 1970.
+	tai64Base = uint64(0x400000000000000a)
+
+	// whitenerMask rounds down the nanoseconds to about 16ms, so the
+	// timestamp doesn't leak precise timing.
+	whitenerMask = uint32(0x1000000 - 1)
+)
+
+// Timestamp is a TAI64N timestamp, which is the 8-byte big-endian TAI64
+// seconds followed by the 4-byte big-endian nanoseconds. It's the payload of
+// the handshake initiation, and the responder must only accept an initiation
+// whose timestamp is after the last one accepted from the same peer.
+type Timestamp [TimestampSize]byte
+
+// NewTimestamp creates the timestamp of the time, with the nanoseconds
+// rounded down.
+func NewTimestamp(t time.Time) Timestamp {
+	var ts Timestamp
+	binary.BigEndian.PutUint64(ts[:8], tai64Base+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(ts[8:], uint32(t.Nanosecond())&^whitenerMask)
+	return ts
+}
+
+// After reports whether the timestamp is after the other one.
+func (t Timestamp) After(other Timestamp) bool {
+	return bytes.Compare(t[:], other[:]) > 0
+}
+
+// Time returns the time of the timestamp.
+func (t Timestamp) Time() time.Time {
+	secs := binary.BigEndian.Uint64(t[:8]) - tai64Base
+	nanos := binary.BigEndian.Uint32(t[8:])
+	return time.Unix(int64(secs), int64(nanos))
+}
@@ -0,0 +1,29 @@
+package wireguard_test
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/crypto-y/babble/wireguard"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimestamp(t *testing.T) {
+	ts := wireguard.NewTimestamp(time.Unix(1, 0x1234567))
+
+	// TAI64 label of 1 second after the epoch, and the nanoseconds rounded
+	// down to the 16ms boundary.
+	require.Equal(t, "400000000000000b01000000", hex.EncodeToString(ts[:]),
+		"timestamp not match")
+	require.Equal(t, time.Unix(1, 0x1000000), ts.Time(), "time not match")
+
+	later := wireguard.NewTimestamp(time.Unix(1, 0x2000000))
+	require.True(t, later.After(ts), "should be after")
+	require.False(t, ts.After(later), "should not be after")
+	require.False(t, ts.After(ts), "should not be after itself")
+
+	// times within the same 16ms are not distinguishable
+	same := wireguard.NewTimestamp(time.Unix(1, 0x1ffffff))
+	require.Equal(t, ts, same, "timestamp not match")
+}